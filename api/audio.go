@@ -0,0 +1,236 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+)
+
+// audioFieldLimit is the maximum size of a form field of an audio request
+const audioFieldLimit = 1 << 20
+
+// subtitleCueEndPattern matches the end time of an SRT or WebVTT cue
+var subtitleCueEndPattern = regexp.MustCompile(`-->\s*(?:(\d+):)?(\d{2}):(\d{2})[,.](\d{3})`)
+
+// audioCall sends an audio request, such as provider.AudioProvider.CreateTranscription
+type audioCall func(p provider.AudioProvider, ctx context.Context, cancel context.CancelFunc, body io.Reader, contentType string, model models.Model, usage *provider.Usage) ([]byte, error, []byte)
+
+// audioField is a form field of an audio request that precedes the file
+type audioField struct {
+	// header is the part header
+	header textproto.MIMEHeader
+	// name is the field name
+	name string
+	// value is the field value
+	value []byte
+}
+
+// AudioTranscriptionHandler handles audio transcription requests, only entries with supports_audio_trans are tried
+func AudioTranscriptionHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	isTranscriptionModel := func(model models.Model) bool {
+		return model.SupportsAudioTrans
+	}
+	return audioHandler(cfg, providerRegistry, isTranscriptionModel, provider.AudioProvider.CreateTranscription)
+}
+
+// AudioTranslationHandler handles audio translation requests, only entries with supports_audio_trans2 are tried
+func AudioTranslationHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	isTranslationModel := func(model models.Model) bool {
+		return model.SupportsAudioTrans2
+	}
+	return audioHandler(cfg, providerRegistry, isTranslationModel, provider.AudioProvider.CreateTranslation)
+}
+
+// audioHandler handles multipart audio requests. The fields before the file are read to find the model,
+// then the upload is streamed to the chosen entry while it is received, so the model field must precede the file.
+// Because the upload cannot be sent twice, there is no failover once an entry has started to receive it.
+func audioHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory, capable func(model models.Model) bool, call audioCall) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Check the content type
+		contentType := c.GetHeader("Content-Type")
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: content type must be multipart/form-data with a boundary", "code": 400})
+			return
+		}
+		reader := multipart.NewReader(c.Request.Body, params["boundary"])
+
+		// Read the fields up to the file
+		fields, filePart, err := readAudioFields(reader)
+		if err != nil {
+			writeBodyError(c, err)
+			return
+		}
+		modelName := ""
+		for _, field := range fields {
+			if field.name == "model" {
+				modelName = string(field.value)
+			}
+		}
+		if modelName == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: model field is missing or does not precede the file", "code": 400})
+			return
+		}
+		if filePart == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: file is missing", "code": 400})
+			return
+		}
+		customProviderNames, _ := parseProviderNames(c, nil)
+
+		// Try the capable entries of the model in round-robin order until one receives the upload
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, capable, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			audioProvider, ok := providerInstance.(provider.AudioProvider)
+			if !ok {
+				return fmt.Errorf("provider type %s does not process audio", model.ProviderType)
+			}
+
+			if cfg.Server.Debug {
+				log.Printf("Request file %q for model %s (entry %d)\n", filePart.FileName(), model.Name, model.ID)
+			}
+
+			// Create a context with a timeout
+			ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Minute)
+			defer cancel()
+
+			// Stream the upload with the entry's model name
+			body, done := streamAudioUpload(reader, params["boundary"], fields, filePart, model.ProviderModelName)
+			response, errCall, errBody := call(audioProvider, ctx, cancel, body, contentType, model, usage)
+			// Stop the upload if the provider did not read all of it, the request body must not be read after the handler
+			_ = body.Close()
+			<-done
+			if errCall != nil {
+				if errBody != nil {
+					errCall = fmt.Errorf("%w: %s", errCall, errBody)
+				}
+				return fmt.Errorf("%w: %w", errCall, errNoFailover)
+			}
+
+			// The text, srt and vtt response formats are plain text
+			meterAudioUsage(response, usage)
+			if gjson.ParseBytes(response).IsObject() {
+				c.Data(http.StatusOK, "application/json; charset=utf-8", response)
+			} else {
+				c.Data(http.StatusOK, "text/plain; charset=utf-8", response)
+			}
+			return nil
+		})
+		if finalErr != nil {
+			writeRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// readAudioFields reads the form fields of a multipart audio request up to the first file part,
+// which is returned unread. The file part is nil if the body has no file.
+func readAudioFields(reader *multipart.Reader) ([]audioField, *multipart.Part, error) {
+	fields := make([]audioField, 0)
+	for {
+		part, err := reader.NextRawPart()
+		if errors.Is(err, io.EOF) {
+			return fields, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FileName() != "" {
+			return fields, part, nil
+		}
+		value, err := io.ReadAll(io.LimitReader(part, audioFieldLimit+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(value) > audioFieldLimit {
+			return nil, nil, fmt.Errorf("field %s exceeds %d bytes", part.FormName(), audioFieldLimit)
+		}
+		fields = append(fields, audioField{header: part.Header, name: part.FormName(), value: value})
+	}
+}
+
+// streamAudioUpload writes the fields, with the model replaced, the file part and the rest of the multipart body
+// to a pipe as the body is received. The boundary is kept, so the request's content type stays valid.
+// The done channel is closed when the writing has stopped.
+func streamAudioUpload(reader *multipart.Reader, boundary string, fields []audioField, filePart *multipart.Part, providerModelName string) (io.ReadCloser, <-chan struct{}) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer := multipart.NewWriter(pw)
+		err := writer.SetBoundary(boundary)
+		for _, field := range fields {
+			if err != nil {
+				break
+			}
+			value := field.value
+			if field.name == "model" {
+				value = []byte(providerModelName)
+			}
+			var partWriter io.Writer
+			if partWriter, err = writer.CreatePart(field.header); err == nil {
+				_, err = partWriter.Write(value)
+			}
+		}
+		for part := filePart; err == nil; {
+			var partWriter io.Writer
+			if partWriter, err = writer.CreatePart(part.Header); err != nil {
+				break
+			}
+			if _, err = io.Copy(partWriter, part); err != nil {
+				break
+			}
+			if part, err = reader.NextRawPart(); errors.Is(err, io.EOF) {
+				err = writer.Close()
+				break
+			}
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return pr, done
+}
+
+// meterAudioUsage sets the audio duration from the duration of a verbose_json response, the duration usage of a json
+// response or the last cue of an srt or vtt response. Token usage of json responses is set as well.
+func meterAudioUsage(response []byte, usage *provider.Usage) {
+	if usage.AudioSeconds > 0 {
+		return
+	}
+	if gjson.ParseBytes(response).IsObject() {
+		if duration := gjson.GetBytes(response, "duration"); duration.Type == gjson.Number {
+			usage.AudioSeconds = duration.Float()
+		}
+		switch gjson.GetBytes(response, "usage.type").String() {
+		case "duration":
+			if usage.AudioSeconds == 0 {
+				usage.AudioSeconds = gjson.GetBytes(response, "usage.seconds").Float()
+			}
+		case "tokens":
+			usage.PromptTokens = int(gjson.GetBytes(response, "usage.input_tokens").Int())
+			usage.CompletionTokens = int(gjson.GetBytes(response, "usage.output_tokens").Int())
+			usage.TotalTokens = int(gjson.GetBytes(response, "usage.total_tokens").Int())
+		}
+		return
+	}
+	for _, match := range subtitleCueEndPattern.FindAllStringSubmatch(string(response), -1) {
+		hours, _ := strconv.Atoi(match[1])
+		minutes, _ := strconv.Atoi(match[2])
+		seconds, _ := strconv.Atoi(match[3])
+		milliseconds, _ := strconv.Atoi(match[4])
+		end := float64(hours*3600+minutes*60+seconds) + float64(milliseconds)/1000
+		usage.AudioSeconds = max(usage.AudioSeconds, end)
+	}
+}
@@ -0,0 +1,597 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	"github.com/luispater/mini-router/core"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// batchDefaultWorkers is the number of batch requests served at the same time when batch_workers is not set
+	batchDefaultWorkers = 4
+	// batchDefaultQuotaShare is the share of the rate limits of batch requests when batch_quota_share is not set
+	batchDefaultQuotaShare = 0.5
+	// batchMaxRequests is the maximum number of requests of a batch
+	batchMaxRequests = 50000
+	// batchMaxErrors is the number of input file errors after which the validation stops
+	batchMaxErrors = 100
+	// batchMinRetryDelay is the shortest wait before a batch request over a rate limit is made again
+	batchMinRetryDelay = time.Second
+)
+
+var (
+	// batchQuotaShare is the share of the rate limits that batch requests may use
+	batchQuotaShare = batchDefaultQuotaShare
+	// batches processes the batches, nil when the Batch API is disabled
+	batches *batchRunner
+)
+
+// batchRequestContextKey is the request context key that marks the requests made by the batch runner
+type batchRequestContextKey struct{}
+
+// isBatchRequest reports whether the request was made by the batch runner
+func isBatchRequest(c *gin.Context) bool {
+	return c.Request.Context().Value(batchRequestContextKey{}) != nil
+}
+
+// batchRunner processes batches. The requests of the input files are served by a pool of workers through the
+// router, like client requests of the API key that created the batch. The results are stored as they come in,
+// so that a batch resumes after a restart without making its finished requests again.
+type batchRunner struct {
+	// cfg is the configuration, for the API keys
+	cfg *config.Config
+	// store stores the files and the batches
+	store *core.BatchStore
+	// handler is the router that serves the requests
+	handler http.Handler
+	// jobs are the requests waiting for a worker
+	jobs chan batchJob
+
+	// mutex guards running
+	mutex sync.Mutex
+	// running are the batches being processed by id
+	running map[string]*batchRun
+}
+
+// batchRun is a batch being processed
+type batchRun struct {
+	// mutex guards batch and the results of the batch
+	mutex sync.Mutex
+	// batch is the batch, written to the store on every change
+	batch *core.StoredBatch
+	// ctx ends when the batch is cancelled or its completion window ends
+	ctx context.Context
+	// cancel cancels ctx
+	cancel context.CancelFunc
+	// wait waits for the requests handed to the workers
+	wait sync.WaitGroup
+}
+
+// batchJob is a request of a batch
+type batchJob struct {
+	// run is the batch
+	run *batchRun
+	// customID is the custom id of the request
+	customID string
+	// body is the request body
+	body []byte
+}
+
+// StartBatchRunner starts the workers of the Batch API and resumes the batches that had not ended.
+// handler is the router that serves the requests of the batches.
+func StartBatchRunner(cfg *config.Config, store *core.BatchStore, handler http.Handler) error {
+	workers := cfg.Server.BatchWorkers
+	if workers == 0 {
+		workers = batchDefaultWorkers
+	}
+	if cfg.Server.BatchQuotaShare > 0 {
+		batchQuotaShare = cfg.Server.BatchQuotaShare
+	}
+
+	runner := &batchRunner{
+		cfg:     cfg,
+		store:   store,
+		handler: handler,
+		jobs:    make(chan batchJob),
+		running: make(map[string]*batchRun),
+	}
+	stored, err := store.ListBatches()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < workers; i++ {
+		go runner.work()
+	}
+	batches = runner
+
+	// Resume the oldest batches first
+	for i := len(stored) - 1; i >= 0; i-- {
+		if stored[i].Active() {
+			log.Printf("Resuming batch %s (%s)\n", stored[i].ID, stored[i].Status)
+			runner.start(stored[i])
+		}
+	}
+	return nil
+}
+
+// start processes a batch in the background
+func (r *batchRunner) start(batch *core.StoredBatch) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Unix(batch.ExpiresAt, 0))
+	run := &batchRun{batch: batch, ctx: ctx, cancel: cancel}
+	r.mutex.Lock()
+	r.running[batch.ID] = run
+	r.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			cancel()
+			r.mutex.Lock()
+			delete(r.running, batch.ID)
+			r.mutex.Unlock()
+		}()
+		r.process(run)
+	}()
+}
+
+// cancel starts cancelling a batch that is validating or in progress. The requests being served are finished,
+// the others are not made. It returns the batch, or nil if it cannot be cancelled.
+func (r *batchRunner) cancel(batch *core.StoredBatch) *core.StoredBatch {
+	r.mutex.Lock()
+	run, ok := r.running[batch.ID]
+	r.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	switch run.batch.Status {
+	case core.BatchValidating, core.BatchInProgress:
+		run.batch.Status = core.BatchCancelling
+		run.batch.CancellingAt = time.Now().Unix()
+		r.save(run.batch)
+		run.cancel()
+	case core.BatchCancelling:
+	default:
+		return nil
+	}
+	snapshot := *run.batch
+	return &snapshot
+}
+
+// usesFile reports whether the file is the input file of a batch being processed
+func (r *batchRunner) usesFile(id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, run := range r.running {
+		if run.batch.InputFileID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// process validates the input file of a batch, serves its requests and publishes its results
+func (r *batchRunner) process(run *batchRun) {
+	if run.status() == core.BatchValidating {
+		total, batchErrors := r.validate(run.batch)
+		if len(batchErrors) > 0 {
+			r.update(run, func(batch *core.StoredBatch) {
+				batch.Status = core.BatchFailed
+				batch.Errors = batchErrors
+				batch.FailedAt = time.Now().Unix()
+			})
+			return
+		}
+		r.update(run, func(batch *core.StoredBatch) {
+			// The batch may have been cancelled during the validation
+			if batch.Status == core.BatchValidating {
+				batch.Status = core.BatchInProgress
+				batch.InProgressAt = time.Now().Unix()
+			}
+			batch.RequestCounts.Total = total
+		})
+	}
+	if run.status() == core.BatchInProgress {
+		r.dispatch(run)
+	}
+	r.finalize(run)
+}
+
+// validate checks the lines of the input file of a batch, it returns their number and the errors
+func (r *batchRunner) validate(batch *core.StoredBatch) (int, []core.BatchError) {
+	input, err := r.store.OpenFile(batch.InputFileID)
+	if err != nil {
+		log.Printf("Failed to open the input file of batch %s: %v\n", batch.ID, err)
+		return 0, []core.BatchError{{Code: "file_not_found", Message: fmt.Sprintf("The input file %s could not be read.", batch.InputFileID)}}
+	}
+	defer func() {
+		_ = input.Close()
+	}()
+
+	total := 0
+	batchErrors := make([]core.BatchError, 0)
+	customIDs := make(map[string]bool)
+	errRead := readBatchLines(input, func(number int, line []byte) bool {
+		total++
+		if total > batchMaxRequests {
+			batchErrors = append(batchErrors, core.BatchError{Code: "too_many_requests", Message: fmt.Sprintf("A batch may have at most %d requests.", batchMaxRequests), Line: number})
+			return false
+		}
+		customID, _, errLine := parseBatchLine(line, batch.Endpoint)
+		switch {
+		case errLine != nil:
+			batchErrors = append(batchErrors, core.BatchError{Code: "invalid_request", Message: fmt.Sprintf("Invalid request: %v.", errLine), Line: number})
+		case customIDs[customID]:
+			batchErrors = append(batchErrors, core.BatchError{Code: "duplicate_custom_id", Message: fmt.Sprintf("The custom_id %s is used by another request.", customID), Line: number})
+		}
+		customIDs[customID] = true
+		return len(batchErrors) < batchMaxErrors
+	})
+	if errRead != nil {
+		log.Printf("Failed to read the input file of batch %s: %v\n", batch.ID, errRead)
+		return 0, []core.BatchError{{Code: "file_error", Message: fmt.Sprintf("The input file %s could not be read.", batch.InputFileID)}}
+	}
+	if total == 0 {
+		batchErrors = append(batchErrors, core.BatchError{Code: "empty_file", Message: "The input file has no requests."})
+	}
+	return total, batchErrors
+}
+
+// dispatch hands the requests of a batch that have no result yet to the workers and waits for them. When the
+// completion window ends, the requests that were not made get an expired result.
+func (r *batchRunner) dispatch(run *batchRun) {
+	batch := run.batch
+	outputIDs, err := r.store.BatchResultIDs(batch.ID, core.BatchOutput)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	errorIDs, err := r.store.BatchResultIDs(batch.ID, core.BatchErrors)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	r.update(run, func(batch *core.StoredBatch) {
+		batch.RequestCounts.Completed = len(outputIDs)
+		batch.RequestCounts.Failed = len(errorIDs)
+	})
+
+	input, err := r.store.OpenFile(batch.InputFileID)
+	if err != nil {
+		log.Printf("Failed to open the input file of batch %s: %v\n", batch.ID, err)
+		return
+	}
+	defer func() {
+		_ = input.Close()
+	}()
+
+	errRead := readBatchLines(input, func(_ int, line []byte) bool {
+		customID, body, errLine := parseBatchLine(line, batch.Endpoint)
+		if errLine != nil || outputIDs[customID] || errorIDs[customID] {
+			return true
+		}
+		if run.ctx.Err() == nil {
+			run.wait.Add(1)
+			select {
+			case r.jobs <- batchJob{run: run, customID: customID, body: body}:
+				return true
+			case <-run.ctx.Done():
+				run.wait.Done()
+			}
+		}
+		if errors.Is(run.ctx.Err(), context.DeadlineExceeded) {
+			r.writeExpired(run, customID)
+			return true
+		}
+		return false
+	})
+	if errRead != nil {
+		log.Printf("Failed to read the input file of batch %s: %v\n", batch.ID, errRead)
+	}
+	run.wait.Wait()
+}
+
+// finalize publishes the results of a batch as files and ends it
+func (r *batchRunner) finalize(run *batchRun) {
+	status := core.BatchCompleted
+	switch {
+	case run.status() == core.BatchCancelling:
+		status = core.BatchCancelled
+	case errors.Is(run.ctx.Err(), context.DeadlineExceeded):
+		status = core.BatchExpired
+	}
+	if status == core.BatchCompleted {
+		r.update(run, func(batch *core.StoredBatch) {
+			batch.Status = core.BatchFinalizing
+			if batch.FinalizingAt == 0 {
+				batch.FinalizingAt = time.Now().Unix()
+			}
+		})
+	}
+
+	r.update(run, func(batch *core.StoredBatch) {
+		now := time.Now().Unix()
+		for kind, fileID := range map[string]*string{core.BatchOutput: &batch.OutputFileID, core.BatchErrors: &batch.ErrorFileID} {
+			if *fileID != "" {
+				continue
+			}
+			file := &core.StoredFile{
+				ID:        newBatchFileID(),
+				APIKeyID:  batch.APIKeyID,
+				CreatedAt: now,
+				Filename:  fmt.Sprintf("%s_%s.jsonl", batch.ID, kind),
+				Purpose:   "batch_output",
+			}
+			published, err := r.store.PublishBatchResults(batch.ID, kind, file)
+			if err != nil {
+				log.Println(err)
+			}
+			if published {
+				*fileID = file.ID
+			}
+		}
+
+		batch.Status = status
+		switch status {
+		case core.BatchCompleted:
+			batch.CompletedAt = now
+		case core.BatchCancelled:
+			batch.CancelledAt = now
+		case core.BatchExpired:
+			batch.ExpiredAt = now
+		}
+	})
+	log.Printf("Batch %s %s: %d completed, %d failed of %d requests\n", run.batch.ID, status, run.batch.RequestCounts.Completed, run.batch.RequestCounts.Failed, run.batch.RequestCounts.Total)
+}
+
+// work serves the requests of the batches
+func (r *batchRunner) work() {
+	for job := range r.jobs {
+		r.execute(job)
+		job.run.wait.Done()
+	}
+}
+
+// execute serves a request of a batch and stores its result. A request over a rate limit is made again once the
+// limit allows it, until the batch is cancelled or its completion window ends.
+func (r *batchRunner) execute(job batchJob) {
+	for {
+		writer := r.serve(job)
+		if writer.status != http.StatusTooManyRequests {
+			r.writeResponse(job.run, job.customID, writer.status, writer.body.Bytes())
+			return
+		}
+
+		delay := batchMinRetryDelay
+		if seconds, err := strconv.Atoi(writer.header.Get("Retry-After")); err == nil {
+			delay = max(time.Duration(seconds)*time.Second, batchMinRetryDelay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-job.run.ctx.Done():
+			if errors.Is(job.run.ctx.Err(), context.DeadlineExceeded) {
+				r.writeExpired(job.run, job.customID)
+			}
+			return
+		}
+	}
+}
+
+// serve makes a request of a batch through the router with the API key of the batch
+func (r *batchRunner) serve(job batchJob) *batchResponseWriter {
+	// The request is not cancelled with the batch, so that a cancelled batch still gets the results it has paid for
+	ctx := context.WithValue(context.Background(), batchRequestContextKey{}, job.run.batch.ID)
+	writer := newBatchResponseWriter()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.run.batch.Endpoint, bytes.NewReader(job.body))
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write(newBatchErrorBody(err.Error(), http.StatusInternalServerError))
+		return writer
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey, ok := r.apiKey(job.run.batch.APIKeyID); ok {
+		req.Header.Set("Authorization", "Bearer "+apiKey.Key)
+	}
+	r.handler.ServeHTTP(writer, req)
+	return writer
+}
+
+// apiKey returns the configured API key with the id
+func (r *batchRunner) apiKey(id uint) (models.APIKey, bool) {
+	for _, apiKey := range r.cfg.APIKeys {
+		if apiKey.ID == id {
+			return apiKey, true
+		}
+	}
+	return models.APIKey{}, false
+}
+
+// writeResponse stores the response of a request, successful responses in the output, others in the errors
+func (r *batchRunner) writeResponse(run *batchRun, customID string, status int, body []byte) {
+	// A body that is not JSON, such as the text of a gin error, is wrapped in an error
+	response := bytes.TrimSpace(body)
+	if !gjson.ValidBytes(response) {
+		response = newBatchErrorBody(string(response), status)
+	}
+
+	result := []byte(`{"id":"","custom_id":"","response":{"status_code":0,"request_id":"","body":null},"error":null}`)
+	result, _ = sjson.SetBytes(result, "id", newResponsesID("batch_req"))
+	result, _ = sjson.SetBytes(result, "custom_id", customID)
+	result, _ = sjson.SetBytes(result, "response.status_code", status)
+	result, _ = sjson.SetBytes(result, "response.request_id", newResponsesID("req"))
+	result, _ = sjson.SetRawBytes(result, "response.body", response)
+
+	kind := core.BatchOutput
+	if status < 200 || status >= 300 {
+		kind = core.BatchErrors
+	}
+	r.appendResult(run, kind, result)
+}
+
+// writeExpired stores the result of a request that was not made before the completion window ended
+func (r *batchRunner) writeExpired(run *batchRun, customID string) {
+	result := []byte(`{"id":"","custom_id":"","response":null,"error":{"code":"batch_expired","message":"This request could not be executed before the completion window expired."}}`)
+	result, _ = sjson.SetBytes(result, "id", newResponsesID("batch_req"))
+	result, _ = sjson.SetBytes(result, "custom_id", customID)
+	r.appendResult(run, core.BatchErrors, result)
+}
+
+// appendResult stores a result and counts it
+func (r *batchRunner) appendResult(run *batchRun, kind string, result []byte) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	if err := r.store.AppendBatchResult(run.batch.ID, kind, result); err != nil {
+		log.Println(err)
+		return
+	}
+	if kind == core.BatchOutput {
+		run.batch.RequestCounts.Completed++
+	} else {
+		run.batch.RequestCounts.Failed++
+	}
+	r.save(run.batch)
+}
+
+// update changes a batch and stores it
+func (r *batchRunner) update(run *batchRun, change func(batch *core.StoredBatch)) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	change(run.batch)
+	r.save(run.batch)
+}
+
+// save stores a batch, the mutex of its run must be held
+func (r *batchRunner) save(batch *core.StoredBatch) {
+	if err := r.store.PutBatch(batch); err != nil {
+		log.Println(err)
+	}
+}
+
+// status returns the status of a batch being processed
+func (run *batchRun) status() string {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	return run.batch.Status
+}
+
+// readBatchLines calls read with the number, starting at 1, and the content of each line of an input file that is
+// not blank, until read returns false
+func readBatchLines(input io.Reader, read func(number int, line []byte) bool) error {
+	reader := bufio.NewReader(input)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 && !read(number, line) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// parseBatchLine checks a line of an input file, it returns the custom id and the body of the request
+func parseBatchLine(line []byte, endpoint string) (string, []byte, error) {
+	if !gjson.ValidBytes(line) || !gjson.ParseBytes(line).IsObject() {
+		return "", nil, errors.New("the line is not a JSON object")
+	}
+	customID := gjson.GetBytes(line, "custom_id")
+	if customID.Type != gjson.String || customID.String() == "" {
+		return "", nil, errors.New("custom_id must be a non-empty string")
+	}
+	if method := gjson.GetBytes(line, "method").String(); method != http.MethodPost {
+		return "", nil, fmt.Errorf("method must be POST, not %q", method)
+	}
+	if url := gjson.GetBytes(line, "url").String(); url != endpoint {
+		return "", nil, fmt.Errorf("url %q does not match the batch endpoint %s", url, endpoint)
+	}
+	body := gjson.GetBytes(line, "body")
+	if !body.IsObject() {
+		return "", nil, errors.New("body must be a JSON object")
+	}
+	if body.Get("stream").Bool() {
+		return "", nil, errors.New("streaming is not supported in batches")
+	}
+	return customID.String(), []byte(body.Raw), nil
+}
+
+// newBatchErrorBody returns an error body with the message and the status code, if it is not 0
+func newBatchErrorBody(message string, code int) []byte {
+	body, _ := sjson.SetBytes([]byte(`{"error":{"message":""}}`), "error.message", message)
+	if code != 0 {
+		body, _ = sjson.SetBytes(body, "error.code", code)
+	}
+	return body
+}
+
+// newBatchFileID returns a random file id
+func newBatchFileID() string {
+	random := make([]byte, 12)
+	_, _ = rand.Read(random)
+	return "file-" + hex.EncodeToString(random)
+}
+
+// batchResponseWriter collects the response of a request of a batch served by the router
+type batchResponseWriter struct {
+	// header is the response header
+	header http.Header
+	// status is the status code, 0 until the header is written
+	status int
+	// body is the response body
+	body bytes.Buffer
+	// closeNotify never fires, the batch runner does not go away
+	closeNotify chan bool
+}
+
+// newBatchResponseWriter returns an empty batchResponseWriter
+func newBatchResponseWriter() *batchResponseWriter {
+	return &batchResponseWriter{header: make(http.Header), closeNotify: make(chan bool)}
+}
+
+// Header returns the response header
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write collects a part of the response body
+func (w *batchResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// WriteHeader sets the status code once
+func (w *batchResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Flush does nothing, the body is collected
+func (w *batchResponseWriter) Flush() {}
+
+// CloseNotify returns a channel that never fires, the streaming helpers of gin require it
+func (w *batchResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify
+}
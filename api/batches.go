@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/core"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// batchesSchemaLoader is used to load the JSON schema of batch creation requests
+var batchesSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.BatchesSchema)
+
+// batchCompletionWindow is the completion window of batches
+const batchCompletionWindow = 24 * time.Hour
+
+// batchTimeFields are the time fields of the batch object, null until the batch reaches them
+var batchTimeFields = []string{"in_progress_at", "finalizing_at", "completed_at", "failed_at", "expired_at", "cancelling_at", "cancelled_at"}
+
+// BatchCreateHandler creates a batch of the requests of an input file of the API key and starts processing it
+func BatchCreateHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			writeBodyError(c, err)
+			return
+		}
+
+		// Validate the request
+		if !validateJSONBody(c, batchesSchemaLoader, rawJson) {
+			return
+		}
+
+		apiKey, _ := requestAPIKey(c)
+		inputFileID := gjson.GetBytes(rawJson, "input_file_id").String()
+		file, err := loadStoredFile(apiKey, inputFileID)
+		if err != nil {
+			writeBatchStoreError(c, inputFileID, err)
+			return
+		}
+		if file.Purpose != batchFilePurpose {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: file %s does not have purpose %s", inputFileID, batchFilePurpose), "code": 400})
+			return
+		}
+
+		now := time.Now()
+		batch := &core.StoredBatch{
+			ID:               newResponsesID("batch"),
+			APIKeyID:         apiKey.ID,
+			Endpoint:         gjson.GetBytes(rawJson, "endpoint").String(),
+			InputFileID:      inputFileID,
+			CompletionWindow: gjson.GetBytes(rawJson, "completion_window").String(),
+			Status:           core.BatchValidating,
+			CreatedAt:        now.Unix(),
+			ExpiresAt:        now.Add(batchCompletionWindow).Unix(),
+		}
+		if metadata := gjson.GetBytes(rawJson, "metadata"); metadata.IsObject() {
+			batch.Metadata = make(map[string]string)
+			metadata.ForEach(func(key, value gjson.Result) bool {
+				batch.Metadata[key.String()] = value.String()
+				return true
+			})
+		}
+		if err = batches.store.PutBatch(batch); err != nil {
+			writeBatchStoreError(c, batch.ID, err)
+			return
+		}
+		snapshot := *batch
+		batches.start(batch)
+		c.JSON(http.StatusOK, batchObject(&snapshot))
+	}
+}
+
+// BatchListHandler lists the batches of the API key, the newest first, paged with limit and after
+func BatchListHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+		limit, err := listLimit(c, 100)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: %v", err), "code": 400})
+			return
+		}
+		stored, err := batches.store.ListBatches()
+		if err != nil {
+			writeBatchStoreError(c, "", err)
+			return
+		}
+
+		apiKey, _ := requestAPIKey(c)
+		after := c.Query("after")
+		data := make([]json.RawMessage, 0)
+		firstID, lastID := "", ""
+		hasMore := false
+		for _, batch := range stored {
+			if batch.APIKeyID != apiKey.ID {
+				continue
+			}
+			if after != "" {
+				if batch.ID == after {
+					after = ""
+				}
+				continue
+			}
+			if len(data) == limit {
+				hasMore = true
+				break
+			}
+			if firstID == "" {
+				firstID = batch.ID
+			}
+			lastID = batch.ID
+			data = append(data, batchObject(batch))
+		}
+
+		response := gin.H{"object": "list", "data": data, "first_id": nil, "last_id": nil, "has_more": hasMore}
+		if firstID != "" {
+			response["first_id"] = firstID
+			response["last_id"] = lastID
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// BatchGetHandler returns a batch of the API key
+func BatchGetHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+		apiKey, _ := requestAPIKey(c)
+		batch, err := loadStoredBatch(apiKey, c.Param("id"))
+		if err != nil {
+			writeBatchStoreError(c, c.Param("id"), err)
+			return
+		}
+		c.JSON(http.StatusOK, batchObject(batch))
+	}
+}
+
+// BatchCancelHandler cancels a batch of the API key that is validating or in progress
+func BatchCancelHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+		apiKey, _ := requestAPIKey(c)
+		batch, err := loadStoredBatch(apiKey, c.Param("id"))
+		if err != nil {
+			writeBatchStoreError(c, c.Param("id"), err)
+			return
+		}
+		cancelled := batches.cancel(batch)
+		if cancelled == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": gin.H{"message": fmt.Sprintf("Batch '%s' cannot be cancelled because it is %s.", batch.ID, batch.Status), "code": 409}})
+			return
+		}
+		c.JSON(http.StatusOK, batchObject(cancelled))
+	}
+}
+
+// loadStoredBatch returns a batch, a batch of another API key is not found
+func loadStoredBatch(apiKey models.APIKey, id string) (*core.StoredBatch, error) {
+	batch, err := batches.store.GetBatch(id)
+	if err != nil {
+		return nil, err
+	}
+	if batch.APIKeyID != apiKey.ID {
+		return nil, core.ErrBatchNotFound
+	}
+	return batch, nil
+}
+
+// batchObject returns the OpenAI batch object of a batch. The times the batch has not reached, the result
+// files it does not have and its errors when it has none are null.
+func batchObject(batch *core.StoredBatch) json.RawMessage {
+	object, _ := json.Marshal(batch)
+	object, _ = sjson.DeleteBytes(object, "api_key_id")
+	object, _ = sjson.SetBytes(object, "object", "batch")
+	for _, field := range batchTimeFields {
+		if gjson.GetBytes(object, field).Int() == 0 {
+			object, _ = sjson.SetRawBytes(object, field, []byte("null"))
+		}
+	}
+	for _, field := range []string{"output_file_id", "error_file_id"} {
+		if gjson.GetBytes(object, field).String() == "" {
+			object, _ = sjson.SetRawBytes(object, field, []byte("null"))
+		}
+	}
+	if len(batch.Errors) > 0 {
+		errorList, _ := sjson.SetRawBytes([]byte(`{"object":"list"}`), "data", []byte(gjson.GetBytes(object, "errors").Raw))
+		object, _ = sjson.SetRawBytes(object, "errors", errorList)
+	}
+	return object
+}
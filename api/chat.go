@@ -3,14 +3,13 @@ package api
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	jsonschema "github.com/luispater/mini-router/json-schema"
 	"io"
 	"log"
 	"net/http"
-	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/luispater/mini-router/config"
@@ -24,16 +23,6 @@ import (
 	"github.com/xeipuuv/gojsonschema"
 )
 
-// lastUsedModelIndex tracks the last used model index for each model name to implement round-robin load balancing
-var (
-	// lastUsedModelIndex stores the last used index for each model name
-	lastUsedModelIndex = make(map[string]int)
-	// modelIndexMutexes stores the mutex for each model name
-	modelIndexMutexes = make(map[string]*sync.Mutex)
-	// mutexMapLock is used to protect concurrent access to modelIndexMutexes
-	mutexMapLock = &sync.Mutex{}
-)
-
 // schemaLoader is used to load the JSON schema
 var schemaLoader gojsonschema.JSONLoader
 
@@ -43,12 +32,25 @@ func init() {
 	schemaLoader = gojsonschema.NewBytesLoader(jsonschema.ChatCompletionsSchema)
 }
 
-// validateRequest validates whether the request conforms to the JSON schema
-func validateRequest(request []byte) (*gojsonschema.Result, error) {
-	// Create a new byte-based document loader
-	documentLoader := gojsonschema.NewBytesLoader(request)
-	// Use the schema loader and document loader for validation
-	return gojsonschema.Validate(schemaLoader, documentLoader)
+// validateJSONBody validates a request body against a JSON schema. If it is invalid, the error response of the first
+// violation is written and false is returned.
+func validateJSONBody(c *gin.Context, loader gojsonschema.JSONLoader, rawJson []byte) bool {
+	result, err := gojsonschema.Validate(loader, gojsonschema.NewBytesLoader(rawJson))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "code": 400})
+		return false
+	}
+	if !result.Valid() {
+		for _, desc := range result.Errors() {
+			errorMsg := fmt.Sprintf("Invalid request: %v", desc.Description())
+			if desc.Type() == "invalid_type" || desc.Type() == "string_gte" {
+				errorMsg = fmt.Sprintf("Invalid request: Field `%s` %s", desc.Field(), desc.Description())
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": errorMsg, "code": 400})
+			return false
+		}
+	}
+	return true
 }
 
 // ChatCompletionHandler handles chat completion requests
@@ -60,48 +62,21 @@ func ChatCompletionHandler(cfg *config.Config, providerRegistry map[_const.Provi
 		// Get the raw JSON data
 		rawJson, err := c.GetRawData()
 		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesError.Limit), "code": 413})
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: %v", err), "code": 400})
 			return
 		}
 
-		customProviderNames := make([]string, 0)
-		providerResult := gjson.GetBytes(rawJson, "provider")
-		if providerResult.Type == gjson.String {
-			customProviderNames = append(customProviderNames, providerResult.String())
-			rawJson, _ = sjson.DeleteBytes(rawJson, "provider")
-		} else if providerResult.Type == gjson.JSON {
-			providerResult.ForEach(func(key, value gjson.Result) bool {
-				customProviderNames = append(customProviderNames, strings.ToLower(value.String()))
-				return true
-			})
-			rawJson, _ = sjson.DeleteBytes(rawJson, "provider")
-		} else {
-			providerHeader := c.GetHeader("Provider")
-			if providerHeader != "" {
-				splitProviderHeader := strings.Split(providerHeader, ",")
-				for _, item := range splitProviderHeader {
-					customProviderNames = append(customProviderNames, strings.ToLower(strings.TrimSpace(item)))
-				}
-			}
-		}
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
 
 		// Validate the request
-		result, err := validateRequest(rawJson)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "code": 400})
+		if !validateJSONBody(c, schemaLoader, rawJson) {
 			return
 		}
-		if !result.Valid() {
-			for _, desc := range result.Errors() {
-				errorMsg := fmt.Sprintf("Invalid request: %v", desc.Description())
-				if desc.Type() == "invalid_type" || desc.Type() == "string_gte" {
-					errorMsg = fmt.Sprintf("Invalid request: Field `%s` %s", desc.Field(), desc.Description())
-				}
-				c.JSON(http.StatusBadRequest, gin.H{"error": errorMsg, "code": 400})
-				// log.Println(string(rawJson))
-				return
-			}
-		}
 
 		modelNameResult := gjson.GetBytes(rawJson, "model")
 		if modelNameResult.Type != gjson.String {
@@ -110,197 +85,55 @@ func ChatCompletionHandler(cfg *config.Config, providerRegistry map[_const.Provi
 		}
 		modelName := modelNameResult.String()
 
-		// Filter models from memory
-		var providerModels []models.Model
-		allModels := cfg.Models
-
-		if len(customProviderNames) > 0 {
-			for _, m := range allModels {
-				if m.Name == modelName && m.Enabled {
-					providerModels = append(providerModels, m)
-				}
-			}
-		} else {
-			for _, m := range allModels {
-				if m.Name == modelName && m.Enabled {
-					providerModels = append(providerModels, m)
-				}
-			}
-		}
-
-		if len(providerModels) == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": fmt.Sprintf("Model %s not found or not available.", modelName), "code": 404}})
+		// Moderate the prompt if a moderation policy applies
+		if errModeration := moderatePrompt(c, cfg, providerRegistry, modelName, chatPromptInputs(rawJson)); errModeration != nil {
+			writeRouteError(c, modelName, errModeration)
 			return
 		}
 
-		// Round-robin load balancing
-		loadBalanceKey := modelName
-		if len(customProviderNames) > 0 {
-			sort.Strings(customProviderNames)
-			loadBalanceKey = fmt.Sprintf("%s-%s", modelName, strings.Join(customProviderNames, "-"))
-		}
-
-		mutex, exists := modelIndexMutexes[loadBalanceKey]
-		if !exists {
-			mutexMapLock.Lock()
-			mutex = &sync.Mutex{}
-			modelIndexMutexes[loadBalanceKey] = mutex
-			mutexMapLock.Unlock()
-		}
-
-		mutex.Lock()
-		startIndex := lastUsedModelIndex[loadBalanceKey]
-		lastUsedModelIndex[loadBalanceKey] = (startIndex + 1) % len(providerModels)
-		mutex.Unlock()
-
-		reorderedModels := make([]models.Model, len(providerModels))
-		for i := 0; i < len(providerModels); i++ {
-			reorderedModels[i] = providerModels[(startIndex+i)%len(providerModels)]
-		}
-
-		var finalErr error
-		for _, model := range reorderedModels {
-			factory, ok := providerRegistry[_const.ProviderOpenAICompatibility]
-
-			if !ok {
-				finalErr = fmt.Errorf("provider factory not found")
-				log.Println(finalErr)
-				continue
+		// Try the entries of the model in round-robin order until one succeeds
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, nil, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			// Rewrite the request body for this entry
+			requestBody, errBody := provider.ApplyModelBody(rawJson, model)
+			if errBody != nil {
+				return fmt.Errorf("request body error: %w", errBody)
 			}
 
-			providerInstance, errFactory := factory(cfg)
-			if errFactory != nil {
-				finalErr = fmt.Errorf("failed to create provider: %v", errFactory)
-				log.Println(finalErr)
-				continue
-			}
-
-			if model.IsOpenAICompatibility {
-				if instance, isOk := providerInstance.(*provider.OpenAICompatibility); isOk {
-					instance.SetBaseUrl(model.BaseURL, model.BaseURLDirect)
-				}
+			isStream := gjson.GetBytes(requestBody, "stream").Bool()
+			requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+			if !isStream {
+				requestBody, _ = sjson.DeleteBytes(requestBody, "stream_options")
 			}
 
-			// If the model name contains gemini, check the reasoning_effort field
-			if model.SupportGoogleThinking {
-				reasoningEffortResult := gjson.GetBytes(rawJson, "reasoning_effort")
-				if reasoningEffortResult.Type == gjson.String {
-					if reasoningEffortResult.String() == "none" {
-						rawJson, err = sjson.DeleteBytes(rawJson, "reasoning_effort")
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.thinking_budget", 0)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.include_thoughts", false)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-					} else if reasoningEffortResult.String() == "auto" {
-						rawJson, err = sjson.DeleteBytes(rawJson, "reasoning_effort")
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.thinking_budget", -1)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.include_thoughts", true)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-					} else if reasoningEffortResult.String() == "low" {
-						rawJson, err = sjson.DeleteBytes(rawJson, "reasoning_effort")
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.thinking_budget", 1024)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.include_thoughts", true)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-					} else if reasoningEffortResult.String() == "medium" {
-						rawJson, err = sjson.DeleteBytes(rawJson, "reasoning_effort")
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.thinking_budget", 8192)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.include_thoughts", true)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-					} else if reasoningEffortResult.String() == "high" {
-						rawJson, err = sjson.DeleteBytes(rawJson, "reasoning_effort")
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.thinking_budget", 24576)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-						rawJson, err = sjson.SetBytes(rawJson, "extra_body.google.thinking_config.include_thoughts", true)
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-					} else {
-						rawJson, err = sjson.DeleteBytes(rawJson, "reasoning_effort")
-						if err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": "request body error", "code": 500})
-							return
-						}
-					}
-				}
+			if cfg.Server.Debug {
+				log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
 			}
 
-			isStream := gjson.GetBytes(rawJson, "stream").Bool()
-			rawJson, _ = sjson.SetBytes(rawJson, "model", model.ProviderModelName)
-
 			if isStream {
-				finalErr = handleStreamingChatCompletion(c, providerInstance, rawJson, model)
-			} else {
-				rawJson, _ = sjson.DeleteBytes(rawJson, "stream_options")
-				finalErr = handleNonStreamingChatCompletion(c, providerInstance, rawJson, model)
+				return handleStreamingChatCompletion(c, providerInstance, requestBody, model, usage)
 			}
-
-			_ = providerInstance.Close()
-
-			if finalErr == nil {
-				// log.Printf("Request model %s OK\n", model.Name)
-				return // Success, exit handler
-			}
-			log.Printf("Request model %s error: %s\n", model.ProviderModelName, finalErr.Error())
-		}
-
+			return handleNonStreamingChatCompletion(c, providerInstance, requestBody, model, usage)
+		})
 		if finalErr != nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{"error": gin.H{"message": "All providers failed: " + finalErr.Error(), "code": 503}})
+			writeRouteError(c, modelName, finalErr)
 		}
 	}
 }
 
-func handleStreamingChatCompletion(c *gin.Context, p provider.Provider, request []byte, model models.Model) error {
+// streamCreator starts a streaming provider call, filling usage as the stream is read
+type streamCreator func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) (io.ReadCloser, error, []byte)
+
+// responseCreator makes a non-streaming provider call, filling usage
+type responseCreator func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) ([]byte, error, []byte)
+
+func handleStreamingChatCompletion(c *gin.Context, p provider.Provider, request []byte, model models.Model, usage *provider.Usage) error {
+	return handleStreamingResponse(c, model, usage, func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) (io.ReadCloser, error, []byte) {
+		return p.CreateChatCompletionStream(ctx, cancel, request, model, usage)
+	})
+}
+
+// handleStreamingResponse relays the events of a streaming provider call to the client, the provider fills usage
+func handleStreamingResponse(c *gin.Context, model models.Model, usage *provider.Usage, create streamCreator) error {
 	// Set response headers for streaming
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -310,31 +143,11 @@ func handleStreamingChatCompletion(c *gin.Context, p provider.Provider, request
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Minute)
 	defer cancel()
 
-	// Call the provider's streaming API
-	usage := provider.Usage{
-		PromptTokens:     0,
-		CompletionTokens: 0,
-		TotalTokens:      0,
-		PromptTokensDetails: provider.UsagePromptTokensDetails{
-			CachedTokens: 0,
-			AudioTokens:  0,
-		},
-		CompletionTokensDetails: provider.UsageCompletionTokensDetails{
-			AudioTokens:     0,
-			ReasoningTokens: 0,
-		},
-	}
-
 	// Get the streaming response
-	stream, err, errBody := p.CreateChatCompletionStream(ctx, cancel, request, model, &usage)
-	// If getting the streaming response fails
+	stream, err, errBody := create(ctx, cancel, usage)
+	// If getting the streaming response fails, the error body is only written if no other entry succeeds
 	if err != nil {
-		// If there is an error body
-		if errBody != nil {
-			// Write the error body to the response
-			_, err = c.Writer.Write(errBody)
-		}
-		return err
+		return withErrorBody(err, errBody)
 	}
 	// Defer closing the stream
 	defer func() {
@@ -351,18 +164,18 @@ func handleStreamingChatCompletion(c *gin.Context, p provider.Provider, request
 		for {
 			// Read data from the stream
 			buffer := make([]byte, 4096)
-			var n int
-			n, err = stream.Read(buffer)
+			// The read error is local, the handler goroutine writes err
+			n, errRead := stream.Read(buffer)
 			// If EOF is reached
-			if err == io.EOF {
+			if errRead == io.EOF {
 				// Send an EOF signal
 				resultEOFChan <- true
 				return
 			}
 			// If an error occurs while reading
-			if err != nil {
+			if errRead != nil {
 				// Send an error signal
-				errChan <- err
+				errChan <- errRead
 				return
 			}
 
@@ -391,7 +204,7 @@ func handleStreamingChatCompletion(c *gin.Context, p provider.Provider, request
 					requestError = fmt.Errorf("unexpected response: %s", string(tmp))
 					return false // stop c.Stream
 				} else {
-					if model.SupportGoogleThinking {
+					if model.SupportGoogleThinking && model.ProviderType == _const.ProviderOpenAICompatibility {
 						response = bytes.TrimSpace(response[5:])
 						thoughtResult := gjson.GetBytes(response, "choices.0.delta.extra_content.google.thought")
 						if thoughtResult.Type == gjson.True {
@@ -445,102 +258,77 @@ func handleStreamingChatCompletion(c *gin.Context, p provider.Provider, request
 	return requestError
 }
 
-func handleNonStreamingChatCompletion(c *gin.Context, p provider.Provider, request []byte, model models.Model) error {
+func handleNonStreamingChatCompletion(c *gin.Context, p provider.Provider, request []byte, model models.Model, usage *provider.Usage) error {
+	return handleNonStreamingResponse(c, model, usage, func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) ([]byte, error, []byte) {
+		return p.CreateChatCompletion(ctx, cancel, request, model, usage)
+	})
+}
+
+// handleNonStreamingResponse writes the response of a non-streaming provider call to the client, the provider fills usage.
+// Newlines keep the connection alive while the call takes long. The error body of a failed call is not written, it is
+// returned with the error so that only the body of the last entry is written if no entry succeeds.
+func handleNonStreamingResponse(c *gin.Context, model models.Model, usage *provider.Usage, create responseCreator) error {
 	// Create a context with a timeout
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Minute)
 	defer cancel()
 
-	// Call the provider's API
-	usage := provider.Usage{
-		PromptTokens:     0,
-		CompletionTokens: 0,
-		TotalTokens:      0,
-		PromptTokensDetails: provider.UsagePromptTokensDetails{
-			CachedTokens: 0,
-			AudioTokens:  0,
-		},
-		CompletionTokensDetails: provider.UsageCompletionTokensDetails{
-			AudioTokens:     0,
-			ReasoningTokens: 0,
-		},
-	}
-
-	// Define the error response struct
-	type ErrorResponse struct {
-		Error error
-		Body  []byte
+	// Define the result struct
+	type Result struct {
+		Response []byte
+		Error    error
+		Body     []byte
 	}
 
-	var err error
-	// Use a channel to receive read results
-	resultChan := make(chan []byte)
-	errChan := make(chan ErrorResponse)
+	// Use a buffered channel to receive the result, so that the goroutine never blocks
+	resultChan := make(chan Result, 1)
 
-	// Read data in a goroutine
+	// Call the provider in a goroutine
 	go func() {
-		var response []byte
-		var errBody []byte
-		// Call the provider's CreateChatCompletion method
-		response, err, errBody = p.CreateChatCompletion(ctx, cancel, request, model, &usage)
-		// If there is an error
-		if err != nil {
-			// Send the error response
-			errChan <- ErrorResponse{Error: err, Body: errBody}
-			return
-		}
-		// Send the response
-		resultChan <- response
+		response, err, errBody := create(ctx, cancel, usage)
+		resultChan <- Result{Response: response, Error: err, Body: errBody}
 	}()
 
-	// Error return value
-	var requestError error
+	for {
+		select {
+		// If the result is received
+		case result := <-resultChan:
+			if result.Error != nil {
+				return withErrorBody(result.Error, result.Body)
+			}
 
-	// Stream the response to the client
-	c.Stream(func(w io.Writer) bool {
-		for {
-			select {
-			// If data is received
-			case response := <-resultChan:
-				// Return the response
-				c.Header("Content-Type", "application/json; charset=utf-8")
-				c.Writer.WriteHeader(http.StatusOK)
-				response = bytes.TrimSpace(response)
-
-				if model.SupportGoogleThinking {
-					thoughtResult := gjson.GetBytes(response, "choices.0.message.extra_content.google.thought")
-					if thoughtResult.Type == gjson.True {
-						contentResult := gjson.GetBytes(response, "choices.0.message.content")
-						if contentResult.Type == gjson.String {
-							content := contentResult.String()
-							thoughtStartIndex := strings.Index(content, "<thought>")
-							thoughtEndIndex := strings.Index(content, "</thought>")
-							if thoughtStartIndex != -1 && thoughtEndIndex != -1 {
-								response, _ = sjson.SetBytes(response, "choices.0.message.reasoning_content", content[thoughtStartIndex+9:thoughtEndIndex])
-								response, _ = sjson.SetBytes(response, "choices.0.message.content", content[:thoughtStartIndex]+content[thoughtEndIndex+10:])
-								response, _ = sjson.DeleteBytes(response, "choices.0.message.extra_content")
-							}
+			// Return the response
+			response := bytes.TrimSpace(result.Response)
+			if model.SupportGoogleThinking && model.ProviderType == _const.ProviderOpenAICompatibility {
+				thoughtResult := gjson.GetBytes(response, "choices.0.message.extra_content.google.thought")
+				if thoughtResult.Type == gjson.True {
+					contentResult := gjson.GetBytes(response, "choices.0.message.content")
+					if contentResult.Type == gjson.String {
+						content := contentResult.String()
+						thoughtStartIndex := strings.Index(content, "<thought>")
+						thoughtEndIndex := strings.Index(content, "</thought>")
+						if thoughtStartIndex != -1 && thoughtEndIndex != -1 {
+							response, _ = sjson.SetBytes(response, "choices.0.message.reasoning_content", content[thoughtStartIndex+9:thoughtEndIndex])
+							response, _ = sjson.SetBytes(response, "choices.0.message.content", content[:thoughtStartIndex]+content[thoughtEndIndex+10:])
+							response, _ = sjson.DeleteBytes(response, "choices.0.message.extra_content")
 						}
 					}
 				}
+			}
 
-				_, err = w.Write(response)
-				return false // stop c.Stream
-			// If an error is received
-			case responseError := <-errChan:
-				// c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create chat completion: %v", err)})
-				// Set the error message
-				requestError = responseError.Error
-				// Write the error body
-				_, err = c.Writer.Write(responseError.Body)
-				return false // stop c.Stream
-			// If a timeout occurs
-			case <-time.After(500 * time.Millisecond):
-				// Write a newline character
-				_, err = w.Write([]byte{10})
-				return true // continue c.Stream
+			c.Header("Content-Type", "application/json; charset=utf-8")
+			c.Writer.WriteHeader(http.StatusOK)
+			_, _ = c.Writer.Write(response)
+			c.Writer.Flush()
+			return nil
+		// If a timeout occurs
+		case <-time.After(500 * time.Millisecond):
+			// Batch requests have no connection to keep alive, their status is only set by the result
+			if isBatchRequest(c) {
+				continue
 			}
+			// Write a newline character, which is valid before the JSON body
+			_, _ = c.Writer.Write([]byte{10})
+			c.Writer.Flush()
 		}
-	})
-
-	return requestError
+	}
 }
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// completionsSchemaLoader is used to load the JSON schema of completion requests
+var completionsSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.CompletionsSchema)
+
+// errPromptNotConvertible is returned when a completion request cannot be sent as a chat completion
+var errPromptNotConvertible = errors.New("the request cannot be converted to a chat completion")
+
+// completionOnlyFields are the completion request fields that chat completions do not accept
+var completionOnlyFields = []string{"prompt", "suffix", "echo", "best_of", "logprobs"}
+
+// CompletionHandler handles legacy text completion requests.
+// Entries with supports_completion whose provider serves completions get the request as it is,
+// the request of other entries is converted to a chat completion and the response converted back.
+func CompletionHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Set the response header, specifying the content type and character set
+		c.Header("Content-Type", "application/json; charset=utf-8")
+
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesError.Limit), "code": 413})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: %v", err), "code": 400})
+			return
+		}
+
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
+
+		// Validate the request
+		if !validateJSONBody(c, completionsSchemaLoader, rawJson) {
+			return
+		}
+		modelName := gjson.GetBytes(rawJson, "model").String()
+
+		// Moderate the prompt if a moderation policy applies
+		if errModeration := moderatePrompt(c, cfg, providerRegistry, modelName, completionPromptInputs(gjson.GetBytes(rawJson, "prompt"))); errModeration != nil {
+			writeRouteError(c, modelName, errModeration)
+			return
+		}
+
+		// A prompt that cannot be converted to a chat completion is only sent to the entries that serve completions,
+		// so that a bad request does not count as a failure of the other entries
+		var capable func(model models.Model) bool
+		if _, errConvert := convertCompletionToChatRequest(rawJson); errConvert != nil {
+			capable = func(model models.Model) bool { return model.SupportsCompletion }
+			if !hasCompletionEntry(cfg, modelName) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": fmt.Sprintf("Invalid request: %v", errConvert), "code": 400}})
+				return
+			}
+		}
+
+		// Try the entries of the model in round-robin order until one succeeds
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, capable, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			completionProvider, isCompletionProvider := providerInstance.(provider.CompletionProvider)
+			native := model.SupportsCompletion && isCompletionProvider
+
+			// Convert the request to a chat completion unless the entry serves completions
+			requestBody := rawJson
+			if !native {
+				var errConvert error
+				if requestBody, errConvert = convertCompletionToChatRequest(rawJson); errConvert != nil {
+					return errConvert
+				}
+			}
+
+			// Rewrite the request body for this entry
+			requestBody, errBody := provider.ApplyModelBody(requestBody, model)
+			if errBody != nil {
+				return fmt.Errorf("request body error: %w", errBody)
+			}
+
+			isStream := gjson.GetBytes(requestBody, "stream").Bool()
+			requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+			if !isStream {
+				requestBody, _ = sjson.DeleteBytes(requestBody, "stream_options")
+			}
+
+			if cfg.Server.Debug {
+				log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
+			}
+
+			// The prompt is prepended to the converted completion when echo is set
+			echo := ""
+			if gjson.GetBytes(rawJson, "echo").Bool() {
+				echo = completionPromptText(gjson.GetBytes(rawJson, "prompt"))
+			}
+
+			if isStream {
+				return handleStreamingResponse(c, model, usage, func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) (io.ReadCloser, error, []byte) {
+					if native {
+						return completionProvider.CreateCompletionStream(ctx, cancel, requestBody, model, usage)
+					}
+					stream, err, errBody := providerInstance.CreateChatCompletionStream(ctx, cancel, requestBody, model, usage)
+					if err != nil {
+						return nil, err, errBody
+					}
+					return newCompletionStreamReader(stream, echo), nil, nil
+				})
+			}
+			return handleNonStreamingResponse(c, model, usage, func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) ([]byte, error, []byte) {
+				if native {
+					return completionProvider.CreateCompletion(ctx, cancel, requestBody, model, usage)
+				}
+				response, err, errBody := providerInstance.CreateChatCompletion(ctx, cancel, requestBody, model, usage)
+				if err != nil {
+					return nil, err, errBody
+				}
+				return convertChatToCompletionResponse(response, echo), nil, nil
+			})
+		})
+		if errors.Is(finalErr, errPromptNotConvertible) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": fmt.Sprintf("Invalid request: %v", finalErr), "code": 400}})
+			return
+		}
+		if finalErr != nil {
+			writeRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// hasCompletionEntry reports whether the model has an enabled entry with supports_completion
+func hasCompletionEntry(cfg *config.Config, modelName string) bool {
+	for _, model := range cfg.Models {
+		if model.Name == modelName && model.Enabled && model.SupportsCompletion {
+			return true
+		}
+	}
+	return false
+}
+
+// convertCompletionToChatRequest converts a completion request into a chat completion request with the prompt as the user message.
+// Only a single text prompt can be converted, and suffix has no chat equivalent.
+func convertCompletionToChatRequest(request []byte) ([]byte, error) {
+	prompt := gjson.GetBytes(request, "prompt")
+	if prompt.IsArray() {
+		items := prompt.Array()
+		if len(items) != 1 || items[0].Type != gjson.String {
+			return nil, fmt.Errorf("%w: prompt must be a single string", errPromptNotConvertible)
+		}
+		prompt = items[0]
+	}
+	if suffix := gjson.GetBytes(request, "suffix"); suffix.Type == gjson.String && suffix.String() != "" {
+		return nil, fmt.Errorf("%w: suffix is not supported", errPromptNotConvertible)
+	}
+
+	out := request
+	for _, field := range completionOnlyFields {
+		out, _ = sjson.DeleteBytes(out, field)
+	}
+	message, _ := sjson.SetBytes([]byte(`{"role":"user","content":""}`), "content", prompt.String())
+	out, _ = sjson.SetRawBytes(out, "messages", append(append([]byte("["), message...), ']'))
+	return out, nil
+}
+
+// completionPromptText returns the text of a string prompt or of the first prompt of a list
+func completionPromptText(prompt gjson.Result) string {
+	if prompt.IsArray() {
+		items := prompt.Array()
+		if len(items) == 0 {
+			return ""
+		}
+		prompt = items[0]
+	}
+	if prompt.Type != gjson.String {
+		return ""
+	}
+	return prompt.String()
+}
+
+// completionID returns the completion id of a chat completion id
+func completionID(chatID string) string {
+	if strings.HasPrefix(chatID, "chatcmpl-") {
+		return "cmpl-" + strings.TrimPrefix(chatID, "chatcmpl-")
+	}
+	return chatID
+}
+
+// convertChatToCompletionResponse converts a chat completion into a text completion, prefixing each text with echo
+func convertChatToCompletionResponse(response []byte, echo string) []byte {
+	out := []byte(`{"id":"","object":"text_completion","created":0,"model":"","choices":[]}`)
+	out, _ = sjson.SetBytes(out, "id", completionID(gjson.GetBytes(response, "id").String()))
+	out, _ = sjson.SetBytes(out, "created", gjson.GetBytes(response, "created").Int())
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(response, "model").String())
+	if fingerprint := gjson.GetBytes(response, "system_fingerprint"); fingerprint.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "system_fingerprint", fingerprint.String())
+	}
+
+	for i, choice := range gjson.GetBytes(response, "choices").Array() {
+		completionChoice := []byte(`{"text":"","index":0,"logprobs":null,"finish_reason":null}`)
+		completionChoice, _ = sjson.SetBytes(completionChoice, "text", echo+choice.Get("message.content").String())
+		completionChoice, _ = sjson.SetBytes(completionChoice, "index", i)
+		if finishReason := choice.Get("finish_reason"); finishReason.Type == gjson.String {
+			completionChoice, _ = sjson.SetBytes(completionChoice, "finish_reason", finishReason.String())
+		}
+		out, _ = sjson.SetRawBytes(out, "choices.-1", completionChoice)
+	}
+
+	if usage := gjson.GetBytes(response, "usage"); usage.IsObject() {
+		out, _ = sjson.SetRawBytes(out, "usage", []byte(usage.Raw))
+	}
+	return out
+}
+
+// newCompletionStreamReader converts the events of a chat completion stream into text completion events.
+// The prompt in echo is sent before the first text of each choice.
+func newCompletionStreamReader(stream io.ReadCloser, echo string) io.ReadCloser {
+	// Create a pipe.
+	pr, pw := io.Pipe()
+
+	// Start a goroutine to convert the events.
+	go func() {
+		// Defer closing the pipe and the chat stream.
+		defer func() {
+			_ = pw.Close()
+			_ = stream.Close()
+		}()
+
+		echoed := make(map[int64]bool)
+		reader := bufio.NewReader(stream)
+		for {
+			line, err := reader.ReadBytes('\n')
+			line = bytes.TrimSpace(line)
+
+			if len(line) > 0 {
+				output := line
+				if bytes.HasPrefix(line, _const.TagData) {
+					data := bytes.TrimSpace(bytes.TrimPrefix(line, _const.TagData))
+					if !bytes.Equal(data, _const.TagDataDone) {
+						// Chunks without text, such as the role chunk, are dropped.
+						output = nil
+						if data = convertChatToCompletionChunk(data, echo, echoed); data != nil {
+							output = append([]byte("data: "), data...)
+						}
+					}
+				}
+				// Other lines, such as comments, are passed through for the streaming handler to judge.
+				if output != nil {
+					if _, errWrite := pw.Write(append(output, "\n\n"...)); errWrite != nil {
+						return
+					}
+				}
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					_ = pw.CloseWithError(err)
+				}
+				return
+			}
+		}
+	}()
+
+	return pr
+}
+
+// convertChatToCompletionChunk converts a chat completion chunk into a text completion chunk.
+// It returns nil for chunks without text or finish reason, such as the role chunk.
+func convertChatToCompletionChunk(data []byte, echo string, echoed map[int64]bool) []byte {
+	out := []byte(`{"id":"","object":"text_completion","created":0,"model":"","choices":[]}`)
+	out, _ = sjson.SetBytes(out, "id", completionID(gjson.GetBytes(data, "id").String()))
+	out, _ = sjson.SetBytes(out, "created", gjson.GetBytes(data, "created").Int())
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(data, "model").String())
+
+	// The usage chunk has no choices.
+	usage := gjson.GetBytes(data, "usage")
+	if usage.IsObject() {
+		out, _ = sjson.SetRawBytes(out, "usage", []byte(usage.Raw))
+	}
+
+	hasChoices := false
+	for _, choice := range gjson.GetBytes(data, "choices").Array() {
+		index := choice.Get("index").Int()
+		text := choice.Get("delta.content").String()
+		finishReason := choice.Get("finish_reason")
+		if text == "" && finishReason.Type != gjson.String {
+			continue
+		}
+		if echo != "" && !echoed[index] {
+			text = echo + text
+			echoed[index] = true
+		}
+
+		completionChoice := []byte(`{"text":"","index":0,"logprobs":null,"finish_reason":null}`)
+		completionChoice, _ = sjson.SetBytes(completionChoice, "text", text)
+		completionChoice, _ = sjson.SetBytes(completionChoice, "index", index)
+		if finishReason.Type == gjson.String {
+			completionChoice, _ = sjson.SetBytes(completionChoice, "finish_reason", finishReason.String())
+		}
+		out, _ = sjson.SetRawBytes(out, "choices.-1", completionChoice)
+		hasChoices = true
+	}
+
+	if !hasChoices && !usage.IsObject() {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+
+	"github.com/gin-gonic/gin"
+)
+
+// convertingWriter is the base of the writers that convert the chat completion written by the chat handlers into
+// the format of another API. A non-streaming completion is buffered for the converting writer to convert once it
+// is complete, the lines of a stream are passed to writeLine as they are complete. Keep-alive writes are passed
+// through, the client response is only flushed once something was written to it, so that a failed entry does not
+// send the headers.
+type convertingWriter struct {
+	gin.ResponseWriter
+	// stream indicates whether the completion is a stream
+	stream bool
+	// buffer holds the non-streaming completion, or the incomplete line of a stream
+	buffer []byte
+	// written indicates whether anything was written to the client
+	written bool
+	// writeLine converts a complete line of a stream
+	writeLine func(line []byte) error
+}
+
+// Write converts or buffers the chat handler output
+func (w *convertingWriter) Write(data []byte) (int, error) {
+	if !w.stream {
+		// Leading whitespace is the keep-alive of the non-streaming handler, it is valid before the JSON body.
+		if len(w.buffer) == 0 && len(bytes.TrimSpace(data)) == 0 {
+			if err := w.writeClient(data); err != nil {
+				return 0, err
+			}
+			return len(data), nil
+		}
+		w.buffer = append(w.buffer, data...)
+		return len(data), nil
+	}
+
+	w.buffer = append(w.buffer, data...)
+	for {
+		end := bytes.IndexByte(w.buffer, '\n')
+		if end < 0 {
+			return len(data), nil
+		}
+		line := bytes.TrimSpace(w.buffer[:end])
+		w.buffer = w.buffer[end+1:]
+		if err := w.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// WriteString converts or buffers the chat handler output
+func (w *convertingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush flushes the client response once something was written to it
+func (w *convertingWriter) Flush() {
+	if w.written {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// flushLine converts the last line of a stream that did not end with a newline
+func (w *convertingWriter) flushLine() error {
+	line := bytes.TrimSpace(w.buffer)
+	w.buffer = nil
+	if len(line) == 0 {
+		return nil
+	}
+	return w.writeLine(line)
+}
+
+// writeEvent writes an SSE event with its event type
+func (w *convertingWriter) writeEvent(event string, data []byte) error {
+	output := make([]byte, 0, len(event)+len(data)+16)
+	output = append(output, "event: "...)
+	output = append(output, event...)
+	output = append(output, "\ndata: "...)
+	output = append(output, data...)
+	output = append(output, "\n\n"...)
+	return w.writeClient(output)
+}
+
+// writeClient writes to the client response
+func (w *convertingWriter) writeClient(data []byte) error {
+	w.written = true
+	_, err := w.ResponseWriter.Write(data)
+	return err
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// embeddingsSchemaLoader is used to load the JSON schema of embedding requests
+var embeddingsSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.EmbeddingsSchema)
+
+// EmbeddingHandler handles embedding requests.
+// Only entries with supports_embedding are tried. The inputs are split into batches of the entry's
+// embedding_batch_size, sent one after another, and the results are merged into one response.
+func EmbeddingHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Set the response header, specifying the content type and character set
+		c.Header("Content-Type", "application/json; charset=utf-8")
+
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			writeBodyError(c, err)
+			return
+		}
+
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
+
+		// Validate the request
+		if !validateJSONBody(c, embeddingsSchemaLoader, rawJson) {
+			return
+		}
+		modelName := gjson.GetBytes(rawJson, "model").String()
+		inputs := embeddingInputs(gjson.GetBytes(rawJson, "input"))
+		encodeBase64 := gjson.GetBytes(rawJson, "encoding_format").String() == "base64"
+
+		// Try the entries of the model that create embeddings in round-robin order until one succeeds
+		isEmbeddingModel := func(model models.Model) bool {
+			return model.SupportsEmbedding
+		}
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, isEmbeddingModel, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			embeddingProvider, ok := providerInstance.(provider.EmbeddingProvider)
+			if !ok {
+				return fmt.Errorf("provider type %s does not create embeddings", model.ProviderType)
+			}
+
+			return handleNonStreamingResponse(c, model, usage, func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) ([]byte, error, []byte) {
+				return createEmbeddings(ctx, cancel, cfg, embeddingProvider, rawJson, inputs, model, usage, encodeBase64)
+			})
+		})
+		if finalErr != nil {
+			writeRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// embeddingInputs returns the inputs of an embedding request. A string or a token array is a single input.
+func embeddingInputs(input gjson.Result) []gjson.Result {
+	if !input.IsArray() {
+		return []gjson.Result{input}
+	}
+	items := input.Array()
+	if len(items) > 0 && items[0].Type == gjson.Number {
+		return []gjson.Result{input}
+	}
+	return items
+}
+
+// createEmbeddings sends the inputs to the entry in batches of its embedding_batch_size and merges the results.
+// The vectors are requested as floats and encoded as base64 by the router when the client asked for it.
+func createEmbeddings(ctx context.Context, cancel context.CancelFunc, cfg *config.Config, p provider.EmbeddingProvider, request []byte, inputs []gjson.Result, model models.Model, usage *provider.Usage, encodeBase64 bool) ([]byte, error, []byte) {
+	batchSize := model.EmbeddingBatchSize
+	if batchSize <= 0 {
+		batchSize = len(inputs)
+	}
+
+	input := gjson.GetBytes(request, "input")
+	singleInput := !input.IsArray() || input.Get("0").Type == gjson.Number
+
+	out := []byte(`{"object":"list","data":[],"model":"","usage":{"prompt_tokens":0,"total_tokens":0}}`)
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+	for offset := 0; offset < len(inputs); offset += batchSize {
+		end := min(offset+batchSize, len(inputs))
+
+		// Build the request of the batch, a single input is sent as it is
+		batch := make([]string, 0, end-offset)
+		for _, item := range inputs[offset:end] {
+			batch = append(batch, item.Raw)
+		}
+		batchInput := "[" + strings.Join(batch, ",") + "]"
+		if singleInput {
+			batchInput = input.Raw
+		}
+		requestBody, _ := sjson.SetRawBytes(request, "input", []byte(batchInput))
+		requestBody, _ = sjson.DeleteBytes(requestBody, "encoding_format")
+
+		// Rewrite the request body for this entry
+		requestBody, errBody := provider.ApplyModelBody(requestBody, model)
+		if errBody != nil {
+			return nil, fmt.Errorf("request body error: %w", errBody), nil
+		}
+		requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+
+		if cfg.Server.Debug {
+			log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
+		}
+
+		// Create the embeddings of the batch
+		batchUsage := provider.Usage{}
+		response, err, errResponse := p.CreateEmbedding(ctx, cancel, requestBody, model, &batchUsage)
+		usage.PromptTokens += batchUsage.PromptTokens
+		usage.TotalTokens += batchUsage.TotalTokens
+		if err != nil {
+			return nil, err, errResponse
+		}
+
+		// Merge the results with their index in the whole request
+		for _, item := range gjson.GetBytes(response, "data").Array() {
+			entry, _ := sjson.SetBytes([]byte(item.Raw), "index", offset+int(item.Get("index").Int()))
+			if encodeBase64 {
+				entry, _ = sjson.SetBytes(entry, "embedding", encodeEmbedding(item.Get("embedding")))
+			}
+			out, _ = sjson.SetRawBytes(out, "data.-1", entry)
+		}
+	}
+
+	out, _ = sjson.SetBytes(out, "usage.prompt_tokens", usage.PromptTokens)
+	out, _ = sjson.SetBytes(out, "usage.total_tokens", usage.TotalTokens)
+	return out, nil, nil
+}
+
+// encodeEmbedding encodes an embedding as base64 of its little-endian float32 values, like the OpenAI API
+func encodeEmbedding(embedding gjson.Result) string {
+	values := embedding.Array()
+	buffer := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.LittleEndian.PutUint32(buffer[4*i:], math.Float32bits(float32(value.Float())))
+	}
+	return base64.StdEncoding.EncodeToString(buffer)
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/core"
+	"github.com/luispater/mini-router/models"
+)
+
+// batchFilePurpose is the purpose of the input files of batches, the only purpose of uploads
+const batchFilePurpose = "batch"
+
+// FileUploadHandler stores a file uploaded for the Batch API. The multipart upload is streamed to the store,
+// the purpose field may come before or after the file.
+func FileUploadHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+
+		// Check the content type
+		mediaType, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: content type must be multipart/form-data with a boundary", "code": 400})
+			return
+		}
+		reader := multipart.NewReader(c.Request.Body, params["boundary"])
+
+		apiKey, _ := requestAPIKey(c)
+		var file *core.StoredFile
+		purpose := ""
+		for {
+			part, errPart := reader.NextPart()
+			if errPart == io.EOF {
+				break
+			}
+			if errPart != nil {
+				err = errPart
+				break
+			}
+			switch part.FormName() {
+			case "purpose":
+				value, errRead := io.ReadAll(io.LimitReader(part, 64))
+				if errRead != nil {
+					err = errRead
+				}
+				purpose = string(value)
+			case "file":
+				if file != nil {
+					err = errors.New("only one file may be uploaded")
+					break
+				}
+				file = &core.StoredFile{
+					ID:        newBatchFileID(),
+					APIKeyID:  apiKey.ID,
+					CreatedAt: time.Now().Unix(),
+					Filename:  part.FileName(),
+				}
+				if err = batches.store.CreateFile(file, part); err != nil {
+					file = nil
+				}
+			}
+			_ = part.Close()
+			if err != nil {
+				break
+			}
+		}
+
+		if err == nil && file == nil {
+			err = errors.New("file is missing")
+		}
+		if err == nil && purpose != batchFilePurpose {
+			err = fmt.Errorf("purpose must be %s", batchFilePurpose)
+		}
+		if err != nil {
+			if file != nil {
+				if errDelete := batches.store.DeleteFile(file.ID); errDelete != nil {
+					log.Println(errDelete)
+				}
+			}
+			writeBodyError(c, err)
+			return
+		}
+
+		file.Purpose = purpose
+		if err = batches.store.PutFile(file); err != nil {
+			writeBatchStoreError(c, file.ID, err)
+			return
+		}
+		c.JSON(http.StatusOK, fileObject(file))
+	}
+}
+
+// FileListHandler lists the files of the API key, the newest first. The list can be filtered by purpose and
+// paged with limit and after.
+func FileListHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+		limit, err := listLimit(c, 10000)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: %v", err), "code": 400})
+			return
+		}
+		files, err := batches.store.ListFiles()
+		if err != nil {
+			writeBatchStoreError(c, "", err)
+			return
+		}
+
+		apiKey, _ := requestAPIKey(c)
+		purpose := c.Query("purpose")
+		after := c.Query("after")
+		data := make([]gin.H, 0)
+		hasMore := false
+		for _, file := range files {
+			if file.APIKeyID != apiKey.ID || (purpose != "" && file.Purpose != purpose) {
+				continue
+			}
+			if after != "" {
+				if file.ID == after {
+					after = ""
+				}
+				continue
+			}
+			if len(data) == limit {
+				hasMore = true
+				break
+			}
+			data = append(data, fileObject(file))
+		}
+		c.JSON(http.StatusOK, gin.H{"object": "list", "data": data, "has_more": hasMore})
+	}
+}
+
+// FileGetHandler returns a file of the API key
+func FileGetHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+		apiKey, _ := requestAPIKey(c)
+		file, err := loadStoredFile(apiKey, c.Param("id"))
+		if err != nil {
+			writeBatchStoreError(c, c.Param("id"), err)
+			return
+		}
+		c.JSON(http.StatusOK, fileObject(file))
+	}
+}
+
+// FileContentHandler returns the content of a file of the API key
+func FileContentHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+		apiKey, _ := requestAPIKey(c)
+		file, err := loadStoredFile(apiKey, c.Param("id"))
+		if err != nil {
+			writeBatchStoreError(c, c.Param("id"), err)
+			return
+		}
+		content, err := batches.store.OpenFile(file.ID)
+		if err != nil {
+			writeBatchStoreError(c, file.ID, err)
+			return
+		}
+		defer func() {
+			_ = content.Close()
+		}()
+		c.DataFromReader(http.StatusOK, file.Bytes, "application/octet-stream", content, map[string]string{
+			"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}),
+		})
+	}
+}
+
+// FileDeleteHandler deletes a file of the API key. The input file of a batch that has not ended cannot be deleted.
+func FileDeleteHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if batches == nil {
+			writeBatchesDisabled(c)
+			return
+		}
+		apiKey, _ := requestAPIKey(c)
+		id := c.Param("id")
+		if _, err := loadStoredFile(apiKey, id); err != nil {
+			writeBatchStoreError(c, id, err)
+			return
+		}
+		if batches.usesFile(id) {
+			c.JSON(http.StatusConflict, gin.H{"error": gin.H{"message": fmt.Sprintf("File '%s' is the input file of a batch in progress.", id), "code": 409}})
+			return
+		}
+		if err := batches.store.DeleteFile(id); err != nil {
+			writeBatchStoreError(c, id, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id, "object": "file", "deleted": true})
+	}
+}
+
+// loadStoredFile returns a file, a file of another API key is not found
+func loadStoredFile(apiKey models.APIKey, id string) (*core.StoredFile, error) {
+	file, err := batches.store.GetFile(id)
+	if err != nil {
+		return nil, err
+	}
+	if file.APIKeyID != apiKey.ID {
+		return nil, core.ErrFileNotFound
+	}
+	return file, nil
+}
+
+// fileObject returns the OpenAI file object of a file
+func fileObject(file *core.StoredFile) gin.H {
+	return gin.H{
+		"id":         file.ID,
+		"object":     "file",
+		"bytes":      file.Bytes,
+		"created_at": file.CreatedAt,
+		"filename":   file.Filename,
+		"purpose":    file.Purpose,
+		"status":     "processed",
+	}
+}
+
+// listLimit returns the limit query parameter of a list request, 20 when it is not set
+func listLimit(c *gin.Context, maxLimit int) (int, error) {
+	value := c.Query("limit")
+	if value == "" {
+		return min(20, maxLimit), nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+	}
+	return limit, nil
+}
+
+// writeBatchesDisabled writes the error response of the Batch API when batch_dir is not set
+func writeBatchesDisabled(c *gin.Context) {
+	c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": "The Batch API is not enabled, set batch_dir to enable it.", "code": 404}})
+}
+
+// writeBatchStoreError writes the error response for an error of the batch store
+func writeBatchStoreError(c *gin.Context, id string, err error) {
+	switch {
+	case errors.Is(err, core.ErrFileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": fmt.Sprintf("No such File object: %s", id), "code": 404}})
+	case errors.Is(err, core.ErrBatchNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": fmt.Sprintf("No such Batch object: %s", id), "code": 404}})
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": "Failed to access the batch store", "code": 500}})
+	}
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	_const "github.com/luispater/mini-router/const"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// geminiToolCall is a function call of a stream, whose arguments are collected until the stream ends
+type geminiToolCall struct {
+	// id is the tool call id
+	id string
+	// name is the function name
+	name string
+	// arguments are the JSON arguments
+	arguments string
+}
+
+// geminiWriter converts the chat completion written by the chat handlers into Gemini generateContent responses.
+// A non-streaming completion is converted by finish, the chunks of a stream are converted into response chunks
+// as their lines are complete, sent as SSE events with alt=sse and as the elements of a JSON array otherwise.
+// Function calls are sent whole in the last chunk, since Gemini does not stream their arguments.
+// Other output, such as the error body of a failed entry, is dropped.
+type geminiWriter struct {
+	convertingWriter
+	// model is the requested model name
+	model string
+	// sse indicates whether the chunks of a stream are sent as SSE events
+	sse bool
+
+	// id is the response id
+	id string
+	// started indicates whether a response chunk was written
+	started bool
+	// stopped indicates whether the last chunk or an error was written
+	stopped bool
+	// toolCalls are the function calls of a stream
+	toolCalls []*geminiToolCall
+	// toolCallIndexes maps the tool call indexes of the chunks to the indexes of toolCalls
+	toolCallIndexes map[int64]int
+	// finishReason is the finish reason of the completion
+	finishReason string
+	// usage is the usage of the completion
+	usage gjson.Result
+	// err is the error of the stream
+	err error
+}
+
+// newGeminiWriter returns a geminiWriter that writes the converted responses to w
+func newGeminiWriter(w gin.ResponseWriter, model string, stream bool, sse bool) *geminiWriter {
+	writer := &geminiWriter{
+		convertingWriter: convertingWriter{ResponseWriter: w, stream: stream},
+		model:            model,
+		sse:              sse,
+		id:               newResponsesID("resp"),
+		toolCallIndexes:  make(map[int64]int),
+	}
+	writer.convertingWriter.writeLine = writer.writeLine
+	return writer
+}
+
+// finish writes the converted non-streaming response, or the end of a stream that ended without [DONE].
+// It returns the error of a stream.
+func (w *geminiWriter) finish() error {
+	if w.stream {
+		if err := w.flushLine(); err != nil {
+			return err
+		}
+		if w.err != nil {
+			return w.err
+		}
+		return w.stop()
+	}
+
+	response := bytes.TrimSpace(w.buffer)
+	if !gjson.GetBytes(response, "choices").IsArray() {
+		return fmt.Errorf("unexpected response: %s", string(response))
+	}
+	w.finishReason = gjson.GetBytes(response, "choices.0.finish_reason").String()
+	w.usage = gjson.GetBytes(response, "usage")
+
+	message := gjson.GetBytes(response, "choices.0.message")
+	parts := w.textParts(message)
+	for _, toolCall := range message.Get("tool_calls").Array() {
+		parts = append(parts, geminiFunctionCallPart(toolCall.Get("id").String(), toolCall.Get("function.name").String(), toolCall.Get("function.arguments").String()))
+	}
+	return w.writeClient(w.response(parts, true))
+}
+
+// writeError ends a started stream with an error
+func (w *geminiWriter) writeError(err error) {
+	if !w.stream || w.stopped {
+		return
+	}
+	w.stopped = true
+	_ = w.writeStreamError(err.Error())
+	w.Flush()
+}
+
+// writeStreamError writes an error as the last element of a stream
+func (w *geminiWriter) writeStreamError(message string) error {
+	if err := w.writeResponseChunk(newGeminiError(http.StatusInternalServerError, message)); err != nil {
+		return err
+	}
+	return w.endArray()
+}
+
+// writeLine converts a line of the chat completion stream
+func (w *geminiWriter) writeLine(line []byte) error {
+	// Comments keep the connection alive, they are passed through to SSE streams.
+	if bytes.HasPrefix(line, _const.TagNoData) {
+		if !w.sse {
+			return nil
+		}
+		return w.writeClient(append(line, "\n\n"...))
+	}
+	if w.stopped || !bytes.HasPrefix(line, _const.TagData) {
+		return nil
+	}
+	data := bytes.TrimSpace(bytes.TrimPrefix(line, _const.TagData))
+	if string(data) == "[DONE]" {
+		return w.stop()
+	}
+	return w.writeChunk(data)
+}
+
+// writeChunk converts a chat.completion.chunk into a response chunk
+func (w *geminiWriter) writeChunk(chunk []byte) error {
+	// An error before the first chunk is left to the failover, an error after it ends the stream.
+	if errorMessage := gjson.GetBytes(chunk, "error.message"); errorMessage.Exists() {
+		w.err = fmt.Errorf("stream error: %s", errorMessage.String())
+		w.stopped = true
+		if !w.started {
+			return nil
+		}
+		return w.writeStreamError(errorMessage.String())
+	}
+	if usage := gjson.GetBytes(chunk, "usage"); usage.IsObject() {
+		w.usage = usage
+	}
+
+	delta := gjson.GetBytes(chunk, "choices.0.delta")
+	for _, toolCall := range delta.Get("tool_calls").Array() {
+		toolCallIndex := toolCall.Get("index").Int()
+		index, ok := w.toolCallIndexes[toolCallIndex]
+		if !ok {
+			index = len(w.toolCalls)
+			w.toolCallIndexes[toolCallIndex] = index
+			w.toolCalls = append(w.toolCalls, &geminiToolCall{id: toolCall.Get("id").String(), name: toolCall.Get("function.name").String()})
+		}
+		w.toolCalls[index].arguments += toolCall.Get("function.arguments").String()
+	}
+	if finishReason := gjson.GetBytes(chunk, "choices.0.finish_reason"); finishReason.Type == gjson.String {
+		w.finishReason = finishReason.String()
+	}
+
+	if parts := w.textParts(delta); len(parts) > 0 {
+		return w.writeResponseChunk(w.response(parts, false))
+	}
+	return nil
+}
+
+// stop writes the last chunk once, with the function calls, the finish reason and the usage
+func (w *geminiWriter) stop() error {
+	if w.stopped {
+		return nil
+	}
+	w.stopped = true
+	parts := make([][]byte, 0, len(w.toolCalls))
+	for _, toolCall := range w.toolCalls {
+		parts = append(parts, geminiFunctionCallPart(toolCall.id, toolCall.name, toolCall.arguments))
+	}
+	if err := w.writeResponseChunk(w.response(parts, true)); err != nil {
+		return err
+	}
+	return w.endArray()
+}
+
+// writeResponseChunk writes a chunk of a stream, as an SSE event or as an element of the JSON array
+func (w *geminiWriter) writeResponseChunk(data []byte) error {
+	output := make([]byte, 0, len(data)+16)
+	switch {
+	case w.sse:
+		output = append(output, "data: "...)
+		output = append(output, data...)
+		output = append(output, "\r\n\r\n"...)
+	case !w.started:
+		// The JSON array is not an event stream.
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		output = append(output, '[')
+		output = append(output, data...)
+	default:
+		output = append(output, ",\r\n"...)
+		output = append(output, data...)
+	}
+	w.started = true
+	return w.writeClient(output)
+}
+
+// endArray closes the JSON array of a stream that is not sent as SSE events
+func (w *geminiWriter) endArray() error {
+	if w.sse {
+		return nil
+	}
+	return w.writeClient([]byte("]"))
+}
+
+// textParts returns the thought and text parts of a chat completion message or delta
+func (w *geminiWriter) textParts(message gjson.Result) [][]byte {
+	parts := make([][]byte, 0, 2)
+	reasoning := message.Get("reasoning_content").String()
+	if reasoning == "" {
+		reasoning = message.Get("reasoning").String()
+	}
+	if reasoning != "" {
+		part, _ := sjson.SetBytes([]byte(`{"text":"","thought":true}`), "text", reasoning)
+		parts = append(parts, part)
+	}
+	if content := message.Get("content").String(); content != "" {
+		part, _ := sjson.SetBytes([]byte(`{"text":""}`), "text", content)
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// geminiFunctionCallPart returns the functionCall part of a tool call
+func geminiFunctionCallPart(id, name, arguments string) []byte {
+	part := []byte(`{"functionCall":{"id":"","name":"","args":{}}}`)
+	part, _ = sjson.SetBytes(part, "functionCall.id", id)
+	part, _ = sjson.SetBytes(part, "functionCall.name", name)
+	if args := gjson.Parse(arguments); args.IsObject() {
+		part, _ = sjson.SetRawBytes(part, "functionCall.args", []byte(args.Raw))
+	}
+	return part
+}
+
+// response returns a response with the parts, the last response has the finish reason and the usage
+func (w *geminiWriter) response(parts [][]byte, last bool) []byte {
+	out := []byte(`{"candidates":[{"content":{"role":"model","parts":[]},"index":0}],"modelVersion":"","responseId":""}`)
+	for _, part := range parts {
+		out, _ = sjson.SetRawBytes(out, "candidates.0.content.parts.-1", part)
+	}
+	out, _ = sjson.SetBytes(out, "modelVersion", w.model)
+	out, _ = sjson.SetBytes(out, "responseId", w.id)
+	if !last {
+		return out
+	}
+
+	finishReason, ok := geminiFinishReasons[w.finishReason]
+	if !ok {
+		finishReason = "STOP"
+	}
+	out, _ = sjson.SetBytes(out, "candidates.0.finishReason", finishReason)
+	if w.usage.IsObject() {
+		out, _ = sjson.SetRawBytes(out, "usageMetadata", w.usageMetadata())
+	}
+	return out
+}
+
+// usageMetadata converts the chat completion usage into a Gemini usageMetadata, whose candidate tokens exclude
+// the thought tokens
+func (w *geminiWriter) usageMetadata() []byte {
+	promptTokens := w.usage.Get("prompt_tokens").Int()
+	completionTokens := w.usage.Get("completion_tokens").Int()
+	reasoningTokens := w.usage.Get("completion_tokens_details.reasoning_tokens").Int()
+	cachedTokens := w.usage.Get("prompt_tokens_details.cached_tokens").Int()
+	totalTokens := w.usage.Get("total_tokens").Int()
+	if totalTokens == 0 {
+		totalTokens = promptTokens + completionTokens
+	}
+
+	usage := []byte(`{"promptTokenCount":0,"candidatesTokenCount":0,"totalTokenCount":0}`)
+	usage, _ = sjson.SetBytes(usage, "promptTokenCount", promptTokens)
+	usage, _ = sjson.SetBytes(usage, "candidatesTokenCount", completionTokens-reasoningTokens)
+	usage, _ = sjson.SetBytes(usage, "totalTokenCount", totalTokens)
+	if reasoningTokens > 0 {
+		usage, _ = sjson.SetBytes(usage, "thoughtsTokenCount", reasoningTokens)
+	}
+	if cachedTokens > 0 {
+		usage, _ = sjson.SetBytes(usage, "cachedContentTokenCount", cachedTokens)
+	}
+	return usage
+}
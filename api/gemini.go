@@ -0,0 +1,422 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/core"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// geminiSchemaLoader is used to load the JSON schema of Gemini generateContent requests
+var geminiSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.GeminiSchema)
+
+// geminiFinishReasons maps OpenAI finish reasons to Gemini finish reasons
+var geminiFinishReasons = map[string]string{
+	"stop":           "STOP",
+	"tool_calls":     "STOP",
+	"function_call":  "STOP",
+	"length":         "MAX_TOKENS",
+	"content_filter": "SAFETY",
+}
+
+// geminiStatuses maps HTTP status codes to the statuses of Google API errors
+var geminiStatuses = map[int]string{
+	http.StatusBadRequest:            "INVALID_ARGUMENT",
+	http.StatusNotFound:              "NOT_FOUND",
+	http.StatusRequestEntityTooLarge: "INVALID_ARGUMENT",
+	http.StatusTooManyRequests:       "RESOURCE_EXHAUSTED",
+	http.StatusInternalServerError:   "INTERNAL",
+	http.StatusServiceUnavailable:    "UNAVAILABLE",
+}
+
+// GeminiHandler handles Gemini generateContent and streamGenerateContent requests, whose path is the model
+// name followed by the method, such as /v1beta/models/gemini-2.5-flash:generateContent.
+// The request is converted into a chat completion request and routed like one, the chat completion or its
+// stream is converted back into Gemini responses.
+func GeminiHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Set the response header, specifying the content type and character set
+		c.Header("Content-Type", "application/json; charset=utf-8")
+
+		// Split the model name and the method
+		action := strings.TrimPrefix(c.Param("action"), "/")
+		separator := strings.LastIndex(action, ":")
+		if separator < 0 {
+			writeGeminiError(c, http.StatusNotFound, fmt.Sprintf("Method not found: %s", action))
+			return
+		}
+		modelName, method := action[:separator], action[separator+1:]
+		if method != "generateContent" && method != "streamGenerateContent" {
+			writeGeminiError(c, http.StatusNotFound, fmt.Sprintf("Method not found: %s", method))
+			return
+		}
+		isStream := method == "streamGenerateContent"
+		c.Set(usageEndpointKey, "/v1beta/models/:model:"+method)
+
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				writeGeminiError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesError.Limit))
+				return
+			}
+			writeGeminiError(c, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
+
+		// Validate the request
+		result, err := gojsonschema.Validate(geminiSchemaLoader, gojsonschema.NewBytesLoader(rawJson))
+		if err != nil {
+			writeGeminiError(c, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		if !result.Valid() {
+			for _, desc := range result.Errors() {
+				writeGeminiError(c, http.StatusBadRequest, fmt.Sprintf("Invalid value at '%s': %s", desc.Field(), desc.Description()))
+				return
+			}
+		}
+
+		// Convert the request into a chat completion request
+		chatRequest := convertGeminiRequest(rawJson, modelName, isStream)
+		if cfg.Server.Debug {
+			log.Printf("Chat completion request of Gemini request for model %s: %s\n", modelName, string(chatRequest))
+		}
+
+		// Moderate the prompt if a moderation policy applies
+		if errModeration := moderatePrompt(c, cfg, providerRegistry, modelName, chatPromptInputs(chatRequest)); errModeration != nil {
+			writeGeminiRouteError(c, modelName, errModeration)
+			return
+		}
+
+		// Try the entries of the model in round-robin order until one succeeds
+		streamed := false
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, nil, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			// Rewrite the request body for this entry
+			requestBody, errBody := provider.ApplyModelBody(chatRequest, model)
+			if errBody != nil {
+				return fmt.Errorf("request body error: %w", errBody)
+			}
+			requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+
+			if cfg.Server.Debug {
+				log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
+			}
+
+			// Serve the chat completion through a writer that converts it, a new writer per entry drops
+			// the error bodies of failed entries
+			writer := newGeminiWriter(c.Writer, modelName, isStream, c.Query("alt") == "sse")
+			c.Writer = writer
+			var errServe error
+			if isStream {
+				errServe = handleStreamingChatCompletion(c, providerInstance, requestBody, model, usage)
+			} else {
+				errServe = handleNonStreamingChatCompletion(c, providerInstance, requestBody, model, usage)
+			}
+			c.Writer = writer.ResponseWriter
+			if errServe == nil {
+				errServe = writer.finish()
+			}
+
+			// Once the first response chunk was sent, the client gets an error instead of another entry's response
+			if errServe != nil && writer.started {
+				streamed = true
+				writer.writeError(errServe)
+				return fmt.Errorf("%w: %w", errServe, errNoFailover)
+			}
+			return errServe
+		})
+		if finalErr != nil && !streamed {
+			writeGeminiRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// convertGeminiRequest converts a Gemini generateContent request into an OpenAI chat completion request
+func convertGeminiRequest(request []byte, modelName string, stream bool) []byte {
+	out := []byte(`{"model":"","messages":[]}`)
+	out, _ = sjson.SetBytes(out, "model", modelName)
+
+	// The system instruction becomes a system message.
+	if systemTexts := geminiTextParts(gjson.GetBytes(request, "systemInstruction.parts")); len(systemTexts) > 0 {
+		message, _ := sjson.SetBytes([]byte(`{"role":"system","content":""}`), "content", strings.Join(systemTexts, "\n"))
+		out, _ = sjson.SetRawBytes(out, "messages.-1", message)
+	}
+
+	// Gemini matches function responses to function calls by name, chat completions by id. The ids of the
+	// function calls without one are generated, and the function responses get the ids of the calls of their name.
+	pendingCalls := make(map[string][]string)
+	callCount := 0
+	for _, content := range gjson.GetBytes(request, "contents").Array() {
+		parts := content.Get("parts").Array()
+		if content.Get("role").String() == "model" {
+			message := []byte(`{"role":"assistant","content":""}`)
+			message, _ = sjson.SetBytes(message, "content", strings.Join(geminiTextParts(content.Get("parts")), ""))
+			for _, part := range parts {
+				functionCall := part.Get("functionCall")
+				if !functionCall.Exists() {
+					continue
+				}
+				name := functionCall.Get("name").String()
+				id := functionCall.Get("id").String()
+				if id == "" {
+					id = fmt.Sprintf("call_%d", callCount)
+				}
+				callCount++
+				pendingCalls[name] = append(pendingCalls[name], id)
+				toolCall := []byte(`{"id":"","type":"function","function":{"name":"","arguments":"{}"}}`)
+				toolCall, _ = sjson.SetBytes(toolCall, "id", id)
+				toolCall, _ = sjson.SetBytes(toolCall, "function.name", name)
+				if args := functionCall.Get("args"); args.IsObject() {
+					toolCall, _ = sjson.SetBytes(toolCall, "function.arguments", args.Raw)
+				}
+				message, _ = sjson.SetRawBytes(message, "tool_calls.-1", toolCall)
+			}
+			out, _ = sjson.SetRawBytes(out, "messages.-1", message)
+			continue
+		}
+
+		// Function responses become tool messages, which come before the rest of the user turn.
+		userParts := make([][]byte, 0)
+		hasImage := false
+		for _, part := range parts {
+			switch {
+			case part.Get("functionResponse").Exists():
+				functionResponse := part.Get("functionResponse")
+				name := functionResponse.Get("name").String()
+				id := functionResponse.Get("id").String()
+				if id == "" && len(pendingCalls[name]) > 0 {
+					id = pendingCalls[name][0]
+					pendingCalls[name] = pendingCalls[name][1:]
+				}
+				toolMessage := []byte(`{"role":"tool","tool_call_id":"","content":""}`)
+				toolMessage, _ = sjson.SetBytes(toolMessage, "tool_call_id", id)
+				toolMessage, _ = sjson.SetBytes(toolMessage, "content", geminiFunctionResult(functionResponse.Get("response")))
+				out, _ = sjson.SetRawBytes(out, "messages.-1", toolMessage)
+			case part.Get("text").Exists() && !part.Get("thought").Bool():
+				userParts = append(userParts, newTextPart(part.Get("text").String()))
+			case strings.HasPrefix(part.Get("inlineData.mimeType").String(), "image/"):
+				url := fmt.Sprintf("data:%s;base64,%s", part.Get("inlineData.mimeType").String(), part.Get("inlineData.data").String())
+				imagePart, _ := sjson.SetBytes([]byte(`{"type":"image_url","image_url":{"url":""}}`), "image_url.url", url)
+				userParts = append(userParts, imagePart)
+				hasImage = true
+			case strings.HasPrefix(part.Get("fileData.mimeType").String(), "image/"):
+				imagePart, _ := sjson.SetBytes([]byte(`{"type":"image_url","image_url":{"url":""}}`), "image_url.url", part.Get("fileData.fileUri").String())
+				userParts = append(userParts, imagePart)
+				hasImage = true
+			}
+		}
+		if len(userParts) == 0 {
+			continue
+		}
+
+		// Text only content is sent as a string, which every provider accepts.
+		message := []byte(`{"role":"user","content":""}`)
+		if hasImage {
+			message, _ = sjson.SetRawBytes(message, "content", []byte("[]"))
+			for _, part := range userParts {
+				message, _ = sjson.SetRawBytes(message, "content.-1", part)
+			}
+		} else {
+			texts := make([]string, 0, len(userParts))
+			for _, part := range userParts {
+				texts = append(texts, gjson.GetBytes(part, "text").String())
+			}
+			message, _ = sjson.SetBytes(message, "content", strings.Join(texts, "\n"))
+		}
+		out, _ = sjson.SetRawBytes(out, "messages.-1", message)
+	}
+
+	// Convert the generation parameters.
+	generationConfig := gjson.GetBytes(request, "generationConfig")
+	for _, names := range [][2]string{{"maxOutputTokens", "max_tokens"}, {"temperature", "temperature"}, {"topP", "top_p"}, {"topK", "top_k"}, {"seed", "seed"}, {"presencePenalty", "presence_penalty"}, {"frequencyPenalty", "frequency_penalty"}} {
+		if value := generationConfig.Get(names[0]); value.Type == gjson.Number {
+			out, _ = sjson.SetRawBytes(out, names[1], []byte(value.Raw))
+		}
+	}
+	if candidateCount := generationConfig.Get("candidateCount").Int(); candidateCount > 1 {
+		out, _ = sjson.SetBytes(out, "n", candidateCount)
+	}
+	if stopSequences := generationConfig.Get("stopSequences"); stopSequences.IsArray() && len(stopSequences.Array()) > 0 {
+		out, _ = sjson.SetRawBytes(out, "stop", []byte(stopSequences.Raw))
+	}
+
+	// Convert the JSON response configuration to response_format.
+	if generationConfig.Get("responseMimeType").String() == "application/json" {
+		schema := generationConfig.Get("responseJsonSchema")
+		var schemaJSON []byte
+		if schema.IsObject() {
+			schemaJSON = []byte(schema.Raw)
+		} else if schema = generationConfig.Get("responseSchema"); schema.IsObject() {
+			schemaJSON = geminiSchema(schema)
+		}
+		if schemaJSON != nil {
+			out, _ = sjson.SetRawBytes(out, "response_format", []byte(`{"type":"json_schema","json_schema":{"name":"response"}}`))
+			out, _ = sjson.SetRawBytes(out, "response_format.json_schema.schema", schemaJSON)
+		} else {
+			out, _ = sjson.SetRawBytes(out, "response_format", []byte(`{"type":"json_object"}`))
+		}
+	}
+
+	// Convert the thinking configuration to reasoning_effort. A budget of 0 or -1 leaves the thinking to the provider.
+	if thinkingLevel := generationConfig.Get("thinkingConfig.thinkingLevel").String(); thinkingLevel != "" {
+		out, _ = sjson.SetBytes(out, "reasoning_effort", strings.ToLower(thinkingLevel))
+	} else if thinkingBudget := generationConfig.Get("thinkingConfig.thinkingBudget").Int(); thinkingBudget > 0 {
+		out, _ = sjson.SetBytes(out, "reasoning_effort", messagesReasoningEffort(int(thinkingBudget)))
+	}
+
+	// Convert the function declarations, built-in tools such as Google Search are not sent.
+	for _, tool := range gjson.GetBytes(request, "tools").Array() {
+		for _, declaration := range tool.Get("functionDeclarations").Array() {
+			function := []byte(`{"type":"function","function":{"name":"","parameters":{"type":"object","properties":{}}}}`)
+			function, _ = sjson.SetBytes(function, "function.name", declaration.Get("name").String())
+			if description := declaration.Get("description"); description.Type == gjson.String {
+				function, _ = sjson.SetBytes(function, "function.description", description.String())
+			}
+			if parameters := declaration.Get("parametersJsonSchema"); parameters.IsObject() {
+				function, _ = sjson.SetRawBytes(function, "function.parameters", []byte(parameters.Raw))
+			} else if parameters = declaration.Get("parameters"); parameters.IsObject() {
+				function, _ = sjson.SetRawBytes(function, "function.parameters", geminiSchema(parameters))
+			}
+			out, _ = sjson.SetRawBytes(out, "tools.-1", function)
+		}
+	}
+
+	// Convert the function calling mode to tool_choice.
+	functionCallingConfig := gjson.GetBytes(request, "toolConfig.functionCallingConfig")
+	switch functionCallingConfig.Get("mode").String() {
+	case "AUTO", "VALIDATED":
+		out, _ = sjson.SetBytes(out, "tool_choice", "auto")
+	case "NONE":
+		out, _ = sjson.SetBytes(out, "tool_choice", "none")
+	case "ANY":
+		if allowedNames := functionCallingConfig.Get("allowedFunctionNames").Array(); len(allowedNames) == 1 {
+			out, _ = sjson.SetRawBytes(out, "tool_choice", []byte(`{"type":"function","function":{"name":""}}`))
+			out, _ = sjson.SetBytes(out, "tool_choice.function.name", allowedNames[0].String())
+		} else {
+			out, _ = sjson.SetBytes(out, "tool_choice", "required")
+		}
+	}
+
+	if stream {
+		out, _ = sjson.SetBytes(out, "stream", true)
+	}
+
+	return out
+}
+
+// geminiTextParts returns the texts of Gemini parts, without the thoughts
+func geminiTextParts(parts gjson.Result) []string {
+	texts := make([]string, 0)
+	for _, part := range parts.Array() {
+		if text := part.Get("text"); text.Exists() && !part.Get("thought").Bool() {
+			texts = append(texts, text.String())
+		}
+	}
+	return texts
+}
+
+// geminiFunctionResult returns the content of the tool message of a function response. A response that only
+// wraps a string, as Gemini asks for results that are not objects, is unwrapped.
+func geminiFunctionResult(response gjson.Result) string {
+	fields := response.Map()
+	if len(fields) == 1 {
+		for _, name := range []string{"content", "output", "result"} {
+			if value, ok := fields[name]; ok && value.Type == gjson.String {
+				return value.String()
+			}
+		}
+	}
+	if !response.Exists() {
+		return ""
+	}
+	return response.Raw
+}
+
+// geminiSchema converts a Gemini OpenAPI schema, whose types are upper case, into a JSON schema
+func geminiSchema(schema gjson.Result) []byte {
+	var value any
+	if err := json.Unmarshal([]byte(schema.Raw), &value); err != nil {
+		return []byte(schema.Raw)
+	}
+	var lowerTypes func(value any)
+	lowerTypes = func(value any) {
+		switch typed := value.(type) {
+		case map[string]any:
+			for key, item := range typed {
+				if text, ok := item.(string); ok && key == "type" {
+					typed[key] = strings.ToLower(text)
+					continue
+				}
+				lowerTypes(item)
+			}
+		case []any:
+			for _, item := range typed {
+				lowerTypes(item)
+			}
+		}
+	}
+	lowerTypes(value)
+	out, err := json.Marshal(value)
+	if err != nil {
+		return []byte(schema.Raw)
+	}
+	return out
+}
+
+// newGeminiError returns a Google API error body
+func newGeminiError(status int, message string) []byte {
+	statusName, ok := geminiStatuses[status]
+	if !ok {
+		statusName = "UNKNOWN"
+	}
+	out := []byte(`{"error":{"code":0,"message":"","status":""}}`)
+	out, _ = sjson.SetBytes(out, "error.code", status)
+	out, _ = sjson.SetBytes(out, "error.message", message)
+	out, _ = sjson.SetBytes(out, "error.status", statusName)
+	return out
+}
+
+// writeGeminiError writes a Google API error response
+func writeGeminiError(c *gin.Context, status int, message string) {
+	c.Data(status, "application/json; charset=utf-8", newGeminiError(status, message))
+}
+
+// writeGeminiRouteError writes the Google API error response for an error returned by routeRequest
+func writeGeminiRouteError(c *gin.Context, modelName string, err error) {
+	// The streaming handler has set the event stream content type
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	if errors.Is(err, errModelNotFound) {
+		writeGeminiError(c, http.StatusNotFound, fmt.Sprintf("Model %s not found or not available.", modelName))
+		return
+	}
+	if errors.Is(err, errPromptFlagged) {
+		writeGeminiError(c, http.StatusBadRequest, "Request blocked: "+err.Error())
+		return
+	}
+	var quotaErr *core.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(quotaErr.RetryAfter.Seconds()))))
+		writeGeminiError(c, http.StatusTooManyRequests, "Rate limit exceeded: "+quotaErr.Error())
+		return
+	}
+	writeGeminiError(c, upstreamStatus(err), "All providers failed: "+err.Error())
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// imagesGenerationsSchemaLoader is used to load the JSON schema of image generation requests
+var imagesGenerationsSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.ImagesGenerationsSchema)
+
+// multipartImageCall sends a multipart image request, such as provider.ImageProvider.EditImage
+type multipartImageCall func(p provider.ImageProvider, ctx context.Context, cancel context.CancelFunc, body []byte, contentType string, model models.Model, usage *provider.Usage) ([]byte, error, []byte)
+
+// ImageGenerationHandler handles image generation requests, only entries with supports_image_gen are tried
+func ImageGenerationHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Set the response header, specifying the content type and character set
+		c.Header("Content-Type", "application/json; charset=utf-8")
+
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			writeBodyError(c, err)
+			return
+		}
+
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
+
+		// Validate the request
+		if !validateJSONBody(c, imagesGenerationsSchemaLoader, rawJson) {
+			return
+		}
+		modelName := gjson.GetBytes(rawJson, "model").String()
+
+		// Try the entries of the model that generate images in round-robin order until one succeeds
+		isImageGenModel := func(model models.Model) bool {
+			return model.SupportsImageGen
+		}
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, isImageGenModel, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			imageProvider, ok := providerInstance.(provider.ImageProvider)
+			if !ok {
+				return fmt.Errorf("provider type %s does not generate images", model.ProviderType)
+			}
+
+			// Rewrite the request body for this entry
+			requestBody, errBody := provider.ApplyModelBody(rawJson, model)
+			if errBody != nil {
+				return fmt.Errorf("request body error: %w", errBody)
+			}
+			requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+
+			if cfg.Server.Debug {
+				log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
+			}
+
+			return handleNonStreamingResponse(c, model, usage, func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) ([]byte, error, []byte) {
+				response, err, errResponse := imageProvider.CreateImage(ctx, cancel, requestBody, model, usage)
+				countImages(response, usage)
+				return response, err, errResponse
+			})
+		})
+		if finalErr != nil {
+			writeRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// ImageEditHandler handles multipart image edit requests, only entries with supports_image_edit are tried
+func ImageEditHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	isImageEditModel := func(model models.Model) bool {
+		return model.SupportsImageEdit
+	}
+	return multipartImageHandler(cfg, providerRegistry, isImageEditModel, []string{"prompt"}, provider.ImageProvider.EditImage)
+}
+
+// ImageVariationHandler handles multipart image variation requests, only entries with supports_image_var are tried
+func ImageVariationHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	isImageVarModel := func(model models.Model) bool {
+		return model.SupportsImageVar
+	}
+	return multipartImageHandler(cfg, providerRegistry, isImageVarModel, nil, provider.ImageProvider.CreateImageVariation)
+}
+
+// multipartImageHandler handles multipart image requests. The body is kept in memory so that it can be sent
+// to the next entry on failover, only its model field is replaced for each entry.
+func multipartImageHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory, capable func(model models.Model) bool, requiredFields []string, call multipartImageCall) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Set the response header, specifying the content type and character set
+		c.Header("Content-Type", "application/json; charset=utf-8")
+
+		// Get the raw multipart data
+		contentType := c.GetHeader("Content-Type")
+		rawBody, err := c.GetRawData()
+		if err != nil {
+			writeBodyError(c, err)
+			return
+		}
+
+		// Validate the request
+		fields, files, err := provider.MultipartFields(rawBody, contentType)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: %v", err), "code": 400})
+			return
+		}
+		if fields["model"] == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: model field is missing", "code": 400})
+			return
+		}
+		if !files["image"] && !files["image[]"] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: image file is missing", "code": 400})
+			return
+		}
+		for _, field := range requiredFields {
+			if fields[field] == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: %s field is missing", field), "code": 400})
+				return
+			}
+		}
+		modelName := fields["model"]
+		customProviderNames, _ := parseProviderNames(c, nil)
+
+		// Try the capable entries of the model in round-robin order until one succeeds
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, capable, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			imageProvider, ok := providerInstance.(provider.ImageProvider)
+			if !ok {
+				return fmt.Errorf("provider type %s does not generate images", model.ProviderType)
+			}
+
+			requestBody, errBody := provider.ReplaceMultipartField(rawBody, contentType, "model", model.ProviderModelName)
+			if errBody != nil {
+				return fmt.Errorf("request body error: %w", errBody)
+			}
+
+			if cfg.Server.Debug {
+				log.Printf("Request fields for model %s (entry %d): %v\n", model.Name, model.ID, fields)
+			}
+
+			return handleNonStreamingResponse(c, model, usage, func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) ([]byte, error, []byte) {
+				response, err, errResponse := call(imageProvider, ctx, cancel, requestBody, contentType, model, usage)
+				countImages(response, usage)
+				return response, err, errResponse
+			})
+		})
+		if finalErr != nil {
+			writeRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// countImages sets the number of images of an image response in the usage, if the provider did not set it
+func countImages(response []byte, usage *provider.Usage) {
+	if usage.Images == 0 {
+		usage.Images = len(gjson.GetBytes(response, "data").Array())
+	}
+}
+
+// writeBodyError writes the error response for a request body that could not be read
+func writeBodyError(c *gin.Context, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesError.Limit), "code": 413})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: %v", err), "code": 400})
+}
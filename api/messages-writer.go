@@ -0,0 +1,295 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_const "github.com/luispater/mini-router/const"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// messagesWriter converts the chat completion written by the chat handlers into an Anthropic message.
+// A non-streaming completion is converted by finish, the chunks of a stream are converted into Anthropic events
+// as their lines are complete. Other output, such as the error body of a failed entry, is dropped.
+type messagesWriter struct {
+	convertingWriter
+	// model is the requested model name
+	model string
+
+	// id is the message id
+	id string
+	// started indicates whether the message_start event was written
+	started bool
+	// stopped indicates whether the message_stop or error event was written
+	stopped bool
+	// blockIndex is the index of the open content block, -1 if none is open
+	blockIndex int
+	// blockType is the type of the open content block
+	blockType string
+	// blocks is the number of content blocks started
+	blocks int
+	// toolBlocks maps the tool call indexes of the chunks to content block indexes
+	toolBlocks map[int64]int
+	// finishReason is the finish reason of the completion
+	finishReason string
+	// usage is the usage of the completion
+	usage gjson.Result
+	// err is the error event of the stream
+	err error
+}
+
+// newMessagesWriter returns a messagesWriter that writes the converted message to w
+func newMessagesWriter(w gin.ResponseWriter, model string, stream bool) *messagesWriter {
+	writer := &messagesWriter{
+		convertingWriter: convertingWriter{ResponseWriter: w, stream: stream},
+		model:            model,
+		id:               fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		blockIndex:       -1,
+		toolBlocks:       make(map[int64]int),
+	}
+	writer.convertingWriter.writeLine = writer.writeLine
+	return writer
+}
+
+// finish writes the converted non-streaming message, or the end of a stream that ended without [DONE].
+// It returns the error event of a stream.
+func (w *messagesWriter) finish() error {
+	if w.stream {
+		if err := w.flushLine(); err != nil {
+			return err
+		}
+		if w.err != nil {
+			return w.err
+		}
+		return w.stop()
+	}
+
+	response := bytes.TrimSpace(w.buffer)
+	if !gjson.GetBytes(response, "choices").IsArray() {
+		return fmt.Errorf("unexpected response: %s", string(response))
+	}
+	w.finishReason = gjson.GetBytes(response, "choices.0.finish_reason").String()
+	w.usage = gjson.GetBytes(response, "usage")
+	return w.writeClient(w.convertCompletion(response))
+}
+
+// writeError ends a started stream with an error event
+func (w *messagesWriter) writeError(err error) {
+	if !w.stream || w.stopped {
+		return
+	}
+	w.stopped = true
+	_ = w.writeEvent("error", newMessagesError("api_error", err.Error()))
+	w.Flush()
+}
+
+// writeLine converts a line of the chat completion stream
+func (w *messagesWriter) writeLine(line []byte) error {
+	// Comments keep the connection alive and are passed through.
+	if bytes.HasPrefix(line, _const.TagNoData) {
+		return w.writeClient(append(line, "\n\n"...))
+	}
+	if w.stopped || !bytes.HasPrefix(line, _const.TagData) {
+		return nil
+	}
+	data := bytes.TrimSpace(bytes.TrimPrefix(line, _const.TagData))
+	if string(data) == "[DONE]" {
+		return w.stop()
+	}
+	return w.writeChunk(data)
+}
+
+// writeChunk converts a chat.completion.chunk into Anthropic events
+func (w *messagesWriter) writeChunk(chunk []byte) error {
+	// An error before the message starts is left to the failover, an error after it ends the stream.
+	if errorMessage := gjson.GetBytes(chunk, "error.message"); errorMessage.Exists() {
+		w.err = fmt.Errorf("stream error: %s", errorMessage.String())
+		w.stopped = true
+		if !w.started {
+			return nil
+		}
+		return w.writeEvent("error", newMessagesError("api_error", errorMessage.String()))
+	}
+	if err := w.start(); err != nil {
+		return err
+	}
+	if usage := gjson.GetBytes(chunk, "usage"); usage.IsObject() {
+		w.usage = usage
+	}
+
+	delta := gjson.GetBytes(chunk, "choices.0.delta")
+	reasoning := delta.Get("reasoning_content").String()
+	if reasoning == "" {
+		reasoning = delta.Get("reasoning").String()
+	}
+	if reasoning != "" {
+		if err := w.writeDelta("thinking", `{"type":"thinking","thinking":"","signature":""}`, "thinking_delta", "thinking", reasoning); err != nil {
+			return err
+		}
+	}
+	if content := delta.Get("content").String(); content != "" {
+		if err := w.writeDelta("text", `{"type":"text","text":""}`, "text_delta", "text", content); err != nil {
+			return err
+		}
+	}
+	for _, toolCall := range delta.Get("tool_calls").Array() {
+		toolCallIndex := toolCall.Get("index").Int()
+		blockIndex, ok := w.toolBlocks[toolCallIndex]
+		if !ok {
+			// A tool call starts with its id and name.
+			block := []byte(`{"type":"tool_use","id":"","name":"","input":{}}`)
+			block, _ = sjson.SetBytes(block, "id", toolCall.Get("id").String())
+			block, _ = sjson.SetBytes(block, "name", toolCall.Get("function.name").String())
+			if err := w.startBlock("tool_use", block); err != nil {
+				return err
+			}
+			blockIndex = w.blockIndex
+			w.toolBlocks[toolCallIndex] = blockIndex
+		}
+		if arguments := toolCall.Get("function.arguments").String(); arguments != "" {
+			event := []byte(`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":""}}`)
+			event, _ = sjson.SetBytes(event, "index", blockIndex)
+			event, _ = sjson.SetBytes(event, "delta.partial_json", arguments)
+			if err := w.writeEvent("content_block_delta", event); err != nil {
+				return err
+			}
+		}
+	}
+
+	if finishReason := gjson.GetBytes(chunk, "choices.0.finish_reason"); finishReason.Type == gjson.String {
+		w.finishReason = finishReason.String()
+	}
+	return nil
+}
+
+// writeDelta writes a text or thinking delta, starting a block of its type if another block is open
+func (w *messagesWriter) writeDelta(blockType, block, deltaType, field, text string) error {
+	if w.blockType != blockType || w.blockIndex < 0 {
+		if err := w.startBlock(blockType, []byte(block)); err != nil {
+			return err
+		}
+	}
+	event := []byte(`{"type":"content_block_delta","index":0,"delta":{"type":""}}`)
+	event, _ = sjson.SetBytes(event, "index", w.blockIndex)
+	event, _ = sjson.SetBytes(event, "delta.type", deltaType)
+	event, _ = sjson.SetBytes(event, "delta."+field, text)
+	return w.writeEvent("content_block_delta", event)
+}
+
+// start writes the message_start event once
+func (w *messagesWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	event := []byte(`{"type":"message_start","message":{"id":"","type":"message","role":"assistant","model":"","content":[],"stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":0,"output_tokens":0}}}`)
+	event, _ = sjson.SetBytes(event, "message.id", w.id)
+	event, _ = sjson.SetBytes(event, "message.model", w.model)
+	return w.writeEvent("message_start", event)
+}
+
+// startBlock closes the open content block and starts a new one
+func (w *messagesWriter) startBlock(blockType string, block []byte) error {
+	if err := w.stopBlock(); err != nil {
+		return err
+	}
+	w.blockIndex = w.blocks
+	w.blockType = blockType
+	w.blocks++
+	event := []byte(`{"type":"content_block_start","index":0,"content_block":{}}`)
+	event, _ = sjson.SetBytes(event, "index", w.blockIndex)
+	event, _ = sjson.SetRawBytes(event, "content_block", block)
+	return w.writeEvent("content_block_start", event)
+}
+
+// stopBlock closes the open content block
+func (w *messagesWriter) stopBlock() error {
+	if w.blockIndex < 0 {
+		return nil
+	}
+	event, _ := sjson.SetBytes([]byte(`{"type":"content_block_stop","index":0}`), "index", w.blockIndex)
+	w.blockIndex = -1
+	w.blockType = ""
+	return w.writeEvent("content_block_stop", event)
+}
+
+// stop closes the open content block and writes the message_delta and message_stop events
+func (w *messagesWriter) stop() error {
+	if w.stopped {
+		return nil
+	}
+	if err := w.start(); err != nil {
+		return err
+	}
+	if err := w.stopBlock(); err != nil {
+		return err
+	}
+	w.stopped = true
+
+	event := []byte(`{"type":"message_delta","delta":{"stop_reason":"","stop_sequence":null},"usage":{}}`)
+	event, _ = sjson.SetBytes(event, "delta.stop_reason", w.stopReason(len(w.toolBlocks) > 0))
+	event, _ = sjson.SetRawBytes(event, "usage", w.messageUsage())
+	if err := w.writeEvent("message_delta", event); err != nil {
+		return err
+	}
+	return w.writeEvent("message_stop", []byte(`{"type":"message_stop"}`))
+}
+
+// convertCompletion converts a chat completion into an Anthropic message
+func (w *messagesWriter) convertCompletion(response []byte) []byte {
+	out := []byte(`{"id":"","type":"message","role":"assistant","model":"","content":[],"stop_reason":"","stop_sequence":null,"usage":{}}`)
+	out, _ = sjson.SetBytes(out, "id", w.id)
+	out, _ = sjson.SetBytes(out, "model", w.model)
+
+	message := gjson.GetBytes(response, "choices.0.message")
+	reasoning := message.Get("reasoning_content").String()
+	if reasoning == "" {
+		reasoning = message.Get("reasoning").String()
+	}
+	if reasoning != "" {
+		block, _ := sjson.SetBytes([]byte(`{"type":"thinking","thinking":"","signature":""}`), "thinking", reasoning)
+		out, _ = sjson.SetRawBytes(out, "content.-1", block)
+	}
+	if content := message.Get("content").String(); content != "" {
+		block, _ := sjson.SetBytes([]byte(`{"type":"text","text":""}`), "text", content)
+		out, _ = sjson.SetRawBytes(out, "content.-1", block)
+	}
+	toolCalls := message.Get("tool_calls").Array()
+	for _, toolCall := range toolCalls {
+		block := []byte(`{"type":"tool_use","id":"","name":"","input":{}}`)
+		block, _ = sjson.SetBytes(block, "id", toolCall.Get("id").String())
+		block, _ = sjson.SetBytes(block, "name", toolCall.Get("function.name").String())
+		if arguments := gjson.Parse(toolCall.Get("function.arguments").String()); arguments.IsObject() {
+			block, _ = sjson.SetRawBytes(block, "input", []byte(arguments.Raw))
+		}
+		out, _ = sjson.SetRawBytes(out, "content.-1", block)
+	}
+
+	out, _ = sjson.SetBytes(out, "stop_reason", w.stopReason(len(toolCalls) > 0))
+	out, _ = sjson.SetRawBytes(out, "usage", w.messageUsage())
+	return out
+}
+
+// stopReason returns the Anthropic stop reason of the completion, tool_use if it has tool calls
+func (w *messagesWriter) stopReason(hasToolCalls bool) string {
+	stopReason := messagesStopReason(w.finishReason)
+	if hasToolCalls && stopReason == "end_turn" {
+		return "tool_use"
+	}
+	return stopReason
+}
+
+// messageUsage converts the chat completion usage into an Anthropic usage, whose input tokens exclude the cached tokens
+func (w *messagesWriter) messageUsage() []byte {
+	cachedTokens := w.usage.Get("prompt_tokens_details.cached_tokens").Int()
+	usage := []byte(`{"input_tokens":0,"output_tokens":0}`)
+	usage, _ = sjson.SetBytes(usage, "input_tokens", w.usage.Get("prompt_tokens").Int()-cachedTokens)
+	usage, _ = sjson.SetBytes(usage, "output_tokens", w.usage.Get("completion_tokens").Int())
+	if cachedTokens > 0 {
+		usage, _ = sjson.SetBytes(usage, "cache_read_input_tokens", cachedTokens)
+	}
+	return usage
+}
@@ -0,0 +1,455 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/core"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+const (
+	// messagesCharsPerToken is the number of characters counted as one token by the token count estimate
+	messagesCharsPerToken = 4
+	// messagesImageTokens is the number of tokens counted for an image, the cost of the largest images at Anthropic
+	messagesImageTokens = 1600
+)
+
+// messagesSchemaLoader is used to load the JSON schema of Anthropic Messages requests
+var messagesSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.MessagesSchema)
+
+// messagesStopReasons maps OpenAI finish reasons to Anthropic stop reasons
+var messagesStopReasons = map[string]string{
+	"stop":           "end_turn",
+	"length":         "max_tokens",
+	"tool_calls":     "tool_use",
+	"function_call":  "tool_use",
+	"content_filter": "refusal",
+}
+
+// MessagesHandler handles Anthropic Messages API requests.
+// The request is converted into a chat completion request and routed like one, the chat completion or its
+// stream is converted back into an Anthropic message or Anthropic events.
+func MessagesHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Set the response header, specifying the content type and character set
+		c.Header("Content-Type", "application/json; charset=utf-8")
+
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			writeMessagesBodyError(c, err)
+			return
+		}
+
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
+
+		// Validate the request
+		if !validateMessagesRequest(c, rawJson) {
+			return
+		}
+		if !gjson.GetBytes(rawJson, "max_tokens").Exists() {
+			writeMessagesError(c, http.StatusBadRequest, "invalid_request_error", "max_tokens: Field required")
+			return
+		}
+		modelName := gjson.GetBytes(rawJson, "model").String()
+		isStream := gjson.GetBytes(rawJson, "stream").Bool()
+
+		// Convert the request into a chat completion request
+		chatRequest := convertMessagesRequest(rawJson)
+		if cfg.Server.Debug {
+			log.Printf("Chat completion request of messages request for model %s: %s\n", modelName, string(chatRequest))
+		}
+
+		// Moderate the prompt if a moderation policy applies
+		if errModeration := moderatePrompt(c, cfg, providerRegistry, modelName, chatPromptInputs(chatRequest)); errModeration != nil {
+			writeMessagesRouteError(c, modelName, errModeration)
+			return
+		}
+
+		// Try the entries of the model in round-robin order until one succeeds
+		streamed := false
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, nil, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			// Rewrite the request body for this entry
+			requestBody, errBody := provider.ApplyModelBody(chatRequest, model)
+			if errBody != nil {
+				return fmt.Errorf("request body error: %w", errBody)
+			}
+			requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+
+			if cfg.Server.Debug {
+				log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
+			}
+
+			// Serve the chat completion through a writer that converts it, a new writer per entry drops
+			// the error bodies of failed entries
+			writer := newMessagesWriter(c.Writer, modelName, isStream)
+			c.Writer = writer
+			var errServe error
+			if isStream {
+				errServe = handleStreamingChatCompletion(c, providerInstance, requestBody, model, usage)
+			} else {
+				errServe = handleNonStreamingChatCompletion(c, providerInstance, requestBody, model, usage)
+			}
+			c.Writer = writer.ResponseWriter
+			if errServe == nil {
+				errServe = writer.finish()
+			}
+
+			// Once the message has started, the client gets an error event instead of another entry's message
+			if errServe != nil && writer.started {
+				streamed = true
+				writer.writeError(errServe)
+				return fmt.Errorf("%w: %w", errServe, errNoFailover)
+			}
+			return errServe
+		})
+		if finalErr != nil && !streamed {
+			writeMessagesRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// MessagesCountTokensHandler handles Anthropic count_tokens requests. The backends of a model differ,
+// so the count is estimated from the length of the text rather than asked from a provider.
+func MessagesCountTokensHandler(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			writeMessagesBodyError(c, err)
+			return
+		}
+
+		_, rawJson = parseProviderNames(c, rawJson)
+
+		// Validate the request
+		if !validateMessagesRequest(c, rawJson) {
+			return
+		}
+		modelName := gjson.GetBytes(rawJson, "model").String()
+		apiKey, _ := requestAPIKey(c)
+		found := false
+		for _, model := range cfg.Models {
+			if model.Name == modelName && model.Enabled && apiKey.AllowsModel(modelName) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			writeMessagesRouteError(c, modelName, errModelNotFound)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"input_tokens": estimateChatRequestTokens(convertMessagesRequest(rawJson))})
+	}
+}
+
+// validateMessagesRequest validates a request against the Messages schema, writing the error response if it is invalid
+func validateMessagesRequest(c *gin.Context, rawJson []byte) bool {
+	result, err := gojsonschema.Validate(messagesSchemaLoader, gojsonschema.NewBytesLoader(rawJson))
+	if err != nil {
+		writeMessagesError(c, http.StatusBadRequest, "invalid_request_error", "Invalid request body")
+		return false
+	}
+	if !result.Valid() {
+		for _, desc := range result.Errors() {
+			writeMessagesError(c, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("%s: %s", desc.Field(), desc.Description()))
+			return false
+		}
+	}
+	return true
+}
+
+// convertMessagesRequest converts an Anthropic Messages request into an OpenAI chat completion request
+func convertMessagesRequest(request []byte) []byte {
+	out := []byte(`{"model":"","messages":[]}`)
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(request, "model").String())
+
+	// The system prompt becomes a system message.
+	system := gjson.GetBytes(request, "system")
+	if systemText := strings.Join(messagesTextParts(system), "\n\n"); systemText != "" {
+		message := []byte(`{"role":"system","content":""}`)
+		message, _ = sjson.SetBytes(message, "content", systemText)
+		out, _ = sjson.SetRawBytes(out, "messages.-1", message)
+	}
+
+	// Convert the messages.
+	for _, message := range gjson.GetBytes(request, "messages").Array() {
+		content := message.Get("content")
+		if message.Get("role").String() == "assistant" {
+			out, _ = sjson.SetRawBytes(out, "messages.-1", convertMessagesAssistantMessage(content))
+			continue
+		}
+
+		// Tool results become tool messages, which must directly follow the assistant message with the tool calls.
+		parts := make([][]byte, 0)
+		hasImage := false
+		if content.Type == gjson.String {
+			parts = append(parts, newTextPart(content.String()))
+		}
+		for _, block := range content.Array() {
+			switch block.Get("type").String() {
+			case "text":
+				parts = append(parts, newTextPart(block.Get("text").String()))
+			case "image":
+				if part := convertMessagesImage(block); part != nil {
+					parts = append(parts, part)
+					hasImage = true
+				}
+			case "tool_result":
+				toolMessage := []byte(`{"role":"tool","tool_call_id":"","content":""}`)
+				toolMessage, _ = sjson.SetBytes(toolMessage, "tool_call_id", block.Get("tool_use_id").String())
+				toolMessage, _ = sjson.SetBytes(toolMessage, "content", strings.Join(messagesTextParts(block.Get("content")), "\n"))
+				out, _ = sjson.SetRawBytes(out, "messages.-1", toolMessage)
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+
+		// Text only content is sent as a string, which every provider accepts.
+		userMessage := []byte(`{"role":"user","content":""}`)
+		if hasImage {
+			userMessage, _ = sjson.SetRawBytes(userMessage, "content", []byte("[]"))
+			for _, part := range parts {
+				userMessage, _ = sjson.SetRawBytes(userMessage, "content.-1", part)
+			}
+		} else {
+			texts := make([]string, 0, len(parts))
+			for _, part := range parts {
+				texts = append(texts, gjson.GetBytes(part, "text").String())
+			}
+			userMessage, _ = sjson.SetBytes(userMessage, "content", strings.Join(texts, "\n"))
+		}
+		out, _ = sjson.SetRawBytes(out, "messages.-1", userMessage)
+	}
+
+	// Copy the sampling parameters.
+	if maxTokens := gjson.GetBytes(request, "max_tokens"); maxTokens.Exists() {
+		out, _ = sjson.SetBytes(out, "max_tokens", maxTokens.Int())
+	}
+	for _, name := range []string{"temperature", "top_p", "top_k"} {
+		if value := gjson.GetBytes(request, name); value.Type == gjson.Number {
+			out, _ = sjson.SetRawBytes(out, name, []byte(value.Raw))
+		}
+	}
+	if stopSequences := gjson.GetBytes(request, "stop_sequences"); len(stopSequences.Array()) > 0 {
+		out, _ = sjson.SetRawBytes(out, "stop", []byte(stopSequences.Raw))
+	}
+
+	// Convert the client tools, server tools such as web search have a type and are not sent.
+	for _, tool := range gjson.GetBytes(request, "tools").Array() {
+		if toolType := tool.Get("type").String(); toolType != "" && toolType != "custom" {
+			continue
+		}
+		function := []byte(`{"type":"function","function":{"name":"","parameters":{"type":"object","properties":{}}}}`)
+		function, _ = sjson.SetBytes(function, "function.name", tool.Get("name").String())
+		if description := tool.Get("description"); description.Exists() {
+			function, _ = sjson.SetBytes(function, "function.description", description.String())
+		}
+		if inputSchema := tool.Get("input_schema"); inputSchema.IsObject() {
+			function, _ = sjson.SetRawBytes(function, "function.parameters", []byte(inputSchema.Raw))
+		}
+		out, _ = sjson.SetRawBytes(out, "tools.-1", function)
+	}
+
+	// Convert tool_choice.
+	toolChoice := gjson.GetBytes(request, "tool_choice")
+	switch toolChoice.Get("type").String() {
+	case "auto":
+		out, _ = sjson.SetBytes(out, "tool_choice", "auto")
+	case "any":
+		out, _ = sjson.SetBytes(out, "tool_choice", "required")
+	case "none":
+		out, _ = sjson.SetBytes(out, "tool_choice", "none")
+	case "tool":
+		out, _ = sjson.SetRawBytes(out, "tool_choice", []byte(`{"type":"function","function":{"name":""}}`))
+		out, _ = sjson.SetBytes(out, "tool_choice.function.name", toolChoice.Get("name").String())
+	}
+	if toolChoice.Get("disable_parallel_tool_use").Bool() && gjson.GetBytes(out, "tools").Exists() {
+		out, _ = sjson.SetBytes(out, "parallel_tool_calls", false)
+	}
+
+	// Map the thinking budget to reasoning_effort.
+	if thinking := gjson.GetBytes(request, "thinking"); thinking.Get("type").String() == "enabled" {
+		out, _ = sjson.SetBytes(out, "reasoning_effort", messagesReasoningEffort(int(thinking.Get("budget_tokens").Int())))
+	}
+
+	// Convert metadata.user_id to user.
+	if userID := gjson.GetBytes(request, "metadata.user_id"); userID.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "user", userID.String())
+	}
+
+	if gjson.GetBytes(request, "stream").Bool() {
+		out, _ = sjson.SetBytes(out, "stream", true)
+	}
+
+	return out
+}
+
+// convertMessagesAssistantMessage converts the content of an Anthropic assistant message into an OpenAI assistant
+// message. Thinking blocks are not sent, their signatures are only meaningful to Anthropic.
+func convertMessagesAssistantMessage(content gjson.Result) []byte {
+	message := []byte(`{"role":"assistant","content":""}`)
+	message, _ = sjson.SetBytes(message, "content", strings.Join(messagesTextParts(content), ""))
+	for _, block := range content.Array() {
+		if block.Get("type").String() != "tool_use" {
+			continue
+		}
+		toolCall := []byte(`{"id":"","type":"function","function":{"name":"","arguments":"{}"}}`)
+		toolCall, _ = sjson.SetBytes(toolCall, "id", block.Get("id").String())
+		toolCall, _ = sjson.SetBytes(toolCall, "function.name", block.Get("name").String())
+		if input := block.Get("input"); input.IsObject() {
+			toolCall, _ = sjson.SetBytes(toolCall, "function.arguments", input.Raw)
+		}
+		message, _ = sjson.SetRawBytes(message, "tool_calls.-1", toolCall)
+	}
+	return message
+}
+
+// convertMessagesImage converts an Anthropic image block into an OpenAI image_url part, nil if its source is not supported
+func convertMessagesImage(block gjson.Result) []byte {
+	url := ""
+	switch block.Get("source.type").String() {
+	case "base64":
+		url = fmt.Sprintf("data:%s;base64,%s", block.Get("source.media_type").String(), block.Get("source.data").String())
+	case "url":
+		url = block.Get("source.url").String()
+	default:
+		return nil
+	}
+	part := []byte(`{"type":"image_url","image_url":{"url":""}}`)
+	part, _ = sjson.SetBytes(part, "image_url.url", url)
+	return part
+}
+
+// messagesTextParts returns the text of an Anthropic content, which is either a string or an array of blocks
+func messagesTextParts(content gjson.Result) []string {
+	if content.Type == gjson.String {
+		return []string{content.String()}
+	}
+	texts := make([]string, 0)
+	for _, block := range content.Array() {
+		if block.Get("type").String() == "text" {
+			texts = append(texts, block.Get("text").String())
+		}
+	}
+	return texts
+}
+
+// newTextPart builds an OpenAI text content part
+func newTextPart(text string) []byte {
+	part, _ := sjson.SetBytes([]byte(`{"type":"text","text":""}`), "text", text)
+	return part
+}
+
+// messagesReasoningEffort maps a thinking budget to the reasoning_effort whose Anthropic budget is the closest
+func messagesReasoningEffort(budgetTokens int) string {
+	switch {
+	case budgetTokens < 4096:
+		return "low"
+	case budgetTokens < 16384:
+		return "medium"
+	default:
+		return "high"
+	}
+}
+
+// estimateChatRequestTokens estimates the prompt tokens of a chat completion request from the length of its messages
+// and tools, images count as messagesImageTokens
+func estimateChatRequestTokens(request []byte) int {
+	characters := 0
+	images := 0
+	for _, message := range gjson.GetBytes(request, "messages").Array() {
+		content := message.Get("content")
+		if content.Type == gjson.String {
+			characters += utf8.RuneCountInString(content.String())
+		}
+		for _, part := range content.Array() {
+			if part.Get("type").String() == "image_url" {
+				images++
+			}
+			characters += utf8.RuneCountInString(part.Get("text").String())
+		}
+		for _, toolCall := range message.Get("tool_calls").Array() {
+			characters += utf8.RuneCountInString(toolCall.Get("function.name").String())
+			characters += utf8.RuneCountInString(toolCall.Get("function.arguments").String())
+		}
+	}
+	characters += utf8.RuneCountInString(gjson.GetBytes(request, "tools").Raw)
+	return (characters+messagesCharsPerToken-1)/messagesCharsPerToken + images*messagesImageTokens
+}
+
+// messagesStopReason maps an OpenAI finish reason to an Anthropic stop reason
+func messagesStopReason(finishReason string) string {
+	if stopReason, ok := messagesStopReasons[finishReason]; ok {
+		return stopReason
+	}
+	return "end_turn"
+}
+
+// newMessagesError builds an Anthropic error body
+func newMessagesError(errorType, message string) []byte {
+	body := []byte(`{"type":"error","error":{"type":"","message":""}}`)
+	body, _ = sjson.SetBytes(body, "error.type", errorType)
+	body, _ = sjson.SetBytes(body, "error.message", message)
+	return body
+}
+
+// writeMessagesError writes an Anthropic error response
+func writeMessagesError(c *gin.Context, status int, errorType, message string) {
+	c.Data(status, "application/json; charset=utf-8", newMessagesError(errorType, message))
+}
+
+// writeMessagesBodyError writes the Anthropic error response for a request body that could not be read
+func writeMessagesBodyError(c *gin.Context, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		writeMessagesError(c, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesError.Limit))
+		return
+	}
+	writeMessagesError(c, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Invalid request: %v", err))
+}
+
+// writeMessagesRouteError writes the Anthropic error response for an error returned by routeRequest
+func writeMessagesRouteError(c *gin.Context, modelName string, err error) {
+	// The streaming handler has set the event stream content type
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	if errors.Is(err, errModelNotFound) {
+		writeMessagesError(c, http.StatusNotFound, "not_found_error", fmt.Sprintf("Model %s not found or not available.", modelName))
+		return
+	}
+	if errors.Is(err, errPromptFlagged) {
+		writeMessagesError(c, http.StatusBadRequest, "invalid_request_error", "Request blocked: "+err.Error())
+		return
+	}
+	var quotaErr *core.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(quotaErr.RetryAfter.Seconds()))))
+		writeMessagesError(c, http.StatusTooManyRequests, "rate_limit_error", "Rate limit exceeded: "+quotaErr.Error())
+		return
+	}
+	status := upstreamStatus(err)
+	errorType := "api_error"
+	if status == http.StatusTooManyRequests {
+		errorType = "rate_limit_error"
+	} else if status < 500 {
+		errorType = "invalid_request_error"
+	}
+	writeMessagesError(c, status, errorType, "All providers failed: "+err.Error())
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -8,13 +9,36 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/luispater/mini-router/config"
 	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
 )
 
-// AuthMiddleware authenticates requests using API keys
+// AuthMiddleware authenticates requests using API keys, sent in the Authorization header,
+// in the x-api-key header as Anthropic clients do, or in the x-goog-api-key header as Google GenAI clients do
 func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
+	return authMiddleware(cfg, false)
+}
+
+// OptionalAuthMiddleware authenticates requests that send an API key like AuthMiddleware, requests without
+// a key pass unauthenticated
+func OptionalAuthMiddleware(cfg *config.Config) gin.HandlerFunc {
+	return authMiddleware(cfg, true)
+}
+
+// authMiddleware authenticates requests using API keys, optional lets requests without a key pass
+func authMiddleware(cfg *config.Config, optional bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get the Authorization header
 		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			authHeader = c.GetHeader("x-api-key")
+		}
+		if authHeader == "" {
+			authHeader = c.GetHeader("x-goog-api-key")
+		}
+		if authHeader == "" && optional {
+			c.Next()
+			return
+		}
 		if authHeader == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "Missing API key",
@@ -91,7 +115,7 @@ func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, x-api-key, anthropic-version, anthropic-beta, x-goog-api-key, x-goog-api-client")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
@@ -127,3 +151,31 @@ func LoggingMiddleware() gin.HandlerFunc {
 		}
 	}
 }
+
+// BodyLimitMiddleware limits the size of request bodies
+func BodyLimitMiddleware(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Reject requests that announce a body larger than the limit
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Request body exceeds the limit of %d bytes", limit),
+				"code":  http.StatusRequestEntityTooLarge,
+			})
+			return
+		}
+
+		// Stop reading chunked bodies once the limit is reached
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+
+		c.Next()
+	}
+}
+
+// ClientHeadersMiddleware makes the client request headers available to the providers,
+// which forward the headers allowed by each model's forward_headers
+func ClientHeadersMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(provider.WithClientHeaders(c.Request.Context(), c.Request.Header))
+		c.Next()
+	}
+}
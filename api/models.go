@@ -0,0 +1,249 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	"github.com/luispater/mini-router/core"
+	"github.com/luispater/mini-router/models"
+)
+
+// modelCapabilities are the capabilities of the model catalog with the flag of the entries that have them
+var modelCapabilities = []struct {
+	name    string
+	capable func(model models.Model) bool
+}{
+	{"chat", func(model models.Model) bool { return model.SupportsChat }},
+	{"completions", func(model models.Model) bool { return model.SupportsChat || model.SupportsCompletion }},
+	{"image_input", func(model models.Model) bool { return model.SupportsInputImage }},
+	{"embeddings", func(model models.Model) bool { return model.SupportsEmbedding }},
+	{"image_generation", func(model models.Model) bool { return model.SupportsImageGen }},
+	{"image_edit", func(model models.Model) bool { return model.SupportsImageEdit }},
+	{"image_variation", func(model models.Model) bool { return model.SupportsImageVar }},
+	{"transcription", func(model models.Model) bool { return model.SupportsAudioTrans }},
+	{"translation", func(model models.Model) bool { return model.SupportsAudioTrans2 }},
+	{"speech", func(model models.Model) bool { return model.SupportsSpeech }},
+	{"moderation", func(model models.Model) bool { return model.SupportsModeration }},
+}
+
+// ModelsHandler lists the visible models. A model is listed once, with the display fields of its first visible
+// entry and the capabilities, modalities and health of all its enabled entries. A request with an API key only
+// lists the models the key may use.
+// The list can be filtered with the query parameters supports (capabilities or supported parameters, such as
+// tools), input_modality and output_modality. They take comma separated values, all of which must match.
+func ModelsHandler(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		supports := queryValues(c, "supports")
+		inputModalities := queryValues(c, "input_modality")
+		outputModalities := queryValues(c, "output_modality")
+
+		data := make([]models.DisplayModel, 0)
+		for _, modelName := range visibleModelNames(c, cfg) {
+			model := catalogModel(cfg, modelName)
+			features := append(append([]string{}, model.Capabilities...), model.SupportedParameters...)
+			if !containsAll(features, supports) ||
+				!containsAll(model.Architecture.InputModalities, inputModalities) ||
+				!containsAll(model.Architecture.OutputModalities, outputModalities) {
+				continue
+			}
+			data = append(data, model)
+		}
+
+		// Return a JSON response with the model list.
+		c.JSON(http.StatusOK, gin.H{
+			// The object type is "list".
+			"object": "list",
+			// Model data.
+			"data": data,
+		})
+	}
+}
+
+// ModelHandler returns a visible model by its name, which may contain slashes
+func ModelHandler(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		modelName := strings.TrimPrefix(c.Param("id"), "/")
+		for _, name := range visibleModelNames(c, cfg) {
+			if name == modelName {
+				c.JSON(http.StatusOK, catalogModel(cfg, modelName))
+				return
+			}
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": fmt.Sprintf("Model %s not found.", modelName), "code": 404}})
+	}
+}
+
+// visibleModelNames returns the names of the models with a visible enabled entry in configuration order,
+// without the models the API key of the request may not use
+func visibleModelNames(c *gin.Context, cfg *config.Config) []string {
+	apiKey, _ := requestAPIKey(c)
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, model := range cfg.Models {
+		if seen[model.Name] || !model.Visible || !model.Enabled || !apiKey.AllowsModel(model.Name) {
+			continue
+		}
+		seen[model.Name] = true
+		names = append(names, model.Name)
+	}
+	return names
+}
+
+// catalogModel returns the catalog entry of a model that has a visible enabled entry
+func catalogModel(cfg *config.Config, modelName string) models.DisplayModel {
+	// Collect the enabled entries, the first visible one describes the model.
+	var first models.Model
+	entries := make([]models.Model, 0)
+	for _, model := range cfg.Models {
+		if model.Name != modelName || !model.Enabled {
+			continue
+		}
+		if model.Visible && !first.Visible {
+			first = model
+		}
+		entries = append(entries, model)
+	}
+
+	// The model has the capabilities and supported parameters of any of its entries.
+	capabilities := make([]string, 0)
+	for _, capability := range modelCapabilities {
+		for _, model := range entries {
+			if capability.capable(model) {
+				capabilities = append(capabilities, capability.name)
+				break
+			}
+		}
+	}
+	supportedParameters := make([]string, 0)
+	for _, model := range entries {
+		for _, parameter := range model.SupportedParameters {
+			if !containsAll(supportedParameters, []string{parameter}) {
+				supportedParameters = append(supportedParameters, parameter)
+			}
+		}
+	}
+	inputModalities, outputModalities := modelModalities(capabilities)
+
+	displayModel := models.DisplayModel{
+		ID:                  first.Name,
+		Object:              "model",
+		Name:                first.DisplayName,
+		Description:         first.Description,
+		SupportedParameters: supportedParameters,
+		ContextLength:       first.ContextLength,
+		MaxCompletionTokens: first.MaxTokens,
+		Capabilities:        capabilities,
+		Entries:             len(entries),
+		Health:              modelHealth(entries),
+	}
+	displayModel.Architecture.Modality = fmt.Sprintf("%s->%s", strings.Join(inputModalities, "+"), strings.Join(outputModalities, "+"))
+	displayModel.Architecture.InputModalities = inputModalities
+	displayModel.Architecture.OutputModalities = outputModalities
+	displayModel.Pricing.Prompt = formatPrice(first.InputPricePerToken)
+	displayModel.Pricing.Completion = formatPrice(first.OutputPricePerToken)
+	return displayModel
+}
+
+// modelModalities returns the input and output modalities of the capabilities, in the order text, image, audio,
+// embeddings and moderation
+func modelModalities(capabilities []string) ([]string, []string) {
+	has := func(names ...string) bool {
+		for _, name := range names {
+			if containsAll(capabilities, []string{name}) {
+				return true
+			}
+		}
+		return false
+	}
+
+	inputModalities := make([]string, 0)
+	if has("chat", "completions", "embeddings", "image_generation", "image_edit", "speech", "moderation") {
+		inputModalities = append(inputModalities, "text")
+	}
+	if has("image_input", "image_edit", "image_variation") {
+		inputModalities = append(inputModalities, "image")
+	}
+	if has("transcription", "translation") {
+		inputModalities = append(inputModalities, "audio")
+	}
+
+	outputModalities := make([]string, 0)
+	if has("chat", "completions", "transcription", "translation") {
+		outputModalities = append(outputModalities, "text")
+	}
+	if has("image_generation", "image_edit", "image_variation") {
+		outputModalities = append(outputModalities, "image")
+	}
+	if has("speech") {
+		outputModalities = append(outputModalities, "audio")
+	}
+	if has("embeddings") {
+		outputModalities = append(outputModalities, "embeddings")
+	}
+	if has("moderation") {
+		outputModalities = append(outputModalities, "moderation")
+	}
+	return inputModalities, outputModalities
+}
+
+// modelHealth aggregates the health of the entries of a model
+func modelHealth(entries []models.Model) models.ModelHealth {
+	health := models.ModelHealth{}
+	for _, model := range entries {
+		switch healthTracker.Health(modelEntryScope(model)).Status {
+		case core.HealthHealthy:
+			health.HealthyEntries++
+		case core.HealthFailing:
+			health.FailingEntries++
+		}
+	}
+	switch {
+	case len(entries) > 0 && health.FailingEntries == len(entries):
+		health.Status = "down"
+	case health.FailingEntries > 0:
+		health.Status = "degraded"
+	case health.HealthyEntries > 0:
+		health.Status = core.HealthHealthy
+	default:
+		health.Status = core.HealthUnknown
+	}
+	return health
+}
+
+// formatPrice formats a price without trailing zeros
+func formatPrice(price float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.10f", price), "0"), ".")
+}
+
+// queryValues returns the comma separated values of a query parameter, which may be repeated
+func queryValues(c *gin.Context, name string) []string {
+	values := make([]string, 0)
+	for _, value := range c.QueryArray(name) {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+// containsAll reports whether values contains every wanted value
+func containsAll(values []string, wanted []string) bool {
+	for _, item := range wanted {
+		found := false
+		for _, value := range values {
+			if value == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// moderationsSchemaLoader is used to load the JSON schema of moderation requests
+var moderationsSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.ModerationsSchema)
+
+// errPromptFlagged is returned by moderatePrompt when a blocking moderation policy flags the prompt
+var errPromptFlagged = errors.New("the prompt was flagged by moderation")
+
+// moderationTimeout is the timeout of the moderation of a prompt before its request is served
+const moderationTimeout = 2 * time.Minute
+
+// ModerationHandler handles moderation requests, only entries with supports_moderation are tried
+func ModerationHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Set the response header, specifying the content type and character set
+		c.Header("Content-Type", "application/json; charset=utf-8")
+
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			writeBodyError(c, err)
+			return
+		}
+
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
+
+		// Validate the request
+		if !validateJSONBody(c, moderationsSchemaLoader, rawJson) {
+			return
+		}
+		modelName := gjson.GetBytes(rawJson, "model").String()
+
+		// Try the entries of the model that moderate content in round-robin order until one succeeds
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, isModerationModel, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			moderationProvider, ok := providerInstance.(provider.ModerationProvider)
+			if !ok {
+				return fmt.Errorf("provider type %s does not moderate content", model.ProviderType)
+			}
+
+			return handleNonStreamingResponse(c, model, usage, func(ctx context.Context, cancel context.CancelFunc, usage *provider.Usage) ([]byte, error, []byte) {
+				return createModeration(ctx, cancel, cfg, moderationProvider, rawJson, model, usage)
+			})
+		})
+		if finalErr != nil {
+			writeRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// isModerationModel reports whether the entry moderates content
+func isModerationModel(model models.Model) bool {
+	return model.SupportsModeration
+}
+
+// createModeration rewrites the moderation request for the entry and sends it
+func createModeration(ctx context.Context, cancel context.CancelFunc, cfg *config.Config, p provider.ModerationProvider, request []byte, model models.Model, usage *provider.Usage) ([]byte, error, []byte) {
+	// Rewrite the request body for this entry
+	requestBody, errBody := provider.ApplyModelBody(request, model)
+	if errBody != nil {
+		return nil, fmt.Errorf("request body error: %w", errBody), nil
+	}
+	requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+
+	if cfg.Server.Debug {
+		log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
+	}
+
+	return p.CreateModeration(ctx, cancel, requestBody, model, usage)
+}
+
+// moderationPolicy returns the moderation policy of a request for the model, the API key's policy if it has one,
+// otherwise the policy of the first enabled entry of the model that has one
+func moderationPolicy(c *gin.Context, cfg *config.Config, modelName string) (models.ModerationPolicy, bool) {
+	if apiKey, ok := requestAPIKey(c); ok && apiKey.Moderation.Enabled() {
+		return apiKey.Moderation, true
+	}
+	for _, model := range cfg.Models {
+		if model.Name == modelName && model.Enabled && model.Moderation.Enabled() {
+			return model.Moderation, true
+		}
+	}
+	return models.ModerationPolicy{}, false
+}
+
+// moderatePrompt runs the texts of a prompt through the moderation model of the request's policy before the request
+// is served. The moderation is routed, metered and logged like a moderation request of the API key, but the key's
+// allowed_models do not apply to it.
+// It returns nil if no policy applies, nothing was flagged or the policy only logs, an error wrapping
+// errPromptFlagged if a blocking policy flagged the prompt, and the error of the moderation if it failed and the
+// policy blocks, so that an unmoderated prompt is not served.
+func moderatePrompt(c *gin.Context, cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory, modelName string, inputs []string) error {
+	// A model the API key may not use is rejected by the routing without spending a moderation
+	apiKey, hasAPIKey := requestAPIKey(c)
+	if hasAPIKey && !apiKey.AllowsModel(modelName) {
+		return nil
+	}
+	policy, ok := moderationPolicy(c, cfg, modelName)
+	if !ok || len(inputs) == 0 {
+		return nil
+	}
+
+	request, _ := sjson.SetBytes([]byte(`{"model":""}`), "model", policy.Model)
+	request, _ = sjson.SetBytes(request, "input", inputs)
+
+	// The usage log records the moderation under its own endpoint
+	endpoint := c.GetString(usageEndpointKey)
+	c.Set(usageEndpointKey, "/v1/moderations")
+	var response []byte
+	err := routeEntries(c, cfg, providerRegistry, policy.Model, nil, isModerationModel, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+		moderationProvider, isModerationProvider := providerInstance.(provider.ModerationProvider)
+		if !isModerationProvider {
+			return fmt.Errorf("provider type %s does not moderate content", model.ProviderType)
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), moderationTimeout)
+		defer cancel()
+		var errModeration error
+		var errResponse []byte
+		response, errModeration, errResponse = createModeration(ctx, cancel, cfg, moderationProvider, request, model, usage)
+		if errModeration != nil && errResponse != nil {
+			errModeration = fmt.Errorf("%w: %s", errModeration, errResponse)
+		}
+		return errModeration
+	})
+	c.Set(usageEndpointKey, endpoint)
+
+	if err != nil {
+		if !policy.Blocks() {
+			log.Printf("Moderation of a request for model %s by API key %d (%s) failed, the request is served: %v\n", modelName, apiKey.ID, apiKey.Name, err)
+			return nil
+		}
+		// The moderation model missing is not the requested model missing
+		if errors.Is(err, errModelNotFound) {
+			return fmt.Errorf("moderation model %s is not available", policy.Model)
+		}
+		return fmt.Errorf("moderation failed: %w", err)
+	}
+
+	flagged, categories := moderationResult(response)
+	if !flagged {
+		return nil
+	}
+	if !policy.Blocks() {
+		log.Printf("Moderation flagged a request for model %s by API key %d (%s) for %s, the request is served\n", modelName, apiKey.ID, apiKey.Name, strings.Join(categories, ", "))
+		return nil
+	}
+	log.Printf("Moderation flagged a request for model %s by API key %d (%s) for %s, the request is blocked\n", modelName, apiKey.ID, apiKey.Name, strings.Join(categories, ", "))
+	if len(categories) == 0 {
+		return errPromptFlagged
+	}
+	return fmt.Errorf("%w for %s", errPromptFlagged, strings.Join(categories, ", "))
+}
+
+// moderationResult reports whether any result of a moderation response is flagged, with the flagged categories
+func moderationResult(response []byte) (bool, []string) {
+	flagged := false
+	categories := make([]string, 0)
+	for _, result := range gjson.GetBytes(response, "results").Array() {
+		if !result.Get("flagged").Bool() {
+			continue
+		}
+		flagged = true
+		result.Get("categories").ForEach(func(category, value gjson.Result) bool {
+			if value.Bool() && !containsAll(categories, []string{category.String()}) {
+				categories = append(categories, category.String())
+			}
+			return true
+		})
+	}
+	return flagged, categories
+}
+
+// chatPromptInputs returns the texts of the user messages of a chat completion request, which are moderated
+func chatPromptInputs(request []byte) []string {
+	inputs := make([]string, 0)
+	for _, message := range gjson.GetBytes(request, "messages").Array() {
+		if message.Get("role").String() != "user" {
+			continue
+		}
+		content := message.Get("content")
+		texts := []string{content.String()}
+		if content.IsArray() {
+			texts = texts[:0]
+			for _, part := range content.Array() {
+				if part.Get("type").String() == "text" {
+					texts = append(texts, part.Get("text").String())
+				}
+			}
+		}
+		if text := strings.Join(texts, "\n"); strings.TrimSpace(text) != "" {
+			inputs = append(inputs, text)
+		}
+	}
+	return inputs
+}
+
+// completionPromptInputs returns the text prompts of a completion request, which are moderated. Token prompts
+// are not moderated.
+func completionPromptInputs(prompt gjson.Result) []string {
+	items := []gjson.Result{prompt}
+	if prompt.IsArray() {
+		items = prompt.Array()
+	}
+	inputs := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Type == gjson.String && strings.TrimSpace(item.String()) != "" {
+			inputs = append(inputs, item.String())
+		}
+	}
+	return inputs
+}
@@ -0,0 +1,475 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_const "github.com/luispater/mini-router/const"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// responsesItem is an output item of a response
+type responsesItem struct {
+	// itemType is the item type: reasoning, message or function_call
+	itemType string
+	// id is the item id
+	id string
+	// text is the reasoning summary, the message text or the function call arguments
+	text string
+	// callID is the call id of a function call
+	callID string
+	// name is the function name of a function call
+	name string
+	// done indicates whether the output_item.done event was written
+	done bool
+}
+
+// responsesWriter converts the chat completion written by the chat handlers into a response of the Responses API.
+// A non-streaming completion is converted by finish, the chunks of a stream are converted into response events
+// as their lines are complete. Other output, such as the error body of a failed entry, is dropped.
+type responsesWriter struct {
+	convertingWriter
+	// request is the Responses request, whose parameters the response echoes
+	request []byte
+	// store stores the completed response before it is written
+	store func(response []byte)
+
+	// id is the response id
+	id string
+	// createdAt is the creation time of the response
+	createdAt int64
+	// sequence is the sequence number of the next event
+	sequence int
+	// started indicates whether the response.created event was written
+	started bool
+	// stopped indicates whether the final event was written
+	stopped bool
+	// items are the output items
+	items []*responsesItem
+	// toolItems maps the tool call indexes of the chunks to output indexes
+	toolItems map[int64]int
+	// finishReason is the finish reason of the completion
+	finishReason string
+	// usage is the usage of the completion
+	usage gjson.Result
+	// err is the error event of the stream
+	err error
+}
+
+// newResponsesWriter returns a responsesWriter that writes the converted response to w
+func newResponsesWriter(w gin.ResponseWriter, request []byte, stream bool, store func(response []byte)) *responsesWriter {
+	writer := &responsesWriter{
+		convertingWriter: convertingWriter{ResponseWriter: w, stream: stream},
+		request:          request,
+		store:            store,
+		id:               newResponsesID("resp"),
+		createdAt:        time.Now().Unix(),
+		toolItems:        make(map[int64]int),
+	}
+	writer.convertingWriter.writeLine = writer.writeLine
+	return writer
+}
+
+// finish writes the converted non-streaming response, or the end of a stream that ended without [DONE].
+// It returns the error event of a stream.
+func (w *responsesWriter) finish() error {
+	if w.stream {
+		if err := w.flushLine(); err != nil {
+			return err
+		}
+		if w.err != nil {
+			return w.err
+		}
+		return w.stop()
+	}
+
+	response := bytes.TrimSpace(w.buffer)
+	if !gjson.GetBytes(response, "choices").IsArray() {
+		return fmt.Errorf("unexpected response: %s", string(response))
+	}
+	w.finishReason = gjson.GetBytes(response, "choices.0.finish_reason").String()
+	w.usage = gjson.GetBytes(response, "usage")
+
+	message := gjson.GetBytes(response, "choices.0.message")
+	reasoning := message.Get("reasoning_content").String()
+	if reasoning == "" {
+		reasoning = message.Get("reasoning").String()
+	}
+	if reasoning != "" {
+		w.items = append(w.items, &responsesItem{itemType: "reasoning", id: newResponsesID("rs"), text: reasoning})
+	}
+	if content := message.Get("content").String(); content != "" {
+		w.items = append(w.items, &responsesItem{itemType: "message", id: newResponsesID("msg"), text: content})
+	}
+	for _, toolCall := range message.Get("tool_calls").Array() {
+		w.items = append(w.items, &responsesItem{
+			itemType: "function_call",
+			id:       newResponsesID("fc"),
+			text:     toolCall.Get("function.arguments").String(),
+			callID:   toolCall.Get("id").String(),
+			name:     toolCall.Get("function.name").String(),
+		})
+	}
+
+	out := w.response(w.status())
+	w.store(out)
+	return w.writeClient(out)
+}
+
+// writeError ends a started stream with a response.failed event
+func (w *responsesWriter) writeError(err error) {
+	if !w.stream || w.stopped {
+		return
+	}
+	w.stopped = true
+	_ = w.writeFailed(err.Error())
+	w.Flush()
+}
+
+// writeFailed writes the response.failed event
+func (w *responsesWriter) writeFailed(message string) error {
+	response := w.response("failed")
+	response, _ = sjson.SetRawBytes(response, "error", []byte(`{"code":"server_error","message":""}`))
+	response, _ = sjson.SetBytes(response, "error.message", message)
+	event, _ := sjson.SetRawBytes([]byte(`{"type":"response.failed","response":{}}`), "response", response)
+	return w.writeResponseEvent(event)
+}
+
+// writeLine converts a line of the chat completion stream
+func (w *responsesWriter) writeLine(line []byte) error {
+	// Comments keep the connection alive and are passed through.
+	if bytes.HasPrefix(line, _const.TagNoData) {
+		return w.writeClient(append(line, "\n\n"...))
+	}
+	if w.stopped || !bytes.HasPrefix(line, _const.TagData) {
+		return nil
+	}
+	data := bytes.TrimSpace(bytes.TrimPrefix(line, _const.TagData))
+	if string(data) == "[DONE]" {
+		return w.stop()
+	}
+	return w.writeChunk(data)
+}
+
+// writeChunk converts a chat.completion.chunk into response events
+func (w *responsesWriter) writeChunk(chunk []byte) error {
+	// An error before the response starts is left to the failover, an error after it fails the response.
+	if errorMessage := gjson.GetBytes(chunk, "error.message"); errorMessage.Exists() {
+		w.err = fmt.Errorf("stream error: %s", errorMessage.String())
+		w.stopped = true
+		if !w.started {
+			return nil
+		}
+		return w.writeFailed(errorMessage.String())
+	}
+	if err := w.start(); err != nil {
+		return err
+	}
+	if usage := gjson.GetBytes(chunk, "usage"); usage.IsObject() {
+		w.usage = usage
+	}
+
+	delta := gjson.GetBytes(chunk, "choices.0.delta")
+	reasoning := delta.Get("reasoning_content").String()
+	if reasoning == "" {
+		reasoning = delta.Get("reasoning").String()
+	}
+	if reasoning != "" {
+		if err := w.writeDelta("reasoning", reasoning); err != nil {
+			return err
+		}
+	}
+	if content := delta.Get("content").String(); content != "" {
+		if err := w.writeDelta("message", content); err != nil {
+			return err
+		}
+	}
+	for _, toolCall := range delta.Get("tool_calls").Array() {
+		toolCallIndex := toolCall.Get("index").Int()
+		outputIndex, ok := w.toolItems[toolCallIndex]
+		if !ok {
+			// A tool call starts with its id and name, the function calls of a turn stay open together.
+			item := &responsesItem{
+				itemType: "function_call",
+				id:       newResponsesID("fc"),
+				callID:   toolCall.Get("id").String(),
+				name:     toolCall.Get("function.name").String(),
+			}
+			if err := w.startItem(item); err != nil {
+				return err
+			}
+			outputIndex = len(w.items) - 1
+			w.toolItems[toolCallIndex] = outputIndex
+		}
+		if arguments := toolCall.Get("function.arguments").String(); arguments != "" {
+			item := w.items[outputIndex]
+			item.text += arguments
+			event := []byte(`{"type":"response.function_call_arguments.delta","item_id":"","output_index":0,"delta":""}`)
+			event, _ = sjson.SetBytes(event, "item_id", item.id)
+			event, _ = sjson.SetBytes(event, "output_index", outputIndex)
+			event, _ = sjson.SetBytes(event, "delta", arguments)
+			if err := w.writeResponseEvent(event); err != nil {
+				return err
+			}
+		}
+	}
+
+	if finishReason := gjson.GetBytes(chunk, "choices.0.finish_reason"); finishReason.Type == gjson.String {
+		w.finishReason = finishReason.String()
+	}
+	return nil
+}
+
+// writeDelta writes a reasoning summary or output text delta, starting an item of its type if the last item
+// has another type or is done
+func (w *responsesWriter) writeDelta(itemType, text string) error {
+	outputIndex := len(w.items) - 1
+	if outputIndex < 0 || w.items[outputIndex].itemType != itemType || w.items[outputIndex].done {
+		if err := w.startItem(&responsesItem{itemType: itemType, id: newResponsesID(itemIDPrefix(itemType))}); err != nil {
+			return err
+		}
+		outputIndex = len(w.items) - 1
+	}
+	item := w.items[outputIndex]
+	item.text += text
+
+	event := []byte(`{"type":"response.output_text.delta","item_id":"","output_index":0,"content_index":0,"delta":""}`)
+	if itemType == "reasoning" {
+		event = []byte(`{"type":"response.reasoning_summary_text.delta","item_id":"","output_index":0,"summary_index":0,"delta":""}`)
+	}
+	event, _ = sjson.SetBytes(event, "item_id", item.id)
+	event, _ = sjson.SetBytes(event, "output_index", outputIndex)
+	event, _ = sjson.SetBytes(event, "delta", text)
+	return w.writeResponseEvent(event)
+}
+
+// itemIDPrefix returns the id prefix of an item type
+func itemIDPrefix(itemType string) string {
+	switch itemType {
+	case "reasoning":
+		return "rs"
+	case "function_call":
+		return "fc"
+	default:
+		return "msg"
+	}
+}
+
+// start writes the response.created and response.in_progress events once
+func (w *responsesWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	response := w.response("in_progress")
+	event, _ := sjson.SetRawBytes([]byte(`{"type":"response.created","response":{}}`), "response", response)
+	if err := w.writeResponseEvent(event); err != nil {
+		return err
+	}
+	event, _ = sjson.SetRawBytes([]byte(`{"type":"response.in_progress","response":{}}`), "response", response)
+	return w.writeResponseEvent(event)
+}
+
+// startItem finishes the open items, except the function calls when a function call starts, and adds an item
+func (w *responsesWriter) startItem(item *responsesItem) error {
+	for outputIndex, openItem := range w.items {
+		if item.itemType == "function_call" && openItem.itemType == "function_call" {
+			continue
+		}
+		if err := w.stopItem(outputIndex); err != nil {
+			return err
+		}
+	}
+	w.items = append(w.items, item)
+	outputIndex := len(w.items) - 1
+
+	added := []byte(`{"type":"response.output_item.added","output_index":0,"item":{}}`)
+	added, _ = sjson.SetBytes(added, "output_index", outputIndex)
+	added, _ = sjson.SetRawBytes(added, "item", w.itemJSON(item, false))
+	if err := w.writeResponseEvent(added); err != nil {
+		return err
+	}
+
+	switch item.itemType {
+	case "reasoning":
+		event := []byte(`{"type":"response.reasoning_summary_part.added","item_id":"","output_index":0,"summary_index":0,"part":{"type":"summary_text","text":""}}`)
+		event, _ = sjson.SetBytes(event, "item_id", item.id)
+		event, _ = sjson.SetBytes(event, "output_index", outputIndex)
+		return w.writeResponseEvent(event)
+	case "message":
+		event := []byte(`{"type":"response.content_part.added","item_id":"","output_index":0,"content_index":0,"part":{"type":"output_text","text":"","annotations":[]}}`)
+		event, _ = sjson.SetBytes(event, "item_id", item.id)
+		event, _ = sjson.SetBytes(event, "output_index", outputIndex)
+		return w.writeResponseEvent(event)
+	}
+	return nil
+}
+
+// stopItem writes the done events of an item once
+func (w *responsesWriter) stopItem(outputIndex int) error {
+	item := w.items[outputIndex]
+	if item.done {
+		return nil
+	}
+	item.done = true
+
+	events := make([][]byte, 0, 3)
+	switch item.itemType {
+	case "reasoning":
+		event := []byte(`{"type":"response.reasoning_summary_text.done","item_id":"","output_index":0,"summary_index":0,"text":""}`)
+		event, _ = sjson.SetBytes(event, "text", item.text)
+		events = append(events, event)
+		event = []byte(`{"type":"response.reasoning_summary_part.done","item_id":"","output_index":0,"summary_index":0,"part":{"type":"summary_text","text":""}}`)
+		event, _ = sjson.SetBytes(event, "part.text", item.text)
+		events = append(events, event)
+	case "message":
+		event := []byte(`{"type":"response.output_text.done","item_id":"","output_index":0,"content_index":0,"text":""}`)
+		event, _ = sjson.SetBytes(event, "text", item.text)
+		events = append(events, event)
+		event = []byte(`{"type":"response.content_part.done","item_id":"","output_index":0,"content_index":0,"part":{"type":"output_text","text":"","annotations":[]}}`)
+		event, _ = sjson.SetBytes(event, "part.text", item.text)
+		events = append(events, event)
+	case "function_call":
+		event := []byte(`{"type":"response.function_call_arguments.done","item_id":"","output_index":0,"arguments":""}`)
+		event, _ = sjson.SetBytes(event, "arguments", item.text)
+		events = append(events, event)
+	}
+	for i := range events {
+		events[i], _ = sjson.SetBytes(events[i], "item_id", item.id)
+		events[i], _ = sjson.SetBytes(events[i], "output_index", outputIndex)
+	}
+	done := []byte(`{"type":"response.output_item.done","output_index":0,"item":{}}`)
+	done, _ = sjson.SetBytes(done, "output_index", outputIndex)
+	done, _ = sjson.SetRawBytes(done, "item", w.itemJSON(item, true))
+	events = append(events, done)
+
+	for _, event := range events {
+		if err := w.writeResponseEvent(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop finishes the open items, stores the response and writes the response.completed or response.incomplete event
+func (w *responsesWriter) stop() error {
+	if w.stopped {
+		return nil
+	}
+	if err := w.start(); err != nil {
+		return err
+	}
+	for outputIndex := range w.items {
+		if err := w.stopItem(outputIndex); err != nil {
+			return err
+		}
+	}
+	w.stopped = true
+
+	status := w.status()
+	response := w.response(status)
+	w.store(response)
+	event, _ := sjson.SetRawBytes([]byte(`{"type":"","response":{}}`), "response", response)
+	event, _ = sjson.SetBytes(event, "type", "response."+status)
+	return w.writeResponseEvent(event)
+}
+
+// writeResponseEvent sets the sequence number of an event and writes it with its type as the event type
+func (w *responsesWriter) writeResponseEvent(event []byte) error {
+	event, _ = sjson.SetBytes(event, "sequence_number", w.sequence)
+	w.sequence++
+	return w.writeEvent(gjson.GetBytes(event, "type").String(), event)
+}
+
+// status returns the status of the finished response, incomplete if the completion was cut off
+func (w *responsesWriter) status() string {
+	switch w.finishReason {
+	case "length", "content_filter":
+		return "incomplete"
+	default:
+		return "completed"
+	}
+}
+
+// itemJSON returns the output item, completed or in progress
+func (w *responsesWriter) itemJSON(item *responsesItem, done bool) []byte {
+	status := "in_progress"
+	if done {
+		status = "completed"
+	}
+	var out []byte
+	switch item.itemType {
+	case "reasoning":
+		out = []byte(`{"id":"","type":"reasoning","summary":[]}`)
+		if done {
+			out, _ = sjson.SetRawBytes(out, "summary.-1", []byte(`{"type":"summary_text","text":""}`))
+			out, _ = sjson.SetBytes(out, "summary.0.text", item.text)
+		}
+	case "message":
+		out = []byte(`{"id":"","type":"message","status":"","role":"assistant","content":[]}`)
+		out, _ = sjson.SetBytes(out, "status", status)
+		if done {
+			out, _ = sjson.SetRawBytes(out, "content.-1", []byte(`{"type":"output_text","text":"","annotations":[]}`))
+			out, _ = sjson.SetBytes(out, "content.0.text", item.text)
+		}
+	case "function_call":
+		out = []byte(`{"id":"","type":"function_call","status":"","arguments":"","call_id":"","name":""}`)
+		out, _ = sjson.SetBytes(out, "status", status)
+		out, _ = sjson.SetBytes(out, "arguments", item.text)
+		out, _ = sjson.SetBytes(out, "call_id", item.callID)
+		out, _ = sjson.SetBytes(out, "name", item.name)
+	}
+	out, _ = sjson.SetBytes(out, "id", item.id)
+	return out
+}
+
+// response returns the response object with the status, echoing the parameters of the request
+func (w *responsesWriter) response(status string) []byte {
+	out := []byte(`{"id":"","object":"response","created_at":0,"status":"","error":null,"incomplete_details":null,"instructions":null,"max_output_tokens":null,"model":"","output":[],"parallel_tool_calls":true,"previous_response_id":null,"reasoning":{"effort":null,"summary":null},"store":true,"temperature":1,"text":{"format":{"type":"text"}},"tool_choice":"auto","tools":[],"top_p":1,"truncation":"disabled","usage":null,"user":null,"metadata":{}}`)
+	out, _ = sjson.SetBytes(out, "id", w.id)
+	out, _ = sjson.SetBytes(out, "created_at", w.createdAt)
+	out, _ = sjson.SetBytes(out, "status", status)
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(w.request, "model").String())
+	for _, name := range []string{"instructions", "max_output_tokens", "parallel_tool_calls", "previous_response_id", "reasoning", "store", "temperature", "text", "tool_choice", "tools", "top_p", "user", "metadata"} {
+		if value := gjson.GetBytes(w.request, name); value.Exists() && value.Type != gjson.Null {
+			out, _ = sjson.SetRawBytes(out, name, []byte(value.Raw))
+		}
+	}
+
+	if status == "in_progress" {
+		return out
+	}
+	if status == "incomplete" {
+		reason := "max_output_tokens"
+		if w.finishReason == "content_filter" {
+			reason = "content_filter"
+		}
+		out, _ = sjson.SetRawBytes(out, "incomplete_details", []byte(`{"reason":""}`))
+		out, _ = sjson.SetBytes(out, "incomplete_details.reason", reason)
+	}
+	for _, item := range w.items {
+		out, _ = sjson.SetRawBytes(out, "output.-1", w.itemJSON(item, item.done || !w.stream))
+	}
+	if w.usage.IsObject() {
+		out, _ = sjson.SetRawBytes(out, "usage", w.responseUsage())
+	}
+	return out
+}
+
+// responseUsage converts the chat completion usage into a Responses usage
+func (w *responsesWriter) responseUsage() []byte {
+	usage := []byte(`{"input_tokens":0,"input_tokens_details":{"cached_tokens":0},"output_tokens":0,"output_tokens_details":{"reasoning_tokens":0},"total_tokens":0}`)
+	usage, _ = sjson.SetBytes(usage, "input_tokens", w.usage.Get("prompt_tokens").Int())
+	usage, _ = sjson.SetBytes(usage, "input_tokens_details.cached_tokens", w.usage.Get("prompt_tokens_details.cached_tokens").Int())
+	usage, _ = sjson.SetBytes(usage, "output_tokens", w.usage.Get("completion_tokens").Int())
+	usage, _ = sjson.SetBytes(usage, "output_tokens_details.reasoning_tokens", w.usage.Get("completion_tokens_details.reasoning_tokens").Int())
+	totalTokens := w.usage.Get("total_tokens").Int()
+	if totalTokens == 0 {
+		totalTokens = w.usage.Get("prompt_tokens").Int() + w.usage.Get("completion_tokens").Int()
+	}
+	usage, _ = sjson.SetBytes(usage, "total_tokens", totalTokens)
+	return usage
+}
@@ -0,0 +1,405 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/core"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// responsesSchemaLoader is used to load the JSON schema of Responses API requests
+var responsesSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.ResponsesSchema)
+
+// responseStore stores the responses of the Responses API, in memory unless SetResponseStore sets another store
+var responseStore core.ResponseStore = core.NewMemoryResponseStore(0, 0)
+
+// SetResponseStore sets the store of the responses of the Responses API
+func SetResponseStore(store core.ResponseStore) {
+	responseStore = store
+}
+
+// ResponsesHandler handles OpenAI Responses API requests.
+// The input of the request, after the conversation of previous_response_id, is converted into a chat completion
+// request and routed like one, the chat completion or its stream is converted back into a response or response
+// events. The response is stored unless store is false.
+func ResponsesHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Set the response header, specifying the content type and character set
+		c.Header("Content-Type", "application/json; charset=utf-8")
+
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			writeBodyError(c, err)
+			return
+		}
+
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
+
+		// Validate the request
+		if !validateJSONBody(c, responsesSchemaLoader, rawJson) {
+			return
+		}
+		modelName := gjson.GetBytes(rawJson, "model").String()
+		isStream := gjson.GetBytes(rawJson, "stream").Bool()
+		apiKey, _ := requestAPIKey(c)
+
+		// Continue the conversation of the previous response
+		input := []byte("[]")
+		if previousID := gjson.GetBytes(rawJson, "previous_response_id").String(); previousID != "" {
+			previous, errPrevious := loadStoredResponse(apiKey, previousID)
+			if errPrevious != nil {
+				writeStoredResponseError(c, previousID, errPrevious)
+				return
+			}
+			input = appendResponsesItems(input, gjson.ParseBytes(previous.Input))
+			input = appendResponsesItems(input, gjson.GetBytes(previous.Response, "output"))
+		}
+		input = appendResponsesItems(input, gjson.GetBytes(rawJson, "input"))
+
+		// Convert the request into a chat completion request
+		chatRequest := convertResponsesRequest(rawJson, input)
+		if cfg.Server.Debug {
+			log.Printf("Chat completion request of responses request for model %s: %s\n", modelName, string(chatRequest))
+		}
+
+		// Moderate the prompt if a moderation policy applies
+		if errModeration := moderatePrompt(c, cfg, providerRegistry, modelName, chatPromptInputs(chatRequest)); errModeration != nil {
+			writeRouteError(c, modelName, errModeration)
+			return
+		}
+
+		// Store the response before the client gets it, so that it can be continued right away
+		store := func(response []byte) {}
+		if gjson.GetBytes(rawJson, "store").Type != gjson.False {
+			store = func(response []byte) {
+				stored := &core.StoredResponse{
+					ID:       gjson.GetBytes(response, "id").String(),
+					APIKeyID: apiKey.ID,
+					Input:    input,
+					Response: response,
+				}
+				if errStore := responseStore.Put(stored); errStore != nil {
+					log.Printf("Failed to store response: %v", errStore)
+				}
+			}
+		}
+
+		// Try the entries of the model in round-robin order until one succeeds
+		streamed := false
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, nil, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			// Rewrite the request body for this entry
+			requestBody, errBody := provider.ApplyModelBody(chatRequest, model)
+			if errBody != nil {
+				return fmt.Errorf("request body error: %w", errBody)
+			}
+			requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+
+			if cfg.Server.Debug {
+				log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
+			}
+
+			// Serve the chat completion through a writer that converts it, a new writer per entry drops
+			// the error bodies of failed entries
+			writer := newResponsesWriter(c.Writer, rawJson, isStream, store)
+			c.Writer = writer
+			var errServe error
+			if isStream {
+				errServe = handleStreamingChatCompletion(c, providerInstance, requestBody, model, usage)
+			} else {
+				errServe = handleNonStreamingChatCompletion(c, providerInstance, requestBody, model, usage)
+			}
+			c.Writer = writer.ResponseWriter
+			if errServe == nil {
+				errServe = writer.finish()
+			}
+
+			// Once the response has started, the client gets a failed response instead of another entry's response
+			if errServe != nil && writer.started {
+				streamed = true
+				writer.writeError(errServe)
+				return fmt.Errorf("%w: %w", errServe, errNoFailover)
+			}
+			return errServe
+		})
+		if finalErr != nil && !streamed {
+			c.Header("Content-Type", "application/json; charset=utf-8")
+			writeRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// ResponseGetHandler returns a stored response
+func ResponseGetHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey, _ := requestAPIKey(c)
+		stored, err := loadStoredResponse(apiKey, c.Param("id"))
+		if err != nil {
+			writeStoredResponseError(c, c.Param("id"), err)
+			return
+		}
+		c.Data(http.StatusOK, "application/json; charset=utf-8", stored.Response)
+	}
+}
+
+// ResponseDeleteHandler deletes a stored response
+func ResponseDeleteHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey, _ := requestAPIKey(c)
+		id := c.Param("id")
+		if _, err := loadStoredResponse(apiKey, id); err != nil {
+			writeStoredResponseError(c, id, err)
+			return
+		}
+		if err := responseStore.Delete(id); err != nil {
+			writeStoredResponseError(c, id, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": id, "object": "response", "deleted": true})
+	}
+}
+
+// loadStoredResponse returns a stored response, a response of another API key is not found
+func loadStoredResponse(apiKey models.APIKey, id string) (*core.StoredResponse, error) {
+	stored, err := responseStore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if stored.APIKeyID != apiKey.ID {
+		return nil, core.ErrResponseNotFound
+	}
+	return stored, nil
+}
+
+// writeStoredResponseError writes the error response for an error of the response store
+func writeStoredResponseError(c *gin.Context, id string, err error) {
+	if errors.Is(err, core.ErrResponseNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": fmt.Sprintf("Response with id '%s' not found.", id), "code": 404}})
+		return
+	}
+	log.Println(err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": "Failed to access the response store", "code": 500}})
+}
+
+// appendResponsesItems appends the items of an input, a string input is a user message
+func appendResponsesItems(items []byte, input gjson.Result) []byte {
+	if input.Type == gjson.String {
+		message, _ := sjson.SetBytes([]byte(`{"type":"message","role":"user","content":""}`), "content", input.String())
+		items, _ = sjson.SetRawBytes(items, "-1", message)
+		return items
+	}
+	for _, item := range input.Array() {
+		items, _ = sjson.SetRawBytes(items, "-1", []byte(item.Raw))
+	}
+	return items
+}
+
+// convertResponsesRequest converts a Responses request, with the input items of the whole conversation,
+// into an OpenAI chat completion request
+func convertResponsesRequest(request []byte, input []byte) []byte {
+	out := []byte(`{"model":"","messages":[]}`)
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(request, "model").String())
+
+	// The instructions become a system message, the instructions of previous responses are not carried over.
+	if instructions := gjson.GetBytes(request, "instructions").String(); instructions != "" {
+		message, _ := sjson.SetBytes([]byte(`{"role":"system","content":""}`), "content", instructions)
+		out, _ = sjson.SetRawBytes(out, "messages.-1", message)
+	}
+
+	// Convert the input items.
+	lastRole := ""
+	for _, item := range gjson.ParseBytes(input).Array() {
+		itemType := item.Get("type").String()
+		if itemType == "" && item.Get("role").Exists() {
+			itemType = "message"
+		}
+		switch itemType {
+		case "message":
+			message := convertResponsesMessage(item)
+			lastRole = gjson.GetBytes(message, "role").String()
+			out, _ = sjson.SetRawBytes(out, "messages.-1", message)
+		case "function_call":
+			toolCall := []byte(`{"id":"","type":"function","function":{"name":"","arguments":""}}`)
+			toolCall, _ = sjson.SetBytes(toolCall, "id", item.Get("call_id").String())
+			toolCall, _ = sjson.SetBytes(toolCall, "function.name", item.Get("name").String())
+			toolCall, _ = sjson.SetBytes(toolCall, "function.arguments", item.Get("arguments").String())
+			// Function calls of one turn belong to one assistant message.
+			if lastRole != "assistant" {
+				out, _ = sjson.SetRawBytes(out, "messages.-1", []byte(`{"role":"assistant","content":""}`))
+				lastRole = "assistant"
+			}
+			lastIndex := len(gjson.GetBytes(out, "messages").Array()) - 1
+			out, _ = sjson.SetRawBytes(out, fmt.Sprintf("messages.%d.tool_calls.-1", lastIndex), toolCall)
+		case "function_call_output":
+			output := item.Get("output")
+			toolMessage := []byte(`{"role":"tool","tool_call_id":"","content":""}`)
+			toolMessage, _ = sjson.SetBytes(toolMessage, "tool_call_id", item.Get("call_id").String())
+			if output.Type == gjson.String {
+				toolMessage, _ = sjson.SetBytes(toolMessage, "content", output.String())
+			} else {
+				toolMessage, _ = sjson.SetBytes(toolMessage, "content", strings.Join(responsesTextParts(output), "\n"))
+			}
+			lastRole = "tool"
+			out, _ = sjson.SetRawBytes(out, "messages.-1", toolMessage)
+		}
+	}
+
+	// Copy the sampling parameters.
+	if maxOutputTokens := gjson.GetBytes(request, "max_output_tokens"); maxOutputTokens.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "max_tokens", maxOutputTokens.Int())
+	}
+	for _, name := range []string{"temperature", "top_p"} {
+		if value := gjson.GetBytes(request, name); value.Type == gjson.Number {
+			out, _ = sjson.SetRawBytes(out, name, []byte(value.Raw))
+		}
+	}
+
+	// Convert the function tools, built-in tools such as web search are not sent.
+	for _, tool := range gjson.GetBytes(request, "tools").Array() {
+		if tool.Get("type").String() != "function" {
+			continue
+		}
+		function := []byte(`{"type":"function","function":{"name":"","parameters":{"type":"object","properties":{}}}}`)
+		function, _ = sjson.SetBytes(function, "function.name", tool.Get("name").String())
+		if description := tool.Get("description"); description.Type == gjson.String {
+			function, _ = sjson.SetBytes(function, "function.description", description.String())
+		}
+		if parameters := tool.Get("parameters"); parameters.IsObject() {
+			function, _ = sjson.SetRawBytes(function, "function.parameters", []byte(parameters.Raw))
+		}
+		if strict := tool.Get("strict"); strict.IsBool() {
+			function, _ = sjson.SetBytes(function, "function.strict", strict.Bool())
+		}
+		out, _ = sjson.SetRawBytes(out, "tools.-1", function)
+	}
+
+	// Convert tool_choice.
+	toolChoice := gjson.GetBytes(request, "tool_choice")
+	if toolChoice.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "tool_choice", toolChoice.String())
+	} else if toolChoice.Get("type").String() == "function" {
+		out, _ = sjson.SetRawBytes(out, "tool_choice", []byte(`{"type":"function","function":{"name":""}}`))
+		out, _ = sjson.SetBytes(out, "tool_choice.function.name", toolChoice.Get("name").String())
+	}
+	if parallelToolCalls := gjson.GetBytes(request, "parallel_tool_calls"); parallelToolCalls.IsBool() && gjson.GetBytes(out, "tools").Exists() {
+		out, _ = sjson.SetBytes(out, "parallel_tool_calls", parallelToolCalls.Bool())
+	}
+
+	// Convert reasoning.effort to reasoning_effort.
+	if effort := gjson.GetBytes(request, "reasoning.effort"); effort.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "reasoning_effort", effort.String())
+	}
+
+	// Convert text.format to response_format.
+	format := gjson.GetBytes(request, "text.format")
+	switch format.Get("type").String() {
+	case "json_object":
+		out, _ = sjson.SetRawBytes(out, "response_format", []byte(`{"type":"json_object"}`))
+	case "json_schema":
+		jsonSchema := []byte(`{"name":""}`)
+		jsonSchema, _ = sjson.SetBytes(jsonSchema, "name", format.Get("name").String())
+		for _, name := range []string{"description", "schema", "strict"} {
+			if value := format.Get(name); value.Exists() {
+				jsonSchema, _ = sjson.SetRawBytes(jsonSchema, name, []byte(value.Raw))
+			}
+		}
+		out, _ = sjson.SetRawBytes(out, "response_format", []byte(`{"type":"json_schema"}`))
+		out, _ = sjson.SetRawBytes(out, "response_format.json_schema", jsonSchema)
+	}
+
+	if user := gjson.GetBytes(request, "user"); user.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "user", user.String())
+	}
+
+	if gjson.GetBytes(request, "stream").Bool() {
+		out, _ = sjson.SetBytes(out, "stream", true)
+	}
+
+	return out
+}
+
+// convertResponsesMessage converts a message item into an OpenAI chat message. Developer messages become
+// system messages, which every provider accepts.
+func convertResponsesMessage(item gjson.Result) []byte {
+	role := item.Get("role").String()
+	if role == "developer" {
+		role = "system"
+	}
+	message, _ := sjson.SetBytes([]byte(`{"role":"","content":""}`), "role", role)
+
+	content := item.Get("content")
+	if content.Type == gjson.String {
+		message, _ = sjson.SetBytes(message, "content", content.String())
+		return message
+	}
+	if role != "user" {
+		message, _ = sjson.SetBytes(message, "content", strings.Join(responsesTextParts(content), ""))
+		return message
+	}
+
+	// Text only content is sent as a string, which every provider accepts.
+	parts := make([][]byte, 0)
+	hasImage := false
+	for _, part := range content.Array() {
+		switch part.Get("type").String() {
+		case "input_text", "output_text", "text":
+			parts = append(parts, newTextPart(part.Get("text").String()))
+		case "input_image":
+			if url := part.Get("image_url").String(); url != "" {
+				imagePart, _ := sjson.SetBytes([]byte(`{"type":"image_url","image_url":{"url":""}}`), "image_url.url", url)
+				if detail := part.Get("detail"); detail.Type == gjson.String {
+					imagePart, _ = sjson.SetBytes(imagePart, "image_url.detail", detail.String())
+				}
+				parts = append(parts, imagePart)
+				hasImage = true
+			}
+		}
+	}
+	if !hasImage {
+		texts := make([]string, 0, len(parts))
+		for _, part := range parts {
+			texts = append(texts, gjson.GetBytes(part, "text").String())
+		}
+		message, _ = sjson.SetBytes(message, "content", strings.Join(texts, "\n"))
+		return message
+	}
+	message, _ = sjson.SetRawBytes(message, "content", []byte("[]"))
+	for _, part := range parts {
+		message, _ = sjson.SetRawBytes(message, "content.-1", part)
+	}
+	return message
+}
+
+// responsesTextParts returns the text parts of a Responses content
+func responsesTextParts(content gjson.Result) []string {
+	texts := make([]string, 0)
+	for _, part := range content.Array() {
+		switch part.Get("type").String() {
+		case "input_text", "output_text", "text", "refusal":
+			texts = append(texts, part.Get("text").String()+part.Get("refusal").String())
+		}
+	}
+	return texts
+}
+
+// newResponsesID returns a random id with the prefix, such as resp for responses. Response ids are random
+// rather than timestamps, since they are the keys of the stored responses.
+func newResponsesID(prefix string) string {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	return prefix + "_" + hex.EncodeToString(random)
+}
@@ -0,0 +1,365 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/core"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// lastUsedModelIndex tracks the last used model index for each model name to implement round-robin load balancing
+var (
+	// lastUsedModelIndex stores the last used index for each model name
+	lastUsedModelIndex = make(map[string]int)
+	// modelIndexLock protects concurrent access to lastUsedModelIndex, the requests of all models share the map
+	modelIndexLock = &sync.Mutex{}
+)
+
+var (
+	// quotaManager enforces the rate limits of the API keys and the model entries
+	quotaManager = core.NewQuotaManager()
+	// usageRecorder writes the usage of served requests, nil when no usage log is configured
+	usageRecorder *core.UsageRecorder
+	// healthTracker tracks the health of the model entries by the outcome of their requests
+	healthTracker = core.NewHealthTracker()
+)
+
+// errModelNotFound is returned by routeRequest when the model has no enabled entry
+var errModelNotFound = errors.New("model not found")
+
+// errNoFailover is wrapped by the errors of serve after which no other entry may be tried,
+// for example because the request body was streamed upstream and cannot be sent again
+var errNoFailover = errors.New("the request cannot be sent to another entry")
+
+// upstreamError is the error of an entry together with the error body that its upstream sent. The body is only
+// written to the client by writeRouteError, when no other entry served the request, so that a failover does not
+// mix it into the response of the next entry.
+type upstreamError struct {
+	// err is the error of the entry
+	err error
+	// body is the error body of the upstream
+	body []byte
+}
+
+// Error returns the error message of the entry
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error of the entry
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// status returns the HTTP status of the upstream response that sent the error body
+func (e *upstreamError) status() int {
+	return upstreamStatus(e.err)
+}
+
+// upstreamStatus returns the HTTP status of the upstream response that an entry failed with, 503 if it failed
+// without an error status
+func upstreamStatus(err error) int {
+	var statusErr *provider.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode <= 599 {
+		return statusErr.StatusCode
+	}
+	return http.StatusServiceUnavailable
+}
+
+// isClientError reports whether an entry failed with a client error status of its upstream. The request itself
+// is at fault, so another entry would reject it too. Timeouts and rate limits are not client errors.
+func isClientError(err error) bool {
+	status := upstreamStatus(err)
+	return status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// withErrorBody returns the error of an entry with the error body of its upstream, the error itself without a body
+func withErrorBody(err error, body []byte) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return err
+	}
+	return &upstreamError{err: err, body: body}
+}
+
+// usageEndpointKey is the context key of the endpoint recorded in the usage log, set by the handlers whose route
+// path does not tell the endpoint
+const usageEndpointKey = "usageEndpoint"
+
+// SetUsageRecorder sets the recorder that the usage of served requests is written to
+func SetUsageRecorder(recorder *core.UsageRecorder) {
+	usageRecorder = recorder
+}
+
+// parseProviderNames returns the provider names requested with the provider field or the Provider header,
+// and the request body without the provider field
+func parseProviderNames(c *gin.Context, rawJson []byte) ([]string, []byte) {
+	customProviderNames := make([]string, 0)
+	providerResult := gjson.GetBytes(rawJson, "provider")
+	if providerResult.Type == gjson.String {
+		customProviderNames = append(customProviderNames, providerResult.String())
+		rawJson, _ = sjson.DeleteBytes(rawJson, "provider")
+	} else if providerResult.Type == gjson.JSON {
+		providerResult.ForEach(func(key, value gjson.Result) bool {
+			customProviderNames = append(customProviderNames, strings.ToLower(value.String()))
+			return true
+		})
+		rawJson, _ = sjson.DeleteBytes(rawJson, "provider")
+	} else {
+		providerHeader := c.GetHeader("Provider")
+		if providerHeader != "" {
+			splitProviderHeader := strings.Split(providerHeader, ",")
+			for _, item := range splitProviderHeader {
+				customProviderNames = append(customProviderNames, strings.ToLower(strings.TrimSpace(item)))
+			}
+		}
+	}
+	return customProviderNames, rawJson
+}
+
+// roundRobinEntries returns the enabled entries of the model, starting with the entry after the one used last
+func roundRobinEntries(cfg *config.Config, modelName string, customProviderNames []string) []models.Model {
+	// Filter models from memory
+	var providerModels []models.Model
+	for _, m := range cfg.Models {
+		if m.Name == modelName && m.Enabled {
+			providerModels = append(providerModels, m)
+		}
+	}
+	if len(providerModels) == 0 {
+		return nil
+	}
+
+	// Round-robin load balancing
+	loadBalanceKey := modelName
+	if len(customProviderNames) > 0 {
+		sorted := append([]string{}, customProviderNames...)
+		sort.Strings(sorted)
+		loadBalanceKey = fmt.Sprintf("%s-%s", modelName, strings.Join(sorted, "-"))
+	}
+
+	modelIndexLock.Lock()
+	startIndex := lastUsedModelIndex[loadBalanceKey] % len(providerModels)
+	lastUsedModelIndex[loadBalanceKey] = (startIndex + 1) % len(providerModels)
+	modelIndexLock.Unlock()
+
+	reorderedModels := make([]models.Model, len(providerModels))
+	for i := 0; i < len(providerModels); i++ {
+		reorderedModels[i] = providerModels[(startIndex+i)%len(providerModels)]
+	}
+	return reorderedModels
+}
+
+// routeRequest calls serve with a provider for each entry of the model in round-robin order until one succeeds.
+// Only the entries accepted by capable are tried, all entries if it is nil. The API key's quota is reserved first,
+// entries whose quota is used up are skipped, and the usage that serve fills in is metered and recorded.
+// Batch requests only use the batch share of the quotas.
+// Errors wrapping errNoFailover and client errors of the upstream end the failover.
+// The outcome of each tried entry is recorded in its health, unless the client went away or the upstream
+// rejected the request with a client error.
+// It returns nil on success, errModelNotFound if the model has no enabled entry or the API key may not use it,
+// a *core.QuotaExceededError
+// if the API key or every entry is over its quota, or the error of the last entry.
+func routeRequest(c *gin.Context, cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory, modelName string, customProviderNames []string, capable func(model models.Model) bool, serve func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error) error {
+	// A model the API key may not use is not found, so that its existence is not revealed
+	if apiKey, hasAPIKey := requestAPIKey(c); hasAPIKey && !apiKey.AllowsModel(modelName) {
+		return errModelNotFound
+	}
+	return routeEntries(c, cfg, providerRegistry, modelName, customProviderNames, capable, serve)
+}
+
+// routeEntries is routeRequest without the check of the models the API key may use, for the requests that the
+// router makes on behalf of the client, such as the moderation of its prompt
+func routeEntries(c *gin.Context, cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory, modelName string, customProviderNames []string, capable func(model models.Model) bool, serve func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error) error {
+	apiKey, hasAPIKey := requestAPIKey(c)
+	reorderedModels := roundRobinEntries(cfg, modelName, customProviderNames)
+	if capable != nil {
+		capableModels := make([]models.Model, 0, len(reorderedModels))
+		for _, model := range reorderedModels {
+			if capable(model) {
+				capableModels = append(capableModels, model)
+			}
+		}
+		reorderedModels = capableModels
+	}
+	if len(reorderedModels) == 0 {
+		return errModelNotFound
+	}
+
+	// Count the request against the API key's quota
+	keyScope := ""
+	if hasAPIKey {
+		keyScope = fmt.Sprintf("API key %d (%s)", apiKey.ID, apiKey.Name)
+		if err := quotaManager.Reserve(keyScope, requestQuotaLimits(c, core.APIKeyQuotaLimits(apiKey))); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	var finalErr error
+	for _, model := range reorderedModels {
+		factory, ok := providerRegistry[model.ProviderType]
+		entryScope := modelEntryScope(model)
+		if !ok {
+			finalErr = fmt.Errorf("provider factory not found for provider type %s", model.ProviderType)
+			log.Println(finalErr)
+			healthTracker.RecordFailure(entryScope)
+			continue
+		}
+
+		// Skip the entry if its quota is used up
+		if err := quotaManager.Reserve(entryScope, requestQuotaLimits(c, core.ModelQuotaLimits(model))); err != nil {
+			finalErr = err
+			log.Println(finalErr)
+			continue
+		}
+
+		providerInstance, errFactory := factory(model.ProviderOptions)
+		if errFactory != nil {
+			finalErr = fmt.Errorf("failed to create provider: %v", errFactory)
+			log.Println(finalErr)
+			healthTracker.RecordFailure(entryScope)
+			continue
+		}
+
+		if model.IsOpenAICompatibility {
+			if instance, isOk := providerInstance.(*provider.OpenAICompatibility); isOk {
+				instance.SetBaseUrl(model.BaseURL, model.BaseURLDirect)
+			}
+		}
+
+		usage := provider.Usage{}
+		finalErr = serve(providerInstance, model, &usage)
+
+		_ = providerInstance.Close()
+
+		// Meter the tokens, a failed entry may still have used some
+		tokens := usage.TotalTokens
+		if tokens == 0 {
+			tokens = usage.PromptTokens + usage.CompletionTokens
+		}
+		quotaManager.AddTokens(entryScope, tokens)
+
+		// A request that the client abandoned or that the upstream rejected as invalid says nothing about the entry
+		if finalErr == nil {
+			healthTracker.RecordSuccess(entryScope)
+		} else if c.Request.Context().Err() == nil && !isClientError(finalErr) {
+			healthTracker.RecordFailure(entryScope)
+		}
+
+		if finalErr == nil {
+			// log.Printf("Request model %s OK\n", model.Name)
+			if hasAPIKey {
+				quotaManager.AddTokens(keyScope, tokens)
+			}
+			recordUsage(c, apiKey, modelName, model, usage)
+			return nil // Success
+		}
+		log.Printf("Request model %s error: %s\n", model.ProviderModelName, finalErr.Error())
+		if errors.Is(finalErr, errNoFailover) || isClientError(finalErr) {
+			break
+		}
+	}
+	return finalErr
+}
+
+// requestQuotaLimits returns the part of the limits that the request may use. Batch requests have a lower
+// priority than interactive requests and only get the batch share of the limits.
+func requestQuotaLimits(c *gin.Context, limits core.QuotaLimits) core.QuotaLimits {
+	if isBatchRequest(c) {
+		return limits.Share(batchQuotaShare)
+	}
+	return limits
+}
+
+// requestAPIKey returns the API key that authenticated the request
+func requestAPIKey(c *gin.Context) (models.APIKey, bool) {
+	value, exists := c.Get("apiKey")
+	if !exists {
+		return models.APIKey{}, false
+	}
+	apiKey, ok := value.(models.APIKey)
+	return apiKey, ok
+}
+
+// modelEntryScope returns the quota scope of a model entry
+func modelEntryScope(model models.Model) string {
+	if model.ID != 0 {
+		return fmt.Sprintf("model entry %d (%s)", model.ID, model.Name)
+	}
+	return fmt.Sprintf("model entry %s (%s at %s)", model.Name, model.ProviderModelName, model.BaseURL)
+}
+
+// recordUsage writes the usage of a served request to the usage log
+func recordUsage(c *gin.Context, apiKey models.APIKey, modelName string, model models.Model, usage provider.Usage) {
+	record := core.UsageRecord{
+		Time:             time.Now(),
+		APIKeyID:         apiKey.ID,
+		APIKeyName:       apiKey.Name,
+		Endpoint:         usageEndpoint(c),
+		Model:            modelName,
+		EntryID:          model.ID,
+		ProviderType:     model.ProviderType.String(),
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		CachedTokens:     usage.PromptTokensDetails.CachedTokens,
+		ReasoningTokens:  usage.CompletionTokensDetails.ReasoningTokens,
+		Images:           usage.Images,
+		AudioSeconds:     usage.AudioSeconds,
+		Characters:       usage.Characters,
+	}
+	record.Cost = core.UsageCost(model, record)
+	usageRecorder.Record(record)
+}
+
+// usageEndpoint returns the endpoint of a request for the usage log, the route path unless the handler set another
+func usageEndpoint(c *gin.Context) string {
+	if endpoint := c.GetString(usageEndpointKey); endpoint != "" {
+		return endpoint
+	}
+	return c.FullPath()
+}
+
+// writeRouteError writes the error response for an error returned by routeRequest
+func writeRouteError(c *gin.Context, modelName string, err error) {
+	// The streaming handler has set the event stream content type
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	if errors.Is(err, errModelNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": gin.H{"message": fmt.Sprintf("Model %s not found or not available.", modelName), "code": 404}})
+		return
+	}
+	if errors.Is(err, errPromptFlagged) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "Request blocked: " + err.Error(), "code": 400}})
+		return
+	}
+	var quotaErr *core.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(quotaErr.RetryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{"message": "Rate limit exceeded: " + quotaErr.Error(), "code": 429}})
+		return
+	}
+	// The error body of the last entry tells the client what went wrong upstream
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		c.Data(upstreamErr.status(), "application/json; charset=utf-8", upstreamErr.body)
+		return
+	}
+	status := upstreamStatus(err)
+	c.JSON(status, gin.H{"error": gin.H{"message": "All providers failed: " + err.Error(), "code": status}})
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	"github.com/luispater/mini-router/core"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+)
+
+// newRoutingTestRouter serves chat completions for a model with two entries at the upstream
+func newRoutingTestRouter(t *testing.T, modelName, upstreamURL string) *gin.Engine {
+	t.Helper()
+	var entries strings.Builder
+	for id := 1; id <= 2; id++ {
+		_, _ = fmt.Fprintf(&entries, `
+  - id: %d
+    name: %q
+    provider_model_name: "gpt-4o"
+    is_openai_compatibility: true
+    base_url: %q
+    enabled: true
+`, id, modelName, upstreamURL)
+	}
+	return newRoutingTestRouterFromConfig(t, "models:"+entries.String())
+}
+
+// newRoutingTestRouterFromConfig serves chat completions for the models of the yaml config
+func newRoutingTestRouterFromConfig(t *testing.T, configYAML string) *gin.Engine {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(configYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path, provider.ValidateModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/v1/chat/completions", ChatCompletionHandler(cfg, provider.ProviderRegistry))
+	return router
+}
+
+func TestRouteRequestKeepsUpstreamClientErrorStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		wantStatus   int
+		wantRequests int32
+	}{
+		{name: "bad request", status: http.StatusBadRequest, body: `{"error":{"message":"bad messages","type":"invalid_request_error","code":null}}`, wantStatus: http.StatusBadRequest, wantRequests: 1},
+		{name: "string code", status: http.StatusNotFound, body: `{"error":{"message":"no such model","type":"invalid_request_error","code":"model_not_found"}}`, wantStatus: http.StatusNotFound, wantRequests: 1},
+		{name: "rate limit", status: http.StatusTooManyRequests, body: `{"error":{"message":"slow down","type":"rate_limit_error","code":null}}`, wantStatus: http.StatusTooManyRequests, wantRequests: 2},
+		{name: "server error", status: http.StatusBadGateway, body: `{"error":{"message":"bad gateway","type":"server_error","code":null}}`, wantStatus: http.StatusBadGateway, wantRequests: 2},
+	}
+	for _, test := range tests {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s stream=%t", test.name, stream), func(t *testing.T) {
+				var requests atomic.Int32
+				upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests.Add(1)
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(test.status)
+					_, _ = w.Write([]byte(test.body))
+				}))
+				defer upstream.Close()
+				modelName := fmt.Sprintf("routing-%d-%t", test.status, stream)
+				router := newRoutingTestRouter(t, modelName, upstream.URL)
+
+				request := fmt.Sprintf(`{"model":%q,"stream":%t,"messages":[{"role":"user","content":"Hi"}]}`, modelName, stream)
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(request)))
+				if recorder.Code != test.wantStatus {
+					t.Errorf("status = %d, want %d, body %s", recorder.Code, test.wantStatus, recorder.Body.String())
+				}
+				if !strings.Contains(recorder.Body.String(), `"message":"`) {
+					t.Errorf("body = %s, want the upstream error", recorder.Body.String())
+				}
+				if got := requests.Load(); got != test.wantRequests {
+					t.Errorf("the upstream received %d requests, want %d", got, test.wantRequests)
+				}
+			})
+		}
+	}
+}
+
+func TestRouteRequestHealthIgnoresClientErrors(t *testing.T) {
+	tests := []struct {
+		status     int
+		wantHealth string
+	}{
+		{status: http.StatusBadRequest, wantHealth: core.HealthUnknown},
+		{status: http.StatusUnprocessableEntity, wantHealth: core.HealthUnknown},
+		{status: http.StatusRequestTimeout, wantHealth: core.HealthFailing},
+		{status: http.StatusTooManyRequests, wantHealth: core.HealthFailing},
+		{status: http.StatusInternalServerError, wantHealth: core.HealthFailing},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.status), func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(`{"error":{"message":"failed","type":"error","code":null}}`))
+			}))
+			defer upstream.Close()
+			modelName := fmt.Sprintf("health-%d", test.status)
+			router := newRoutingTestRouter(t, modelName, upstream.URL)
+
+			request := fmt.Sprintf(`{"model":%q,"messages":[{"role":"user","content":"Hi"}]}`, modelName)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(request)))
+			for id := uint(1); id <= 2; id++ {
+				scope := modelEntryScope(models.Model{ID: id, Name: modelName})
+				if got := healthTracker.Health(scope).Status; got != test.wantHealth {
+					t.Errorf("health of %s = %s, want %s", scope, got, test.wantHealth)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteRequestFailsOverFromMockErrors(t *testing.T) {
+	const modelName = "mock-failover"
+	router := newRoutingTestRouterFromConfig(t, fmt.Sprintf(`models:
+  - id: 1
+    name: %[1]q
+    provider_model_name: "mock"
+    provider_type: "mock"
+    provider_options:
+      error_probability: 1
+      error_status: 503
+    enabled: true
+  - id: 2
+    name: %[1]q
+    provider_model_name: "mock"
+    provider_type: "mock"
+    provider_options:
+      mode: "canned"
+      content: "From the second entry"
+      chunks: 3
+    enabled: true
+`, modelName))
+	// Streams need a connection that can notify the handler of a close
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%t", stream), func(t *testing.T) {
+			request := fmt.Sprintf(`{"model":%q,"stream":%t,"messages":[{"role":"user","content":"Hi"}]}`, modelName, stream)
+			response, err := http.Post(server.URL+"/v1/chat/completions", "application/json", strings.NewReader(request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = response.Body.Close() }()
+			responseBody, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := string(responseBody)
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200, body %s", response.StatusCode, body)
+			}
+			if stream {
+				for _, chunk := range []string{`"content":"From th"`, `"content":"e secon"`, `"content":"d entry"`, `"finish_reason":"stop"`, "data: [DONE]"} {
+					if !strings.Contains(body, chunk) {
+						t.Errorf("stream = %s, want %s", body, chunk)
+					}
+				}
+			} else if !strings.Contains(body, `"content":"From the second entry"`) {
+				t.Errorf("body = %s, want the content of the second entry", body)
+			}
+		})
+	}
+
+	if got := healthTracker.Health(modelEntryScope(models.Model{ID: 1, Name: modelName})).Status; got != core.HealthFailing {
+		t.Errorf("health of the failing entry = %s, want %s", got, core.HealthFailing)
+	}
+	if got := healthTracker.Health(modelEntryScope(models.Model{ID: 2, Name: modelName})).Status; got == core.HealthFailing {
+		t.Errorf("health of the second entry = %s, want it not failing", got)
+	}
+}
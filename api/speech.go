@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luispater/mini-router/config"
+	_const "github.com/luispater/mini-router/const"
+	jsonschema "github.com/luispater/mini-router/json-schema"
+	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/provider"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// speechSchemaLoader is used to load the JSON schema of speech requests
+var speechSchemaLoader = gojsonschema.NewBytesLoader(jsonschema.SpeechSchema)
+
+// speechContentTypes are the content types of the speech response formats
+var speechContentTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"opus": "audio/opus",
+	"aac":  "audio/aac",
+	"flac": "audio/flac",
+	"wav":  "audio/wav",
+	"pcm":  "audio/pcm",
+}
+
+// SpeechHandler handles text-to-speech requests, only entries with supports_speech are tried.
+// The audio is relayed to the client chunk by chunk as the upstream sends it.
+func SpeechHandler(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the raw JSON data
+		rawJson, err := c.GetRawData()
+		if err != nil {
+			writeBodyError(c, err)
+			return
+		}
+
+		customProviderNames, rawJson := parseProviderNames(c, rawJson)
+
+		// Validate the request
+		if !validateJSONBody(c, speechSchemaLoader, rawJson) {
+			return
+		}
+		modelName := gjson.GetBytes(rawJson, "model").String()
+		voice := gjson.GetBytes(rawJson, "voice").String()
+
+		// The content type follows the requested format
+		contentType := speechContentTypes["mp3"]
+		if format := gjson.GetBytes(rawJson, "response_format"); format.Exists() {
+			contentType = speechContentTypes[format.String()]
+		}
+		if gjson.GetBytes(rawJson, "stream_format").String() == "sse" {
+			contentType = "text/event-stream"
+		}
+
+		// Try the entries of the model that synthesize speech in round-robin order until one succeeds
+		isSpeechModel := func(model models.Model) bool {
+			return model.SupportsSpeech
+		}
+		finalErr := routeRequest(c, cfg, providerRegistry, modelName, customProviderNames, isSpeechModel, func(providerInstance provider.Provider, model models.Model, usage *provider.Usage) error {
+			speechProvider, ok := providerInstance.(provider.SpeechProvider)
+			if !ok {
+				return fmt.Errorf("provider type %s does not synthesize speech", model.ProviderType)
+			}
+
+			// Rewrite the request body for this entry
+			requestBody, errBody := provider.ApplyModelBody(rawJson, model)
+			if errBody != nil {
+				return fmt.Errorf("request body error: %w", errBody)
+			}
+			requestBody, _ = sjson.SetBytes(requestBody, "model", model.ProviderModelName)
+			if entryVoice, mapped := model.SpeechVoices[voice]; mapped {
+				requestBody, _ = sjson.SetBytes(requestBody, "voice", entryVoice)
+			}
+
+			if cfg.Server.Debug {
+				log.Printf("Request body for model %s (entry %d): %s\n", model.Name, model.ID, string(requestBody))
+			}
+
+			// Create a context with a timeout
+			ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Minute)
+			defer cancel()
+
+			usage.Characters = utf8.RuneCountInString(gjson.GetBytes(requestBody, "input").String())
+			stream, errCall, errResponse := speechProvider.CreateSpeech(ctx, cancel, requestBody, model, usage)
+			if errCall != nil {
+				if errResponse != nil {
+					errCall = fmt.Errorf("%w: %s", errCall, errResponse)
+				}
+				return errCall
+			}
+			defer func() {
+				_ = stream.Close()
+			}()
+			return handleBinaryStream(c, contentType, stream)
+		})
+		// An error in the middle of the audio cannot be reported to the client, the audio just ends
+		if finalErr != nil && !c.Writer.Written() {
+			writeRouteError(c, modelName, finalErr)
+		}
+	}
+}
+
+// handleBinaryStream relays a binary stream to the client, flushing every chunk. The response starts with the
+// first chunk, so an error before it still allows failover, an error after it wraps errNoFailover.
+func handleBinaryStream(c *gin.Context, contentType string, stream io.Reader) error {
+	started := false
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := stream.Read(buffer)
+		if n > 0 || (errors.Is(err, io.EOF) && !started) {
+			if !started {
+				started = true
+				c.Header("Content-Type", contentType)
+				c.Header("Cache-Control", "no-cache")
+				c.Status(http.StatusOK)
+			}
+			if _, errWrite := c.Writer.Write(buffer[:n]); errWrite != nil {
+				return fmt.Errorf("%w: %w", errWrite, errNoFailover)
+			}
+			c.Writer.Flush()
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			if started {
+				return fmt.Errorf("%w: %w", err, errNoFailover)
+			}
+			return err
+		}
+	}
+}
@@ -3,7 +3,12 @@ package config
 import (
 	"fmt"
 	"github.com/luispater/mini-router/models"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -11,21 +16,79 @@ import (
 
 // Config represents the application's configuration
 type Config struct {
-	Server  ServerConfig    `yaml:"server"`
-	Models  []models.Model  `yaml:"models"`
+	Server ServerConfig `yaml:"server"`
+	// Models are decoded separately by resolveModels once template inheritance is applied
+	Models  []models.Model  `yaml:"-"`
 	APIKeys []models.APIKey `yaml:"api_keys"`
 }
 
 // ServerConfig represents the server's configuration
 type ServerConfig struct {
+	// Host is the address to bind to, empty means all interfaces
+	Host string `yaml:"host"`
 	// Port to listen on
 	Port string `yaml:"port"`
 	// ShutdownTimeout is the timeout for graceful shutdown
 	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ReadHeaderTimeout is the amount of time allowed to read request headers, 0 means no timeout
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// IdleTimeout is the maximum amount of time to wait for the next request on a keep-alive connection
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxHeaderBytes is the maximum size of the request headers, 0 means the net/http default
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// MaxRequestBodySize is the maximum size of a request body in bytes, 0 means no limit
+	MaxRequestBodySize int64 `yaml:"max_request_body_size"`
+	// GinMode is the gin mode: debug, release or test
+	GinMode string `yaml:"gin_mode"`
+	// Debug logs the request body sent upstream for every model entry that is tried
+	Debug bool `yaml:"debug"`
+	// UsageLog is the path of the file that the usage of every served request is appended to as a JSON line
+	UsageLog string `yaml:"usage_log"`
+	// ResponseStoreDir is the directory that the responses of the Responses API are stored in, in memory when empty
+	ResponseStoreDir string `yaml:"response_store_dir"`
+	// ResponseStoreMaxEntries is the number of responses kept in memory, 0 means 10000
+	ResponseStoreMaxEntries int `yaml:"response_store_max_entries"`
+	// ResponseStoreTTL is the time a response is kept in memory, 0 means 24 hours
+	ResponseStoreTTL time.Duration `yaml:"response_store_ttl"`
+	// BatchDir is the directory that the files and batches of the Batch API are stored in, the Batch API is disabled when empty
+	BatchDir string `yaml:"batch_dir"`
+	// BatchWorkers is the number of batch requests served at the same time, 0 means 4
+	BatchWorkers int `yaml:"batch_workers"`
+	// BatchQuotaShare is the share of the rate limits that batch requests may use, 0 means 0.5
+	BatchQuotaShare float64 `yaml:"batch_quota_share"`
+	// TrustedProxies is the list of proxy IPs or CIDRs whose forwarding headers are trusted
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// TLS is the TLS configuration, TLS is disabled when no certificate is set
+	TLS TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig represents the server's TLS configuration
+type TLSConfig struct {
+	// CertFile is the path to the PEM encoded certificate chain
+	CertFile string `yaml:"cert_file"`
+	// KeyFile is the path to the PEM encoded private key
+	KeyFile string `yaml:"key_file"`
+}
+
+// Enabled reports whether TLS is configured
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// ModelValidator checks a resolved model entry, for example against the provider registry
+type ModelValidator func(model models.Model) error
+
+// modelNodes holds the raw model entries and templates before inheritance is resolved
+type modelNodes struct {
+	// Templates are the named partial model entries that can be extended
+	Templates map[string]yaml.Node `yaml:"templates"`
+	// Models are the model entries
+	Models []yaml.Node `yaml:"models"`
 }
 
 // / LoadConfig loads the configuration from the specified file
-func LoadConfig(configFile string) (*Config, error) {
+// / validators are run on every resolved model entry in addition to the built-in checks
+func LoadConfig(configFile string, validators ...ModelValidator) (*Config, error) {
 	// Read the configuration file
 	data, err := os.ReadFile(configFile)
 	// If reading the file fails
@@ -42,6 +105,382 @@ func LoadConfig(configFile string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	// Validate the server configuration
+	if err = validateServer(config.Server); err != nil {
+		return nil, fmt.Errorf("invalid server configuration: %w", err)
+	}
+
+	// Parse the model entries and templates as raw nodes
+	var nodes modelNodes
+	if err = yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	// Validate the API keys
+	if err = validateAPIKeys(config.APIKeys); err != nil {
+		return nil, fmt.Errorf("invalid api_keys configuration: %w", err)
+	}
+
+	// Resolve the model entries against their templates
+	config.Models, err = resolveModels(nodes, validators)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the moderation policies against the model entries
+	if err = validateModerationPolicies(&config); err != nil {
+		return nil, fmt.Errorf("invalid moderation configuration: %w", err)
+	}
+
 	// Return the configuration
 	return &config, nil
 }
+
+// validateServer checks that the server configuration is usable
+func validateServer(server ServerConfig) error {
+	switch server.GinMode {
+	case "", "debug", "release", "test":
+	default:
+		return fmt.Errorf("unknown gin_mode %q", server.GinMode)
+	}
+	if (server.TLS.CertFile == "") != (server.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if server.MaxRequestBodySize < 0 || server.MaxHeaderBytes < 0 {
+		return fmt.Errorf("max_request_body_size and max_header_bytes must not be negative")
+	}
+	if server.ResponseStoreMaxEntries < 0 || server.ResponseStoreTTL < 0 {
+		return fmt.Errorf("response_store_max_entries and response_store_ttl must not be negative")
+	}
+	if server.BatchWorkers < 0 {
+		return fmt.Errorf("batch_workers must not be negative")
+	}
+	if server.BatchQuotaShare < 0 || server.BatchQuotaShare > 1 {
+		return fmt.Errorf("batch_quota_share must be between 0 and 1")
+	}
+	if server.ReadHeaderTimeout < 0 || server.IdleTimeout < 0 || server.ShutdownTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	for _, trustedProxy := range server.TrustedProxies {
+		if net.ParseIP(trustedProxy) == nil {
+			if _, _, err := net.ParseCIDR(trustedProxy); err != nil {
+				return fmt.Errorf("invalid trusted proxy %q", trustedProxy)
+			}
+		}
+	}
+	return nil
+}
+
+// validateAPIKeys checks that the model patterns of the API keys are valid
+func validateAPIKeys(apiKeys []models.APIKey) error {
+	for _, apiKey := range apiKeys {
+		for _, pattern := range apiKey.AllowedModels {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("API key %d (%s) has an invalid allowed_models pattern %q", apiKey.ID, apiKey.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// validateModerationPolicies checks that the moderation policies of the API keys and the model entries have a
+// known action and name a model with an enabled entry that supports moderation
+func validateModerationPolicies(config *Config) error {
+	validate := func(owner string, policy models.ModerationPolicy) error {
+		if !policy.Enabled() {
+			if policy.Action != "" {
+				return fmt.Errorf("%s has a moderation action but no moderation model", owner)
+			}
+			return nil
+		}
+		switch policy.Action {
+		case "", models.ModerationActionBlock, models.ModerationActionLog:
+		default:
+			return fmt.Errorf("%s has an unknown moderation action %q", owner, policy.Action)
+		}
+		for _, model := range config.Models {
+			if model.Name == policy.Model && model.Enabled && model.SupportsModeration {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s uses moderation model %s, which has no enabled entry with supports_moderation", owner, policy.Model)
+	}
+
+	for _, apiKey := range config.APIKeys {
+		if err := validate(fmt.Sprintf("API key %d (%s)", apiKey.ID, apiKey.Name), apiKey.Moderation); err != nil {
+			return err
+		}
+	}
+	for _, model := range config.Models {
+		if err := validate(fmt.Sprintf("model entry %d (%s)", model.ID, model.Name), model.Moderation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveModels applies template inheritance to every model entry and validates the result
+func resolveModels(nodes modelNodes, validators []ModelValidator) ([]models.Model, error) {
+	resolvedModels := make([]models.Model, 0, len(nodes.Models))
+	ids := make(map[uint]int)
+	for i := range nodes.Models {
+		// Merge the entry with the templates it extends
+		node, err := resolveModelNode(&nodes.Models[i], nodes.Templates, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid model entry #%d: %w", i+1, err)
+		}
+
+		// Decode the resolved entry
+		var model models.Model
+		if err = node.Decode(&model); err != nil {
+			return nil, fmt.Errorf("invalid model entry #%d: %w (resolved entry: %s)", i+1, err, describeModelNode(node))
+		}
+
+		// Expand the environment variables of the headers and query parameters
+		if err = expandModelEnv(&model); err != nil {
+			return nil, fmt.Errorf("invalid model entry #%d: %w (resolved entry: %s)", i+1, err, describeModelNode(node))
+		}
+
+		// Validate the resolved entry
+		if err = validateModel(model); err != nil {
+			return nil, fmt.Errorf("invalid model entry #%d: %w (resolved entry: %s)", i+1, err, describeModelNode(node))
+		}
+		for _, validator := range validators {
+			if err = validator(model); err != nil {
+				return nil, fmt.Errorf("invalid model entry #%d: %w (resolved entry: %s)", i+1, err, describeModelNode(node))
+			}
+		}
+		if model.ID != 0 {
+			if previous, exists := ids[model.ID]; exists {
+				return nil, fmt.Errorf("invalid model entry #%d: id %d is already used by entry #%d (resolved entry: %s)", i+1, model.ID, previous, describeModelNode(node))
+			}
+			ids[model.ID] = i + 1
+		}
+
+		resolvedModels = append(resolvedModels, model)
+	}
+	return resolvedModels, nil
+}
+
+// resolveModelNode returns the mapping node of an entry merged with the chain of templates it extends.
+// Keys set on the entry override the keys inherited from its template.
+func resolveModelNode(node *yaml.Node, templates map[string]yaml.Node, visiting []string) (*yaml.Node, error) {
+	// Follow YAML aliases
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping", node.Line)
+	}
+
+	// Find the template name
+	templateName := ""
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "extends" {
+			templateName = node.Content[i+1].Value
+		}
+	}
+	if templateName == "" {
+		return node, nil
+	}
+
+	// Detect inheritance cycles
+	for _, name := range visiting {
+		if name == templateName {
+			return nil, fmt.Errorf("template inheritance cycle: %s -> %s", strings.Join(visiting, " -> "), templateName)
+		}
+	}
+
+	template, exists := templates[templateName]
+	if !exists {
+		return nil, fmt.Errorf("line %d: unknown template %q", node.Line, templateName)
+	}
+
+	// Resolve the template itself, which may extend another template
+	parent, err := resolveModelNode(&template, templates, append(visiting, templateName))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the inherited keys, then apply the keys of this entry
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: node.Line, Column: node.Column}
+	merged.Content = append(merged.Content, parent.Content...)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		overridden := false
+		for j := 0; j+1 < len(merged.Content); j += 2 {
+			if merged.Content[j].Value == node.Content[i].Value {
+				merged.Content[j+1] = node.Content[i+1]
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged.Content = append(merged.Content, node.Content[i], node.Content[i+1])
+		}
+	}
+	return merged, nil
+}
+
+// validateModel checks that a resolved model entry is usable
+func validateModel(model models.Model) error {
+	if model.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if model.ProviderModelName == "" {
+		return fmt.Errorf("provider_model_name is required")
+	}
+	if model.InputPricePerToken < 0 || model.OutputPricePerToken < 0 || model.PricePerImage < 0 || model.PricePerAudioSecond < 0 || model.PricePerCharacter < 0 {
+		return fmt.Errorf("prices must not be negative")
+	}
+	if model.RPM < 0 || model.RPH < 0 || model.RPD < 0 || model.TPM < 0 || model.TPH < 0 || model.TPD < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if model.MaxTokens < 0 || model.ContextLength < 0 {
+		return fmt.Errorf("max_tokens and context_length must not be negative")
+	}
+	if model.EmbeddingBatchSize < 0 {
+		return fmt.Errorf("embedding_batch_size must not be negative")
+	}
+	if model.ProxyURL != "" {
+		if err := validateProxyURL(model.ProxyURL); err != nil {
+			return err
+		}
+	}
+	if err := validateBodyRewrite(model.BodyDefaults, model.BodyOverrides, model.BodyRemove); err != nil {
+		return err
+	}
+	for i, rule := range model.BodyRules {
+		if err := validateBodyRewrite(rule.Defaults, rule.Overrides, rule.Remove); err != nil {
+			return fmt.Errorf("body_rules[%d]: %w", i, err)
+		}
+	}
+	for _, header := range model.ForwardHeaders {
+		if _, blocked := unforwardableHeaders[strings.ToLower(header)]; blocked {
+			return fmt.Errorf("forward_headers must not contain %s", header)
+		}
+	}
+	return nil
+}
+
+// protectedBodyFields are the request body fields that the router sets itself and body rewrites may not touch
+var protectedBodyFields = []string{"model", "stream"}
+
+// validateBodyRewrite checks that body rewrites do not change the fields the router manages
+func validateBodyRewrite(defaults, overrides models.BodyPatch, remove []string) error {
+	for _, field := range protectedBodyFields {
+		if _, exists := defaults[field]; exists {
+			return fmt.Errorf("body defaults must not set %s", field)
+		}
+		if _, exists := overrides[field]; exists {
+			return fmt.Errorf("body overrides must not set %s", field)
+		}
+	}
+	for _, path := range remove {
+		if path == "" {
+			return fmt.Errorf("body remove paths must not be empty")
+		}
+		for _, field := range protectedBodyFields {
+			if path == field {
+				return fmt.Errorf("body remove must not delete %s", field)
+			}
+		}
+	}
+	return nil
+}
+
+// validateProxyURL checks that a proxy URL has a supported scheme and a host
+func validateProxyURL(proxyURL string) error {
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy_url: %w", err)
+	}
+	switch parsedURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("proxy_url scheme must be http, https, socks5 or socks5h")
+	}
+	if parsedURL.Host == "" {
+		return fmt.Errorf("proxy_url must contain a host")
+	}
+	return nil
+}
+
+// unforwardableHeaders are the client headers that may not be forwarded upstream, because they carry
+// the router's own credentials or are managed by the HTTP client
+var unforwardableHeaders = map[string]struct{}{
+	"authorization":     {},
+	"x-api-key":         {},
+	"x-goog-api-key":    {},
+	"provider":          {},
+	"host":              {},
+	"content-length":    {},
+	"transfer-encoding": {},
+	"connection":        {},
+	"cookie":            {},
+}
+
+// expandModelEnv replaces ${VAR} references in the headers and query parameters with environment variables
+func expandModelEnv(model *models.Model) error {
+	for name, value := range model.Headers {
+		expanded, err := expandEnv(value)
+		if err != nil {
+			return fmt.Errorf("headers.%s: %w", name, err)
+		}
+		model.Headers[name] = expanded
+	}
+	for name, value := range model.QueryParams {
+		expanded, err := expandEnv(value)
+		if err != nil {
+			return fmt.Errorf("query_params.%s: %w", name, err)
+		}
+		model.QueryParams[name] = expanded
+	}
+	return nil
+}
+
+// envReferencePattern matches ${VAR} references
+var envReferencePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv expands ${VAR} references, failing on variables that are not set. A bare $ is kept as is.
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envReferencePattern.ReplaceAllStringFunc(value, func(reference string) string {
+		name := reference[2 : len(reference)-1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// redactedModelKeys are the model keys whose values may contain secrets and are hidden in error messages
+var redactedModelKeys = map[string]struct{}{
+	"provider_api_key": {},
+	"headers":          {},
+	"query_params":     {},
+	"proxy_url":        {},
+	"provider_options": {},
+}
+
+// describeModelNode renders a resolved model entry on a single line, hiding the provider API keys and options
+func describeModelNode(node *yaml.Node) string {
+	description := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Style: yaml.FlowStyle}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		value := node.Content[i+1]
+		if _, secret := redactedModelKeys[node.Content[i].Value]; secret {
+			value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "<redacted>"}
+		}
+		description.Content = append(description.Content, node.Content[i], value)
+	}
+
+	data, err := yaml.Marshal(description)
+	if err != nil {
+		return fmt.Sprintf("line %d", node.Line)
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -1,12 +1,92 @@
 package _const
 
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
 // ProviderType represents the type of AI provider
 type ProviderType uint
 
 const (
 	ProviderOpenAICompatibility ProviderType = 0
+	ProviderAnthropic           ProviderType = 1
+	ProviderGemini              ProviderType = 2
+	ProviderAzure               ProviderType = 3
+	ProviderOllama              ProviderType = 4
+	ProviderBedrock             ProviderType = 5
+	ProviderOpenAIResponses     ProviderType = 6
+	ProviderVertex              ProviderType = 7
+	ProviderMock                ProviderType = 8
 )
 
+// providerTypeNames maps each provider type to the name used in the configuration
+var providerTypeNames = map[ProviderType]string{
+	ProviderOpenAICompatibility: "openai-compatibility",
+	ProviderAnthropic:           "anthropic",
+	ProviderGemini:              "gemini",
+	ProviderAzure:               "azure",
+	ProviderOllama:              "ollama",
+	ProviderBedrock:             "bedrock",
+	ProviderOpenAIResponses:     "openai-responses",
+	ProviderVertex:              "vertex",
+	ProviderMock:                "mock",
+}
+
+// String returns the configuration name of the provider type
+func (t ProviderType) String() string {
+	if name, ok := providerTypeNames[t]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(t), 10)
+}
+
+// ParseProviderType returns the provider type with the given configuration name
+func ParseProviderType(name string) (ProviderType, error) {
+	for providerType, providerTypeName := range providerTypeNames {
+		if providerTypeName == name {
+			return providerType, nil
+		}
+	}
+	// Accept the numeric value as well
+	if value, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return ProviderType(value), nil
+	}
+	return 0, fmt.Errorf("unknown provider type %q", name)
+}
+
+// UnmarshalYAML decodes a provider type from its configuration name
+func (t *ProviderType) UnmarshalYAML(value *yaml.Node) error {
+	providerType, err := ParseProviderType(value.Value)
+	if err != nil {
+		return err
+	}
+	*t = providerType
+	return nil
+}
+
+// MarshalYAML encodes a provider type as its configuration name
+func (t ProviderType) MarshalYAML() (interface{}, error) {
+	return t.String(), nil
+}
+
+// UnmarshalText decodes a provider type from its configuration name
+func (t *ProviderType) UnmarshalText(text []byte) error {
+	providerType, err := ParseProviderType(string(text))
+	if err != nil {
+		return err
+	}
+	*t = providerType
+	return nil
+}
+
+// MarshalText encodes a provider type as its configuration name
+func (t ProviderType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
 var (
 	TagNoData       = []byte{58}
 	TagData         = []byte("data: ")
@@ -0,0 +1,435 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ErrFileNotFound is returned by a BatchStore when it has no file with the id
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrBatchNotFound is returned by a BatchStore when it has no batch with the id
+var ErrBatchNotFound = errors.New("batch not found")
+
+var (
+	// fileIDPattern matches the ids of files, which keeps ids from naming other files
+	fileIDPattern = regexp.MustCompile(`^file-[A-Za-z0-9_-]+$`)
+	// batchIDPattern matches the ids of batches
+	batchIDPattern = regexp.MustCompile(`^batch_[A-Za-z0-9_-]+$`)
+)
+
+// Batch statuses
+const (
+	// BatchValidating is the status of a batch whose input file is being validated
+	BatchValidating = "validating"
+	// BatchFailed is the status of a batch whose input file is invalid
+	BatchFailed = "failed"
+	// BatchInProgress is the status of a batch whose requests are being served
+	BatchInProgress = "in_progress"
+	// BatchFinalizing is the status of a batch whose result files are being prepared
+	BatchFinalizing = "finalizing"
+	// BatchCompleted is the status of a batch whose requests were all served
+	BatchCompleted = "completed"
+	// BatchExpired is the status of a batch that did not finish within its completion window
+	BatchExpired = "expired"
+	// BatchCancelling is the status of a batch that is being cancelled
+	BatchCancelling = "cancelling"
+	// BatchCancelled is the status of a cancelled batch
+	BatchCancelled = "cancelled"
+)
+
+// Batch result kinds
+const (
+	// BatchOutput are the results of the requests that succeeded
+	BatchOutput = "output"
+	// BatchErrors are the results of the requests that failed
+	BatchErrors = "errors"
+)
+
+// StoredFile is a file uploaded to or produced by the Batch API
+type StoredFile struct {
+	// ID is the file id
+	ID string `json:"id"`
+	// APIKeyID is the id of the API key that owns the file, only it may use the file
+	APIKeyID uint `json:"api_key_id"`
+	// Bytes is the size of the file
+	Bytes int64 `json:"bytes"`
+	// CreatedAt is the creation time as a Unix timestamp
+	CreatedAt int64 `json:"created_at"`
+	// Filename is the name of the file
+	Filename string `json:"filename"`
+	// Purpose is batch for input files, batch_output for result files
+	Purpose string `json:"purpose"`
+}
+
+// BatchError is an error of the input file of a batch
+type BatchError struct {
+	// Code is the error code
+	Code string `json:"code"`
+	// Message is the error message
+	Message string `json:"message"`
+	// Line is the line of the input file, starting at 1
+	Line int `json:"line,omitempty"`
+}
+
+// BatchRequestCounts are the request counts of a batch
+type BatchRequestCounts struct {
+	// Total is the number of requests of the input file
+	Total int `json:"total"`
+	// Completed is the number of requests that succeeded
+	Completed int `json:"completed"`
+	// Failed is the number of requests that failed
+	Failed int `json:"failed"`
+}
+
+// StoredBatch is a batch of the Batch API. The times are Unix timestamps, 0 when the batch has not reached them.
+type StoredBatch struct {
+	// ID is the batch id
+	ID string `json:"id"`
+	// APIKeyID is the id of the API key that created the batch, its requests are made with that key
+	APIKeyID uint `json:"api_key_id"`
+	// Endpoint is the endpoint of the requests, such as /v1/chat/completions
+	Endpoint string `json:"endpoint"`
+	// InputFileID is the id of the input file
+	InputFileID string `json:"input_file_id"`
+	// CompletionWindow is the time frame within which the batch should be processed
+	CompletionWindow string `json:"completion_window"`
+	// Status is the batch status
+	Status string `json:"status"`
+	// OutputFileID is the id of the file with the results of the requests that succeeded, set when the batch ends
+	OutputFileID string `json:"output_file_id"`
+	// ErrorFileID is the id of the file with the results of the requests that failed, set when the batch ends
+	ErrorFileID string `json:"error_file_id"`
+	// Errors are the errors of the input file
+	Errors []BatchError `json:"errors"`
+	// CreatedAt is the creation time
+	CreatedAt int64 `json:"created_at"`
+	// InProgressAt is the time the batch started processing
+	InProgressAt int64 `json:"in_progress_at"`
+	// ExpiresAt is the end of the completion window
+	ExpiresAt int64 `json:"expires_at"`
+	// FinalizingAt is the time the batch started finalizing
+	FinalizingAt int64 `json:"finalizing_at"`
+	// CompletedAt is the time the batch completed
+	CompletedAt int64 `json:"completed_at"`
+	// FailedAt is the time the batch failed
+	FailedAt int64 `json:"failed_at"`
+	// ExpiredAt is the time the batch expired
+	ExpiredAt int64 `json:"expired_at"`
+	// CancellingAt is the time the batch started cancelling
+	CancellingAt int64 `json:"cancelling_at"`
+	// CancelledAt is the time the batch was cancelled
+	CancelledAt int64 `json:"cancelled_at"`
+	// RequestCounts are the request counts
+	RequestCounts BatchRequestCounts `json:"request_counts"`
+	// Metadata are the key-value pairs set by the client
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Active reports whether the batch has not ended yet
+func (b *StoredBatch) Active() bool {
+	switch b.Status {
+	case BatchValidating, BatchInProgress, BatchFinalizing, BatchCancelling:
+		return true
+	}
+	return false
+}
+
+// BatchStore keeps the files and the batches of the Batch API in a directory, so that they survive restarts.
+// The results of a batch are appended to a results file of the batch as they come in, and become files when
+// the batch ends.
+type BatchStore struct {
+	// dir is the directory of the store
+	dir string
+}
+
+// NewBatchStore creates a batch store in the directory, creating it if needed
+func NewBatchStore(dir string) (*BatchStore, error) {
+	for _, sub := range []string{"files", "batches"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create batch store directory: %w", err)
+		}
+	}
+	return &BatchStore{dir: dir}, nil
+}
+
+// CreateFile writes the content of a new file and its metadata, setting its size
+func (s *BatchStore) CreateFile(file *StoredFile, content io.Reader) error {
+	if !fileIDPattern.MatchString(file.ID) {
+		return fmt.Errorf("invalid file id %q", file.ID)
+	}
+	temp, err := os.CreateTemp(filepath.Join(s.dir, "files"), file.ID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write file %s: %w", file.ID, err)
+	}
+	file.Bytes, err = io.Copy(temp, content)
+	if errClose := temp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), s.fileContentPath(file.ID))
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		return fmt.Errorf("failed to write file %s: %w", file.ID, err)
+	}
+	return writeJSONFile(s.fileMetaPath(file.ID), file)
+}
+
+// PutFile writes the metadata of a file, replacing the metadata with the same id
+func (s *BatchStore) PutFile(file *StoredFile) error {
+	if !fileIDPattern.MatchString(file.ID) {
+		return fmt.Errorf("invalid file id %q", file.ID)
+	}
+	return writeJSONFile(s.fileMetaPath(file.ID), file)
+}
+
+// GetFile returns the metadata of the file with the id
+func (s *BatchStore) GetFile(id string) (*StoredFile, error) {
+	if !fileIDPattern.MatchString(id) {
+		return nil, ErrFileNotFound
+	}
+	file := &StoredFile{}
+	if err := readJSONFile(s.fileMetaPath(id), file); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFileNotFound
+		}
+		return nil, fmt.Errorf("failed to read file %s: %w", id, err)
+	}
+	return file, nil
+}
+
+// ListFiles returns the metadata of all files, the newest first
+func (s *BatchStore) ListFiles() ([]*StoredFile, error) {
+	files := make([]*StoredFile, 0)
+	err := s.readDir("files", func(id string) error {
+		file, err := s.GetFile(id)
+		if err == nil {
+			files = append(files, file)
+		}
+		return err
+	})
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].CreatedAt > files[j].CreatedAt
+	})
+	return files, err
+}
+
+// OpenFile opens the content of the file with the id
+func (s *BatchStore) OpenFile(id string) (*os.File, error) {
+	if !fileIDPattern.MatchString(id) {
+		return nil, ErrFileNotFound
+	}
+	content, err := os.Open(s.fileContentPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrFileNotFound
+	}
+	return content, err
+}
+
+// DeleteFile deletes the file with the id
+func (s *BatchStore) DeleteFile(id string) error {
+	if !fileIDPattern.MatchString(id) {
+		return ErrFileNotFound
+	}
+	err := os.Remove(s.fileMetaPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete file %s: %w", id, err)
+	}
+	if err = os.Remove(s.fileContentPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete file %s: %w", id, err)
+	}
+	return nil
+}
+
+// GetBatch returns the batch with the id
+func (s *BatchStore) GetBatch(id string) (*StoredBatch, error) {
+	if !batchIDPattern.MatchString(id) {
+		return nil, ErrBatchNotFound
+	}
+	batch := &StoredBatch{}
+	if err := readJSONFile(s.batchPath(id, ".json"), batch); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrBatchNotFound
+		}
+		return nil, fmt.Errorf("failed to read batch %s: %w", id, err)
+	}
+	return batch, nil
+}
+
+// PutBatch writes a batch, replacing the batch with the same id
+func (s *BatchStore) PutBatch(batch *StoredBatch) error {
+	if !batchIDPattern.MatchString(batch.ID) {
+		return fmt.Errorf("invalid batch id %q", batch.ID)
+	}
+	return writeJSONFile(s.batchPath(batch.ID, ".json"), batch)
+}
+
+// ListBatches returns all batches, the newest first
+func (s *BatchStore) ListBatches() ([]*StoredBatch, error) {
+	batches := make([]*StoredBatch, 0)
+	err := s.readDir("batches", func(id string) error {
+		batch, err := s.GetBatch(id)
+		if err == nil {
+			batches = append(batches, batch)
+		}
+		return err
+	})
+	sort.SliceStable(batches, func(i, j int) bool {
+		return batches[i].CreatedAt > batches[j].CreatedAt
+	})
+	return batches, err
+}
+
+// AppendBatchResult appends a result line to the output or errors results of a batch
+func (s *BatchStore) AppendBatchResult(id string, kind string, line []byte) error {
+	results, err := os.OpenFile(s.batchPath(id, "."+kind+".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write results of batch %s: %w", id, err)
+	}
+	// The line is written at once, so that a crash leaves at most one partial line
+	_, err = results.Write(append(bytes.TrimSpace(line), '\n'))
+	if errClose := results.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write results of batch %s: %w", id, err)
+	}
+	return nil
+}
+
+// BatchResultIDs returns the custom ids of the output or errors results of a batch. A partial last line, left
+// by a crash, is removed, so that its request is made again.
+func (s *BatchStore) BatchResultIDs(id string, kind string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	path := s.batchPath(id, "."+kind+".jsonl")
+	results, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if errors.Is(err, os.ErrNotExist) {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results of batch %s: %w", id, err)
+	}
+	defer func() {
+		_ = results.Close()
+	}()
+
+	reader := bufio.NewReader(results)
+	var complete int64
+	for {
+		line, errRead := reader.ReadBytes('\n')
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			return nil, fmt.Errorf("failed to read results of batch %s: %w", id, errRead)
+		}
+		complete += int64(len(line))
+		var result struct {
+			CustomID string `json:"custom_id"`
+		}
+		if json.Unmarshal(line, &result) == nil {
+			ids[result.CustomID] = true
+		}
+	}
+	if err = results.Truncate(complete); err != nil {
+		return nil, fmt.Errorf("failed to repair results of batch %s: %w", id, err)
+	}
+	return ids, nil
+}
+
+// PublishBatchResults turns the output or errors results of a batch into the file, setting its size.
+// It reports false if the batch has no such results.
+func (s *BatchStore) PublishBatchResults(id string, kind string, file *StoredFile) (bool, error) {
+	if !fileIDPattern.MatchString(file.ID) {
+		return false, fmt.Errorf("invalid file id %q", file.ID)
+	}
+	info, err := os.Stat(s.batchPath(id, "."+kind+".jsonl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to publish results of batch %s: %w", id, err)
+	}
+	file.Bytes = info.Size()
+	if err = os.Rename(s.batchPath(id, "."+kind+".jsonl"), s.fileContentPath(file.ID)); err != nil {
+		return false, fmt.Errorf("failed to publish results of batch %s: %w", id, err)
+	}
+	return true, writeJSONFile(s.fileMetaPath(file.ID), file)
+}
+
+// readDir calls read with the id of each JSON metadata file of a sub directory
+func (s *BatchStore) readDir(sub string, read func(id string) error) error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, sub))
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", sub, err)
+	}
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			if err = read(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fileMetaPath returns the path of the metadata of the file with the id
+func (s *BatchStore) fileMetaPath(id string) string {
+	return filepath.Join(s.dir, "files", id+".json")
+}
+
+// fileContentPath returns the path of the content of the file with the id
+func (s *BatchStore) fileContentPath(id string) string {
+	return filepath.Join(s.dir, "files", id+".jsonl")
+}
+
+// batchPath returns the path of a file of the batch with the id, by its suffix
+func (s *BatchStore) batchPath(id string, suffix string) string {
+	return filepath.Join(s.dir, "batches", id+suffix)
+}
+
+// readJSONFile decodes a JSON file into value
+func readJSONFile(path string, value any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// writeJSONFile writes value as JSON, through a temporary file so that a crash does not leave a partial file
+func writeJSONFile(path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", filepath.Base(path), err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	_, err = file.Write(data)
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
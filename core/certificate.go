@@ -0,0 +1,100 @@
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is the minimum time between two checks of the certificate files
+const certificateCheckInterval = 5 * time.Second
+
+// CertificateReloader serves a TLS certificate and reloads it when its files change on disk
+type CertificateReloader struct {
+	// certFile is the path to the certificate chain
+	certFile string
+	// keyFile is the path to the private key
+	keyFile string
+
+	// mutex protects the fields below
+	mutex sync.Mutex
+	// certificate is the currently served certificate
+	certificate *tls.Certificate
+	// certModTime is the modification time of the loaded certificate file
+	certModTime time.Time
+	// keyModTime is the modification time of the loaded key file
+	keyModTime time.Time
+	// lastCheck is the time the files were last checked
+	lastCheck time.Time
+}
+
+// NewCertificateReloader loads the certificate and returns a reloader for it
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate returns the current certificate, it is meant to be used as tls.Config.GetCertificate
+func (r *CertificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Check the files at most once per interval
+	if time.Since(r.lastCheck) >= certificateCheckInterval {
+		r.lastCheck = time.Now()
+		if r.changed() {
+			// Keep serving the previous certificate if the new one cannot be loaded
+			if err := r.reload(); err != nil {
+				log.Printf("Failed to reload TLS certificate: %v", err)
+			} else {
+				log.Printf("Reloaded TLS certificate from %s", r.certFile)
+			}
+		}
+	}
+
+	return r.certificate, nil
+}
+
+// changed reports whether the certificate or key file was modified since it was loaded
+func (r *CertificateReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+// reload reads the certificate and key files
+func (r *CertificateReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat certificate file: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat key file: %w", err)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	r.certificate = &certificate
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return nil
+}
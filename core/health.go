@@ -0,0 +1,84 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry health statuses
+const (
+	// HealthUnknown is the status of an entry that has not served a request yet
+	HealthUnknown = "unknown"
+	// HealthHealthy is the status of an entry whose last request succeeded
+	HealthHealthy = "healthy"
+	// HealthFailing is the status of an entry whose last request failed
+	HealthFailing = "failing"
+)
+
+// EntryHealth is the health of a model entry, judged by the outcome of its recent requests
+type EntryHealth struct {
+	// Status is HealthUnknown, HealthHealthy or HealthFailing
+	Status string
+	// ConsecutiveFailures is the number of failed requests since the last success
+	ConsecutiveFailures int
+	// LastSuccess is the time of the last successful request
+	LastSuccess time.Time
+	// LastFailure is the time of the last failed request
+	LastFailure time.Time
+}
+
+// HealthTracker tracks the health of the model entries. The outcomes are kept in memory.
+type HealthTracker struct {
+	// mutex protects entries
+	mutex sync.RWMutex
+	// entries are the entry healths by scope
+	entries map[string]*EntryHealth
+}
+
+// NewHealthTracker creates a new health tracker
+func NewHealthTracker() *HealthTracker {
+	return &HealthTracker{
+		entries: make(map[string]*EntryHealth),
+	}
+}
+
+// RecordSuccess records a successful request of the entry
+func (t *HealthTracker) RecordSuccess(scope string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entry := t.entry(scope)
+	entry.Status = HealthHealthy
+	entry.ConsecutiveFailures = 0
+	entry.LastSuccess = time.Now()
+}
+
+// RecordFailure records a failed request of the entry
+func (t *HealthTracker) RecordFailure(scope string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entry := t.entry(scope)
+	entry.Status = HealthFailing
+	entry.ConsecutiveFailures++
+	entry.LastFailure = time.Now()
+}
+
+// Health returns the health of the entry
+func (t *HealthTracker) Health(scope string) EntryHealth {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	entry, ok := t.entries[scope]
+	if !ok {
+		return EntryHealth{Status: HealthUnknown}
+	}
+	return *entry
+}
+
+// entry returns the health of a scope, creating it if needed, the mutex must be held
+func (t *HealthTracker) entry(scope string) *EntryHealth {
+	entry, ok := t.entries[scope]
+	if !ok {
+		entry = &EntryHealth{Status: HealthUnknown}
+		t.entries[scope] = entry
+	}
+	return entry
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/luispater/mini-router/models"
+)
+
+// quotaWindow is a fixed rate limit window
+type quotaWindow struct {
+	// name is the window name used in error messages
+	name string
+	// duration is the window length
+	duration time.Duration
+}
+
+// quotaWindows are the rate limit windows, from second to day
+var quotaWindows = [4]quotaWindow{
+	{name: "second", duration: time.Second},
+	{name: "minute", duration: time.Minute},
+	{name: "hour", duration: time.Hour},
+	{name: "day", duration: 24 * time.Hour},
+}
+
+// QuotaLimits are the request and token limits per second, minute, hour and day, 0 means no limit
+type QuotaLimits struct {
+	// Requests are the request limits
+	Requests [4]int
+	// Tokens are the token limits
+	Tokens [4]int
+}
+
+// APIKeyQuotaLimits returns the limits of a client API key
+func APIKeyQuotaLimits(apiKey models.APIKey) QuotaLimits {
+	return QuotaLimits{
+		Requests: [4]int{apiKey.RPS, apiKey.RPM, apiKey.RPH, apiKey.RPD},
+		Tokens:   [4]int{apiKey.TPS, apiKey.TPM, apiKey.TPH, apiKey.TPD},
+	}
+}
+
+// ModelQuotaLimits returns the limits of a model entry
+func ModelQuotaLimits(model models.Model) QuotaLimits {
+	return QuotaLimits{
+		Requests: [4]int{0, model.RPM, model.RPH, model.RPD},
+		Tokens:   [4]int{0, model.TPM, model.TPH, model.TPD},
+	}
+}
+
+// Share returns the part of the limits that traffic of a lower priority may use, at least 1 where a limit is set.
+// The counters are shared, so that such traffic stops at its share while other traffic can use the rest.
+func (l QuotaLimits) Share(share float64) QuotaLimits {
+	scale := func(limit int) int {
+		if limit <= 0 {
+			return limit
+		}
+		return max(int(float64(limit)*share), 1)
+	}
+	shared := QuotaLimits{}
+	for i := range quotaWindows {
+		shared.Requests[i] = scale(l.Requests[i])
+		shared.Tokens[i] = scale(l.Tokens[i])
+	}
+	return shared
+}
+
+// QuotaExceededError is returned when a request would exceed a limit
+type QuotaExceededError struct {
+	// Scope names what the limit belongs to, such as an API key or a model entry
+	Scope string
+	// Limit is the exceeded limit
+	Limit int
+	// Unit is requests or tokens
+	Unit string
+	// Window is the window name
+	Window string
+	// RetryAfter is the time until the window ends
+	RetryAfter time.Duration
+}
+
+// Error returns the error message
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s exceeded its limit of %d %s per %s", e.Scope, e.Limit, e.Unit, e.Window)
+}
+
+// quotaCounter counts the requests and tokens of a scope in the current windows
+type quotaCounter struct {
+	// starts are the start times of the current windows
+	starts [4]time.Time
+	// requests are the request counts of the current windows
+	requests [4]int
+	// tokens are the token counts of the current windows
+	tokens [4]int
+}
+
+// roll starts new windows for the windows that have ended
+func (c *quotaCounter) roll(now time.Time) {
+	for i, window := range quotaWindows {
+		start := now.Truncate(window.duration)
+		if !c.starts[i].Equal(start) {
+			c.starts[i] = start
+			c.requests[i] = 0
+			c.tokens[i] = 0
+		}
+	}
+}
+
+// QuotaManager enforces request and token limits in fixed windows. The counters are kept in memory.
+type QuotaManager struct {
+	// mutex protects counters
+	mutex sync.Mutex
+	// counters are the counters by scope
+	counters map[string]*quotaCounter
+}
+
+// NewQuotaManager creates a new quota manager
+func NewQuotaManager() *QuotaManager {
+	return &QuotaManager{
+		counters: make(map[string]*quotaCounter),
+	}
+}
+
+// counter returns the counter of a scope with its windows rolled to now, the mutex must be held
+func (m *QuotaManager) counter(scope string, now time.Time) *quotaCounter {
+	counter, ok := m.counters[scope]
+	if !ok {
+		counter = &quotaCounter{}
+		m.counters[scope] = counter
+	}
+	counter.roll(now)
+	return counter
+}
+
+// Reserve counts a request of the scope, or returns a QuotaExceededError if a request limit is reached
+// or a token limit has been used up in the current window
+func (m *QuotaManager) Reserve(scope string, limits QuotaLimits) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	counter := m.counter(scope, now)
+	for i, window := range quotaWindows {
+		retryAfter := counter.starts[i].Add(window.duration).Sub(now)
+		if limit := limits.Requests[i]; limit > 0 && counter.requests[i] >= limit {
+			return &QuotaExceededError{Scope: scope, Limit: limit, Unit: "requests", Window: window.name, RetryAfter: retryAfter}
+		}
+		if limit := limits.Tokens[i]; limit > 0 && counter.tokens[i] >= limit {
+			return &QuotaExceededError{Scope: scope, Limit: limit, Unit: "tokens", Window: window.name, RetryAfter: retryAfter}
+		}
+	}
+	for i := range quotaWindows {
+		counter.requests[i]++
+	}
+	return nil
+}
+
+// AddTokens counts the tokens used by a request of the scope
+func (m *QuotaManager) AddTokens(scope string, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counter := m.counter(scope, time.Now())
+	for i := range quotaWindows {
+		counter.tokens[i] += tokens
+	}
+}
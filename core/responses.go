@@ -0,0 +1,216 @@
+package core
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ErrResponseNotFound is returned by a ResponseStore when it has no response with the id
+var ErrResponseNotFound = errors.New("response not found")
+
+// responseIDPattern matches the ids that may be stored, which keeps ids from naming other files
+var responseIDPattern = regexp.MustCompile(`^resp_[A-Za-z0-9_-]+$`)
+
+// StoredResponse is a response of the Responses API with the conversation that led to it
+type StoredResponse struct {
+	// ID is the response id
+	ID string `json:"id"`
+	// APIKeyID is the id of the API key that created the response, only it may read the response
+	APIKeyID uint `json:"api_key_id"`
+	// Input are the input items of the conversation up to the response, without the instructions
+	Input json.RawMessage `json:"input"`
+	// Response is the response object
+	Response json.RawMessage `json:"response"`
+}
+
+// ResponseStore stores the responses of the Responses API, so that previous_response_id can continue a conversation
+type ResponseStore interface {
+	// Get returns the response with the id, ErrResponseNotFound if there is none
+	Get(id string) (*StoredResponse, error)
+	// Put stores a response, replacing the response with the same id
+	Put(response *StoredResponse) error
+	// Delete deletes the response with the id, ErrResponseNotFound if there is none
+	Delete(id string) error
+}
+
+// DefaultResponseStoreMaxEntries is the number of responses a MemoryResponseStore keeps when no limit is set
+const DefaultResponseStoreMaxEntries = 10000
+
+// DefaultResponseStoreTTL is the time a MemoryResponseStore keeps a response when no time is set
+const DefaultResponseStoreTTL = 24 * time.Hour
+
+// MemoryResponseStore keeps the responses in memory, they are lost on restart. It keeps at most maxEntries
+// responses for ttl each, the oldest responses are dropped first.
+type MemoryResponseStore struct {
+	// mutex guards responses and order
+	mutex sync.Mutex
+	// responses maps the ids to the elements of order
+	responses map[string]*list.Element
+	// order holds the *memoryResponse of the responses, the oldest first
+	order *list.List
+	// maxEntries is the maximum number of responses
+	maxEntries int
+	// ttl is the time a response is kept
+	ttl time.Duration
+}
+
+// memoryResponse is a response of a MemoryResponseStore with the time it was stored
+type memoryResponse struct {
+	// response is the stored response
+	response *StoredResponse
+	// storedAt is the time the response was stored
+	storedAt time.Time
+}
+
+// NewMemoryResponseStore creates an empty in-memory response store that keeps at most maxEntries responses for
+// ttl each, 0 means DefaultResponseStoreMaxEntries and DefaultResponseStoreTTL
+func NewMemoryResponseStore(maxEntries int, ttl time.Duration) *MemoryResponseStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultResponseStoreMaxEntries
+	}
+	if ttl <= 0 {
+		ttl = DefaultResponseStoreTTL
+	}
+	return &MemoryResponseStore{responses: make(map[string]*list.Element), order: list.New(), maxEntries: maxEntries, ttl: ttl}
+}
+
+// Get returns the response with the id, an expired response is not found
+func (s *MemoryResponseStore) Get(id string) (*StoredResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropExpired(time.Now())
+	element, ok := s.responses[id]
+	if !ok {
+		return nil, ErrResponseNotFound
+	}
+	return element.Value.(*memoryResponse).response, nil
+}
+
+// Put stores a response as the newest, dropping the expired responses and the oldest ones over the limit
+func (s *MemoryResponseStore) Put(response *StoredResponse) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if element, ok := s.responses[response.ID]; ok {
+		s.order.Remove(element)
+	}
+	s.responses[response.ID] = s.order.PushBack(&memoryResponse{response: response, storedAt: now})
+	s.dropExpired(now)
+	for s.order.Len() > s.maxEntries {
+		s.remove(s.order.Front())
+	}
+	return nil
+}
+
+// Delete deletes the response with the id
+func (s *MemoryResponseStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropExpired(time.Now())
+	element, ok := s.responses[id]
+	if !ok {
+		return ErrResponseNotFound
+	}
+	s.remove(element)
+	return nil
+}
+
+// dropExpired removes the responses stored more than ttl before now, the caller holds the mutex
+func (s *MemoryResponseStore) dropExpired(now time.Time) {
+	for element := s.order.Front(); element != nil && now.Sub(element.Value.(*memoryResponse).storedAt) >= s.ttl; element = s.order.Front() {
+		s.remove(element)
+	}
+}
+
+// remove removes a response, the caller holds the mutex
+func (s *MemoryResponseStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.responses, element.Value.(*memoryResponse).response.ID)
+}
+
+// FileResponseStore keeps each response in a JSON file of a directory, so that they survive restarts
+type FileResponseStore struct {
+	// dir is the directory of the response files
+	dir string
+}
+
+// NewFileResponseStore creates a response store in the directory, creating it if needed
+func NewFileResponseStore(dir string) (*FileResponseStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create response store directory: %w", err)
+	}
+	return &FileResponseStore{dir: dir}, nil
+}
+
+// Get reads the response with the id
+func (s *FileResponseStore) Get(id string) (*StoredResponse, error) {
+	if !responseIDPattern.MatchString(id) {
+		return nil, ErrResponseNotFound
+	}
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrResponseNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response %s: %w", id, err)
+	}
+	response := &StoredResponse{}
+	if err = json.Unmarshal(data, response); err != nil {
+		return nil, fmt.Errorf("failed to decode response %s: %w", id, err)
+	}
+	return response, nil
+}
+
+// Put writes a response, through a temporary file so that a crash does not leave a partial file
+func (s *FileResponseStore) Put(response *StoredResponse) error {
+	if !responseIDPattern.MatchString(response.ID) {
+		return fmt.Errorf("invalid response id %q", response.ID)
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to encode response %s: %w", response.ID, err)
+	}
+	file, err := os.CreateTemp(s.dir, response.ID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write response %s: %w", response.ID, err)
+	}
+	_, err = file.Write(data)
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path(response.ID))
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return fmt.Errorf("failed to write response %s: %w", response.ID, err)
+	}
+	return nil
+}
+
+// Delete removes the file of the response with the id
+func (s *FileResponseStore) Delete(id string) error {
+	if !responseIDPattern.MatchString(id) {
+		return ErrResponseNotFound
+	}
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrResponseNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete response %s: %w", id, err)
+	}
+	return nil
+}
+
+// path returns the file path of the response with the id
+func (s *FileResponseStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/luispater/mini-router/models"
+)
+
+// UsageRecord is the metered usage of a request served by a model entry
+type UsageRecord struct {
+	// Time is when the request finished
+	Time time.Time `json:"time"`
+	// APIKeyID is the id of the client API key
+	APIKeyID uint `json:"api_key_id"`
+	// APIKeyName is the name of the client API key
+	APIKeyName string `json:"api_key_name"`
+	// Endpoint is the route that was called, such as /v1/embeddings
+	Endpoint string `json:"endpoint"`
+	// Model is the requested model name
+	Model string `json:"model"`
+	// EntryID is the id of the model entry that served the request
+	EntryID uint `json:"entry_id"`
+	// ProviderType is the provider type of the entry
+	ProviderType string `json:"provider_type"`
+	// PromptTokens is the number of prompt or input tokens
+	PromptTokens int `json:"prompt_tokens"`
+	// CompletionTokens is the number of completion tokens
+	CompletionTokens int `json:"completion_tokens"`
+	// TotalTokens is the total number of tokens
+	TotalTokens int `json:"total_tokens"`
+	// CachedTokens is the number of cached prompt tokens
+	CachedTokens int `json:"cached_tokens"`
+	// ReasoningTokens is the number of reasoning tokens
+	ReasoningTokens int `json:"reasoning_tokens"`
+	// Images is the number of generated images
+	Images int `json:"images,omitempty"`
+	// AudioSeconds is the duration of the transcribed or translated audio
+	AudioSeconds float64 `json:"audio_seconds,omitempty"`
+	// Characters is the number of characters synthesized into speech
+	Characters int `json:"characters,omitempty"`
+	// Cost is the cost in USD from the entry's prices
+	Cost float64 `json:"cost"`
+}
+
+// UsageCost returns the cost of the metered usage of a record at the model entry's prices
+func UsageCost(model models.Model, record UsageRecord) float64 {
+	cost := float64(record.PromptTokens)*model.InputPricePerToken + float64(record.CompletionTokens)*model.OutputPricePerToken
+	cost += float64(record.Images) * model.PricePerImage
+	cost += record.AudioSeconds * model.PricePerAudioSecond
+	cost += float64(record.Characters) * model.PricePerCharacter
+	return cost
+}
+
+// UsageRecorder appends usage records as JSON lines to a file
+type UsageRecorder struct {
+	// mutex serializes the writes
+	mutex sync.Mutex
+	// file is the usage log file
+	file *os.File
+}
+
+// NewUsageRecorder opens the usage log file for appending, creating it if needed
+func NewUsageRecorder(path string) (*UsageRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage log: %w", err)
+	}
+	return &UsageRecorder{file: file}, nil
+}
+
+// Record writes a usage record, a nil recorder discards it
+func (r *UsageRecorder) Record(record UsageRecord) {
+	if r == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to encode usage record: %v", err)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, err = r.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write usage record: %v", err)
+	}
+}
+
+// Close closes the usage log file
+func (r *UsageRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
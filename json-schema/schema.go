@@ -4,3 +4,30 @@ import _ "embed"
 
 //go:embed chat-completions.json
 var ChatCompletionsSchema []byte
+
+//go:embed completions.json
+var CompletionsSchema []byte
+
+//go:embed embeddings.json
+var EmbeddingsSchema []byte
+
+//go:embed images-generations.json
+var ImagesGenerationsSchema []byte
+
+//go:embed speech.json
+var SpeechSchema []byte
+
+//go:embed messages.json
+var MessagesSchema []byte
+
+//go:embed responses.json
+var ResponsesSchema []byte
+
+//go:embed gemini.json
+var GeminiSchema []byte
+
+//go:embed moderations.json
+var ModerationsSchema []byte
+
+//go:embed batches.json
+var BatchesSchema []byte
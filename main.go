@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/gin-gonic/gin"
 	"github.com/luispater/mini-router/config"
+	"github.com/luispater/mini-router/core"
 	"github.com/luispater/mini-router/provider"
 	"github.com/luispater/mini-router/router"
 )
@@ -20,40 +24,72 @@ const (
 
 // / main function is the entry point of the application.
 func main() {
-	// gin.SetMode(gin.ReleaseMode)
-
 	// Set the log format, including standard flags and short file names.
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	// Print startup information.
 	log.Println("Starting AI Router...")
 
-	// Load the configuration file.
-	cfg, err := config.LoadConfig(configFile)
+	// Load the configuration file, checking every model entry against the provider registry.
+	cfg, err := config.LoadConfig(configFile, provider.ValidateModel)
 	// If loading the configuration fails, log the error and exit.
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Set the gin mode if configured.
+	if cfg.Server.GinMode != "" {
+		gin.SetMode(cfg.Server.GinMode)
+	}
+
 	// Register providers.
 	providerRegistry := provider.ProviderRegistry
 
 	// Create a Gin router.
-	r := router.SetupRouter(cfg, providerRegistry)
+	r, err := router.SetupRouter(cfg, providerRegistry)
+	// If creating the router fails, log the error and exit.
+	if err != nil {
+		log.Fatalf("Failed to set up router: %v", err)
+	}
 
 	// Create an HTTP server.
 	server := &http.Server{
 		// Set the server's listening address.
-		Addr: ":" + cfg.Server.Port,
+		Addr: net.JoinHostPort(cfg.Server.Host, cfg.Server.Port),
 		// Set the server's handler.
 		Handler: r,
+		// Set the time allowed to read request headers.
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		// Set the keep-alive idle timeout.
+		IdleTimeout: cfg.Server.IdleTimeout,
+		// Set the maximum size of the request headers.
+		MaxHeaderBytes: cfg.Server.MaxHeaderBytes,
+	}
+
+	// If TLS is configured, serve the certificate through a reloader so that renewed certificates are picked up.
+	if cfg.Server.TLS.Enabled() {
+		reloader, errReloader := core.NewCertificateReloader(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+		if errReloader != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", errReloader)
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
 	}
 
 	// Start the server in a goroutine
 	go func() {
-		// Print information about the server listening port.
-		log.Printf("Server listening on port %s", cfg.Server.Port)
+		// Print information about the server listening address.
+		log.Printf("Server listening on %s (TLS: %t)", server.Addr, cfg.Server.TLS.Enabled())
 		// Start the server and listen. If an error occurs and it is not a server closed error, log the error and exit.
-		if errListenAndServe := server.ListenAndServe(); errListenAndServe != nil && !errors.Is(errListenAndServe, http.ErrServerClosed) {
+		var errListenAndServe error
+		if cfg.Server.TLS.Enabled() {
+			// The certificate is provided by TLSConfig.GetCertificate.
+			errListenAndServe = server.ListenAndServeTLS("", "")
+		} else {
+			errListenAndServe = server.ListenAndServe()
+		}
+		if errListenAndServe != nil && !errors.Is(errListenAndServe, http.ErrServerClosed) {
 			log.Fatalf("Failed to start server: %v", errListenAndServe)
 		}
 	}()
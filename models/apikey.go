@@ -1,6 +1,7 @@
 package models
 
 import (
+	"path"
 	"time"
 )
 
@@ -16,6 +17,10 @@ type APIKey struct {
 	ExpiresAt time.Time `json:"expires_at" yaml:"expires_at"`
 	// IsActive indicates whether the key is active
 	IsActive bool `json:"is_active" yaml:"is_active"`
+	// AllowedModels are the names of the models the key may use, as path.Match patterns such as "gpt-*", empty allows all models
+	AllowedModels []string `json:"allowed_models" yaml:"allowed_models"`
+	// Moderation is the policy that moderates the prompts of the key's chat requests, it takes precedence over the model's
+	Moderation ModerationPolicy `json:"moderation" yaml:"moderation"`
 
 	// RPS is the requests per second, if 0, use the model's default value
 	RPS int `json:"rps" yaml:"rps"`
@@ -34,3 +39,16 @@ type APIKey struct {
 	// TPD is the tokens per day, if 0, use the model's default value
 	TPD int `json:"tpd" yaml:"tpd"`
 }
+
+// AllowsModel reports whether the key may use the model
+func (k APIKey) AllowsModel(modelName string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, pattern := range k.AllowedModels {
+		if matched, _ := path.Match(pattern, modelName); matched {
+			return true
+		}
+	}
+	return false
+}
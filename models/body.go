@@ -0,0 +1,17 @@
+package models
+
+// BodyPatch is a JSON object merged into a request body, nested objects are merged key by key
+type BodyPatch map[string]interface{}
+
+// BodyRule is a request body rewrite that applies when all conditions of When match
+type BodyRule struct {
+	// When maps request body paths to the value they must have, a list matches any of its values.
+	// An empty When always matches.
+	When map[string]interface{} `json:"when" yaml:"when"`
+	// Defaults are set where the request body does not have a value
+	Defaults BodyPatch `json:"defaults" yaml:"defaults"`
+	// Overrides are always set
+	Overrides BodyPatch `json:"overrides" yaml:"overrides"`
+	// Remove lists the request body paths that are deleted
+	Remove []string `json:"remove" yaml:"remove"`
+}
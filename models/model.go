@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	_const "github.com/luispater/mini-router/const"
 )
 
 // Model represents an AI model from a provider
@@ -21,14 +23,18 @@ type Model struct {
 	DisplayName string `json:"display_name" yaml:"display_name"`
 	// Description is the description
 	Description string `json:"description" yaml:"description"`
+	// Extends is the name of the template this entry inherits its unset fields from
+	Extends string `json:"extends" yaml:"extends"`
 
 	// Model capabilities
 	// SupportsChat indicates whether chat is supported
 	SupportsChat bool `json:"supports_chat" yaml:"supports_chat"`
-	// SupportsCompletion indicates whether completion is supported
+	// SupportsCompletion indicates whether the provider serves legacy text completions, otherwise they are sent as chat completions
 	SupportsCompletion bool `json:"supports_completion" yaml:"supports_completion"`
 	// SupportsEmbedding indicates whether embedding is supported
 	SupportsEmbedding bool `json:"supports_embedding" yaml:"supports_embedding"`
+	// EmbeddingBatchSize is the maximum number of inputs per upstream embeddings request, 0 means no limit
+	EmbeddingBatchSize int `json:"embedding_batch_size" yaml:"embedding_batch_size"`
 	// SupportsInputImage indicates whether image input is supported
 	SupportsInputImage bool `json:"supports_input_image" yaml:"supports_input_image"`
 	// SupportsImageGen indicates whether image generation is supported
@@ -41,6 +47,14 @@ type Model struct {
 	SupportsAudioTrans bool `json:"supports_audio_trans" yaml:"supports_audio_trans"`
 	// SupportsAudioTrans2 indicates whether audio translation is supported
 	SupportsAudioTrans2 bool `json:"supports_audio_trans2" yaml:"supports_audio_trans2"`
+	// SupportsSpeech indicates whether text-to-speech is supported
+	SupportsSpeech bool `json:"supports_speech" yaml:"supports_speech"`
+	// SpeechVoices maps the voice names of speech requests to the voices of this entry, other voices are sent as they are
+	SpeechVoices map[string]string `json:"speech_voices" yaml:"speech_voices"`
+	// SupportsModeration indicates whether moderation is supported
+	SupportsModeration bool `json:"supports_moderation" yaml:"supports_moderation"`
+	// Moderation is the policy that moderates the prompts of the chat requests to this entry's model
+	Moderation ModerationPolicy `json:"moderation" yaml:"moderation"`
 
 	SupportGoogleThinking bool `json:"support_google_thinking" yaml:"support_google_thinking"`
 
@@ -69,8 +83,18 @@ type Model struct {
 	InputPricePerToken float64 `json:"input_price_per_token" yaml:"input_price_per_token"`
 	// OutputPricePerToken is the price per output token (in USD)
 	OutputPricePerToken float64 `json:"output_price_per_token" yaml:"output_price_per_token"`
+	// PricePerImage is the price per generated, edited or varied image (in USD)
+	PricePerImage float64 `json:"price_per_image" yaml:"price_per_image"`
+	// PricePerAudioSecond is the price per second of transcribed or translated audio (in USD)
+	PricePerAudioSecond float64 `json:"price_per_audio_second" yaml:"price_per_audio_second"`
+	// PricePerCharacter is the price per character synthesized into speech (in USD)
+	PricePerCharacter float64 `json:"price_per_character" yaml:"price_per_character"`
 
 	// Relationships
+	// ProviderType selects the provider implementation used for this entry
+	ProviderType _const.ProviderType `json:"provider_type" yaml:"provider_type"`
+	// ProviderOptions are the provider specific settings for this entry
+	ProviderOptions ProviderOptions `json:"provider_options" yaml:"provider_options"`
 	// BaseURL is the base URL
 	BaseURL string `json:"base_url" yaml:"base_url"`
 	// BaseURLDirect indicates whether to use the base URL directly
@@ -79,6 +103,22 @@ type Model struct {
 	IsOpenAICompatibility bool `json:"is_openai_compatibility" yaml:"is_openai_compatibility"`
 	// StreamOnly indicates whether only streaming is supported
 	StreamOnly bool `json:"stream_only" yaml:"stream_only"`
+	// Headers are extra headers sent with every upstream request, ${VAR} references are expanded from the environment
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	// QueryParams are extra query parameters added to every upstream URL, ${VAR} references are expanded from the environment
+	QueryParams map[string]string `json:"query_params" yaml:"query_params"`
+	// ForwardHeaders is the allowlist of client request headers forwarded upstream
+	ForwardHeaders []string `json:"forward_headers" yaml:"forward_headers"`
+	// BodyDefaults are set in the upstream request body where the client did not set a value
+	BodyDefaults BodyPatch `json:"body_defaults" yaml:"body_defaults"`
+	// BodyOverrides are always set in the upstream request body
+	BodyOverrides BodyPatch `json:"body_overrides" yaml:"body_overrides"`
+	// BodyRemove lists the paths deleted from the upstream request body
+	BodyRemove []string `json:"body_remove" yaml:"body_remove"`
+	// BodyRules are conditional request body rewrites, applied in order before the defaults, overrides and removals
+	BodyRules []BodyRule `json:"body_rules" yaml:"body_rules"`
+	// ProxyURL is the http, https or socks5 proxy used for upstream requests, if empty the environment's proxy is used
+	ProxyURL string `json:"proxy_url" yaml:"proxy_url"`
 
 	// ProviderAPIKey is the list of provider API keys for this model
 	ProviderAPIKey []string `json:"provider_api_key" yaml:"provider_api_key"`
@@ -105,4 +145,20 @@ type DisplayModel struct {
 		Prompt     string `json:"prompt"`
 		Completion string `json:"completion"`
 	} `json:"pricing,omitempty"`
+	// Capabilities are the endpoints the entries of the model serve, such as chat or embeddings
+	Capabilities []string `json:"capabilities"`
+	// Entries is the number of enabled provider entries of the model
+	Entries int `json:"entries"`
+	// Health is the health of the entries of the model
+	Health ModelHealth `json:"health"`
+}
+
+// ModelHealth is the aggregated health of the entries of a model
+type ModelHealth struct {
+	// Status is healthy, degraded if some entries are failing, down if all are, or unknown before any request
+	Status string `json:"status"`
+	// HealthyEntries is the number of entries whose last request succeeded
+	HealthyEntries int `json:"healthy_entries"`
+	// FailingEntries is the number of entries whose last request failed
+	FailingEntries int `json:"failing_entries"`
 }
@@ -0,0 +1,27 @@
+package models
+
+// Moderation policy actions
+const (
+	// ModerationActionBlock rejects a flagged request
+	ModerationActionBlock = "block"
+	// ModerationActionLog only logs a flagged request and serves it
+	ModerationActionLog = "log"
+)
+
+// ModerationPolicy runs the prompt of a request through a moderation model before it is served
+type ModerationPolicy struct {
+	// Model is the name of the model that moderates the prompt, it must have an entry with supports_moderation
+	Model string `json:"model" yaml:"model"`
+	// Action is ModerationActionBlock or ModerationActionLog, block when empty
+	Action string `json:"action" yaml:"action"`
+}
+
+// Enabled reports whether the policy is set
+func (p ModerationPolicy) Enabled() bool {
+	return p.Model != ""
+}
+
+// Blocks reports whether flagged requests are rejected
+func (p ModerationPolicy) Blocks() bool {
+	return p.Action != ModerationActionLog
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ProviderOptions holds the provider specific settings of a model entry
+type ProviderOptions map[string]interface{}
+
+// OptionType is the type that the value of a provider option must have
+type OptionType int
+
+const (
+	// OptionString is a string, numbers are accepted and formatted
+	OptionString OptionType = iota
+	// OptionInt is an integer or a string of one
+	OptionInt
+	// OptionFloat is a number or a string of one
+	OptionFloat
+	// OptionBool is a boolean or a string of one
+	OptionBool
+	// OptionDuration is a duration string such as 500ms, or a number of seconds
+	OptionDuration
+	// OptionMap is a map
+	OptionMap
+)
+
+// optionTypeNames are the names of the option types in error messages
+var optionTypeNames = map[OptionType]string{
+	OptionString:   "a string",
+	OptionInt:      "an integer",
+	OptionFloat:    "a number",
+	OptionBool:     "a boolean",
+	OptionDuration: "a duration",
+	OptionMap:      "a map",
+}
+
+// OptionTypes maps the names of the options of a provider to their types
+type OptionTypes map[string]OptionType
+
+// Check returns an error for the first option, in name order, that is not one of the known options or whose value
+// does not have the option's type. Options without a value are not set and always accepted.
+func (o ProviderOptions) Check(known OptionTypes) error {
+	keys := make([]string, 0, len(o))
+	for key := range o {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		optionType, ok := known[key]
+		if !ok {
+			return fmt.Errorf("unknown option %s", key)
+		}
+		if o[key] != nil && !optionType.accepts(o[key]) {
+			return fmt.Errorf("%s must be %s", key, optionTypeNames[optionType])
+		}
+	}
+	return nil
+}
+
+// accepts reports whether the getter of the option type reads the value
+func (t OptionType) accepts(value interface{}) bool {
+	switch t {
+	case OptionString:
+		switch value.(type) {
+		case string, int, int64, uint64, float64:
+			return true
+		}
+	case OptionInt:
+		switch value := value.(type) {
+		case int, int64, uint64:
+			return true
+		case float64:
+			return value == math.Trunc(value)
+		case string:
+			_, err := strconv.Atoi(value)
+			return err == nil
+		}
+	case OptionFloat:
+		switch value := value.(type) {
+		case int, int64, uint64, float64:
+			return true
+		case string:
+			_, err := strconv.ParseFloat(value, 64)
+			return err == nil
+		}
+	case OptionBool:
+		switch value := value.(type) {
+		case bool:
+			return true
+		case string:
+			_, err := strconv.ParseBool(value)
+			return err == nil
+		}
+	case OptionDuration:
+		switch value := value.(type) {
+		case int, float64:
+			return true
+		case string:
+			_, err := time.ParseDuration(value)
+			return err == nil
+		}
+	case OptionMap:
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+	return false
+}
+
+// String returns the option as a string, or def if it is not set
+func (o ProviderOptions) String(key string, def string) string {
+	value, ok := o[key]
+	if !ok || value == nil {
+		return def
+	}
+	if s, isString := value.(string); isString {
+		return s
+	}
+	return fmt.Sprint(value)
+}
+
+// Int returns the option as an integer, or def if it is not set or not a number
+func (o ProviderOptions) Int(key string, def int) int {
+	switch value := o[key].(type) {
+	case int:
+		return value
+	case int64:
+		return int(value)
+	case uint64:
+		return int(value)
+	case float64:
+		return int(value)
+	case string:
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+// Float returns the option as a float, or def if it is not set or not a number
+func (o ProviderOptions) Float(key string, def float64) float64 {
+	switch value := o[key].(type) {
+	case int:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case uint64:
+		return float64(value)
+	case float64:
+		return value
+	case string:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+// Bool returns the option as a boolean, or def if it is not set or not a boolean
+func (o ProviderOptions) Bool(key string, def bool) bool {
+	switch value := o[key].(type) {
+	case bool:
+		return value
+	case string:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+// Duration returns the option as a duration, or def if it is not set.
+// Strings are parsed with time.ParseDuration and numbers are read as seconds.
+func (o ProviderOptions) Duration(key string, def time.Duration) time.Duration {
+	switch value := o[key].(type) {
+	case string:
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	case int:
+		return time.Duration(value) * time.Second
+	case float64:
+		return time.Duration(value * float64(time.Second))
+	}
+	return def
+}
+
+// StringMap returns the option as a map of strings, or nil if it is not a map
+func (o ProviderOptions) StringMap(key string) map[string]string {
+	value, ok := o[key].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	result := make(map[string]string, len(value))
+	for k, v := range value {
+		result[k] = fmt.Sprint(v)
+	}
+	return result
+}
+
+// Map returns the option as a nested options map, or nil if it is not a map
+func (o ProviderOptions) Map(key string) ProviderOptions {
+	value, ok := o[key].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestProviderOptionsCheck(t *testing.T) {
+	known := OptionTypes{
+		"mode":     OptionString,
+		"chunks":   OptionInt,
+		"ratio":    OptionFloat,
+		"store":    OptionBool,
+		"latency":  OptionDuration,
+		"settings": OptionMap,
+	}
+	tests := []struct {
+		name    string
+		options ProviderOptions
+		wantErr string
+	}{
+		{name: "empty"},
+		{name: "typed values", options: ProviderOptions{"mode": "echo", "chunks": 3, "ratio": 0.5, "store": true, "latency": "500ms", "settings": map[string]interface{}{"a": 1}}},
+		{name: "string values", options: ProviderOptions{"mode": 1, "chunks": "3", "ratio": "0.5", "store": "false", "latency": 2}},
+		{name: "integral float", options: ProviderOptions{"chunks": 3.0}},
+		{name: "unset value", options: ProviderOptions{"settings": nil}},
+		{name: "unknown option", options: ProviderOptions{"mode": "echo", "chunk": 3}, wantErr: "unknown option chunk"},
+		{name: "fractional integer", options: ProviderOptions{"chunks": 2.5}, wantErr: "chunks must be an integer"},
+		{name: "non numeric float", options: ProviderOptions{"ratio": "half"}, wantErr: "ratio must be a number"},
+		{name: "non boolean", options: ProviderOptions{"store": "maybe"}, wantErr: "store must be a boolean"},
+		{name: "bad duration", options: ProviderOptions{"latency": "soon"}, wantErr: "latency must be a duration"},
+		{name: "list for map", options: ProviderOptions{"settings": []interface{}{"a"}}, wantErr: "settings must be a map"},
+		{name: "map for string", options: ProviderOptions{"mode": map[string]interface{}{}}, wantErr: "mode must be a string"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.options.Check(known)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("Check() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("Check() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
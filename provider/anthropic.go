@@ -0,0 +1,596 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// anthropicDefaultBaseURL is the Anthropic API base URL used when the model has no base_url
+	anthropicDefaultBaseURL = "https://api.anthropic.com/v1"
+	// anthropicDefaultVersion is the default value of the anthropic-version header
+	anthropicDefaultVersion = "2023-06-01"
+	// anthropicDefaultMaxTokens is used when neither the request nor the model sets max_tokens, which Anthropic requires
+	anthropicDefaultMaxTokens = 4096
+)
+
+// anthropicThinkingBudgets maps reasoning_effort values to thinking.budget_tokens
+var anthropicThinkingBudgets = map[string]int{
+	"auto":   8192,
+	"low":    1024,
+	"medium": 8192,
+	"high":   24576,
+}
+
+// anthropicFinishReasons maps Anthropic stop reasons to OpenAI finish reasons
+var anthropicFinishReasons = map[string]string{
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"pause_turn":    "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+	"refusal":       "content_filter",
+}
+
+// anthropicOptionTypes are the provider_options of the anthropic provider
+var anthropicOptionTypes = models.OptionTypes{
+	"anthropic_version":  models.OptionString,
+	"anthropic_beta":     models.OptionString,
+	"default_max_tokens": models.OptionInt,
+	"thinking_budgets":   models.OptionMap,
+}
+
+// / NewProviderAnthropic creates a new Anthropic provider.
+// / Options: anthropic_version, anthropic_beta, default_max_tokens and thinking_budgets (a map of reasoning_effort to budget_tokens).
+func NewProviderAnthropic(options models.ProviderOptions) (Provider, error) {
+	if err := options.Check(anthropicOptionTypes); err != nil {
+		return nil, err
+	}
+	p := &Anthropic{
+		version:          options.String("anthropic_version", anthropicDefaultVersion),
+		beta:             options.String("anthropic_beta", ""),
+		defaultMaxTokens: options.Int("default_max_tokens", anthropicDefaultMaxTokens),
+		thinkingBudgets:  make(map[string]int, len(anthropicThinkingBudgets)),
+	}
+	if p.defaultMaxTokens <= 0 {
+		return nil, fmt.Errorf("default_max_tokens must be positive")
+	}
+
+	// Start from the default budgets and apply the configured ones.
+	for effort, budget := range anthropicThinkingBudgets {
+		p.thinkingBudgets[effort] = budget
+	}
+	budgets := options.Map("thinking_budgets")
+	for effort := range budgets {
+		budget := budgets.Int(effort, -1)
+		if budget < 0 {
+			return nil, fmt.Errorf("thinking_budgets.%s must be a non-negative integer", effort)
+		}
+		p.thinkingBudgets[effort] = budget
+	}
+	return p, nil
+}
+
+// / init registers the provider.
+func init() {
+	RegisterProvider(_const.ProviderAnthropic, NewProviderAnthropic)
+}
+
+// / Anthropic implements the Provider interface for Anthropic's Messages API.
+type Anthropic struct {
+	// version is the anthropic-version header value.
+	version string
+	// beta is the optional anthropic-beta header value.
+	beta string
+	// defaultMaxTokens is the max_tokens used when the request and the model do not set it.
+	defaultMaxTokens int
+	// thinkingBudgets maps reasoning_effort values to thinking budgets.
+	thinkingBudgets map[string]int
+}
+
+// / GetProviderType returns the provider's type.
+func (p *Anthropic) GetProviderType() _const.ProviderType {
+	return _const.ProviderAnthropic
+}
+
+// / CreateChatCompletion creates a chat completion.
+func (p *Anthropic) CreateChatCompletion(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	// Convert the OpenAI request to an Anthropic request.
+	anthropicRequest, err := p.convertRequest(request, model, false)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, anthropicRequest, model)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Defer closing the response body.
+	defer func() {
+		err = resp.Body.Close()
+	}()
+
+	// Read the response body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode), convertAnthropicError(data, resp.StatusCode)
+	}
+
+	// Check that the response is a message.
+	if gjson.GetBytes(data, "type").String() != "message" {
+		return nil, fmt.Errorf("unexpected response: %s", string(data)), data
+	}
+
+	return convertAnthropicResponse(data, model, usage), nil, nil
+}
+
+// / CreateChatCompletionStream creates a streaming chat completion.
+func (p *Anthropic) CreateChatCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	// Convert the OpenAI request to an Anthropic request.
+	anthropicRequest, err := p.convertRequest(request, model, true)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, anthropicRequest, model)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp.StatusCode), convertAnthropicError(body, resp.StatusCode)
+	}
+
+	// Create a pipe.
+	pr, pw := io.Pipe()
+
+	// Start a goroutine to translate the Anthropic events into OpenAI chunks.
+	go func() {
+		// Defer closing the pipe and the response body.
+		defer func() {
+			_ = pw.Close()
+			_ = resp.Body.Close()
+		}()
+
+		if errTranslate := translateAnthropicStream(resp.Body, pw, model, usage); errTranslate != nil {
+			// If reading fails, cancel the request.
+			cancel()
+		}
+	}()
+
+	return pr, nil, nil
+}
+
+// / Close closes the provider.
+func (p *Anthropic) Close() error {
+	return nil
+}
+
+// doRequest sends a Messages API request
+func (p *Anthropic) doRequest(ctx context.Context, request []byte, model models.Model) (*http.Response, error) {
+	// Build the URL.
+	baseURL := model.BaseURL
+	if baseURL == "" {
+		baseURL = anthropicDefaultBaseURL
+	}
+	url := baseURL
+	if !model.BaseURLDirect {
+		url = fmt.Sprintf("%s/messages", strings.TrimRight(baseURL, "/"))
+	}
+
+	// Create an HTTP request.
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(request))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the request headers.
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("anthropic-version", p.version)
+	if p.beta != "" {
+		req.Header.Set("anthropic-beta", p.beta)
+	}
+	if apiKey := getAPIKey(model); apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	if gjson.GetBytes(request, "stream").Bool() {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	// Add the model's headers and query parameters.
+	applyModelRequestOptions(req, model)
+
+	// Use http.Client to send the request.
+	return newHttpClient(model.ProxyURL).Do(req)
+}
+
+// convertRequest converts an OpenAI chat completion request into an Anthropic Messages request
+func (p *Anthropic) convertRequest(request []byte, model models.Model, stream bool) ([]byte, error) {
+	out := []byte(`{"model":"","max_tokens":0,"messages":[]}`)
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(request, "model").String())
+
+	// Convert the messages.
+	var err error
+	messageIndex := -1
+	lastRole := ""
+	for _, message := range gjson.GetBytes(request, "messages").Array() {
+		role := message.Get("role").String()
+
+		// System and developer messages become the system prompt.
+		if role == "system" || role == "developer" {
+			for _, text := range openAITextParts(message.Get("content")) {
+				block := []byte(`{"type":"text","text":""}`)
+				block, _ = sjson.SetBytes(block, "text", text)
+				out, _ = sjson.SetRawBytes(out, "system.-1", block)
+			}
+			continue
+		}
+
+		// Build the content blocks of the message.
+		blocks := make([][]byte, 0)
+		anthropicRole := "user"
+		switch role {
+		case "assistant":
+			anthropicRole = "assistant"
+			for _, text := range openAITextParts(message.Get("content")) {
+				if text == "" {
+					continue
+				}
+				block := []byte(`{"type":"text","text":""}`)
+				block, _ = sjson.SetBytes(block, "text", text)
+				blocks = append(blocks, block)
+			}
+			for _, toolCall := range message.Get("tool_calls").Array() {
+				block := []byte(`{"type":"tool_use","id":"","name":"","input":{}}`)
+				block, _ = sjson.SetBytes(block, "id", toolCall.Get("id").String())
+				block, _ = sjson.SetBytes(block, "name", toolCall.Get("function.name").String())
+				arguments := toolCall.Get("function.arguments").String()
+				if arguments != "" && gjson.Valid(arguments) {
+					block, _ = sjson.SetRawBytes(block, "input", []byte(arguments))
+				}
+				blocks = append(blocks, block)
+			}
+		case "tool":
+			block := []byte(`{"type":"tool_result","tool_use_id":"","content":""}`)
+			block, _ = sjson.SetBytes(block, "tool_use_id", message.Get("tool_call_id").String())
+			block, _ = sjson.SetBytes(block, "content", strings.Join(openAITextParts(message.Get("content")), ""))
+			blocks = append(blocks, block)
+		default:
+			blocks, err = convertOpenAIUserContent(message.Get("content"))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		// Consecutive messages of the same role are merged, tool results become user messages.
+		if anthropicRole != lastRole {
+			messageIndex++
+			newMessage := []byte(`{"role":"","content":[]}`)
+			newMessage, _ = sjson.SetBytes(newMessage, "role", anthropicRole)
+			out, _ = sjson.SetRawBytes(out, "messages.-1", newMessage)
+			lastRole = anthropicRole
+		}
+		for _, block := range blocks {
+			out, _ = sjson.SetRawBytes(out, fmt.Sprintf("messages.%d.content.-1", messageIndex), block)
+		}
+	}
+
+	// Set max_tokens, which is required by Anthropic.
+	maxTokens := int(gjson.GetBytes(request, "max_completion_tokens").Int())
+	if maxTokens == 0 {
+		maxTokens = int(gjson.GetBytes(request, "max_tokens").Int())
+	}
+	if maxTokens == 0 {
+		maxTokens = model.MaxTokens
+	}
+	if maxTokens == 0 {
+		maxTokens = p.defaultMaxTokens
+	}
+
+	// Map reasoning_effort to extended thinking.
+	thinking := false
+	if reasoningEffortResult := gjson.GetBytes(request, "reasoning_effort"); reasoningEffortResult.Type == gjson.String {
+		if budget, ok := p.thinkingBudgets[reasoningEffortResult.String()]; ok && budget > 0 {
+			thinking = true
+			out, _ = sjson.SetBytes(out, "thinking.type", "enabled")
+			out, _ = sjson.SetBytes(out, "thinking.budget_tokens", budget)
+			// The thinking budget is part of max_tokens.
+			if maxTokens <= budget {
+				maxTokens = budget + p.defaultMaxTokens
+			}
+		}
+	}
+	out, _ = sjson.SetBytes(out, "max_tokens", maxTokens)
+
+	// Copy the sampling parameters, Anthropic rejects temperature and top_k with extended thinking.
+	if !thinking {
+		if temperature := gjson.GetBytes(request, "temperature"); temperature.Type == gjson.Number {
+			out, _ = sjson.SetBytes(out, "temperature", temperature.Float())
+		}
+		if topK := gjson.GetBytes(request, "top_k"); topK.Type == gjson.Number && topK.Int() > 0 {
+			out, _ = sjson.SetBytes(out, "top_k", topK.Int())
+		}
+	}
+	if topP := gjson.GetBytes(request, "top_p"); topP.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "top_p", topP.Float())
+	}
+
+	// Convert stop to stop_sequences.
+	stop := gjson.GetBytes(request, "stop")
+	if stop.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "stop_sequences", []string{stop.String()})
+	} else if stop.IsArray() {
+		for _, item := range stop.Array() {
+			out, _ = sjson.SetBytes(out, "stop_sequences.-1", item.String())
+		}
+	}
+
+	// Convert the tools.
+	for _, tool := range gjson.GetBytes(request, "tools").Array() {
+		if tool.Get("type").String() != "function" {
+			continue
+		}
+		anthropicTool := []byte(`{"name":"","input_schema":{"type":"object"}}`)
+		anthropicTool, _ = sjson.SetBytes(anthropicTool, "name", tool.Get("function.name").String())
+		if description := tool.Get("function.description"); description.Exists() {
+			anthropicTool, _ = sjson.SetBytes(anthropicTool, "description", description.String())
+		}
+		if parameters := tool.Get("function.parameters"); parameters.IsObject() {
+			anthropicTool, _ = sjson.SetRawBytes(anthropicTool, "input_schema", []byte(parameters.Raw))
+		}
+		out, _ = sjson.SetRawBytes(out, "tools.-1", anthropicTool)
+	}
+
+	// Convert tool_choice.
+	toolChoice := gjson.GetBytes(request, "tool_choice")
+	switch {
+	case toolChoice.Type == gjson.String && toolChoice.String() == "auto":
+		out, _ = sjson.SetBytes(out, "tool_choice.type", "auto")
+	case toolChoice.Type == gjson.String && toolChoice.String() == "required":
+		out, _ = sjson.SetBytes(out, "tool_choice.type", "any")
+	case toolChoice.Type == gjson.String && toolChoice.String() == "none":
+		out, _ = sjson.SetBytes(out, "tool_choice.type", "none")
+	case toolChoice.IsObject():
+		out, _ = sjson.SetBytes(out, "tool_choice.type", "tool")
+		out, _ = sjson.SetBytes(out, "tool_choice.name", toolChoice.Get("function.name").String())
+	}
+	if parallelToolCalls := gjson.GetBytes(request, "parallel_tool_calls"); parallelToolCalls.Type == gjson.False && gjson.GetBytes(out, "tools").Exists() {
+		if !gjson.GetBytes(out, "tool_choice").Exists() {
+			out, _ = sjson.SetBytes(out, "tool_choice.type", "auto")
+		}
+		out, _ = sjson.SetBytes(out, "tool_choice.disable_parallel_tool_use", true)
+	}
+
+	// Convert user to metadata.user_id.
+	if user := gjson.GetBytes(request, "user"); user.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "metadata.user_id", user.String())
+	}
+
+	if stream {
+		out, _ = sjson.SetBytes(out, "stream", true)
+	}
+
+	return out, nil
+}
+
+// openAITextParts returns the text of an OpenAI message content, which is either a string or an array of parts
+func openAITextParts(content gjson.Result) []string {
+	if content.Type == gjson.String {
+		return []string{content.String()}
+	}
+	texts := make([]string, 0)
+	for _, part := range content.Array() {
+		if part.Get("type").String() == "text" {
+			texts = append(texts, part.Get("text").String())
+		}
+	}
+	return texts
+}
+
+// convertOpenAIUserContent converts the content of an OpenAI user message into Anthropic content blocks
+func convertOpenAIUserContent(content gjson.Result) ([][]byte, error) {
+	blocks := make([][]byte, 0)
+	if content.Type == gjson.String {
+		block := []byte(`{"type":"text","text":""}`)
+		block, _ = sjson.SetBytes(block, "text", content.String())
+		return append(blocks, block), nil
+	}
+
+	for _, part := range content.Array() {
+		switch part.Get("type").String() {
+		case "text":
+			block := []byte(`{"type":"text","text":""}`)
+			block, _ = sjson.SetBytes(block, "text", part.Get("text").String())
+			blocks = append(blocks, block)
+		case "image_url":
+			url := part.Get("image_url.url").String()
+			if strings.HasPrefix(url, "data:") {
+				mediaType, data, err := parseDataURL(url)
+				if err != nil {
+					return nil, err
+				}
+				block := []byte(`{"type":"image","source":{"type":"base64","media_type":"","data":""}}`)
+				block, _ = sjson.SetBytes(block, "source.media_type", mediaType)
+				block, _ = sjson.SetBytes(block, "source.data", data)
+				blocks = append(blocks, block)
+			} else {
+				block := []byte(`{"type":"image","source":{"type":"url","url":""}}`)
+				block, _ = sjson.SetBytes(block, "source.url", url)
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// convertAnthropicResponse converts an Anthropic message into an OpenAI chat completion and fills the usage
+func convertAnthropicResponse(data []byte, model models.Model, usage *Usage) []byte {
+	out := []byte(`{"id":"","object":"chat.completion","created":0,"model":"","choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":null}]}`)
+	out, _ = sjson.SetBytes(out, "id", gjson.GetBytes(data, "id").String())
+	out, _ = sjson.SetBytes(out, "created", time.Now().Unix())
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+
+	// Collect the text, thinking and tool use blocks.
+	var content, reasoningContent strings.Builder
+	toolCallIndex := 0
+	for _, block := range gjson.GetBytes(data, "content").Array() {
+		switch block.Get("type").String() {
+		case "text":
+			content.WriteString(block.Get("text").String())
+		case "thinking":
+			reasoningContent.WriteString(block.Get("thinking").String())
+		case "tool_use":
+			toolCall := []byte(`{"id":"","type":"function","function":{"name":"","arguments":""}}`)
+			toolCall, _ = sjson.SetBytes(toolCall, "id", block.Get("id").String())
+			toolCall, _ = sjson.SetBytes(toolCall, "function.name", block.Get("name").String())
+			toolCall, _ = sjson.SetBytes(toolCall, "function.arguments", block.Get("input").Raw)
+			out, _ = sjson.SetRawBytes(out, fmt.Sprintf("choices.0.message.tool_calls.%d", toolCallIndex), toolCall)
+			toolCallIndex++
+		}
+	}
+	out, _ = sjson.SetBytes(out, "choices.0.message.content", content.String())
+	if reasoningContent.Len() > 0 {
+		out, _ = sjson.SetBytes(out, "choices.0.message.reasoning_content", reasoningContent.String())
+	}
+	out, _ = sjson.SetBytes(out, "choices.0.finish_reason", anthropicFinishReason(gjson.GetBytes(data, "stop_reason").String()))
+
+	// Set the usage.
+	setAnthropicUsage(gjson.GetBytes(data, "usage"), usage)
+	out, _ = sjson.SetBytes(out, "usage", usage)
+
+	return out
+}
+
+// setAnthropicUsage copies the token counts of an Anthropic usage object into usage
+func setAnthropicUsage(anthropicUsage gjson.Result, usage *Usage) {
+	if inputTokens := anthropicUsage.Get("input_tokens"); inputTokens.Exists() {
+		cacheReadTokens := int(anthropicUsage.Get("cache_read_input_tokens").Int())
+		cacheCreationTokens := int(anthropicUsage.Get("cache_creation_input_tokens").Int())
+		usage.PromptTokens = int(inputTokens.Int()) + cacheReadTokens + cacheCreationTokens
+		usage.PromptTokensDetails.CachedTokens = cacheReadTokens
+	}
+	if outputTokens := anthropicUsage.Get("output_tokens"); outputTokens.Exists() {
+		usage.CompletionTokens = int(outputTokens.Int())
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+}
+
+// anthropicFinishReason maps an Anthropic stop reason to an OpenAI finish reason
+func anthropicFinishReason(stopReason string) string {
+	if finishReason, ok := anthropicFinishReasons[stopReason]; ok {
+		return finishReason
+	}
+	return "stop"
+}
+
+// convertAnthropicError converts an Anthropic error body into an OpenAI error body
+func convertAnthropicError(body []byte, statusCode int) []byte {
+	message := gjson.GetBytes(body, "error.message")
+	if !message.Exists() {
+		return body
+	}
+	return newOpenAIError(message.String(), gjson.GetBytes(body, "error.type").String(), statusCode)
+}
+
+// translateAnthropicStream reads Anthropic SSE events from r and writes OpenAI chat.completion.chunk events to w
+func translateAnthropicStream(r io.Reader, w io.Writer, model models.Model, usage *Usage) error {
+	reader := bufio.NewReader(r)
+	id := ""
+	created := time.Now().Unix()
+	// toolCallIndexes maps content block indexes to tool call indexes.
+	toolCallIndexes := make(map[int64]int)
+
+	for {
+		// Read a line of data.
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, _const.TagData) {
+			data := bytes.TrimPrefix(line, _const.TagData)
+			var chunk []byte
+
+			switch gjson.GetBytes(data, "type").String() {
+			case "message_start":
+				id = gjson.GetBytes(data, "message.id").String()
+				setAnthropicUsage(gjson.GetBytes(data, "message.usage"), usage)
+				chunk = newChatCompletionChunk(id, created, model.Name, []byte(`{"role":"assistant","content":""}`), "")
+			case "content_block_start":
+				block := gjson.GetBytes(data, "content_block")
+				if block.Get("type").String() == "tool_use" {
+					toolCallIndex := len(toolCallIndexes)
+					toolCallIndexes[gjson.GetBytes(data, "index").Int()] = toolCallIndex
+					delta := []byte(`{"tool_calls":[{"index":0,"id":"","type":"function","function":{"name":"","arguments":""}}]}`)
+					delta, _ = sjson.SetBytes(delta, "tool_calls.0.index", toolCallIndex)
+					delta, _ = sjson.SetBytes(delta, "tool_calls.0.id", block.Get("id").String())
+					delta, _ = sjson.SetBytes(delta, "tool_calls.0.function.name", block.Get("name").String())
+					chunk = newChatCompletionChunk(id, created, model.Name, delta, "")
+				}
+			case "content_block_delta":
+				delta := gjson.GetBytes(data, "delta")
+				switch delta.Get("type").String() {
+				case "text_delta":
+					openAIDelta, _ := sjson.SetBytes([]byte(`{}`), "content", delta.Get("text").String())
+					chunk = newChatCompletionChunk(id, created, model.Name, openAIDelta, "")
+				case "thinking_delta":
+					openAIDelta, _ := sjson.SetBytes([]byte(`{}`), "reasoning_content", delta.Get("thinking").String())
+					chunk = newChatCompletionChunk(id, created, model.Name, openAIDelta, "")
+				case "input_json_delta":
+					toolCallIndex := toolCallIndexes[gjson.GetBytes(data, "index").Int()]
+					openAIDelta := []byte(`{"tool_calls":[{"index":0,"function":{"arguments":""}}]}`)
+					openAIDelta, _ = sjson.SetBytes(openAIDelta, "tool_calls.0.index", toolCallIndex)
+					openAIDelta, _ = sjson.SetBytes(openAIDelta, "tool_calls.0.function.arguments", delta.Get("partial_json").String())
+					chunk = newChatCompletionChunk(id, created, model.Name, openAIDelta, "")
+				}
+			case "message_delta":
+				setAnthropicUsage(gjson.GetBytes(data, "usage"), usage)
+				if stopReason := gjson.GetBytes(data, "delta.stop_reason"); stopReason.Type == gjson.String {
+					chunk = newChatCompletionChunk(id, created, model.Name, nil, anthropicFinishReason(stopReason.String()))
+				}
+			case "message_stop":
+				if errWrite := writeDataEvent(w, newUsageChunk(id, created, model.Name, usage)); errWrite != nil {
+					return errWrite
+				}
+				return writeDoneEvent(w)
+			case "error":
+				chunk = newOpenAIError(gjson.GetBytes(data, "error.message").String(), gjson.GetBytes(data, "error.type").String(), http.StatusInternalServerError)
+			}
+
+			if chunk != nil {
+				if errWrite := writeDataEvent(w, chunk); errWrite != nil {
+					return errWrite
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
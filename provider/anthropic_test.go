@@ -0,0 +1,350 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+)
+
+// anthropicTestStream is a Messages API event stream with thinking, text, a ping and a tool call
+const anthropicTestStream = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_01","type":"message","role":"assistant","model":"claude-sonnet-4-5","content":[],"stop_reason":null,"usage":{"input_tokens":12,"cache_read_input_tokens":4,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"The user greets."}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":" there"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":1}
+
+event: content_block_start
+data: {"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_01","name":"get_weather","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":2}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":20}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+// newAnthropicTestServer starts a Messages API that checks the translated request and answers with response,
+// as an event stream when the request streams
+func newAnthropicTestServer(t *testing.T, response string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.URL.Path != "/v1/messages":
+			http.NotFound(w, r)
+			return
+		case r.Header.Get("x-api-key") != "test-key" || r.Header.Get("anthropic-version") != anthropicDefaultVersion:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`))
+			return
+		case gjson.GetBytes(body, "model").String() != "claude-sonnet-4-5" || gjson.GetBytes(body, "max_tokens").Int() != anthropicDefaultMaxTokens ||
+			gjson.GetBytes(body, "system.0.text").String() != "Be brief." || gjson.GetBytes(body, "messages.#").Int() != 1 ||
+			gjson.GetBytes(body, "messages.0.role").String() != "user":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"unexpected request"}}`))
+			return
+		}
+		if gjson.GetBytes(body, "stream").Bool() {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// anthropicTestModel returns a model entry of the test server
+func anthropicTestModel(server *httptest.Server) models.Model {
+	return models.Model{Name: "claude", ProviderModelName: "claude-sonnet-4-5", BaseURL: server.URL + "/v1", ProviderAPIKey: []string{"test-key"}}
+}
+
+// anthropicTestRequest is the OpenAI chat completion request sent to the provider
+const anthropicTestRequest = `{"model":"claude-sonnet-4-5","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi, what is the weather in Paris?"}]}`
+
+func TestAnthropicChatCompletion(t *testing.T) {
+	server := newAnthropicTestServer(t, `{"id":"msg_01","type":"message","role":"assistant","model":"claude-sonnet-4-5",`+
+		`"content":[{"type":"thinking","thinking":"The user greets."},{"type":"text","text":"Hello there"},{"type":"tool_use","id":"toolu_01","name":"get_weather","input":{"city":"Paris"}}],`+
+		`"stop_reason":"tool_use","usage":{"input_tokens":12,"cache_read_input_tokens":4,"output_tokens":20}}`)
+	providerInstance, err := NewProviderAnthropic(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := &Usage{}
+	response, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(anthropicTestRequest), anthropicTestModel(server), usage)
+	if err != nil {
+		t.Fatalf("CreateChatCompletion() error = %v, body %s", err, errBody)
+	}
+	checks := map[string]string{
+		"id":                                  "msg_01",
+		"object":                              "chat.completion",
+		"model":                               "claude",
+		"choices.0.message.content":           "Hello there",
+		"choices.0.message.reasoning_content": "The user greets.",
+		"choices.0.message.tool_calls.0.id":   "toolu_01",
+		"choices.0.message.tool_calls.0.function.name": "get_weather",
+		"choices.0.finish_reason":                      "tool_calls",
+	}
+	for path, want := range checks {
+		if got := gjson.GetBytes(response, path).String(); got != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+	if arguments := gjson.GetBytes(response, "choices.0.message.tool_calls.0.function.arguments").String(); gjson.Get(arguments, "city").String() != "Paris" {
+		t.Errorf("tool call arguments = %q, want the city Paris", arguments)
+	}
+	if usage.PromptTokens != 16 || usage.PromptTokensDetails.CachedTokens != 4 || usage.CompletionTokens != 20 || usage.TotalTokens != 36 {
+		t.Errorf("usage = %+v, want 16 prompt tokens of which 4 cached and 20 completion tokens", usage)
+	}
+}
+
+func TestAnthropicChatCompletionError(t *testing.T) {
+	server := newAnthropicTestServer(t, "")
+	providerInstance, err := NewProviderAnthropic(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := anthropicTestModel(server)
+	model.ProviderAPIKey = []string{"wrong-key"}
+	_, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(anthropicTestRequest), model, &Usage{})
+	if err == nil {
+		t.Fatal("CreateChatCompletion() succeeded with a wrong API key")
+	}
+	if got := gjson.GetBytes(errBody, "error.message").String(); got != "invalid x-api-key" {
+		t.Errorf("error.message = %q, want invalid x-api-key", got)
+	}
+	if got := gjson.GetBytes(errBody, "error.type").String(); got != "authentication_error" {
+		t.Errorf("error.type = %q, want authentication_error", got)
+	}
+}
+
+func TestAnthropicChatCompletionStream(t *testing.T) {
+	server := newAnthropicTestServer(t, anthropicTestStream)
+	providerInstance, err := NewProviderAnthropic(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := &Usage{}
+	request := strings.Replace(anthropicTestRequest, `{"model"`, `{"stream":true,"model"`, 1)
+	stream, err, errBody := providerInstance.CreateChatCompletionStream(context.Background(), func() {}, []byte(request), anthropicTestModel(server), usage)
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream() error = %v, body %s", err, errBody)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	var content, reasoningContent, arguments strings.Builder
+	finishReason, toolCallName, lastData := "", "", ""
+	var usageChunk []byte
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("data: ")) {
+			continue
+		}
+		data := bytes.TrimPrefix(line, []byte("data: "))
+		lastData = string(data)
+		if lastData == "[DONE]" {
+			continue
+		}
+		if gjson.GetBytes(data, "object").String() != "chat.completion.chunk" || gjson.GetBytes(data, "id").String() != "msg_01" {
+			t.Errorf("unexpected chunk %s", data)
+		}
+		if gjson.GetBytes(data, "usage").Exists() {
+			usageChunk = append([]byte{}, data...)
+		}
+		delta := gjson.GetBytes(data, "choices.0.delta")
+		content.WriteString(delta.Get("content").String())
+		reasoningContent.WriteString(delta.Get("reasoning_content").String())
+		if name := delta.Get("tool_calls.0.function.name").String(); name != "" {
+			toolCallName = name
+		}
+		arguments.WriteString(delta.Get("tool_calls.0.function.arguments").String())
+		if reason := gjson.GetBytes(data, "choices.0.finish_reason").String(); reason != "" {
+			finishReason = reason
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if content.String() != "Hello there" || reasoningContent.String() != "The user greets." {
+		t.Errorf("content = %q and reasoning_content = %q, want Hello there and The user greets.", content.String(), reasoningContent.String())
+	}
+	if toolCallName != "get_weather" || arguments.String() != `{"city":"Paris"}` {
+		t.Errorf("tool call = %s(%s), want get_weather({\"city\":\"Paris\"})", toolCallName, arguments.String())
+	}
+	if finishReason != "tool_calls" {
+		t.Errorf("finish_reason = %q, want tool_calls", finishReason)
+	}
+	if gjson.GetBytes(usageChunk, "usage.prompt_tokens").Int() != 16 || gjson.GetBytes(usageChunk, "usage.completion_tokens").Int() != 20 {
+		t.Errorf("usage chunk = %s, want 16 prompt and 20 completion tokens", usageChunk)
+	}
+	if lastData != "[DONE]" {
+		t.Errorf("the stream ends with %q, want [DONE]", lastData)
+	}
+}
+
+func TestAnthropicChatCompletionTranslatesRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    map[string]string
+		absent  []string
+	}{
+		{
+			name: "image parts",
+			request: `{"model":"claude-sonnet-4-5","messages":[{"role":"user","content":[{"type":"text","text":"Compare these images."},` +
+				`{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo="}},{"type":"image_url","image_url":{"url":"https://example.com/cat.jpg"}}]}]}`,
+			want: map[string]string{
+				"messages.0.content.#":                   "3",
+				"messages.0.content.0.type":              "text",
+				"messages.0.content.0.text":              "Compare these images.",
+				"messages.0.content.1.type":              "image",
+				"messages.0.content.1.source.type":       "base64",
+				"messages.0.content.1.source.media_type": "image/png",
+				"messages.0.content.1.source.data":       "iVBORw0KGgo=",
+				"messages.0.content.2.type":              "image",
+				"messages.0.content.2.source.type":       "url",
+				"messages.0.content.2.source.url":        "https://example.com/cat.jpg",
+			},
+		},
+		{
+			name: "tools and a tool round trip",
+			request: `{"model":"claude-sonnet-4-5","tool_choice":"required","parallel_tool_calls":false,"messages":[{"role":"user","content":"Weather in Paris?"},` +
+				`{"role":"assistant","content":null,"tool_calls":[{"id":"toolu_01","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},` +
+				`{"role":"tool","tool_call_id":"toolu_01","content":"Sunny"}],` +
+				`"tools":[{"type":"function","function":{"name":"get_weather","description":"Gets the weather","parameters":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}}]}`,
+			want: map[string]string{
+				"tools.#":             "1",
+				"tools.0.name":        "get_weather",
+				"tools.0.description": "Gets the weather",
+				"tools.0.input_schema.properties.city.type": "string",
+				"tools.0.input_schema.required.0":           "city",
+				"tool_choice.type":                          "any",
+				"tool_choice.disable_parallel_tool_use":     "true",
+				"messages.#":                                "3",
+				"messages.1.role":                           "assistant",
+				"messages.1.content.0.type":                 "tool_use",
+				"messages.1.content.0.id":                   "toolu_01",
+				"messages.1.content.0.name":                 "get_weather",
+				"messages.1.content.0.input.city":           "Paris",
+				"messages.2.role":                           "user",
+				"messages.2.content.0.type":                 "tool_result",
+				"messages.2.content.0.tool_use_id":          "toolu_01",
+				"messages.2.content.0.content":              "Sunny",
+			},
+		},
+		{
+			name: "named tool choice",
+			request: `{"model":"claude-sonnet-4-5","tool_choice":{"type":"function","function":{"name":"get_weather"}},"messages":[{"role":"user","content":"Hi"}],` +
+				`"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}]}`,
+			want:   map[string]string{"tool_choice.type": "tool", "tool_choice.name": "get_weather"},
+			absent: []string{"tool_choice.disable_parallel_tool_use"},
+		},
+		{
+			name:    "no tool choice",
+			request: `{"model":"claude-sonnet-4-5","tool_choice":"none","messages":[{"role":"user","content":"Hi"}],"tools":[{"type":"function","function":{"name":"get_weather"}}]}`,
+			want:    map[string]string{"tool_choice.type": "none", "tools.0.input_schema.type": "object"},
+		},
+		{
+			name:    "reasoning effort",
+			request: `{"model":"claude-sonnet-4-5","reasoning_effort":"low","temperature":0.2,"top_k":5,"messages":[{"role":"user","content":"Hi"}]}`,
+			want:    map[string]string{"thinking.type": "enabled", "thinking.budget_tokens": "1024", "max_tokens": "4096"},
+			absent:  []string{"temperature", "top_k"},
+		},
+		{
+			name:    "reasoning budget above max_tokens",
+			request: `{"model":"claude-sonnet-4-5","reasoning_effort":"medium","max_tokens":2000,"messages":[{"role":"user","content":"Hi"}]}`,
+			want:    map[string]string{"thinking.type": "enabled", "thinking.budget_tokens": "8192", "max_tokens": "12288"},
+		},
+		{
+			name:    "configured reasoning budget",
+			request: `{"model":"claude-sonnet-4-5","reasoning_effort":"high","max_tokens":64000,"messages":[{"role":"user","content":"Hi"}]}`,
+			want:    map[string]string{"thinking.type": "enabled", "thinking.budget_tokens": "32000", "max_tokens": "64000"},
+		},
+		{
+			name:    "disabled reasoning effort",
+			request: `{"model":"claude-sonnet-4-5","reasoning_effort":"minimal","temperature":0.2,"messages":[{"role":"user","content":"Hi"}]}`,
+			want:    map[string]string{"temperature": "0.2", "max_tokens": "4096"},
+			absent:  []string{"thinking"},
+		},
+	}
+
+	// The stub records the translated request and answers with a minimal message
+	var translated []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		translated, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"msg_01","type":"message","role":"assistant","content":[{"type":"text","text":"OK"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer server.Close()
+	providerInstance, err := NewProviderAnthropic(models.ProviderOptions{"thinking_budgets": map[string]interface{}{"high": 32000, "minimal": 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			translated = nil
+			_, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(test.request), anthropicTestModel(server), &Usage{})
+			if err != nil {
+				t.Fatalf("CreateChatCompletion() error = %v, body %s", err, errBody)
+			}
+			for path, want := range test.want {
+				if got := gjson.GetBytes(translated, path).String(); got != want {
+					t.Errorf("%s = %q, want %q", path, got, want)
+				}
+			}
+			for _, path := range test.absent {
+				if gjson.GetBytes(translated, path).Exists() {
+					t.Errorf("%s is set in %s", path, translated)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package provider
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// awsEventStreamPreludeLength is the length of the total length, headers length and prelude CRC fields
+	awsEventStreamPreludeLength = 12
+	// awsEventStreamMaxMessageLength is the largest message accepted by the decoder
+	awsEventStreamMaxMessageLength = 16 * 1024 * 1024
+)
+
+// awsEventStreamMessage is a decoded message of the AWS event stream encoding (application/vnd.amazon.eventstream)
+type awsEventStreamMessage struct {
+	// Headers are the message headers, values that are not strings are formatted with fmt
+	Headers map[string]string
+	// Payload is the message payload
+	Payload []byte
+}
+
+// readAWSEventStreamMessage reads and verifies one message from an AWS event stream.
+// It returns io.EOF when the stream ends between two messages.
+func readAWSEventStreamMessage(r io.Reader) (*awsEventStreamMessage, error) {
+	// Read the prelude.
+	prelude := make([]byte, awsEventStreamPreludeLength)
+	if _, err := io.ReadFull(r, prelude); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated event stream prelude")
+		}
+		return nil, err
+	}
+	totalLength := binary.BigEndian.Uint32(prelude[0:4])
+	headersLength := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[0:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, fmt.Errorf("event stream prelude checksum mismatch")
+	}
+	if totalLength < awsEventStreamPreludeLength+4+headersLength || totalLength > awsEventStreamMaxMessageLength {
+		return nil, fmt.Errorf("invalid event stream message length %d", totalLength)
+	}
+
+	// Read the rest of the message.
+	message := make([]byte, totalLength)
+	copy(message, prelude)
+	if _, err := io.ReadFull(r, message[awsEventStreamPreludeLength:]); err != nil {
+		return nil, fmt.Errorf("truncated event stream message: %w", err)
+	}
+	if crc32.ChecksumIEEE(message[:totalLength-4]) != binary.BigEndian.Uint32(message[totalLength-4:]) {
+		return nil, fmt.Errorf("event stream message checksum mismatch")
+	}
+
+	headers, err := parseAWSEventStreamHeaders(message[awsEventStreamPreludeLength : awsEventStreamPreludeLength+headersLength])
+	if err != nil {
+		return nil, err
+	}
+	return &awsEventStreamMessage{
+		Headers: headers,
+		Payload: message[awsEventStreamPreludeLength+headersLength : totalLength-4],
+	}, nil
+}
+
+// parseAWSEventStreamHeaders decodes the header section of an event stream message
+func parseAWSEventStreamHeaders(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for len(data) > 0 {
+		// Read the header name.
+		nameLength := int(data[0])
+		if len(data) < 1+nameLength+1 {
+			return nil, fmt.Errorf("truncated event stream header")
+		}
+		name := string(data[1 : 1+nameLength])
+		valueType := data[1+nameLength]
+		data = data[2+nameLength:]
+
+		// Read the header value.
+		var valueLength int
+		switch valueType {
+		case 0, 1:
+			headers[name] = fmt.Sprint(valueType == 0)
+			continue
+		case 2:
+			valueLength = 1
+		case 3:
+			valueLength = 2
+		case 4:
+			valueLength = 4
+		case 5, 8:
+			valueLength = 8
+		case 9:
+			valueLength = 16
+		case 6, 7:
+			if len(data) < 2 {
+				return nil, fmt.Errorf("truncated event stream header")
+			}
+			valueLength = int(binary.BigEndian.Uint16(data[0:2]))
+			data = data[2:]
+		default:
+			return nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+		if len(data) < valueLength {
+			return nil, fmt.Errorf("truncated event stream header")
+		}
+		value := data[:valueLength]
+		data = data[valueLength:]
+
+		switch valueType {
+		case 2:
+			headers[name] = fmt.Sprint(int8(value[0]))
+		case 3:
+			headers[name] = fmt.Sprint(int16(binary.BigEndian.Uint16(value)))
+		case 4:
+			headers[name] = fmt.Sprint(int32(binary.BigEndian.Uint32(value)))
+		case 5, 8:
+			headers[name] = fmt.Sprint(int64(binary.BigEndian.Uint64(value)))
+		case 9:
+			headers[name] = fmt.Sprintf("%x", value)
+		default:
+			headers[name] = string(value)
+		}
+	}
+	return headers, nil
+}
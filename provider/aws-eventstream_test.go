@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+// encodeAWSEventStreamMessage encodes a message with string headers in the AWS event stream encoding
+func encodeAWSEventStreamMessage(headers [][2]string, payload []byte) []byte {
+	var headerBytes bytes.Buffer
+	for _, header := range headers {
+		headerBytes.WriteByte(byte(len(header[0])))
+		headerBytes.WriteString(header[0])
+		headerBytes.WriteByte(7)
+		_ = binary.Write(&headerBytes, binary.BigEndian, uint16(len(header[1])))
+		headerBytes.WriteString(header[1])
+	}
+	totalLength := awsEventStreamPreludeLength + headerBytes.Len() + len(payload) + 4
+	message := make([]byte, 0, totalLength)
+	message = binary.BigEndian.AppendUint32(message, uint32(totalLength))
+	message = binary.BigEndian.AppendUint32(message, uint32(headerBytes.Len()))
+	message = binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(message))
+	message = append(message, headerBytes.Bytes()...)
+	message = append(message, payload...)
+	return binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(message))
+}
+
+func TestReadAWSEventStreamMessageVectors(t *testing.T) {
+	// The empty_message and payload_no_headers vectors of the aws-c-event-stream test suite.
+	tests := []struct {
+		name    string
+		frame   string
+		payload string
+	}{
+		{name: "empty message", frame: "0000001000000000" + "05c248eb" + "7d98c8ff", payload: ""},
+		{name: "payload without headers", frame: "0000001d00000000" + "fd528c5a" + "7b27666f6f273a27626172277d" + "c3653936", payload: "{'foo':'bar'}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := hex.DecodeString(test.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := readAWSEventStreamMessage(bytes.NewReader(frame))
+			if err != nil {
+				t.Fatalf("readAWSEventStreamMessage() error = %v", err)
+			}
+			if len(message.Headers) != 0 {
+				t.Errorf("Headers = %v, want none", message.Headers)
+			}
+			if string(message.Payload) != test.payload {
+				t.Errorf("Payload = %q, want %q", message.Payload, test.payload)
+			}
+		})
+	}
+}
+
+func TestReadAWSEventStreamMessageStream(t *testing.T) {
+	// Two ConverseStream deltas followed by the end of the stream.
+	headers := [][2]string{{":event-type", "contentBlockDelta"}, {":content-type", "application/json"}, {":message-type", "event"}}
+	payload := []byte(`{"contentBlockIndex":0,"delta":{"text":"Hello"}}`)
+	stream := bytes.NewReader(append(encodeAWSEventStreamMessage(headers, payload), encodeAWSEventStreamMessage(headers, payload)...))
+
+	for i := 0; i < 2; i++ {
+		message, err := readAWSEventStreamMessage(stream)
+		if err != nil {
+			t.Fatalf("message %d: readAWSEventStreamMessage() error = %v", i, err)
+		}
+		if message.Headers[":event-type"] != "contentBlockDelta" || message.Headers[":message-type"] != "event" {
+			t.Errorf("message %d: Headers = %v", i, message.Headers)
+		}
+		if !bytes.Equal(message.Payload, payload) {
+			t.Errorf("message %d: Payload = %q, want %q", i, message.Payload, payload)
+		}
+	}
+	if _, err := readAWSEventStreamMessage(stream); err != io.EOF {
+		t.Errorf("readAWSEventStreamMessage() at the end error = %v, want io.EOF", err)
+	}
+}
+
+func TestReadAWSEventStreamMessageErrors(t *testing.T) {
+	frame := encodeAWSEventStreamMessage([][2]string{{":message-type", "event"}}, []byte(`{"delta":{"text":"Hello"}}`))
+	corrupt := func(offset int) []byte {
+		corrupted := append([]byte{}, frame...)
+		corrupted[offset] ^= 0xff
+		return corrupted
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  string
+	}{
+		{name: "bad prelude CRC", frame: corrupt(9), want: "prelude checksum mismatch"},
+		{name: "bad message CRC", frame: corrupt(len(frame) - 1), want: "message checksum mismatch"},
+		{name: "corrupted payload", frame: corrupt(len(frame) - 6), want: "message checksum mismatch"},
+		{name: "truncated prelude", frame: frame[:6], want: "truncated event stream prelude"},
+		{name: "truncated message", frame: frame[:len(frame)-3], want: "truncated event stream message"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readAWSEventStreamMessage(bytes.NewReader(test.frame))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("readAWSEventStreamMessage() error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// awsTestSuiteCredentials and awsTestSuiteTime are the credentials and the time of the AWS Signature Version 4 test suite
+var (
+	awsTestSuiteCredentials = awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	awsTestSuiteTime        = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+func TestSignAWSRequestV4TestSuite(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		authorization string
+	}{
+		{
+			name:          "get-vanilla",
+			method:        "GET",
+			url:           "https://example.amazonaws.com/",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:          "get-vanilla-empty-query-key",
+			method:        "GET",
+			url:           "https://example.amazonaws.com/?Param1=value1",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb",
+		},
+		{
+			name:          "get-vanilla-query-order-key-case",
+			method:        "GET",
+			url:           "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:          "post-vanilla",
+			method:        "POST",
+			url:           "https://example.amazonaws.com/",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The user agent is not part of the signature.
+			req.Header.Set("User-Agent", "mini-router-test")
+			signAWSRequestV4(req, nil, awsTestSuiteCredentials, "us-east-1", "service", awsTestSuiteTime)
+			if got := req.Header.Get("Authorization"); got != test.authorization {
+				t.Errorf("Authorization = %q, want %q", got, test.authorization)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q, want 20150830T123600Z", got)
+			}
+		})
+	}
+}
+
+func TestSignAWSRequestV4SessionToken(t *testing.T) {
+	req, err := http.NewRequest("POST", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := awsTestSuiteCredentials
+	credentials.SessionToken = "session-token"
+	signAWSRequestV4(req, nil, credentials, "us-east-1", "service", awsTestSuiteTime)
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "session-token" {
+		t.Errorf("X-Amz-Security-Token = %q, want session-token", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("Authorization = %q, want the session token to be signed", got)
+	}
+}
+
+func TestAWSCanonicalURIEncodesModelIDTwice(t *testing.T) {
+	// Bedrock model ids contain a colon, which is escaped on the wire and escaped again in the canonical URI.
+	requestURL := "https://bedrock-runtime.us-east-1.amazonaws.com/model/" + awsURIEncode("anthropic.claude-3-haiku-20240307-v1:0") + "/converse"
+	req, err := http.NewRequest("POST", requestURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.URL.EscapedPath(), "/model/anthropic.claude-3-haiku-20240307-v1%3A0/converse"; got != want {
+		t.Errorf("EscapedPath() = %q, want %q", got, want)
+	}
+	if got, want := awsCanonicalURI(req.URL), "/model/anthropic.claude-3-haiku-20240307-v1%253A0/converse"; got != want {
+		t.Errorf("awsCanonicalURI() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// azureDefaultAPIVersion is the api-version used when the model does not set one
+	azureDefaultAPIVersion = "2024-10-21"
+	// azureAuthModeAPIKey sends the key in the api-key header
+	azureAuthModeAPIKey = "api-key"
+	// azureAuthModeBearer sends the key as a bearer token, for Microsoft Entra ID tokens
+	azureAuthModeBearer = "bearer"
+)
+
+// azureOptionTypes are the provider_options of the azure provider
+var azureOptionTypes = models.OptionTypes{
+	"deployment":  models.OptionString,
+	"api_version": models.OptionString,
+	"auth_mode":   models.OptionString,
+}
+
+// / NewProviderAzure creates a new Azure OpenAI provider.
+// / Options: deployment (defaults to provider_model_name), api_version and auth_mode (api-key or bearer).
+func NewProviderAzure(options models.ProviderOptions) (Provider, error) {
+	if err := options.Check(azureOptionTypes); err != nil {
+		return nil, err
+	}
+	p := &Azure{
+		OpenAICompatibility: &OpenAICompatibility{},
+		deployment:          options.String("deployment", ""),
+		apiVersion:          options.String("api_version", azureDefaultAPIVersion),
+		authMode:            options.String("auth_mode", azureAuthModeAPIKey),
+	}
+	if p.authMode != azureAuthModeAPIKey && p.authMode != azureAuthModeBearer {
+		return nil, fmt.Errorf("auth_mode must be %q or %q", azureAuthModeAPIKey, azureAuthModeBearer)
+	}
+
+	// Reuse the OpenAI compatible implementation with Azure's URLs, authentication and content filtering.
+	p.endpoint = p.deploymentURL
+	p.authorize = p.setAPIKey
+	p.transformChunk = transformAzureChunk
+	p.transformError = transformAzureError
+	return p, nil
+}
+
+// / init registers the provider.
+func init() {
+	RegisterProvider(_const.ProviderAzure, NewProviderAzure)
+}
+
+// / Azure implements the Provider interface for Azure OpenAI deployments.
+type Azure struct {
+	*OpenAICompatibility
+
+	// deployment is the deployment name, if empty the provider model name is used.
+	deployment string
+	// apiVersion is the api-version query parameter.
+	apiVersion string
+	// authMode selects how the API key is sent.
+	authMode string
+}
+
+// / GetProviderType returns the provider's type.
+func (p *Azure) GetProviderType() _const.ProviderType {
+	return _const.ProviderAzure
+}
+
+// deploymentURL returns the chat completions URL of the deployment
+func (p *Azure) deploymentURL(model models.Model) string {
+	// If base_url_direct is set, the base URL is the full URL.
+	if model.BaseURLDirect {
+		return model.BaseURL
+	}
+
+	deployment := p.deployment
+	if deployment == "" {
+		deployment = model.ProviderModelName
+	}
+	return fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", strings.TrimRight(model.BaseURL, "/"), url.PathEscape(deployment), url.QueryEscape(p.apiVersion))
+}
+
+// setAPIKey sets the authentication header for the configured auth mode
+func (p *Azure) setAPIKey(req *http.Request, apiKey string) {
+	if p.authMode == azureAuthModeBearer {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+		return
+	}
+	req.Header.Set("api-key", apiKey)
+}
+
+// transformAzureChunk drops Azure's prompt_filter_results chunks and strips the content filter annotations
+func transformAzureChunk(data []byte) []byte {
+	choices := gjson.GetBytes(data, "choices")
+
+	// The first chunk only carries prompt_filter_results and has no id or choices.
+	if len(choices.Array()) == 0 && !gjson.GetBytes(data, "usage").IsObject() {
+		return nil
+	}
+
+	data, _ = sjson.DeleteBytes(data, "prompt_filter_results")
+	for i, choice := range choices.Array() {
+		data, _ = sjson.DeleteBytes(data, fmt.Sprintf("choices.%d.content_filter_results", i))
+		data, _ = sjson.DeleteBytes(data, fmt.Sprintf("choices.%d.content_filter_offsets", i))
+
+		// Asynchronous filter annotations arrive as chunks with an empty delta and no finish reason.
+		delta := choice.Get("delta")
+		if len(choices.Array()) == 1 && delta.IsObject() && len(delta.Map()) == 0 && choice.Get("finish_reason").Type == gjson.Null && !gjson.GetBytes(data, "usage").IsObject() {
+			return nil
+		}
+	}
+	return data
+}
+
+// transformAzureError converts Azure content filter errors into OpenAI errors that name the filtered categories
+func transformAzureError(body []byte, statusCode int) []byte {
+	if gjson.GetBytes(body, "error.code").String() != "content_filter" {
+		return body
+	}
+
+	// Collect the categories that were filtered.
+	categories := make([]string, 0)
+	gjson.GetBytes(body, "error.innererror.content_filter_result").ForEach(func(key, value gjson.Result) bool {
+		if value.Get("filtered").Bool() {
+			categories = append(categories, key.String())
+		}
+		return true
+	})
+	sort.Strings(categories)
+
+	message := gjson.GetBytes(body, "error.message").String()
+	if len(categories) > 0 {
+		message = fmt.Sprintf("%s (filtered categories: %s)", message, strings.Join(categories, ", "))
+	}
+	return newOpenAIError(message, "content_filter", statusCode)
+}
@@ -0,0 +1,621 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// bedrockSigningService is the service name used in the Signature Version 4 scope
+	bedrockSigningService = "bedrock"
+	// bedrockDefaultSigningRegion is the signing region used with a custom base_url when no region is configured
+	bedrockDefaultSigningRegion = "us-east-1"
+)
+
+// bedrockFinishReasons maps Bedrock stop reasons to OpenAI finish reasons
+var bedrockFinishReasons = map[string]string{
+	"end_turn":             "stop",
+	"stop_sequence":        "stop",
+	"max_tokens":           "length",
+	"tool_use":             "tool_calls",
+	"guardrail_intervened": "content_filter",
+	"content_filtered":     "content_filter",
+}
+
+// bedrockImageFormats maps image media types to Bedrock image formats
+var bedrockImageFormats = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpeg",
+	"image/jpg":  "jpeg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// bedrockOptionTypes are the provider_options of the bedrock provider
+var bedrockOptionTypes = models.OptionTypes{
+	"region":                          models.OptionString,
+	"access_key_id":                   models.OptionString,
+	"secret_access_key":               models.OptionString,
+	"session_token":                   models.OptionString,
+	"thinking_budgets":                models.OptionMap,
+	"additional_model_request_fields": models.OptionMap,
+}
+
+// / NewProviderBedrock creates a new AWS Bedrock provider using the Converse API.
+// / Options: region, access_key_id, secret_access_key, session_token, thinking_budgets (a map of reasoning_effort to budget_tokens)
+// / and additional_model_request_fields. Credentials and region fall back to the standard AWS environment variables.
+func NewProviderBedrock(options models.ProviderOptions) (Provider, error) {
+	if err := options.Check(bedrockOptionTypes); err != nil {
+		return nil, err
+	}
+	p := &Bedrock{
+		region: options.String("region", ""),
+		credentials: awsCredentials{
+			AccessKeyID:     options.String("access_key_id", ""),
+			SecretAccessKey: options.String("secret_access_key", ""),
+			SessionToken:    options.String("session_token", ""),
+		},
+		thinkingBudgets: make(map[string]int),
+	}
+	if (p.credentials.AccessKeyID == "") != (p.credentials.SecretAccessKey == "") {
+		return nil, fmt.Errorf("access_key_id and secret_access_key must be set together")
+	}
+
+	// Thinking is only enabled for the configured efforts, not every Bedrock model supports it.
+	budgets := options.Map("thinking_budgets")
+	for effort := range budgets {
+		budget := budgets.Int(effort, -1)
+		if budget < 0 {
+			return nil, fmt.Errorf("thinking_budgets.%s must be a non-negative integer", effort)
+		}
+		p.thinkingBudgets[effort] = budget
+	}
+
+	// Model specific fields are passed through as additionalModelRequestFields.
+	if fields := options.Map("additional_model_request_fields"); len(fields) > 0 {
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return nil, fmt.Errorf("additional_model_request_fields: %w", err)
+		}
+		p.additionalModelRequestFields = data
+	}
+	return p, nil
+}
+
+// / init registers the provider.
+func init() {
+	RegisterProvider(_const.ProviderBedrock, NewProviderBedrock)
+}
+
+// / Bedrock implements the Provider interface for the AWS Bedrock Converse API.
+type Bedrock struct {
+	// region is the AWS region, if empty AWS_REGION or AWS_DEFAULT_REGION is used.
+	region string
+	// credentials are the configured credentials, if empty the environment is used.
+	credentials awsCredentials
+	// thinkingBudgets maps reasoning_effort values to thinking budgets.
+	thinkingBudgets map[string]int
+	// additionalModelRequestFields is the raw JSON sent as additionalModelRequestFields.
+	additionalModelRequestFields []byte
+}
+
+// / GetProviderType returns the provider's type.
+func (p *Bedrock) GetProviderType() _const.ProviderType {
+	return _const.ProviderBedrock
+}
+
+// / CreateChatCompletion creates a chat completion.
+func (p *Bedrock) CreateChatCompletion(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	// Convert the OpenAI request to a Converse request.
+	converseRequest, err := p.convertRequest(request, model)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, converseRequest, model, false)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Defer closing the response body.
+	defer func() {
+		err = resp.Body.Close()
+	}()
+
+	// Read the response body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode), convertBedrockError(data, resp.Header.Get("X-Amzn-Errortype"), resp.StatusCode)
+	}
+
+	// Check that the response has an output message.
+	if !gjson.GetBytes(data, "output.message").Exists() {
+		return nil, fmt.Errorf("unexpected response: %s", string(data)), data
+	}
+
+	return convertBedrockResponse(data, bedrockCompletionID(resp), model, usage), nil, nil
+}
+
+// / CreateChatCompletionStream creates a streaming chat completion.
+func (p *Bedrock) CreateChatCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	// Convert the OpenAI request to a Converse request.
+	converseRequest, err := p.convertRequest(request, model)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, converseRequest, model, true)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp.StatusCode), convertBedrockError(body, resp.Header.Get("X-Amzn-Errortype"), resp.StatusCode)
+	}
+
+	// Create a pipe.
+	pr, pw := io.Pipe()
+
+	// Start a goroutine to translate the event stream into OpenAI chunks.
+	go func() {
+		// Defer closing the pipe and the response body.
+		defer func() {
+			_ = pw.Close()
+			_ = resp.Body.Close()
+		}()
+
+		if errTranslate := translateBedrockStream(resp.Body, pw, bedrockCompletionID(resp), model, usage); errTranslate != nil {
+			// If reading fails, cancel the request.
+			cancel()
+		}
+	}()
+
+	return pr, nil, nil
+}
+
+// / Close closes the provider.
+func (p *Bedrock) Close() error {
+	return nil
+}
+
+// resolveRegion returns the configured region or the region of the environment
+func (p *Bedrock) resolveRegion() string {
+	if p.region != "" {
+		return p.region
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// resolveCredentials returns the configured credentials or the credentials of the environment
+func (p *Bedrock) resolveCredentials() (awsCredentials, error) {
+	if p.credentials.AccessKeyID != "" {
+		return p.credentials, nil
+	}
+	credentials := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials configured")
+	}
+	return credentials, nil
+}
+
+// doRequest sends a signed Converse or ConverseStream request
+func (p *Bedrock) doRequest(ctx context.Context, request []byte, model models.Model, stream bool) (*http.Response, error) {
+	credentials, err := p.resolveCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the URL, the model id is fully escaped like the AWS SDKs do (e.g. ':' becomes %3A).
+	// A custom base_url is signed for the default region when none is configured.
+	region := p.resolveRegion()
+	baseURL := model.BaseURL
+	if baseURL == "" {
+		if region == "" {
+			return nil, fmt.Errorf("no AWS region configured")
+		}
+		baseURL = fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", region)
+	}
+	if region == "" {
+		region = bedrockDefaultSigningRegion
+	}
+	requestURL := baseURL
+	if !model.BaseURLDirect {
+		operation := "converse"
+		if stream {
+			operation = "converse-stream"
+		}
+		requestURL = fmt.Sprintf("%s/model/%s/%s", strings.TrimRight(baseURL, "/"), awsURIEncode(model.ProviderModelName), operation)
+	}
+
+	// Create an HTTP request.
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBuffer(request))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the request headers.
+	req.Header.Set("Content-Type", "application/json")
+	if stream {
+		req.Header.Set("Accept", "application/vnd.amazon.eventstream")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+	// Add the model's headers and query parameters before signing, so they are part of the signature.
+	applyModelRequestOptions(req, model)
+	signAWSRequestV4(req, request, credentials, region, bedrockSigningService, time.Now())
+
+	// Use http.Client to send the request.
+	return newHttpClient(model.ProxyURL).Do(req)
+}
+
+// convertRequest converts an OpenAI chat completion request into a Converse request
+func (p *Bedrock) convertRequest(request []byte, model models.Model) ([]byte, error) {
+	out := []byte(`{"messages":[]}`)
+
+	// Convert the messages.
+	messageIndex := -1
+	lastRole := ""
+	for _, message := range gjson.GetBytes(request, "messages").Array() {
+		role := message.Get("role").String()
+
+		// System and developer messages become the system prompt.
+		if role == "system" || role == "developer" {
+			for _, text := range openAITextParts(message.Get("content")) {
+				if text == "" {
+					continue
+				}
+				block, _ := sjson.SetBytes([]byte(`{}`), "text", text)
+				out, _ = sjson.SetRawBytes(out, "system.-1", block)
+			}
+			continue
+		}
+
+		// Build the content blocks of the message.
+		blocks := make([][]byte, 0)
+		converseRole := "user"
+		switch role {
+		case "assistant":
+			converseRole = "assistant"
+			for _, text := range openAITextParts(message.Get("content")) {
+				if text == "" {
+					continue
+				}
+				block, _ := sjson.SetBytes([]byte(`{}`), "text", text)
+				blocks = append(blocks, block)
+			}
+			for _, toolCall := range message.Get("tool_calls").Array() {
+				block := []byte(`{"toolUse":{"toolUseId":"","name":"","input":{}}}`)
+				block, _ = sjson.SetBytes(block, "toolUse.toolUseId", toolCall.Get("id").String())
+				block, _ = sjson.SetBytes(block, "toolUse.name", toolCall.Get("function.name").String())
+				arguments := toolCall.Get("function.arguments").String()
+				if arguments != "" && gjson.Valid(arguments) {
+					block, _ = sjson.SetRawBytes(block, "toolUse.input", []byte(arguments))
+				}
+				blocks = append(blocks, block)
+			}
+		case "tool":
+			block := []byte(`{"toolResult":{"toolUseId":"","content":[{"text":""}]}}`)
+			block, _ = sjson.SetBytes(block, "toolResult.toolUseId", message.Get("tool_call_id").String())
+			block, _ = sjson.SetBytes(block, "toolResult.content.0.text", strings.Join(openAITextParts(message.Get("content")), ""))
+			blocks = append(blocks, block)
+		default:
+			userBlocks, err := convertBedrockUserContent(message.Get("content"))
+			if err != nil {
+				return nil, err
+			}
+			blocks = userBlocks
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		// Consecutive messages of the same role are merged, tool results become user messages.
+		if converseRole != lastRole {
+			messageIndex++
+			newMessage := []byte(`{"role":"","content":[]}`)
+			newMessage, _ = sjson.SetBytes(newMessage, "role", converseRole)
+			out, _ = sjson.SetRawBytes(out, "messages.-1", newMessage)
+			lastRole = converseRole
+		}
+		for _, block := range blocks {
+			out, _ = sjson.SetRawBytes(out, fmt.Sprintf("messages.%d.content.-1", messageIndex), block)
+		}
+	}
+
+	// Set the inference configuration.
+	maxTokens := gjson.GetBytes(request, "max_completion_tokens").Int()
+	if maxTokens == 0 {
+		maxTokens = gjson.GetBytes(request, "max_tokens").Int()
+	}
+	if maxTokens == 0 {
+		maxTokens = int64(model.MaxTokens)
+	}
+	if temperature := gjson.GetBytes(request, "temperature"); temperature.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "inferenceConfig.temperature", temperature.Float())
+	}
+	if topP := gjson.GetBytes(request, "top_p"); topP.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "inferenceConfig.topP", topP.Float())
+	}
+	stop := gjson.GetBytes(request, "stop")
+	if stop.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "inferenceConfig.stopSequences", []string{stop.String()})
+	} else if stop.IsArray() {
+		for _, item := range stop.Array() {
+			out, _ = sjson.SetBytes(out, "inferenceConfig.stopSequences.-1", item.String())
+		}
+	}
+
+	// Pass through the additional model request fields and map reasoning_effort to thinking.
+	if len(p.additionalModelRequestFields) > 0 {
+		out, _ = sjson.SetRawBytes(out, "additionalModelRequestFields", p.additionalModelRequestFields)
+	}
+	if reasoningEffortResult := gjson.GetBytes(request, "reasoning_effort"); reasoningEffortResult.Type == gjson.String {
+		if budget, ok := p.thinkingBudgets[reasoningEffortResult.String()]; ok && budget > 0 {
+			out, _ = sjson.SetBytes(out, "additionalModelRequestFields.thinking.type", "enabled")
+			out, _ = sjson.SetBytes(out, "additionalModelRequestFields.thinking.budget_tokens", budget)
+			// The thinking budget is part of maxTokens and sampling parameters are not allowed with thinking.
+			if maxTokens <= int64(budget) {
+				maxTokens = int64(budget) + anthropicDefaultMaxTokens
+			}
+			out, _ = sjson.DeleteBytes(out, "inferenceConfig.temperature")
+			out, _ = sjson.DeleteBytes(out, "inferenceConfig.topP")
+		}
+	}
+	if maxTokens > 0 {
+		out, _ = sjson.SetBytes(out, "inferenceConfig.maxTokens", maxTokens)
+	}
+
+	// Convert the tools.
+	for _, tool := range gjson.GetBytes(request, "tools").Array() {
+		if tool.Get("type").String() != "function" {
+			continue
+		}
+		toolSpec := []byte(`{"toolSpec":{"name":"","inputSchema":{"json":{"type":"object"}}}}`)
+		toolSpec, _ = sjson.SetBytes(toolSpec, "toolSpec.name", tool.Get("function.name").String())
+		if description := tool.Get("function.description"); description.Exists() && description.String() != "" {
+			toolSpec, _ = sjson.SetBytes(toolSpec, "toolSpec.description", description.String())
+		}
+		if parameters := tool.Get("function.parameters"); parameters.IsObject() {
+			toolSpec, _ = sjson.SetRawBytes(toolSpec, "toolSpec.inputSchema.json", []byte(parameters.Raw))
+		}
+		out, _ = sjson.SetRawBytes(out, "toolConfig.tools.-1", toolSpec)
+	}
+
+	// Convert tool_choice, Converse has no equivalent of none so the model decides.
+	if gjson.GetBytes(out, "toolConfig").Exists() {
+		toolChoice := gjson.GetBytes(request, "tool_choice")
+		switch {
+		case toolChoice.Type == gjson.String && toolChoice.String() == "auto":
+			out, _ = sjson.SetRawBytes(out, "toolConfig.toolChoice.auto", []byte(`{}`))
+		case toolChoice.Type == gjson.String && toolChoice.String() == "required":
+			out, _ = sjson.SetRawBytes(out, "toolConfig.toolChoice.any", []byte(`{}`))
+		case toolChoice.IsObject():
+			out, _ = sjson.SetBytes(out, "toolConfig.toolChoice.tool.name", toolChoice.Get("function.name").String())
+		}
+	}
+
+	return out, nil
+}
+
+// convertBedrockUserContent converts the content of an OpenAI user message into Converse content blocks
+func convertBedrockUserContent(content gjson.Result) ([][]byte, error) {
+	blocks := make([][]byte, 0)
+	if content.Type == gjson.String {
+		block, _ := sjson.SetBytes([]byte(`{}`), "text", content.String())
+		return append(blocks, block), nil
+	}
+
+	for _, part := range content.Array() {
+		switch part.Get("type").String() {
+		case "text":
+			block, _ := sjson.SetBytes([]byte(`{}`), "text", part.Get("text").String())
+			blocks = append(blocks, block)
+		case "image_url":
+			// Converse only accepts inline image bytes.
+			mediaType, data, err := parseDataURL(part.Get("image_url.url").String())
+			if err != nil {
+				return nil, fmt.Errorf("bedrock images must be base64 data URLs: %w", err)
+			}
+			format, ok := bedrockImageFormats[mediaType]
+			if !ok {
+				return nil, fmt.Errorf("unsupported image type %q", mediaType)
+			}
+			block := []byte(`{"image":{"format":"","source":{"bytes":""}}}`)
+			block, _ = sjson.SetBytes(block, "image.format", format)
+			block, _ = sjson.SetBytes(block, "image.source.bytes", data)
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+// bedrockCompletionID returns a completion id derived from the AWS request id
+func bedrockCompletionID(resp *http.Response) string {
+	requestID := resp.Header.Get("X-Amzn-Requestid")
+	if requestID == "" {
+		requestID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("chatcmpl-%s", requestID)
+}
+
+// convertBedrockResponse converts a Converse response into an OpenAI chat completion and fills the usage
+func convertBedrockResponse(data []byte, id string, model models.Model, usage *Usage) []byte {
+	out := []byte(`{"id":"","object":"chat.completion","created":0,"model":"","choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":null}]}`)
+	out, _ = sjson.SetBytes(out, "id", id)
+	out, _ = sjson.SetBytes(out, "created", time.Now().Unix())
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+
+	// Collect the text, reasoning and tool use blocks.
+	var content, reasoningContent strings.Builder
+	toolCallIndex := 0
+	for _, block := range gjson.GetBytes(data, "output.message.content").Array() {
+		switch {
+		case block.Get("text").Exists():
+			content.WriteString(block.Get("text").String())
+		case block.Get("reasoningContent").Exists():
+			reasoningContent.WriteString(block.Get("reasoningContent.reasoningText.text").String())
+		case block.Get("toolUse").Exists():
+			toolCall := []byte(`{"id":"","type":"function","function":{"name":"","arguments":""}}`)
+			toolCall, _ = sjson.SetBytes(toolCall, "id", block.Get("toolUse.toolUseId").String())
+			toolCall, _ = sjson.SetBytes(toolCall, "function.name", block.Get("toolUse.name").String())
+			toolCall, _ = sjson.SetBytes(toolCall, "function.arguments", block.Get("toolUse.input").Raw)
+			out, _ = sjson.SetRawBytes(out, fmt.Sprintf("choices.0.message.tool_calls.%d", toolCallIndex), toolCall)
+			toolCallIndex++
+		}
+	}
+	out, _ = sjson.SetBytes(out, "choices.0.message.content", content.String())
+	if reasoningContent.Len() > 0 {
+		out, _ = sjson.SetBytes(out, "choices.0.message.reasoning_content", reasoningContent.String())
+	}
+	out, _ = sjson.SetBytes(out, "choices.0.finish_reason", bedrockFinishReason(gjson.GetBytes(data, "stopReason").String()))
+
+	// Set the usage.
+	setBedrockUsage(gjson.GetBytes(data, "usage"), usage)
+	out, _ = sjson.SetBytes(out, "usage", usage)
+
+	return out
+}
+
+// setBedrockUsage copies the token counts of a Converse usage object into usage
+func setBedrockUsage(bedrockUsage gjson.Result, usage *Usage) {
+	cacheReadTokens := int(bedrockUsage.Get("cacheReadInputTokens").Int())
+	cacheWriteTokens := int(bedrockUsage.Get("cacheWriteInputTokens").Int())
+	usage.PromptTokens = int(bedrockUsage.Get("inputTokens").Int()) + cacheReadTokens + cacheWriteTokens
+	usage.PromptTokensDetails.CachedTokens = cacheReadTokens
+	usage.CompletionTokens = int(bedrockUsage.Get("outputTokens").Int())
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+}
+
+// bedrockFinishReason maps a Bedrock stop reason to an OpenAI finish reason
+func bedrockFinishReason(stopReason string) string {
+	if finishReason, ok := bedrockFinishReasons[stopReason]; ok {
+		return finishReason
+	}
+	return "stop"
+}
+
+// convertBedrockError converts a Bedrock error body into an OpenAI error body.
+// errorType is the x-amzn-ErrorType header, which may be followed by a colon and a URL.
+func convertBedrockError(body []byte, errorType string, statusCode int) []byte {
+	message := gjson.GetBytes(body, "message")
+	if !message.Exists() {
+		message = gjson.GetBytes(body, "Message")
+	}
+	if !message.Exists() {
+		return body
+	}
+	errorType, _, _ = strings.Cut(errorType, ":")
+	if errorType == "" {
+		errorType = "bedrock_error"
+	}
+	return newOpenAIError(message.String(), errorType, statusCode)
+}
+
+// translateBedrockStream reads ConverseStream events from r and writes OpenAI chat.completion.chunk events to w
+func translateBedrockStream(r io.Reader, w io.Writer, id string, model models.Model, usage *Usage) error {
+	created := time.Now().Unix()
+	// toolCallIndexes maps content block indexes to tool call indexes.
+	toolCallIndexes := make(map[int64]int)
+
+	for {
+		// Read an event stream message.
+		message, err := readAWSEventStreamMessage(r)
+		if err == io.EOF {
+			if errWrite := writeDataEvent(w, newUsageChunk(id, created, model.Name, usage)); errWrite != nil {
+				return errWrite
+			}
+			return writeDoneEvent(w)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Exceptions end the stream with an error chunk.
+		switch message.Headers[":message-type"] {
+		case "exception":
+			errorMessage := gjson.GetBytes(message.Payload, "message").String()
+			if errWrite := writeDataEvent(w, newOpenAIError(errorMessage, message.Headers[":exception-type"], http.StatusInternalServerError)); errWrite != nil {
+				return errWrite
+			}
+			return fmt.Errorf("bedrock stream exception %s: %s", message.Headers[":exception-type"], errorMessage)
+		case "error":
+			errorMessage := message.Headers[":error-message"]
+			if errWrite := writeDataEvent(w, newOpenAIError(errorMessage, message.Headers[":error-code"], http.StatusInternalServerError)); errWrite != nil {
+				return errWrite
+			}
+			return fmt.Errorf("bedrock stream error %s: %s", message.Headers[":error-code"], errorMessage)
+		}
+
+		data := message.Payload
+		var chunk []byte
+		switch message.Headers[":event-type"] {
+		case "messageStart":
+			chunk = newChatCompletionChunk(id, created, model.Name, []byte(`{"role":"assistant","content":""}`), "")
+		case "contentBlockStart":
+			if toolUse := gjson.GetBytes(data, "start.toolUse"); toolUse.Exists() {
+				toolCallIndex := len(toolCallIndexes)
+				toolCallIndexes[gjson.GetBytes(data, "contentBlockIndex").Int()] = toolCallIndex
+				delta := []byte(`{"tool_calls":[{"index":0,"id":"","type":"function","function":{"name":"","arguments":""}}]}`)
+				delta, _ = sjson.SetBytes(delta, "tool_calls.0.index", toolCallIndex)
+				delta, _ = sjson.SetBytes(delta, "tool_calls.0.id", toolUse.Get("toolUseId").String())
+				delta, _ = sjson.SetBytes(delta, "tool_calls.0.function.name", toolUse.Get("name").String())
+				chunk = newChatCompletionChunk(id, created, model.Name, delta, "")
+			}
+		case "contentBlockDelta":
+			delta := gjson.GetBytes(data, "delta")
+			switch {
+			case delta.Get("text").Exists():
+				openAIDelta, _ := sjson.SetBytes([]byte(`{}`), "content", delta.Get("text").String())
+				chunk = newChatCompletionChunk(id, created, model.Name, openAIDelta, "")
+			case delta.Get("reasoningContent.text").Exists():
+				openAIDelta, _ := sjson.SetBytes([]byte(`{}`), "reasoning_content", delta.Get("reasoningContent.text").String())
+				chunk = newChatCompletionChunk(id, created, model.Name, openAIDelta, "")
+			case delta.Get("toolUse").Exists():
+				toolCallIndex := toolCallIndexes[gjson.GetBytes(data, "contentBlockIndex").Int()]
+				openAIDelta := []byte(`{"tool_calls":[{"index":0,"function":{"arguments":""}}]}`)
+				openAIDelta, _ = sjson.SetBytes(openAIDelta, "tool_calls.0.index", toolCallIndex)
+				openAIDelta, _ = sjson.SetBytes(openAIDelta, "tool_calls.0.function.arguments", delta.Get("toolUse.input").String())
+				chunk = newChatCompletionChunk(id, created, model.Name, openAIDelta, "")
+			}
+		case "messageStop":
+			chunk = newChatCompletionChunk(id, created, model.Name, nil, bedrockFinishReason(gjson.GetBytes(data, "stopReason").String()))
+		case "metadata":
+			setBedrockUsage(gjson.GetBytes(data, "usage"), usage)
+		}
+
+		if chunk != nil {
+			if errWrite := writeDataEvent(w, chunk); errWrite != nil {
+				return errWrite
+			}
+		}
+	}
+}
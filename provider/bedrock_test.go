@@ -0,0 +1,310 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+)
+
+// bedrockTestCredentials are the fixed credentials of the Bedrock tests
+var bedrockTestCredentials = awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", SessionToken: "session-token"}
+
+// bedrockTestModelID is a Bedrock model id, its colon is escaped in the URL
+const bedrockTestModelID = "anthropic.claude-3-7-sonnet-20250219-v1:0"
+
+// bedrockTestRequest is an OpenAI chat completion request with a system prompt, an image, a tool round trip,
+// tools and reasoning_effort
+const bedrockTestRequest = `{"model":"claude","temperature":0.5,"reasoning_effort":"low","tool_choice":"required",` +
+	`"messages":[{"role":"system","content":"Be brief."},` +
+	`{"role":"user","content":[{"type":"text","text":"What is in the image, and the weather in Paris?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo="}}]},` +
+	`{"role":"assistant","content":null,"tool_calls":[{"id":"tooluse_01","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},` +
+	`{"role":"tool","tool_call_id":"tooluse_01","content":"Sunny"}],` +
+	`"tools":[{"type":"function","function":{"name":"get_weather","description":"Gets the weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}}]}`
+
+// bedrockTestStream are the events of a recorded ConverseStream response with reasoning, text and a tool call
+var bedrockTestStream = [][2]string{
+	{"messageStart", `{"p":"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRS","role":"assistant"}`},
+	{"contentBlockDelta", `{"contentBlockIndex":0,"delta":{"reasoningContent":{"text":"The user wants the weather."}},"p":"abcdefghijk"}`},
+	{"contentBlockDelta", `{"contentBlockIndex":0,"delta":{"reasoningContent":{"signature":"EqoBCkgIARABGAIiQF"}},"p":"abcd"}`},
+	{"contentBlockStop", `{"contentBlockIndex":0,"p":"abcdefghijklmnopqrstuvwxyzABCD"}`},
+	{"contentBlockDelta", `{"contentBlockIndex":1,"delta":{"text":"It is"},"p":"abcdefghijklmnopq"}`},
+	{"contentBlockDelta", `{"contentBlockIndex":1,"delta":{"text":" sunny."},"p":"abcdefghij"}`},
+	{"contentBlockStop", `{"contentBlockIndex":1,"p":"abcdefghijklmnopqrstuvwxyzABCD"}`},
+	{"contentBlockStart", `{"contentBlockIndex":2,"p":"abcdefghijklmnopqrstuvwx","start":{"toolUse":{"name":"get_weather","toolUseId":"tooluse_02"}}}`},
+	{"contentBlockDelta", `{"contentBlockIndex":2,"delta":{"toolUse":{"input":"{\"city\": "}},"p":"abcdefgh"}`},
+	{"contentBlockDelta", `{"contentBlockIndex":2,"delta":{"toolUse":{"input":"\"Lyon\"}"}},"p":"abcdefghijklmn"}`},
+	{"contentBlockStop", `{"contentBlockIndex":2,"p":"abcdefghijklmnopqrstuvwxyzABCD"}`},
+	{"messageStop", `{"p":"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUV","stopReason":"tool_use"}`},
+	{"metadata", `{"metrics":{"latencyMs":1021},"p":"abcdefghijklmn","usage":{"inputTokens":120,"cacheReadInputTokens":30,"outputTokens":45,"totalTokens":195}}`},
+}
+
+// newBedrockTestServer starts a Bedrock runtime that checks the signature and the Converse request, and answers
+// Converse with response and ConverseStream with the recorded event stream
+func newBedrockTestServer(t *testing.T, response string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := checkBedrockTestSignature(r, body); err != nil {
+			w.Header().Set("X-Amzn-Errortype", "InvalidSignatureException:http://internal.amazon.com/coral/com.amazon.coral.service/")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"message":"` + err.Error() + `"}`))
+			return
+		}
+		if err := checkBedrockTestRequest(body); err != nil {
+			w.Header().Set("X-Amzn-Errortype", "ValidationException:http://internal.amazon.com/coral/com.amazon.bedrock/")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message":"` + err.Error() + `"}`))
+			return
+		}
+
+		w.Header().Set("X-Amzn-Requestid", "b1e0c6d4-request")
+		switch r.URL.EscapedPath() {
+		case "/model/" + awsURIEncode(bedrockTestModelID) + "/converse":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(response))
+		case "/model/" + awsURIEncode(bedrockTestModelID) + "/converse-stream":
+			w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+			for _, event := range bedrockTestStream {
+				headers := [][2]string{{":event-type", event[0]}, {":content-type", "application/json"}, {":message-type", "event"}}
+				_, _ = w.Write(encodeAWSEventStreamMessage(headers, []byte(event[1])))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// checkBedrockTestSignature signs the request again with the test credentials at its X-Amz-Date and compares
+// the signatures, only the signed headers are copied
+func checkBedrockTestSignature(r *http.Request, body []byte) error {
+	authorization := r.Header.Get("Authorization")
+	_, signedHeaders, ok := strings.Cut(authorization, "SignedHeaders=")
+	if !ok {
+		return errors.New("missing signature")
+	}
+	signedHeaders, _, _ = strings.Cut(signedHeaders, ",")
+	if signedHeaders != "accept;content-type;host;x-amz-date;x-amz-security-token" {
+		return errors.New("unexpected signed headers " + signedHeaders)
+	}
+	signedAt, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(signedHeaders, ";") {
+		if name != "host" && name != "x-amz-date" && name != "x-amz-security-token" {
+			req.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	signAWSRequestV4(req, body, bedrockTestCredentials, "us-west-2", bedrockSigningService, signedAt)
+	if req.Header.Get("Authorization") != authorization {
+		return errors.New("signature mismatch")
+	}
+	if !strings.Contains(authorization, "Credential=AKIDEXAMPLE/"+signedAt.Format("20060102")+"/us-west-2/bedrock/aws4_request,") {
+		return errors.New("unexpected credential scope")
+	}
+	if r.Header.Get("X-Amz-Security-Token") != "session-token" {
+		return errors.New("missing session token")
+	}
+	return nil
+}
+
+// checkBedrockTestRequest checks the translation of bedrockTestRequest into a Converse request
+func checkBedrockTestRequest(body []byte) error {
+	checks := map[string]string{
+		"system.0.text":                                                     "Be brief.",
+		"messages.#":                                                        "3",
+		"messages.0.role":                                                   "user",
+		"messages.0.content.0.text":                                         "What is in the image, and the weather in Paris?",
+		"messages.0.content.1.image.format":                                 "png",
+		"messages.0.content.1.image.source.bytes":                           "iVBORw0KGgo=",
+		"messages.1.role":                                                   "assistant",
+		"messages.1.content.0.toolUse.toolUseId":                            "tooluse_01",
+		"messages.1.content.0.toolUse.name":                                 "get_weather",
+		"messages.1.content.0.toolUse.input.city":                           "Paris",
+		"messages.2.role":                                                   "user",
+		"messages.2.content.0.toolResult.toolUseId":                         "tooluse_01",
+		"messages.2.content.0.toolResult.content.0.text":                    "Sunny",
+		"toolConfig.tools.0.toolSpec.name":                                  "get_weather",
+		"toolConfig.tools.0.toolSpec.description":                           "Gets the weather",
+		"toolConfig.tools.0.toolSpec.inputSchema.json.properties.city.type": "string",
+		"additionalModelRequestFields.thinking.type":                        "enabled",
+		"additionalModelRequestFields.thinking.budget_tokens":               "2048",
+		"inferenceConfig.maxTokens":                                         "6144",
+	}
+	for path, want := range checks {
+		if got := gjson.GetBytes(body, path).String(); got != want {
+			return errors.New(path + " is " + got + ", want " + want)
+		}
+	}
+	if !gjson.GetBytes(body, "toolConfig.toolChoice.any").IsObject() {
+		return errors.New("tool_choice required is not toolChoice.any")
+	}
+	if gjson.GetBytes(body, "inferenceConfig.temperature").Exists() {
+		return errors.New("temperature is sent with thinking")
+	}
+	return nil
+}
+
+// newBedrockTestProvider creates a Bedrock provider with the test credentials and a thinking budget for low
+func newBedrockTestProvider(t *testing.T) Provider {
+	t.Helper()
+	providerInstance, err := NewProviderBedrock(models.ProviderOptions{
+		"region":            "us-west-2",
+		"access_key_id":     bedrockTestCredentials.AccessKeyID,
+		"secret_access_key": bedrockTestCredentials.SecretAccessKey,
+		"session_token":     bedrockTestCredentials.SessionToken,
+		"thinking_budgets":  map[string]interface{}{"low": 2048},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return providerInstance
+}
+
+// bedrockTestModel returns a model entry of the test server
+func bedrockTestModel(server *httptest.Server) models.Model {
+	return models.Model{Name: "claude", ProviderModelName: bedrockTestModelID, BaseURL: server.URL}
+}
+
+func TestBedrockChatCompletion(t *testing.T) {
+	server := newBedrockTestServer(t, `{"output":{"message":{"role":"assistant","content":[`+
+		`{"reasoningContent":{"reasoningText":{"text":"The user wants the weather.","signature":"EqoBCkgIARABGAIiQF"}}},`+
+		`{"text":"It is sunny."},{"toolUse":{"toolUseId":"tooluse_02","name":"get_weather","input":{"city":"Lyon"}}}]}},`+
+		`"stopReason":"tool_use","usage":{"inputTokens":120,"cacheReadInputTokens":30,"outputTokens":45,"totalTokens":195},"metrics":{"latencyMs":1021}}`)
+	providerInstance := newBedrockTestProvider(t)
+
+	usage := &Usage{}
+	response, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(bedrockTestRequest), bedrockTestModel(server), usage)
+	if err != nil {
+		t.Fatalf("CreateChatCompletion() error = %v, body %s", err, errBody)
+	}
+	checks := map[string]string{
+		"id":                                  "chatcmpl-b1e0c6d4-request",
+		"object":                              "chat.completion",
+		"model":                               "claude",
+		"choices.0.message.content":           "It is sunny.",
+		"choices.0.message.reasoning_content": "The user wants the weather.",
+		"choices.0.message.tool_calls.0.id":   "tooluse_02",
+		"choices.0.message.tool_calls.0.function.name": "get_weather",
+		"choices.0.finish_reason":                      "tool_calls",
+	}
+	for path, want := range checks {
+		if got := gjson.GetBytes(response, path).String(); got != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+	if arguments := gjson.GetBytes(response, "choices.0.message.tool_calls.0.function.arguments").String(); gjson.Get(arguments, "city").String() != "Lyon" {
+		t.Errorf("tool call arguments = %q, want the city Lyon", arguments)
+	}
+	if usage.PromptTokens != 150 || usage.PromptTokensDetails.CachedTokens != 30 || usage.CompletionTokens != 45 || usage.TotalTokens != 195 {
+		t.Errorf("usage = %+v, want 150 prompt tokens of which 30 cached and 45 completion tokens", usage)
+	}
+}
+
+func TestBedrockChatCompletionError(t *testing.T) {
+	server := newBedrockTestServer(t, "")
+	providerInstance := newBedrockTestProvider(t)
+
+	// Without a thinking budget for high the request has no thinking, which the stub rejects
+	request := strings.Replace(bedrockTestRequest, `"reasoning_effort":"low"`, `"reasoning_effort":"high"`, 1)
+	_, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(request), bedrockTestModel(server), &Usage{})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("CreateChatCompletion() error = %v, want status 400", err)
+	}
+	if got := gjson.GetBytes(errBody, "error.type").String(); got != "ValidationException" {
+		t.Errorf("error.type = %q, want ValidationException", got)
+	}
+	if got := gjson.GetBytes(errBody, "error.message").String(); !strings.Contains(got, ", want ") {
+		t.Errorf("error.message = %q, want the message of the validation error", got)
+	}
+}
+
+func TestBedrockChatCompletionStream(t *testing.T) {
+	server := newBedrockTestServer(t, "")
+	providerInstance := newBedrockTestProvider(t)
+
+	usage := &Usage{}
+	stream, err, errBody := providerInstance.CreateChatCompletionStream(context.Background(), func() {}, []byte(bedrockTestRequest), bedrockTestModel(server), usage)
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream() error = %v, body %s", err, errBody)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	var content, reasoningContent, arguments strings.Builder
+	finishReason, toolCallID, toolCallName, role, lastData := "", "", "", "", ""
+	var usageChunk []byte
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("data: ")) {
+			continue
+		}
+		data := bytes.TrimPrefix(line, []byte("data: "))
+		lastData = string(data)
+		if lastData == "[DONE]" {
+			continue
+		}
+		if gjson.GetBytes(data, "object").String() != "chat.completion.chunk" || gjson.GetBytes(data, "id").String() != "chatcmpl-b1e0c6d4-request" {
+			t.Errorf("unexpected chunk %s", data)
+		}
+		if gjson.GetBytes(data, "usage").Exists() {
+			usageChunk = append([]byte{}, data...)
+		}
+		delta := gjson.GetBytes(data, "choices.0.delta")
+		if value := delta.Get("role").String(); value != "" {
+			role = value
+		}
+		content.WriteString(delta.Get("content").String())
+		reasoningContent.WriteString(delta.Get("reasoning_content").String())
+		if id := delta.Get("tool_calls.0.id").String(); id != "" {
+			toolCallID, toolCallName = id, delta.Get("tool_calls.0.function.name").String()
+		}
+		arguments.WriteString(delta.Get("tool_calls.0.function.arguments").String())
+		if reason := gjson.GetBytes(data, "choices.0.finish_reason").String(); reason != "" {
+			finishReason = reason
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if role != "assistant" {
+		t.Errorf("role = %q, want assistant", role)
+	}
+	if content.String() != "It is sunny." || reasoningContent.String() != "The user wants the weather." {
+		t.Errorf("content = %q and reasoning_content = %q, want It is sunny. and The user wants the weather.", content.String(), reasoningContent.String())
+	}
+	if toolCallID != "tooluse_02" || toolCallName != "get_weather" || arguments.String() != `{"city": "Lyon"}` {
+		t.Errorf("tool call %s = %s(%s), want tooluse_02 = get_weather({\"city\": \"Lyon\"})", toolCallID, toolCallName, arguments.String())
+	}
+	if finishReason != "tool_calls" {
+		t.Errorf("finish_reason = %q, want tool_calls", finishReason)
+	}
+	if gjson.GetBytes(usageChunk, "usage.prompt_tokens").Int() != 150 || gjson.GetBytes(usageChunk, "usage.completion_tokens").Int() != 45 ||
+		gjson.GetBytes(usageChunk, "usage.prompt_tokens_details.cached_tokens").Int() != 30 {
+		t.Errorf("usage chunk = %s, want 150 prompt tokens of which 30 cached and 45 completion tokens", usageChunk)
+	}
+	if lastData != "[DONE]" {
+		t.Errorf("the stream ends with %q, want [DONE]", lastData)
+	}
+}
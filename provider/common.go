@@ -0,0 +1,254 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/sjson"
+)
+
+// apiKeyCounters stores the API key counters for each model
+var apiKeyCounters sync.Map
+
+// getAPIKey selects an API key from the model's API key list
+func getAPIKey(model models.Model) string {
+	if len(model.ProviderAPIKey) == 0 {
+		return ""
+	}
+
+	// Get the model's counter
+	counterValue, _ := apiKeyCounters.LoadOrStore(model.ID, int64(0))
+	counter := counterValue.(int64)
+
+	// Calculate the index and get the API key
+	index := int(counter) % len(model.ProviderAPIKey)
+	apiKey := model.ProviderAPIKey[index]
+
+	// Increment the counter
+	apiKeyCounters.Store(model.ID, counter+1)
+
+	// log.Printf("Using API key: %s", apiKey)
+
+	return apiKey
+}
+
+// clientHeadersKey is the context key of the client request headers
+type clientHeadersKey struct{}
+
+// WithClientHeaders returns a context carrying the client request headers.
+// Providers forward the headers named in the model's forward_headers allowlist.
+func WithClientHeaders(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, clientHeadersKey{}, header.Clone())
+}
+
+// applyModelRequestOptions adds the model's query parameters and headers and the allowlisted client headers to an upstream request.
+// Forwarded client headers never replace a header the provider has set, the model's headers do.
+func applyModelRequestOptions(req *http.Request, model models.Model) {
+	// Add the query parameters.
+	if len(model.QueryParams) > 0 {
+		query := req.URL.Query()
+		for name, value := range model.QueryParams {
+			query.Set(name, value)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+
+	// Forward the allowlisted client headers.
+	if clientHeaders, ok := req.Context().Value(clientHeadersKey{}).(http.Header); ok {
+		for _, name := range model.ForwardHeaders {
+			if values := clientHeaders.Values(name); len(values) > 0 && req.Header.Get(name) == "" {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+		}
+	}
+
+	// Set the model's headers.
+	for name, value := range model.Headers {
+		req.Header.Set(name, value)
+	}
+}
+
+// / newHttpClient creates a new HTTP client.
+// / proxyURL is an http, https or socks5 proxy URL, if empty the proxy is taken from the environment.
+func newHttpClient(proxyURL string) *http.Client {
+	// Create an HTTP transport.
+	transport := &http.Transport{
+		// Use the proxy of the environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY) by default.
+		Proxy: http.ProxyFromEnvironment,
+		// Set the connection context.
+		DialContext: (&net.Dialer{
+			// Set the connection timeout to 3 seconds.
+			Timeout: 3 * time.Second,
+			// Set keep-alive.
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+	}
+
+	// Use the configured proxy, the URL is validated when the configuration is loaded.
+	if proxyURL != "" {
+		if parsedProxyURL, err := url.Parse(proxyURL); err == nil {
+			transport.Proxy = http.ProxyURL(parsedProxyURL)
+		}
+	}
+
+	// Create an HTTP client without a global timeout.
+	return &http.Client{
+		// Set the transport.
+		Transport: transport,
+	}
+}
+
+// newChatCompletionChunk builds an OpenAI chat.completion.chunk with a single choice.
+// delta is the raw JSON of the choice delta, finishReason is omitted when empty.
+func newChatCompletionChunk(id string, created int64, model string, delta []byte, finishReason string) []byte {
+	chunk := []byte(`{"id":"","object":"chat.completion.chunk","created":0,"model":"","choices":[{"index":0,"delta":{},"finish_reason":null}]}`)
+	chunk, _ = sjson.SetBytes(chunk, "id", id)
+	chunk, _ = sjson.SetBytes(chunk, "created", created)
+	chunk, _ = sjson.SetBytes(chunk, "model", model)
+	if len(delta) > 0 {
+		chunk, _ = sjson.SetRawBytes(chunk, "choices.0.delta", delta)
+	}
+	if finishReason != "" {
+		chunk, _ = sjson.SetBytes(chunk, "choices.0.finish_reason", finishReason)
+	}
+	return chunk
+}
+
+// newUsageChunk builds the final chat.completion.chunk that carries the usage and no choices
+func newUsageChunk(id string, created int64, model string, usage *Usage) []byte {
+	chunk := []byte(`{"id":"","object":"chat.completion.chunk","created":0,"model":"","choices":[]}`)
+	chunk, _ = sjson.SetBytes(chunk, "id", id)
+	chunk, _ = sjson.SetBytes(chunk, "created", created)
+	chunk, _ = sjson.SetBytes(chunk, "model", model)
+	chunk, _ = sjson.SetBytes(chunk, "usage", usage)
+	return chunk
+}
+
+// writeDataEvent writes an SSE data event in the format expected by the streaming handler
+func writeDataEvent(w io.Writer, data []byte) error {
+	output := make([]byte, 0, len(data)+8)
+	output = append(output, "data: "...)
+	output = append(output, data...)
+	output = append(output, "\n\n"...)
+	_, err := w.Write(output)
+	return err
+}
+
+// writeDoneEvent writes the SSE [DONE] marker
+func writeDoneEvent(w io.Writer) error {
+	_, err := w.Write([]byte("data: [DONE]\n\n"))
+	return err
+}
+
+// parseDataURL splits a base64 data URL into its media type and base64 encoded data
+func parseDataURL(url string) (string, string, error) {
+	if !strings.HasPrefix(url, "data:") {
+		return "", "", fmt.Errorf("not a data URL")
+	}
+	header, data, found := strings.Cut(url[5:], ",")
+	if !found || !strings.HasSuffix(header, ";base64") {
+		return "", "", fmt.Errorf("unsupported data URL")
+	}
+	return strings.TrimSuffix(header, ";base64"), data, nil
+}
+
+// newOpenAIError builds an OpenAI style error body
+func newOpenAIError(message, errorType string, code int) []byte {
+	body := []byte(`{"error":{"message":"","type":"","code":0}}`)
+	body, _ = sjson.SetBytes(body, "error.message", message)
+	body, _ = sjson.SetBytes(body, "error.type", errorType)
+	body, _ = sjson.SetBytes(body, "error.code", code)
+	return body
+}
+
+// multipartReader returns a reader for the parts of a multipart/form-data body
+func multipartReader(body io.Reader, contentType string) (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, fmt.Errorf("content type must be multipart/form-data with a boundary")
+	}
+	return multipart.NewReader(body, params["boundary"]), nil
+}
+
+// MultipartFields returns the values of the text fields of a multipart/form-data body and the names of its file parts
+func MultipartFields(body []byte, contentType string) (map[string]string, map[string]bool, error) {
+	reader, err := multipartReader(bytes.NewReader(body), contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := make(map[string]string)
+	files := make(map[string]bool)
+	for {
+		part, errPart := reader.NextPart()
+		if errors.Is(errPart, io.EOF) {
+			return fields, files, nil
+		}
+		if errPart != nil {
+			return nil, nil, fmt.Errorf("invalid multipart body: %w", errPart)
+		}
+		if part.FileName() != "" {
+			files[part.FormName()] = true
+			continue
+		}
+		value, errRead := io.ReadAll(part)
+		if errRead != nil {
+			return nil, nil, fmt.Errorf("invalid multipart body: %w", errRead)
+		}
+		fields[part.FormName()] = string(value)
+	}
+}
+
+// ReplaceMultipartField returns a copy of a multipart/form-data body with the value of a text field replaced.
+// The other parts are copied unchanged and the boundary is kept, so the content type stays valid.
+func ReplaceMultipartField(body []byte, contentType, name, value string) ([]byte, error) {
+	reader, err := multipartReader(bytes.NewReader(body), contentType)
+	if err != nil {
+		return nil, err
+	}
+	_, params, _ := mime.ParseMediaType(contentType)
+
+	var out bytes.Buffer
+	writer := multipart.NewWriter(&out)
+	if err = writer.SetBoundary(params["boundary"]); err != nil {
+		return nil, err
+	}
+	for {
+		part, errPart := reader.NextRawPart()
+		if errors.Is(errPart, io.EOF) {
+			break
+		}
+		if errPart != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", errPart)
+		}
+		partWriter, errCreate := writer.CreatePart(part.Header)
+		if errCreate != nil {
+			return nil, errCreate
+		}
+		if part.FormName() == name && part.FileName() == "" {
+			_, err = io.WriteString(partWriter, value)
+		} else {
+			_, err = io.Copy(partWriter, part)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
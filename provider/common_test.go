@@ -0,0 +1,45 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+)
+
+func TestProxyURLRoutesUpstreamTraffic(t *testing.T) {
+	// The proxy answers for the upstream, whose host does not resolve, so only proxied requests can succeed.
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "upstream.invalid" || r.URL.Path != "/v1/chat/completions" {
+			http.Error(w, "unexpected proxy request", http.StatusBadGateway)
+			return
+		}
+		proxied.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`))
+	}))
+	defer proxy.Close()
+
+	providerInstance, err := NewProviderOpenAICompatibility(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerInstance.(*OpenAICompatibility).SetBaseUrl("http://upstream.invalid/v1")
+	model := models.Model{Name: "gpt-4o", ProviderModelName: "gpt-4o", ProxyURL: proxy.URL}
+
+	response, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`), model, &Usage{})
+	if err != nil {
+		t.Fatalf("CreateChatCompletion() error = %v, body %s", err, errBody)
+	}
+	if content := gjson.GetBytes(response, "choices.0.message.content").String(); content != "Hello" {
+		t.Errorf("content = %q, want Hello", content)
+	}
+	if got := proxied.Load(); got != 1 {
+		t.Errorf("the proxy received %d requests, want 1", got)
+	}
+}
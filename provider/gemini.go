@@ -0,0 +1,651 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// geminiDefaultBaseURL is the Gemini API base URL used when the model has no base_url
+	geminiDefaultBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+)
+
+// geminiThinkingBudgets maps reasoning_effort values to thinkingConfig.thinkingBudget, -1 is a dynamic budget
+var geminiThinkingBudgets = map[string]int{
+	"none":   0,
+	"auto":   -1,
+	"low":    1024,
+	"medium": 8192,
+	"high":   24576,
+}
+
+// geminiFinishReasons maps Gemini finish reasons to OpenAI finish reasons
+var geminiFinishReasons = map[string]string{
+	"STOP":               "stop",
+	"MAX_TOKENS":         "length",
+	"SAFETY":             "content_filter",
+	"RECITATION":         "content_filter",
+	"BLOCKLIST":          "content_filter",
+	"PROHIBITED_CONTENT": "content_filter",
+	"SPII":               "content_filter",
+	"IMAGE_SAFETY":       "content_filter",
+}
+
+// geminiOptionTypes are the provider_options of the gemini provider
+var geminiOptionTypes = models.OptionTypes{
+	"thinking_budgets": models.OptionMap,
+}
+
+// / NewProviderGemini creates a new Gemini provider.
+// / Options: thinking_budgets (a map of reasoning_effort to thinkingBudget).
+func NewProviderGemini(options models.ProviderOptions) (Provider, error) {
+	if err := options.Check(geminiOptionTypes); err != nil {
+		return nil, err
+	}
+	return newGemini(options)
+}
+
+// newGemini creates a Gemini provider from options that have been checked
+func newGemini(options models.ProviderOptions) (*Gemini, error) {
+	p := &Gemini{
+		thinkingBudgets: make(map[string]int, len(geminiThinkingBudgets)),
+	}
+
+	// Start from the default budgets and apply the configured ones.
+	for effort, budget := range geminiThinkingBudgets {
+		p.thinkingBudgets[effort] = budget
+	}
+	budgets := options.Map("thinking_budgets")
+	for effort := range budgets {
+		budget := budgets.Int(effort, -2)
+		if budget < -1 {
+			return nil, fmt.Errorf("thinking_budgets.%s must be an integer of at least -1", effort)
+		}
+		p.thinkingBudgets[effort] = budget
+	}
+
+	// Use the Gemini API endpoint and API key authentication.
+	p.endpoint = p.apiEndpoint
+	p.authorize = p.apiKeyAuthorize
+	return p, nil
+}
+
+// / init registers the provider.
+func init() {
+	RegisterProvider(_const.ProviderGemini, NewProviderGemini)
+}
+
+// / Gemini implements the Provider interface for the native Gemini generateContent API.
+type Gemini struct {
+	// thinkingBudgets maps reasoning_effort values to thinking budgets.
+	thinkingBudgets map[string]int
+	// endpoint returns the generateContent or streamGenerateContent URL for the model.
+	endpoint func(model models.Model, stream bool) (string, error)
+	// authorize sets the authentication of an upstream request.
+	authorize func(ctx context.Context, req *http.Request, model models.Model) error
+}
+
+// / GetProviderType returns the provider's type.
+func (p *Gemini) GetProviderType() _const.ProviderType {
+	return _const.ProviderGemini
+}
+
+// / CreateChatCompletion creates a chat completion.
+func (p *Gemini) CreateChatCompletion(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	// Convert the OpenAI request to a Gemini request.
+	geminiRequest, err := p.convertRequest(request)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, geminiRequest, model, false)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Defer closing the response body.
+	defer func() {
+		err = resp.Body.Close()
+	}()
+
+	// Read the response body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode), convertGeminiError(data, resp.StatusCode)
+	}
+
+	// Check that the response has candidates or prompt feedback.
+	if !gjson.GetBytes(data, "candidates").Exists() && !gjson.GetBytes(data, "promptFeedback").Exists() {
+		return nil, fmt.Errorf("unexpected response: %s", string(data)), data
+	}
+
+	return convertGeminiResponse(data, model, usage), nil, nil
+}
+
+// / CreateChatCompletionStream creates a streaming chat completion.
+func (p *Gemini) CreateChatCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	// Convert the OpenAI request to a Gemini request.
+	geminiRequest, err := p.convertRequest(request)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, geminiRequest, model, true)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp.StatusCode), convertGeminiError(body, resp.StatusCode)
+	}
+
+	// Create a pipe.
+	pr, pw := io.Pipe()
+
+	// Start a goroutine to translate the Gemini responses into OpenAI chunks.
+	go func() {
+		// Defer closing the pipe and the response body.
+		defer func() {
+			_ = pw.Close()
+			_ = resp.Body.Close()
+		}()
+
+		if errTranslate := translateGeminiStream(resp.Body, pw, model, usage); errTranslate != nil {
+			// If reading fails, cancel the request.
+			cancel()
+		}
+	}()
+
+	return pr, nil, nil
+}
+
+// / Close closes the provider.
+func (p *Gemini) Close() error {
+	return nil
+}
+
+// apiEndpoint returns the Gemini API URL for the model
+func (p *Gemini) apiEndpoint(model models.Model, stream bool) (string, error) {
+	baseURL := model.BaseURL
+	if baseURL == "" {
+		baseURL = geminiDefaultBaseURL
+	}
+	if model.BaseURLDirect {
+		return baseURL, nil
+	}
+	if stream {
+		return fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse", strings.TrimRight(baseURL, "/"), model.ProviderModelName), nil
+	}
+	return fmt.Sprintf("%s/models/%s:generateContent", strings.TrimRight(baseURL, "/"), model.ProviderModelName), nil
+}
+
+// apiKeyAuthorize authenticates a Gemini API request with the model's API key
+func (p *Gemini) apiKeyAuthorize(_ context.Context, req *http.Request, model models.Model) error {
+	if apiKey := getAPIKey(model); apiKey != "" {
+		req.Header.Set("x-goog-api-key", apiKey)
+	}
+	return nil
+}
+
+// doRequest sends a generateContent or streamGenerateContent request
+func (p *Gemini) doRequest(ctx context.Context, request []byte, model models.Model, stream bool) (*http.Response, error) {
+	// Build the URL.
+	url, err := p.endpoint(model, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create an HTTP request.
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(request))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the request headers.
+	req.Header.Set("Content-Type", "application/json")
+	if stream {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	if err = p.authorize(ctx, req, model); err != nil {
+		return nil, err
+	}
+	// Add the model's headers and query parameters.
+	applyModelRequestOptions(req, model)
+
+	// Use http.Client to send the request.
+	return newHttpClient(model.ProxyURL).Do(req)
+}
+
+// convertRequest converts an OpenAI chat completion request into a Gemini generateContent request
+func (p *Gemini) convertRequest(request []byte) ([]byte, error) {
+	out := []byte(`{"contents":[]}`)
+
+	// Remember the function names of the tool calls, Gemini function responses are matched by name.
+	toolCallNames := make(map[string]string)
+
+	// Convert the messages.
+	contentIndex := -1
+	lastRole := ""
+	for _, message := range gjson.GetBytes(request, "messages").Array() {
+		role := message.Get("role").String()
+
+		// System and developer messages become the system instruction.
+		if role == "system" || role == "developer" {
+			for _, text := range openAITextParts(message.Get("content")) {
+				part, _ := sjson.SetBytes([]byte(`{}`), "text", text)
+				out, _ = sjson.SetRawBytes(out, "systemInstruction.parts.-1", part)
+			}
+			continue
+		}
+
+		// Build the parts of the message.
+		parts := make([][]byte, 0)
+		geminiRole := "user"
+		switch role {
+		case "assistant":
+			geminiRole = "model"
+			for _, text := range openAITextParts(message.Get("content")) {
+				if text == "" {
+					continue
+				}
+				part, _ := sjson.SetBytes([]byte(`{}`), "text", text)
+				parts = append(parts, part)
+			}
+			for _, toolCall := range message.Get("tool_calls").Array() {
+				name := toolCall.Get("function.name").String()
+				toolCallNames[toolCall.Get("id").String()] = name
+				part := []byte(`{"functionCall":{"name":"","args":{}}}`)
+				part, _ = sjson.SetBytes(part, "functionCall.name", name)
+				arguments := toolCall.Get("function.arguments").String()
+				if arguments != "" && gjson.Valid(arguments) {
+					part, _ = sjson.SetRawBytes(part, "functionCall.args", []byte(arguments))
+				}
+				parts = append(parts, part)
+			}
+		case "tool":
+			content := strings.Join(openAITextParts(message.Get("content")), "")
+			part := []byte(`{"functionResponse":{"name":"","response":{}}}`)
+			part, _ = sjson.SetBytes(part, "functionResponse.name", toolCallNames[message.Get("tool_call_id").String()])
+			// Structured results are passed as they are, anything else is wrapped.
+			if gjson.Valid(content) && gjson.Parse(content).IsObject() {
+				part, _ = sjson.SetRawBytes(part, "functionResponse.response", []byte(content))
+			} else {
+				part, _ = sjson.SetBytes(part, "functionResponse.response.content", content)
+			}
+			parts = append(parts, part)
+		default:
+			content := message.Get("content")
+			if content.Type == gjson.String {
+				part, _ := sjson.SetBytes([]byte(`{}`), "text", content.String())
+				parts = append(parts, part)
+			}
+			for _, item := range content.Array() {
+				switch item.Get("type").String() {
+				case "text":
+					part, _ := sjson.SetBytes([]byte(`{}`), "text", item.Get("text").String())
+					parts = append(parts, part)
+				case "image_url":
+					part, err := geminiImagePart(item.Get("image_url.url").String())
+					if err != nil {
+						return nil, err
+					}
+					parts = append(parts, part)
+				}
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+
+		// Consecutive messages of the same role are merged.
+		if geminiRole != lastRole {
+			contentIndex++
+			content, _ := sjson.SetBytes([]byte(`{"parts":[]}`), "role", geminiRole)
+			out, _ = sjson.SetRawBytes(out, "contents.-1", content)
+			lastRole = geminiRole
+		}
+		for _, part := range parts {
+			out, _ = sjson.SetRawBytes(out, fmt.Sprintf("contents.%d.parts.-1", contentIndex), part)
+		}
+	}
+
+	// Convert the generation parameters.
+	if temperature := gjson.GetBytes(request, "temperature"); temperature.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "generationConfig.temperature", temperature.Float())
+	}
+	if topP := gjson.GetBytes(request, "top_p"); topP.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "generationConfig.topP", topP.Float())
+	}
+	if topK := gjson.GetBytes(request, "top_k"); topK.Type == gjson.Number && topK.Int() > 0 {
+		out, _ = sjson.SetBytes(out, "generationConfig.topK", topK.Int())
+	}
+	if seed := gjson.GetBytes(request, "seed"); seed.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "generationConfig.seed", seed.Int())
+	}
+	if n := gjson.GetBytes(request, "n"); n.Type == gjson.Number && n.Int() > 1 {
+		out, _ = sjson.SetBytes(out, "generationConfig.candidateCount", n.Int())
+	}
+	if presencePenalty := gjson.GetBytes(request, "presence_penalty"); presencePenalty.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "generationConfig.presencePenalty", presencePenalty.Float())
+	}
+	if frequencyPenalty := gjson.GetBytes(request, "frequency_penalty"); frequencyPenalty.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "generationConfig.frequencyPenalty", frequencyPenalty.Float())
+	}
+	maxTokens := gjson.GetBytes(request, "max_completion_tokens")
+	if maxTokens.Type != gjson.Number {
+		maxTokens = gjson.GetBytes(request, "max_tokens")
+	}
+	if maxTokens.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "generationConfig.maxOutputTokens", maxTokens.Int())
+	}
+	stop := gjson.GetBytes(request, "stop")
+	if stop.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "generationConfig.stopSequences", []string{stop.String()})
+	} else if stop.IsArray() {
+		for _, item := range stop.Array() {
+			out, _ = sjson.SetBytes(out, "generationConfig.stopSequences.-1", item.String())
+		}
+	}
+
+	// Convert response_format.
+	responseFormat := gjson.GetBytes(request, "response_format")
+	switch responseFormat.Get("type").String() {
+	case "json_object":
+		out, _ = sjson.SetBytes(out, "generationConfig.responseMimeType", "application/json")
+	case "json_schema":
+		out, _ = sjson.SetBytes(out, "generationConfig.responseMimeType", "application/json")
+		if schema := responseFormat.Get("json_schema.schema"); schema.IsObject() {
+			out, _ = sjson.SetRawBytes(out, "generationConfig.responseJsonSchema", []byte(schema.Raw))
+		}
+	}
+
+	// Map reasoning_effort to the thinking configuration.
+	if reasoningEffortResult := gjson.GetBytes(request, "reasoning_effort"); reasoningEffortResult.Type == gjson.String {
+		if budget, ok := p.thinkingBudgets[reasoningEffortResult.String()]; ok {
+			out, _ = sjson.SetBytes(out, "generationConfig.thinkingConfig.thinkingBudget", budget)
+			out, _ = sjson.SetBytes(out, "generationConfig.thinkingConfig.includeThoughts", budget != 0)
+		}
+	} else if thinkingConfig := gjson.GetBytes(request, "extra_body.google.thinking_config"); thinkingConfig.IsObject() {
+		// Accept the thinking configuration of the OpenAI compatible endpoint as well.
+		if budget := thinkingConfig.Get("thinking_budget"); budget.Type == gjson.Number {
+			out, _ = sjson.SetBytes(out, "generationConfig.thinkingConfig.thinkingBudget", budget.Int())
+		}
+		if includeThoughts := thinkingConfig.Get("include_thoughts"); includeThoughts.IsBool() {
+			out, _ = sjson.SetBytes(out, "generationConfig.thinkingConfig.includeThoughts", includeThoughts.Bool())
+		}
+	}
+
+	// Convert the tools to function declarations.
+	for _, tool := range gjson.GetBytes(request, "tools").Array() {
+		if tool.Get("type").String() != "function" {
+			continue
+		}
+		declaration, _ := sjson.SetBytes([]byte(`{}`), "name", tool.Get("function.name").String())
+		if description := tool.Get("function.description"); description.Exists() {
+			declaration, _ = sjson.SetBytes(declaration, "description", description.String())
+		}
+		if parameters := tool.Get("function.parameters"); parameters.IsObject() {
+			declaration, _ = sjson.SetRawBytes(declaration, "parametersJsonSchema", []byte(parameters.Raw))
+		}
+		out, _ = sjson.SetRawBytes(out, "tools.0.functionDeclarations.-1", declaration)
+	}
+
+	// Convert tool_choice.
+	toolChoice := gjson.GetBytes(request, "tool_choice")
+	switch {
+	case toolChoice.Type == gjson.String && toolChoice.String() == "auto":
+		out, _ = sjson.SetBytes(out, "toolConfig.functionCallingConfig.mode", "AUTO")
+	case toolChoice.Type == gjson.String && toolChoice.String() == "required":
+		out, _ = sjson.SetBytes(out, "toolConfig.functionCallingConfig.mode", "ANY")
+	case toolChoice.Type == gjson.String && toolChoice.String() == "none":
+		out, _ = sjson.SetBytes(out, "toolConfig.functionCallingConfig.mode", "NONE")
+	case toolChoice.IsObject():
+		out, _ = sjson.SetBytes(out, "toolConfig.functionCallingConfig.mode", "ANY")
+		out, _ = sjson.SetBytes(out, "toolConfig.functionCallingConfig.allowedFunctionNames", []string{toolChoice.Get("function.name").String()})
+	}
+
+	return out, nil
+}
+
+// geminiImagePart converts an OpenAI image URL into an inlineData or fileData part
+func geminiImagePart(url string) ([]byte, error) {
+	if strings.HasPrefix(url, "data:") {
+		mediaType, data, err := parseDataURL(url)
+		if err != nil {
+			return nil, err
+		}
+		part := []byte(`{"inlineData":{"mimeType":"","data":""}}`)
+		part, _ = sjson.SetBytes(part, "inlineData.mimeType", mediaType)
+		part, _ = sjson.SetBytes(part, "inlineData.data", data)
+		return part, nil
+	}
+
+	// Guess the media type from the file extension.
+	mediaType := mime.TypeByExtension(path.Ext(strings.SplitN(url, "?", 2)[0]))
+	if mediaType == "" {
+		mediaType = "image/jpeg"
+	}
+	part := []byte(`{"fileData":{"mimeType":"","fileUri":""}}`)
+	part, _ = sjson.SetBytes(part, "fileData.mimeType", mediaType)
+	part, _ = sjson.SetBytes(part, "fileData.fileUri", url)
+	return part, nil
+}
+
+// convertGeminiResponse converts a Gemini generateContent response into an OpenAI chat completion and fills the usage
+func convertGeminiResponse(data []byte, model models.Model, usage *Usage) []byte {
+	out := []byte(`{"id":"","object":"chat.completion","created":0,"model":"","choices":[]}`)
+	out, _ = sjson.SetBytes(out, "id", geminiResponseID(data))
+	out, _ = sjson.SetBytes(out, "created", time.Now().Unix())
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+
+	candidates := gjson.GetBytes(data, "candidates").Array()
+	for i, candidate := range candidates {
+		choice := []byte(`{"index":0,"message":{"role":"assistant","content":""},"finish_reason":null}`)
+		choice, _ = sjson.SetBytes(choice, "index", candidate.Get("index").Int())
+
+		// Collect the text, thoughts and function calls.
+		var content, reasoningContent strings.Builder
+		toolCallIndex := 0
+		for _, part := range candidate.Get("content.parts").Array() {
+			switch {
+			case part.Get("functionCall").Exists():
+				toolCall := []byte(`{"id":"","type":"function","function":{"name":"","arguments":""}}`)
+				toolCall, _ = sjson.SetBytes(toolCall, "id", fmt.Sprintf("call_%d_%d", i, toolCallIndex))
+				toolCall, _ = sjson.SetBytes(toolCall, "function.name", part.Get("functionCall.name").String())
+				toolCall, _ = sjson.SetBytes(toolCall, "function.arguments", geminiArguments(part.Get("functionCall.args")))
+				choice, _ = sjson.SetRawBytes(choice, fmt.Sprintf("message.tool_calls.%d", toolCallIndex), toolCall)
+				toolCallIndex++
+			case part.Get("thought").Bool():
+				reasoningContent.WriteString(part.Get("text").String())
+			default:
+				content.WriteString(part.Get("text").String())
+			}
+		}
+		choice, _ = sjson.SetBytes(choice, "message.content", content.String())
+		if reasoningContent.Len() > 0 {
+			choice, _ = sjson.SetBytes(choice, "message.reasoning_content", reasoningContent.String())
+		}
+		choice, _ = sjson.SetBytes(choice, "finish_reason", geminiFinishReason(candidate.Get("finishReason").String(), toolCallIndex > 0))
+		out, _ = sjson.SetRawBytes(out, "choices.-1", choice)
+	}
+
+	// A blocked prompt has no candidates.
+	if len(candidates) == 0 {
+		out, _ = sjson.SetRawBytes(out, "choices.-1", []byte(`{"index":0,"message":{"role":"assistant","content":""},"finish_reason":"content_filter"}`))
+	}
+
+	// Set the usage.
+	setGeminiUsage(gjson.GetBytes(data, "usageMetadata"), usage)
+	out, _ = sjson.SetBytes(out, "usage", usage)
+
+	return out
+}
+
+// geminiResponseID returns the response ID, or a generated one if Gemini did not send it
+func geminiResponseID(data []byte) string {
+	if responseID := gjson.GetBytes(data, "responseId").String(); responseID != "" {
+		return responseID
+	}
+	return fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+}
+
+// geminiArguments returns function call arguments as a JSON string
+func geminiArguments(args gjson.Result) string {
+	if !args.Exists() {
+		return "{}"
+	}
+	return args.Raw
+}
+
+// setGeminiUsage copies the token counts of a Gemini usageMetadata object into usage
+func setGeminiUsage(usageMetadata gjson.Result, usage *Usage) {
+	if !usageMetadata.Exists() {
+		return
+	}
+	thoughtsTokens := int(usageMetadata.Get("thoughtsTokenCount").Int())
+	usage.PromptTokens = int(usageMetadata.Get("promptTokenCount").Int())
+	usage.CompletionTokens = int(usageMetadata.Get("candidatesTokenCount").Int()) + thoughtsTokens
+	usage.TotalTokens = int(usageMetadata.Get("totalTokenCount").Int())
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	usage.PromptTokensDetails.CachedTokens = int(usageMetadata.Get("cachedContentTokenCount").Int())
+	usage.CompletionTokensDetails.ReasoningTokens = thoughtsTokens
+}
+
+// geminiFinishReason maps a Gemini finish reason to an OpenAI finish reason
+func geminiFinishReason(finishReason string, hasToolCalls bool) string {
+	if hasToolCalls && (finishReason == "STOP" || finishReason == "") {
+		return "tool_calls"
+	}
+	if openAIFinishReason, ok := geminiFinishReasons[finishReason]; ok {
+		return openAIFinishReason
+	}
+	return "stop"
+}
+
+// convertGeminiError converts a Google API error body into an OpenAI error body
+func convertGeminiError(body []byte, statusCode int) []byte {
+	// Errors may be returned as a single object or wrapped in an array.
+	errorResult := gjson.GetBytes(body, "error")
+	if !errorResult.Exists() {
+		errorResult = gjson.GetBytes(body, "0.error")
+	}
+	if !errorResult.Get("message").Exists() {
+		return body
+	}
+	return newOpenAIError(errorResult.Get("message").String(), errorResult.Get("status").String(), statusCode)
+}
+
+// translateGeminiStream reads Gemini SSE responses from r and writes OpenAI chat.completion.chunk events to w
+func translateGeminiStream(r io.Reader, w io.Writer, model models.Model, usage *Usage) error {
+	reader := bufio.NewReader(r)
+	id := ""
+	created := time.Now().Unix()
+	// started records the candidates whose role has been sent.
+	started := make(map[int64]bool)
+	// toolCallCounts counts the tool calls of each candidate.
+	toolCallCounts := make(map[int64]int)
+
+	for {
+		// Read a line of data.
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, _const.TagData) {
+			data := bytes.TrimPrefix(line, _const.TagData)
+			if id == "" {
+				id = geminiResponseID(data)
+			}
+			setGeminiUsage(gjson.GetBytes(data, "usageMetadata"), usage)
+
+			for _, candidate := range gjson.GetBytes(data, "candidates").Array() {
+				index := candidate.Get("index").Int()
+				chunks := make([][]byte, 0)
+
+				// Send the role with the first chunk of a candidate.
+				if !started[index] {
+					started[index] = true
+					chunks = append(chunks, []byte(`{"role":"assistant","content":""}`))
+				}
+
+				for _, part := range candidate.Get("content.parts").Array() {
+					switch {
+					case part.Get("functionCall").Exists():
+						delta := []byte(`{"tool_calls":[{"index":0,"id":"","type":"function","function":{"name":"","arguments":""}}]}`)
+						delta, _ = sjson.SetBytes(delta, "tool_calls.0.index", toolCallCounts[index])
+						delta, _ = sjson.SetBytes(delta, "tool_calls.0.id", fmt.Sprintf("call_%d_%d", index, toolCallCounts[index]))
+						delta, _ = sjson.SetBytes(delta, "tool_calls.0.function.name", part.Get("functionCall.name").String())
+						delta, _ = sjson.SetBytes(delta, "tool_calls.0.function.arguments", geminiArguments(part.Get("functionCall.args")))
+						chunks = append(chunks, delta)
+						toolCallCounts[index]++
+					case part.Get("thought").Bool():
+						delta, _ := sjson.SetBytes([]byte(`{}`), "reasoning_content", part.Get("text").String())
+						chunks = append(chunks, delta)
+					case part.Get("text").Exists():
+						delta, _ := sjson.SetBytes([]byte(`{}`), "content", part.Get("text").String())
+						chunks = append(chunks, delta)
+					}
+				}
+
+				for _, delta := range chunks {
+					chunk := newChatCompletionChunk(id, created, model.Name, delta, "")
+					chunk, _ = sjson.SetBytes(chunk, "choices.0.index", index)
+					if errWrite := writeDataEvent(w, chunk); errWrite != nil {
+						return errWrite
+					}
+				}
+
+				// Send the finish reason.
+				if finishReason := candidate.Get("finishReason").String(); finishReason != "" {
+					chunk := newChatCompletionChunk(id, created, model.Name, nil, geminiFinishReason(finishReason, toolCallCounts[index] > 0))
+					chunk, _ = sjson.SetBytes(chunk, "choices.0.index", index)
+					if errWrite := writeDataEvent(w, chunk); errWrite != nil {
+						return errWrite
+					}
+				}
+			}
+
+			// A blocked prompt has no candidates.
+			if blockReason := gjson.GetBytes(data, "promptFeedback.blockReason"); blockReason.Exists() && !gjson.GetBytes(data, "candidates").Exists() {
+				if errWrite := writeDataEvent(w, newChatCompletionChunk(id, created, model.Name, nil, "content_filter")); errWrite != nil {
+					return errWrite
+				}
+			}
+		}
+
+		if err == io.EOF {
+			// Send the usage and the end marker.
+			if errWrite := writeDataEvent(w, newUsageChunk(id, created, model.Name, usage)); errWrite != nil {
+				return errWrite
+			}
+			return writeDoneEvent(w)
+		}
+	}
+}
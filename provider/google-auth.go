@@ -0,0 +1,266 @@
+package provider
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// googleDefaultTokenURL is the OAuth token endpoint used when neither the options nor the service account set one
+	googleDefaultTokenURL = "https://oauth2.googleapis.com/token"
+	// googleCloudPlatformScope is the OAuth scope requested for Google Cloud APIs
+	googleCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	// googleAssertionLifetime is the lifetime of the signed JWT assertion
+	googleAssertionLifetime = time.Hour
+	// googleTokenRefreshMargin is how long before expiry an access token is refreshed
+	googleTokenRefreshMargin = 5 * time.Minute
+)
+
+// googleTokenSources caches the token sources by service account, token URL and scopes, so tokens survive provider instances
+var googleTokenSources sync.Map
+
+// googleServiceAccounts caches the parsed service accounts by key file path and modification time, or by the hash of
+// the inline JSON, so that the credentials are not read and parsed for every provider instance
+var googleServiceAccounts sync.Map
+
+// googleServiceAccount is the part of a Google service account key file that is used to mint tokens
+type googleServiceAccount struct {
+	// Type is the credential type, which must be service_account
+	Type string `json:"type"`
+	// ProjectID is the project of the service account
+	ProjectID string `json:"project_id"`
+	// PrivateKeyID is the id of the private key
+	PrivateKeyID string `json:"private_key_id"`
+	// PrivateKey is the PEM encoded private key
+	PrivateKey string `json:"private_key"`
+	// ClientEmail is the service account email
+	ClientEmail string `json:"client_email"`
+	// TokenURI is the OAuth token endpoint
+	TokenURI string `json:"token_uri"`
+}
+
+// parseGoogleServiceAccount parses and checks a service account key file
+func parseGoogleServiceAccount(data []byte) (*googleServiceAccount, error) {
+	account := &googleServiceAccount{}
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, fmt.Errorf("invalid service account JSON: %w", err)
+	}
+	if account.Type != "service_account" {
+		return nil, fmt.Errorf("credentials type must be service_account, got %q", account.Type)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, fmt.Errorf("service account JSON must contain client_email and private_key")
+	}
+	return account, nil
+}
+
+// loadGoogleServiceAccountFile returns the parsed service account of a key file. A file that is replaced or
+// modified is read again.
+func loadGoogleServiceAccountFile(path string) (*googleServiceAccount, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials_file: %w", err)
+	}
+	key := fmt.Sprintf("file|%s|%d|%d", path, info.ModTime().UnixNano(), info.Size())
+	if account, ok := googleServiceAccounts.Load(key); ok {
+		return account.(*googleServiceAccount), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials_file: %w", err)
+	}
+	account, err := parseGoogleServiceAccount(data)
+	if err != nil {
+		return nil, err
+	}
+	googleServiceAccounts.Store(key, account)
+	return account, nil
+}
+
+// loadGoogleServiceAccountJSON returns the parsed service account of an inline key
+func loadGoogleServiceAccountJSON(data []byte) (*googleServiceAccount, error) {
+	key := "json|" + sha256Hex(data)
+	if account, ok := googleServiceAccounts.Load(key); ok {
+		return account.(*googleServiceAccount), nil
+	}
+
+	account, err := parseGoogleServiceAccount(data)
+	if err != nil {
+		return nil, err
+	}
+	googleServiceAccounts.Store(key, account)
+	return account, nil
+}
+
+// googleTokenSource mints OAuth access tokens for a service account with the JWT bearer flow and caches them
+type googleTokenSource struct {
+	// account is the service account
+	account *googleServiceAccount
+	// privateKey is the parsed private key of the service account
+	privateKey *rsa.PrivateKey
+	// tokenURL is the OAuth token endpoint
+	tokenURL string
+	// scopes are the space separated scopes requested
+	scopes string
+
+	// mutex protects the cached token
+	mutex sync.Mutex
+	// accessToken is the cached access token
+	accessToken string
+	// expiry is when the cached access token expires
+	expiry time.Time
+}
+
+// getGoogleTokenSource returns the cached token source of the service account, creating it if needed
+func getGoogleTokenSource(account *googleServiceAccount, tokenURL, scopes string) (*googleTokenSource, error) {
+	key := strings.Join([]string{account.ClientEmail, account.PrivateKeyID, tokenURL, scopes}, "|")
+	if source, ok := googleTokenSources.Load(key); ok {
+		return source.(*googleTokenSource), nil
+	}
+
+	privateKey, err := parseRSAPrivateKey(account.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	source, _ := googleTokenSources.LoadOrStore(key, &googleTokenSource{
+		account:    account,
+		privateKey: privateKey,
+		tokenURL:   tokenURL,
+		scopes:     scopes,
+	})
+	return source.(*googleTokenSource), nil
+}
+
+// Token returns a valid access token, minting a new one through proxyURL when the cached token is about to expire
+func (s *googleTokenSource) Token(ctx context.Context, proxyURL string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.accessToken != "" && time.Now().Add(googleTokenRefreshMargin).Before(s.expiry) {
+		return s.accessToken, nil
+	}
+
+	accessToken, expiresIn, err := s.fetchToken(ctx, proxyURL)
+	if err != nil {
+		return "", err
+	}
+	s.accessToken = accessToken
+	s.expiry = time.Now().Add(expiresIn)
+	return s.accessToken, nil
+}
+
+// fetchToken exchanges a signed JWT assertion for an access token
+func (s *googleTokenSource) fetchToken(ctx context.Context, proxyURL string) (string, time.Duration, error) {
+	assertion, err := s.signAssertion(time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Create an HTTP request.
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Use http.Client to send the request.
+	resp, err := newHttpClient(proxyURL).Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("token request failed: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("token request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token request failed with status %s: %s", resp.Status, string(data))
+	}
+
+	accessToken := gjson.GetBytes(data, "access_token").String()
+	if accessToken == "" {
+		return "", 0, fmt.Errorf("token response has no access_token")
+	}
+	expiresIn := time.Duration(gjson.GetBytes(data, "expires_in").Int()) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = googleAssertionLifetime
+	}
+	return accessToken, expiresIn, nil
+}
+
+// signAssertion builds the RS256 signed JWT assertion of the service account
+func (s *googleTokenSource) signAssertion(now time.Time) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if s.account.PrivateKeyID != "" {
+		header["kid"] = s.account.PrivateKeyID
+	}
+	claims := map[string]interface{}{
+		"iss":   s.account.ClientEmail,
+		"scope": s.scopes,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(googleAssertionLifetime).Unix(),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("signing the token assertion failed: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded PKCS#8 or PKCS#1 RSA private key
+func parseRSAPrivateKey(privateKeyPEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("private_key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private_key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private_key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,763 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// mockModeEcho answers with the text of the last user message
+	mockModeEcho = "echo"
+	// mockModeCanned answers with the configured content
+	mockModeCanned = "canned"
+	// mockDefaultChunks is the number of content chunks streamed when the model does not set one
+	mockDefaultChunks = 10
+	// mockCharsPerToken is the number of characters counted as one token by the synthetic usage
+	mockCharsPerToken = 4
+	// mockAudioBytesPerSecond is the audio bit rate assumed to derive the duration from the size of an upload
+	mockAudioBytesPerSecond = 16000
+	// mockSpeechBytesPerCharacter is the length of the silence synthesized per input character, 60 ms of 16-bit 24 kHz PCM
+	mockSpeechBytesPerCharacter = 2880
+	// mockDefaultTranscription is the text of transcriptions in echo mode when the request has no prompt
+	mockDefaultTranscription = "This is a mock transcription."
+	// mockDefaultEmbeddingDimensions is the length of the embeddings when the request does not set dimensions
+	mockDefaultEmbeddingDimensions = 8
+	// mockDefaultFlaggedCategory is the moderation category of flagged inputs when the model does not set one
+	mockDefaultFlaggedCategory = "harassment"
+)
+
+// mockModerationCategories are the categories of moderation results
+var mockModerationCategories = []string{
+	"harassment", "harassment/threatening", "hate", "hate/threatening", "illicit", "illicit/violent",
+	"self-harm", "self-harm/intent", "self-harm/instructions", "sexual", "sexual/minors", "violence", "violence/graphic",
+}
+
+// mockImage is the image returned by image requests, a base64 encoded 1x1 PNG
+const mockImage = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII="
+
+// mockMalformedEvent is the stream event written when malformed SSE is injected, it lacks the data: prefix
+var mockMalformedEvent = []byte("{\"malformed\":true\n\n")
+
+// mockOptionTypes are the provider_options of the mock provider
+var mockOptionTypes = models.OptionTypes{
+	"mode":                   models.OptionString,
+	"content":                models.OptionString,
+	"chunks":                 models.OptionInt,
+	"chunk_interval":         models.OptionDuration,
+	"latency":                models.OptionDuration,
+	"latency_probability":    models.OptionFloat,
+	"error_probability":      models.OptionFloat,
+	"error_status":           models.OptionInt,
+	"error_message":          models.OptionString,
+	"malformed_probability":  models.OptionFloat,
+	"disconnect_probability": models.OptionFloat,
+	"prompt_tokens":          models.OptionInt,
+	"completion_tokens":      models.OptionInt,
+	"embedding_dimensions":   models.OptionInt,
+	"flagged_words":          models.OptionString,
+	"flagged_category":       models.OptionString,
+}
+
+// / NewProviderMock creates a new mock provider that answers without calling an upstream.
+// / Options: mode (echo or canned), content, chunks, chunk_interval, latency, latency_probability, error_probability,
+// / error_status, error_message, malformed_probability, disconnect_probability, prompt_tokens, completion_tokens,
+// / embedding_dimensions, flagged_words and flagged_category.
+func NewProviderMock(options models.ProviderOptions) (Provider, error) {
+	if err := options.Check(mockOptionTypes); err != nil {
+		return nil, err
+	}
+	p := &Mock{
+		mode:                  options.String("mode", mockModeEcho),
+		content:               options.String("content", ""),
+		chunks:                options.Int("chunks", mockDefaultChunks),
+		chunkInterval:         options.Duration("chunk_interval", 0),
+		latency:               options.Duration("latency", 0),
+		latencyProbability:    options.Float("latency_probability", 1),
+		errorProbability:      options.Float("error_probability", 0),
+		errorStatus:           options.Int("error_status", http.StatusInternalServerError),
+		errorMessage:          options.String("error_message", "mock provider error"),
+		malformedProbability:  options.Float("malformed_probability", 0),
+		disconnectProbability: options.Float("disconnect_probability", 0),
+		promptTokens:          options.Int("prompt_tokens", -1),
+		completionTokens:      options.Int("completion_tokens", -1),
+		embeddingDimensions:   options.Int("embedding_dimensions", mockDefaultEmbeddingDimensions),
+		flaggedCategory:       options.String("flagged_category", mockDefaultFlaggedCategory),
+	}
+	for _, word := range strings.Split(options.String("flagged_words", ""), ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			p.flaggedWords = append(p.flaggedWords, word)
+		}
+	}
+
+	// Check the options.
+	switch p.mode {
+	case mockModeEcho:
+	case mockModeCanned:
+		if p.content == "" {
+			return nil, fmt.Errorf("content is required in canned mode")
+		}
+	default:
+		return nil, fmt.Errorf("mode must be %q or %q", mockModeEcho, mockModeCanned)
+	}
+	if p.chunks < 1 {
+		return nil, fmt.Errorf("chunks must be at least 1")
+	}
+	if p.embeddingDimensions < 1 {
+		return nil, fmt.Errorf("embedding_dimensions must be at least 1")
+	}
+	if !slices.Contains(mockModerationCategories, p.flaggedCategory) {
+		return nil, fmt.Errorf("flagged_category must be a moderation category such as %q", mockDefaultFlaggedCategory)
+	}
+	if p.chunkInterval < 0 || p.latency < 0 {
+		return nil, fmt.Errorf("chunk_interval and latency must not be negative")
+	}
+	if p.errorStatus < 400 || p.errorStatus > 599 {
+		return nil, fmt.Errorf("error_status must be a 4xx or 5xx status code")
+	}
+	probabilities := map[string]float64{
+		"latency_probability":    p.latencyProbability,
+		"error_probability":      p.errorProbability,
+		"malformed_probability":  p.malformedProbability,
+		"disconnect_probability": p.disconnectProbability,
+	}
+	for name, probability := range probabilities {
+		if probability < 0 || probability > 1 {
+			return nil, fmt.Errorf("%s must be between 0 and 1", name)
+		}
+	}
+	return p, nil
+}
+
+// / init registers the provider.
+func init() {
+	RegisterProvider(_const.ProviderMock, NewProviderMock)
+}
+
+// / Mock implements the Provider interface with generated responses and injected failures, for tests and load tests.
+type Mock struct {
+	// mode is echo or canned.
+	mode string
+	// content is the response content in canned mode.
+	content string
+	// chunks is the number of content chunks of a streamed response.
+	chunks int
+	// chunkInterval is the delay between streamed chunks.
+	chunkInterval time.Duration
+	// latency is the delay before the response starts.
+	latency time.Duration
+	// latencyProbability is the probability that the latency is applied.
+	latencyProbability float64
+	// errorProbability is the probability that the request fails with errorStatus.
+	errorProbability float64
+	// errorStatus is the HTTP status code of an injected error.
+	errorStatus int
+	// errorMessage is the message of an injected error.
+	errorMessage string
+	// malformedProbability is the probability that the response is malformed.
+	malformedProbability float64
+	// disconnectProbability is the probability that the connection drops.
+	disconnectProbability float64
+	// promptTokens is the reported prompt token count, negative to estimate it from the request.
+	promptTokens int
+	// completionTokens is the reported completion token count, negative to estimate it from the content.
+	completionTokens int
+	// embeddingDimensions is the length of the embeddings when the request does not set dimensions.
+	embeddingDimensions int
+	// flaggedWords are the lowercase words that get a moderation input flagged.
+	flaggedWords []string
+	// flaggedCategory is the moderation category of flagged inputs.
+	flaggedCategory string
+}
+
+// / GetProviderType returns the provider's type.
+func (p *Mock) GetProviderType() _const.ProviderType {
+	return _const.ProviderMock
+}
+
+// / CreateChatCompletion creates a chat completion.
+func (p *Mock) CreateChatCompletion(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	return p.createResponse(ctx, request, model, usage, false)
+}
+
+// / CreateChatCompletionStream creates a streaming chat completion.
+func (p *Mock) CreateChatCompletionStream(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	return p.createStream(ctx, request, model, usage, false)
+}
+
+// / CreateCompletion creates a legacy text completion.
+func (p *Mock) CreateCompletion(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	return p.createResponse(ctx, request, model, usage, true)
+}
+
+// / CreateCompletionStream creates a streaming legacy text completion.
+func (p *Mock) CreateCompletionStream(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	return p.createStream(ctx, request, model, usage, true)
+}
+
+// / CreateEmbedding creates deterministic embeddings derived from the inputs.
+func (p *Mock) CreateEmbedding(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	if err, errBody := p.injectFailure(ctx); err != nil {
+		return nil, err, errBody
+	}
+	if mockChance(p.malformedProbability) {
+		return nil, fmt.Errorf("unexpected response: %s", string(mockMalformedEvent)), mockMalformedEvent
+	}
+
+	dimensions := p.embeddingDimensions
+	if value := gjson.GetBytes(request, "dimensions"); value.Type == gjson.Number && value.Int() > 0 {
+		dimensions = int(value.Int())
+	}
+
+	// Single inputs are a string or a token array, other arrays hold several inputs.
+	input := gjson.GetBytes(request, "input")
+	inputs := []gjson.Result{input}
+	if input.IsArray() && len(input.Array()) > 0 && input.Array()[0].Type != gjson.Number {
+		inputs = input.Array()
+	}
+
+	// Build the response.
+	out := []byte(`{"object":"list","data":[],"model":""}`)
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+	promptTokens := 0
+	for i, item := range inputs {
+		embedding := mockEmbedding(item.Raw, dimensions)
+		entry, _ := sjson.SetBytes([]byte(`{"object":"embedding","index":0}`), "index", i)
+		entry, _ = sjson.SetBytes(entry, "embedding", embedding)
+		out, _ = sjson.SetRawBytes(out, "data.-1", entry)
+		if item.Type == gjson.String {
+			promptTokens += estimateMockTokens(item.String())
+		} else {
+			promptTokens += len(item.Array())
+		}
+	}
+	usage.PromptTokens = p.promptTokens
+	if usage.PromptTokens < 0 {
+		usage.PromptTokens = promptTokens
+	}
+	usage.TotalTokens = usage.PromptTokens
+	out, _ = sjson.SetBytes(out, "usage", map[string]int{"prompt_tokens": usage.PromptTokens, "total_tokens": usage.TotalTokens})
+	return out, nil, nil
+}
+
+// / CreateModeration flags the inputs that contain one of the flagged words, ignoring case.
+func (p *Mock) CreateModeration(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, _ *Usage) ([]byte, error, []byte) {
+	if err, errBody := p.injectFailure(ctx); err != nil {
+		return nil, err, errBody
+	}
+	if mockChance(p.malformedProbability) {
+		return nil, fmt.Errorf("unexpected response: %s", string(mockMalformedEvent)), mockMalformedEvent
+	}
+
+	// The input is a string or an array of strings with a result each, or an array of multimodal parts with one
+	// result for their texts.
+	input := gjson.GetBytes(request, "input")
+	texts := []string{input.String()}
+	switch {
+	case input.Get("0").IsObject():
+		parts := make([]string, 0)
+		for _, item := range input.Array() {
+			parts = append(parts, item.Get("text").String())
+		}
+		texts = []string{strings.Join(parts, "\n")}
+	case input.IsArray():
+		texts = make([]string, 0)
+		for _, item := range input.Array() {
+			texts = append(texts, item.String())
+		}
+	}
+
+	// Build the response.
+	out := []byte(`{"id":"","model":"","results":[]}`)
+	out, _ = sjson.SetBytes(out, "id", fmt.Sprintf("modr-mock-%d", time.Now().UnixNano()))
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+	for _, text := range texts {
+		text = strings.ToLower(text)
+		flagged := false
+		for _, word := range p.flaggedWords {
+			if strings.Contains(text, word) {
+				flagged = true
+				break
+			}
+		}
+
+		result := []byte(`{"flagged":false,"categories":{},"category_scores":{}}`)
+		result, _ = sjson.SetBytes(result, "flagged", flagged)
+		for _, category := range mockModerationCategories {
+			categoryFlagged := flagged && category == p.flaggedCategory
+			score := 0.0001
+			if categoryFlagged {
+				score = 0.99
+			}
+			result, _ = sjson.SetBytes(result, "categories."+category, categoryFlagged)
+			result, _ = sjson.SetBytes(result, "category_scores."+category, score)
+		}
+		out, _ = sjson.SetRawBytes(out, "results.-1", result)
+	}
+	return out, nil, nil
+}
+
+// / CreateImage generates images.
+func (p *Mock) CreateImage(ctx context.Context, _ context.CancelFunc, request []byte, _ models.Model, usage *Usage) ([]byte, error, []byte) {
+	return p.createImages(ctx, int(gjson.GetBytes(request, "n").Int()), gjson.GetBytes(request, "response_format").String(), usage)
+}
+
+// / EditImage edits images.
+func (p *Mock) EditImage(ctx context.Context, _ context.CancelFunc, body []byte, contentType string, _ models.Model, usage *Usage) ([]byte, error, []byte) {
+	return p.createMultipartImages(ctx, body, contentType, usage)
+}
+
+// / CreateImageVariation creates variations of an image.
+func (p *Mock) CreateImageVariation(ctx context.Context, _ context.CancelFunc, body []byte, contentType string, _ models.Model, usage *Usage) ([]byte, error, []byte) {
+	return p.createMultipartImages(ctx, body, contentType, usage)
+}
+
+// createMultipartImages creates the images of a multipart image request
+func (p *Mock) createMultipartImages(ctx context.Context, body []byte, contentType string, usage *Usage) ([]byte, error, []byte) {
+	fields, _, err := MultipartFields(body, contentType)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+	n, _ := strconv.Atoi(fields["n"])
+	return p.createImages(ctx, n, fields["response_format"], usage)
+}
+
+// createImages builds an image response with n copies of the mock image, as data URLs if responseFormat is url
+func (p *Mock) createImages(ctx context.Context, n int, responseFormat string, usage *Usage) ([]byte, error, []byte) {
+	if err, errBody := p.injectFailure(ctx); err != nil {
+		return nil, err, errBody
+	}
+	if mockChance(p.malformedProbability) {
+		return nil, fmt.Errorf("unexpected response: %s", string(mockMalformedEvent)), mockMalformedEvent
+	}
+
+	if n < 1 {
+		n = 1
+	}
+	out := []byte(`{"created":0,"data":[]}`)
+	out, _ = sjson.SetBytes(out, "created", time.Now().Unix())
+	for i := 0; i < n; i++ {
+		image, _ := sjson.SetBytes([]byte(`{"b64_json":""}`), "b64_json", mockImage)
+		if responseFormat == "url" {
+			image, _ = sjson.SetBytes([]byte(`{"url":""}`), "url", "data:image/png;base64,"+mockImage)
+		}
+		out, _ = sjson.SetRawBytes(out, "data.-1", image)
+	}
+	usage.Images = n
+	return out, nil, nil
+}
+
+// / CreateTranscription transcribes audio.
+func (p *Mock) CreateTranscription(ctx context.Context, _ context.CancelFunc, body io.Reader, contentType string, _ models.Model, usage *Usage) ([]byte, error, []byte) {
+	return p.createAudioText(ctx, body, contentType, "transcribe", usage)
+}
+
+// / CreateTranslation translates audio into English.
+func (p *Mock) CreateTranslation(ctx context.Context, _ context.CancelFunc, body io.Reader, contentType string, _ models.Model, usage *Usage) ([]byte, error, []byte) {
+	return p.createAudioText(ctx, body, contentType, "translate", usage)
+}
+
+// createAudioText reads an audio upload and answers in its response_format, with a duration derived from the file size
+func (p *Mock) createAudioText(ctx context.Context, body io.Reader, contentType, task string, usage *Usage) ([]byte, error, []byte) {
+	// Read the upload, the file is only counted.
+	reader, err := multipartReader(body, contentType)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+	fields := make(map[string]string)
+	var size int64
+	for {
+		part, errPart := reader.NextPart()
+		if errors.Is(errPart, io.EOF) {
+			break
+		}
+		if errPart != nil {
+			return nil, errPart, nil
+		}
+		if part.FileName() != "" {
+			n, errCopy := io.Copy(io.Discard, part)
+			if errCopy != nil {
+				return nil, errCopy, nil
+			}
+			size += n
+			continue
+		}
+		value, _ := io.ReadAll(part)
+		fields[part.FormName()] = string(value)
+	}
+
+	if err, errBody := p.injectFailure(ctx); err != nil {
+		return nil, err, errBody
+	}
+	if mockChance(p.malformedProbability) {
+		return nil, fmt.Errorf("unexpected response: %s", string(mockMalformedEvent)), mockMalformedEvent
+	}
+
+	text := p.content
+	if p.mode == mockModeEcho {
+		text = fields["prompt"]
+		if text == "" {
+			text = mockDefaultTranscription
+		}
+	}
+	duration := float64(size) / mockAudioBytesPerSecond
+	usage.AudioSeconds = duration
+
+	// Answer in the response format.
+	switch fields["response_format"] {
+	case "text":
+		return []byte(text + "\n"), nil, nil
+	case "srt":
+		return []byte(fmt.Sprintf("1\n%s --> %s\n%s\n\n", mockSubtitleTime(0, ","), mockSubtitleTime(duration, ","), text)), nil, nil
+	case "vtt":
+		return []byte(fmt.Sprintf("WEBVTT\n\n%s --> %s\n%s\n\n", mockSubtitleTime(0, "."), mockSubtitleTime(duration, "."), text)), nil, nil
+	case "verbose_json":
+		out := []byte(`{"task":"","language":"english","duration":0,"text":"","segments":[{"id":0,"seek":0,"start":0,"end":0,"text":""}]}`)
+		out, _ = sjson.SetBytes(out, "task", task)
+		out, _ = sjson.SetBytes(out, "duration", duration)
+		out, _ = sjson.SetBytes(out, "text", text)
+		out, _ = sjson.SetBytes(out, "segments.0.end", duration)
+		out, _ = sjson.SetBytes(out, "segments.0.text", text)
+		return out, nil, nil
+	default:
+		out := []byte(`{"text":"","usage":{"type":"duration","seconds":0}}`)
+		out, _ = sjson.SetBytes(out, "text", text)
+		out, _ = sjson.SetBytes(out, "usage.seconds", math.Ceil(duration))
+		return out, nil, nil
+	}
+}
+
+// / CreateSpeech synthesizes silence as 16-bit 24 kHz mono PCM, whatever the response_format, in chunks.
+func (p *Mock) CreateSpeech(ctx context.Context, _ context.CancelFunc, request []byte, _ models.Model, _ *Usage) (io.ReadCloser, error, []byte) {
+	if err, errBody := p.injectFailure(ctx); err != nil {
+		return nil, err, errBody
+	}
+
+	size := len([]rune(gjson.GetBytes(request, "input").String())) * mockSpeechBytesPerCharacter
+	chunkSize := max((size+p.chunks-1)/p.chunks, 1)
+	pr, pw := io.Pipe()
+	go func() {
+		for written := 0; written < size; written += chunkSize {
+			if written > 0 {
+				if err := p.wait(ctx, p.chunkInterval, 1); err != nil {
+					_ = pw.CloseWithError(err)
+					return
+				}
+				if mockChance(p.disconnectProbability) {
+					_ = pw.CloseWithError(fmt.Errorf("mock provider disconnected: %w", io.ErrUnexpectedEOF))
+					return
+				}
+			}
+			if _, err := pw.Write(make([]byte, min(chunkSize, size-written))); err != nil {
+				return
+			}
+		}
+		_ = pw.Close()
+	}()
+	return pr, nil, nil
+}
+
+// injectFailure waits for the latency and injects the failures that happen before a response
+func (p *Mock) injectFailure(ctx context.Context) (error, []byte) {
+	if err := p.wait(ctx, p.latency, p.latencyProbability); err != nil {
+		return err, nil
+	}
+	if mockChance(p.errorProbability) {
+		return newStatusError(p.errorStatus), p.errorBody()
+	}
+	if mockChance(p.disconnectProbability) {
+		return fmt.Errorf("mock provider disconnected: %w", io.ErrUnexpectedEOF), nil
+	}
+	return nil, nil
+}
+
+// createResponse builds a chat completion, or a text completion if text is set
+func (p *Mock) createResponse(ctx context.Context, request []byte, model models.Model, usage *Usage, text bool) ([]byte, error, []byte) {
+	if err, errBody := p.injectFailure(ctx); err != nil {
+		return nil, err, errBody
+	}
+
+	content := p.responseContent(request)
+	if mockChance(p.malformedProbability) {
+		return nil, fmt.Errorf("unexpected response: %s", string(mockMalformedEvent)), mockMalformedEvent
+	}
+
+	// Build the response.
+	p.setUsage(request, content, usage)
+	out := []byte(`{"id":"","object":"chat.completion","created":0,"model":"","choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":"stop"}]}`)
+	if text {
+		out = []byte(`{"id":"","object":"text_completion","created":0,"model":"","choices":[{"text":"","index":0,"logprobs":null,"finish_reason":"stop"}]}`)
+	}
+	out, _ = sjson.SetBytes(out, "id", mockResponseID(text))
+	out, _ = sjson.SetBytes(out, "created", time.Now().Unix())
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+	if text {
+		out, _ = sjson.SetBytes(out, "choices.0.text", content)
+	} else {
+		out, _ = sjson.SetBytes(out, "choices.0.message.content", content)
+	}
+	out, _ = sjson.SetBytes(out, "usage", usage)
+	return out, nil, nil
+}
+
+// createStream streams a chat completion, or a text completion if text is set
+func (p *Mock) createStream(ctx context.Context, request []byte, model models.Model, usage *Usage, text bool) (io.ReadCloser, error, []byte) {
+	// Wait for the latency and inject the failures that happen before the stream starts.
+	if err := p.wait(ctx, p.latency, p.latencyProbability); err != nil {
+		return nil, err, nil
+	}
+	if mockChance(p.errorProbability) {
+		return nil, newStatusError(p.errorStatus), p.errorBody()
+	}
+
+	content := p.responseContent(request)
+	pieces := splitMockContent(content, p.chunks)
+
+	// Choose the positions of the injected malformed event and disconnect, -1 means none.
+	malformedAt, disconnectAt := -1, -1
+	if mockChance(p.malformedProbability) {
+		malformedAt = rand.IntN(len(pieces) + 1)
+	}
+	if mockChance(p.disconnectProbability) {
+		disconnectAt = rand.IntN(len(pieces) + 1)
+	}
+
+	// Create a pipe.
+	pr, pw := io.Pipe()
+
+	// Start a goroutine to write the chunks.
+	go func() {
+		// Defer closing the pipe.
+		defer func() {
+			_ = pw.Close()
+		}()
+
+		id := mockResponseID(text)
+		created := time.Now().Unix()
+		if !text {
+			if writeDataEvent(pw, newChatCompletionChunk(id, created, model.Name, []byte(`{"role":"assistant","content":""}`), "")) != nil {
+				return
+			}
+		}
+
+		for i := 0; i <= len(pieces); i++ {
+			if i == malformedAt {
+				if _, err := pw.Write(mockMalformedEvent); err != nil {
+					return
+				}
+			}
+			if i == disconnectAt {
+				_ = pw.CloseWithError(fmt.Errorf("mock provider disconnected: %w", io.ErrUnexpectedEOF))
+				return
+			}
+			if i == len(pieces) {
+				break
+			}
+
+			if i > 0 {
+				if err := p.wait(ctx, p.chunkInterval, 1); err != nil {
+					_ = pw.CloseWithError(err)
+					return
+				}
+			}
+			if writeDataEvent(pw, newMockChunk(id, created, model.Name, pieces[i], "", text)) != nil {
+				return
+			}
+		}
+
+		// Finish the stream with the finish reason, the usage and the [DONE] marker.
+		p.setUsage(request, content, usage)
+		if writeDataEvent(pw, newMockChunk(id, created, model.Name, "", "stop", text)) != nil {
+			return
+		}
+		usageChunk := newUsageChunk(id, created, model.Name, usage)
+		if text {
+			usageChunk, _ = sjson.SetBytes(usageChunk, "object", "text_completion")
+		}
+		if writeDataEvent(pw, usageChunk) != nil {
+			return
+		}
+		_ = writeDoneEvent(pw)
+	}()
+
+	return pr, nil, nil
+}
+
+// / Close closes the provider.
+func (p *Mock) Close() error {
+	return nil
+}
+
+// wait sleeps for delay with the given probability, returning early with the context's error when it is done
+func (p *Mock) wait(ctx context.Context, delay time.Duration, probability float64) error {
+	if delay <= 0 || !mockChance(probability) {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// responseContent returns the canned content, or in echo mode the text of the last user message or the prompt
+func (p *Mock) responseContent(request []byte) string {
+	if p.mode == mockModeCanned {
+		return p.content
+	}
+	if prompt := gjson.GetBytes(request, "prompt"); prompt.Exists() {
+		return mockPromptText(prompt)
+	}
+	messages := gjson.GetBytes(request, "messages").Array()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Get("role").String() == "user" {
+			return strings.Join(openAITextParts(messages[i].Get("content")), "")
+		}
+	}
+	return ""
+}
+
+// setUsage fills the usage with the configured token counts, or with estimates from the request and the content
+func (p *Mock) setUsage(request []byte, content string, usage *Usage) {
+	usage.PromptTokens = p.promptTokens
+	if usage.PromptTokens < 0 {
+		var prompt strings.Builder
+		for _, message := range gjson.GetBytes(request, "messages").Array() {
+			prompt.WriteString(strings.Join(openAITextParts(message.Get("content")), ""))
+		}
+		prompt.WriteString(mockPromptText(gjson.GetBytes(request, "prompt")))
+		usage.PromptTokens = estimateMockTokens(prompt.String())
+	}
+	usage.CompletionTokens = p.completionTokens
+	if usage.CompletionTokens < 0 {
+		usage.CompletionTokens = estimateMockTokens(content)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+}
+
+// errorBody builds the OpenAI style error body of an injected error
+func (p *Mock) errorBody() []byte {
+	errorType := "server_error"
+	switch {
+	case p.errorStatus == http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	case p.errorStatus == http.StatusUnauthorized || p.errorStatus == http.StatusForbidden:
+		errorType = "authentication_error"
+	case p.errorStatus < 500:
+		errorType = "invalid_request_error"
+	}
+	return newOpenAIError(p.errorMessage, errorType, p.errorStatus)
+}
+
+// mockPromptText returns the text of a completion prompt, joining the prompts of a list
+func mockPromptText(prompt gjson.Result) string {
+	if prompt.IsArray() {
+		texts := make([]string, 0)
+		for _, item := range prompt.Array() {
+			if item.Type == gjson.String {
+				texts = append(texts, item.String())
+			}
+		}
+		return strings.Join(texts, "")
+	}
+	if prompt.Type == gjson.String {
+		return prompt.String()
+	}
+	return ""
+}
+
+// mockResponseID returns a new chat completion or text completion id
+func mockResponseID(text bool) string {
+	if text {
+		return fmt.Sprintf("cmpl-%d", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+}
+
+// newMockChunk builds a chat completion chunk with the content, or a text completion chunk if text is set
+func newMockChunk(id string, created int64, model, content, finishReason string, text bool) []byte {
+	if !text {
+		var delta []byte
+		if content != "" {
+			delta, _ = sjson.SetBytes([]byte(`{"content":""}`), "content", content)
+		}
+		return newChatCompletionChunk(id, created, model, delta, finishReason)
+	}
+	chunk := []byte(`{"id":"","object":"text_completion","created":0,"model":"","choices":[{"text":"","index":0,"logprobs":null,"finish_reason":null}]}`)
+	chunk, _ = sjson.SetBytes(chunk, "id", id)
+	chunk, _ = sjson.SetBytes(chunk, "created", created)
+	chunk, _ = sjson.SetBytes(chunk, "model", model)
+	chunk, _ = sjson.SetBytes(chunk, "choices.0.text", content)
+	if finishReason != "" {
+		chunk, _ = sjson.SetBytes(chunk, "choices.0.finish_reason", finishReason)
+	}
+	return chunk
+}
+
+// mockChance reports true with the given probability
+func mockChance(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+// splitMockContent splits content into at most n pieces of about the same number of characters
+func splitMockContent(content string, n int) []string {
+	runes := []rune(content)
+	if len(runes) == 0 {
+		return nil
+	}
+	if n > len(runes) {
+		n = len(runes)
+	}
+	pieces := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		pieces = append(pieces, string(runes[i*len(runes)/n:(i+1)*len(runes)/n]))
+	}
+	return pieces
+}
+
+// mockEmbedding returns a unit vector of the given length that is derived from the input
+func mockEmbedding(input string, dimensions int) []float64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(input))
+	random := rand.New(rand.NewPCG(hash.Sum64(), uint64(dimensions)))
+
+	embedding := make([]float64, dimensions)
+	norm := 0.0
+	for i := range embedding {
+		embedding[i] = random.Float64()*2 - 1
+		norm += embedding[i] * embedding[i]
+	}
+	norm = math.Sqrt(norm)
+	for i := range embedding {
+		embedding[i] /= norm
+	}
+	return embedding
+}
+
+// mockSubtitleTime formats seconds as an SRT or WebVTT timestamp with the given millisecond separator
+func mockSubtitleTime(seconds float64, separator string) string {
+	milliseconds := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", milliseconds/3600000, milliseconds/60000%60, milliseconds/1000%60, separator, milliseconds%1000)
+}
+
+// estimateMockTokens estimates the token count of a text from its length
+func estimateMockTokens(text string) int {
+	return (len([]rune(text)) + mockCharsPerToken - 1) / mockCharsPerToken
+}
@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+)
+
+// mockTestRequest is a chat completion request whose last user message is echoed
+const mockTestRequest = `{"model":"mock","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"First question"},` +
+	`{"role":"assistant","content":"First answer"},{"role":"user","content":[{"type":"text","text":"Echo "},{"type":"text","text":"this back"}]}]}`
+
+// newMockTestProvider creates a mock provider with the options
+func newMockTestProvider(t *testing.T, options models.ProviderOptions) Provider {
+	t.Helper()
+	providerInstance, err := NewProviderMock(options)
+	if err != nil {
+		t.Fatalf("NewProviderMock() error = %v", err)
+	}
+	return providerInstance
+}
+
+// mockTestStream is a chat completion stream read to its end
+type mockTestStream struct {
+	// contents are the non-empty content deltas in order
+	contents []string
+	// finishReason is the last finish reason
+	finishReason string
+	// usage is the usage of the usage chunk
+	usage gjson.Result
+	// malformed counts the data lines that are not JSON
+	malformed int
+	// done reports whether the stream ended with [DONE]
+	done bool
+	// err is the error that ended the stream early
+	err error
+}
+
+// readMockTestStream reads the events of a chat completion stream
+func readMockTestStream(stream io.Reader) mockTestStream {
+	result := mockTestStream{}
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("data: ")) {
+			result.malformed++
+			continue
+		}
+		data := bytes.TrimPrefix(line, []byte("data: "))
+		if string(data) == "[DONE]" {
+			result.done = true
+			continue
+		}
+		if !gjson.ValidBytes(data) {
+			result.malformed++
+			continue
+		}
+		if content := gjson.GetBytes(data, "choices.0.delta.content").String(); content != "" {
+			result.contents = append(result.contents, content)
+		}
+		if reason := gjson.GetBytes(data, "choices.0.finish_reason").String(); reason != "" {
+			result.finishReason = reason
+		}
+		if usage := gjson.GetBytes(data, "usage"); usage.Exists() {
+			result.usage = usage
+		}
+	}
+	result.err = scanner.Err()
+	return result
+}
+
+func TestMockChatCompletion(t *testing.T) {
+	tests := []struct {
+		name    string
+		options models.ProviderOptions
+		want    string
+	}{
+		{name: "echo", options: models.ProviderOptions{}, want: "Echo this back"},
+		{name: "canned", options: models.ProviderOptions{"mode": "canned", "content": "Canned answer"}, want: "Canned answer"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usage := &Usage{}
+			response, err, errBody := newMockTestProvider(t, test.options).CreateChatCompletion(context.Background(), func() {}, []byte(mockTestRequest), models.Model{Name: "mock"}, usage)
+			if err != nil {
+				t.Fatalf("CreateChatCompletion() error = %v, body %s", err, errBody)
+			}
+			if got := gjson.GetBytes(response, "choices.0.message.content").String(); got != test.want {
+				t.Errorf("content = %q, want %q", got, test.want)
+			}
+			if got := gjson.GetBytes(response, "choices.0.finish_reason").String(); got != "stop" {
+				t.Errorf("finish_reason = %q, want stop", got)
+			}
+			if usage.CompletionTokens != estimateMockTokens(test.want) || usage.PromptTokens == 0 || usage.TotalTokens != usage.PromptTokens+usage.CompletionTokens {
+				t.Errorf("usage = %+v, want estimated token counts", usage)
+			}
+		})
+	}
+}
+
+func TestMockChatCompletionStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    models.ProviderOptions
+		want       string
+		wantChunks int
+	}{
+		{name: "echo", options: models.ProviderOptions{"chunks": 3}, want: "Echo this back", wantChunks: 3},
+		{name: "canned", options: models.ProviderOptions{"mode": "canned", "content": "One two three four five", "chunks": 5}, want: "One two three four five", wantChunks: 5},
+		{name: "more chunks than characters", options: models.ProviderOptions{"mode": "canned", "content": "Hi", "chunks": 10}, want: "Hi", wantChunks: 2},
+		{name: "configured usage", options: models.ProviderOptions{"mode": "canned", "content": "Hello", "chunks": 1, "prompt_tokens": 7, "completion_tokens": 3}, want: "Hello", wantChunks: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usage := &Usage{}
+			stream, err, errBody := newMockTestProvider(t, test.options).CreateChatCompletionStream(context.Background(), func() {}, []byte(mockTestRequest), models.Model{Name: "mock"}, usage)
+			if err != nil {
+				t.Fatalf("CreateChatCompletionStream() error = %v, body %s", err, errBody)
+			}
+			result := readMockTestStream(stream)
+			_ = stream.Close()
+
+			if result.err != nil || !result.done || result.malformed != 0 {
+				t.Fatalf("stream error = %v, done = %t, %d malformed events", result.err, result.done, result.malformed)
+			}
+			if got := strings.Join(result.contents, ""); got != test.want {
+				t.Errorf("content = %q, want %q", got, test.want)
+			}
+			if len(result.contents) != test.wantChunks {
+				t.Errorf("%d content chunks %q, want %d", len(result.contents), result.contents, test.wantChunks)
+			}
+			if result.finishReason != "stop" {
+				t.Errorf("finish_reason = %q, want stop", result.finishReason)
+			}
+			if result.usage.Get("completion_tokens").Int() != int64(usage.CompletionTokens) || usage.CompletionTokens == 0 {
+				t.Errorf("usage chunk = %s, want the usage %+v", result.usage.Raw, usage)
+			}
+			if promptTokens, ok := test.options["prompt_tokens"]; ok && (usage.PromptTokens != promptTokens || usage.CompletionTokens != test.options["completion_tokens"]) {
+				t.Errorf("usage = %+v, want the configured token counts", usage)
+			}
+		})
+	}
+}
+
+func TestMockInjectedError(t *testing.T) {
+	providerInstance := newMockTestProvider(t, models.ProviderOptions{"error_probability": 1, "error_status": 429, "error_message": "Slow down"})
+	_, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(mockTestRequest), models.Model{Name: "mock"}, &Usage{})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("CreateChatCompletion() error = %v, want status 429", err)
+	}
+	if gjson.GetBytes(errBody, "error.message").String() != "Slow down" || gjson.GetBytes(errBody, "error.type").String() != "rate_limit_error" {
+		t.Errorf("error body = %s, want the configured message of a rate_limit_error", errBody)
+	}
+
+	_, err, _ = providerInstance.CreateChatCompletionStream(context.Background(), func() {}, []byte(mockTestRequest), models.Model{Name: "mock"}, &Usage{})
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("CreateChatCompletionStream() error = %v, want status 429", err)
+	}
+}
+
+func TestMockInjectedMalformedResponse(t *testing.T) {
+	providerInstance := newMockTestProvider(t, models.ProviderOptions{"mode": "canned", "content": "Hello there", "chunks": 2, "malformed_probability": 1})
+	_, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(mockTestRequest), models.Model{Name: "mock"}, &Usage{})
+	if err == nil || !strings.Contains(err.Error(), "unexpected response") || gjson.ValidBytes(errBody) {
+		t.Errorf("CreateChatCompletion() error = %v, body %q, want an unexpected malformed response", err, errBody)
+	}
+
+	stream, err, errBody := providerInstance.CreateChatCompletionStream(context.Background(), func() {}, []byte(mockTestRequest), models.Model{Name: "mock"}, &Usage{})
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream() error = %v, body %s", err, errBody)
+	}
+	result := readMockTestStream(stream)
+	_ = stream.Close()
+	if result.malformed != 1 {
+		t.Errorf("%d malformed events, want 1", result.malformed)
+	}
+	if result.err != nil || !result.done || strings.Join(result.contents, "") != "Hello there" {
+		t.Errorf("stream error = %v, done = %t, content %q, want the whole content around the malformed event", result.err, result.done, result.contents)
+	}
+}
+
+func TestMockInjectedDisconnect(t *testing.T) {
+	providerInstance := newMockTestProvider(t, models.ProviderOptions{"mode": "canned", "content": "Hello there", "chunks": 2, "disconnect_probability": 1})
+	_, err, _ := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(mockTestRequest), models.Model{Name: "mock"}, &Usage{})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("CreateChatCompletion() error = %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	stream, err, errBody := providerInstance.CreateChatCompletionStream(context.Background(), func() {}, []byte(mockTestRequest), models.Model{Name: "mock"}, &Usage{})
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream() error = %v, body %s", err, errBody)
+	}
+	result := readMockTestStream(stream)
+	_ = stream.Close()
+	if !errors.Is(result.err, io.ErrUnexpectedEOF) || result.done || result.finishReason != "" {
+		t.Errorf("stream error = %v, done = %t, finish_reason %q, want a disconnect before the end", result.err, result.done, result.finishReason)
+	}
+}
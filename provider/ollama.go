@@ -0,0 +1,505 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// ollamaDefaultBaseURL is the Ollama address used when the model has no base_url
+	ollamaDefaultBaseURL = "http://localhost:11434"
+)
+
+// ollamaRequestOptions maps OpenAI request fields to Ollama options
+var ollamaRequestOptions = map[string]string{
+	"temperature":       "temperature",
+	"top_p":             "top_p",
+	"top_k":             "top_k",
+	"min_p":             "min_p",
+	"seed":              "seed",
+	"presence_penalty":  "presence_penalty",
+	"frequency_penalty": "frequency_penalty",
+}
+
+// ollamaOptionTypes are the provider_options of the ollama provider
+var ollamaOptionTypes = models.OptionTypes{
+	"keep_alive": models.OptionString,
+	"options":    models.OptionMap,
+}
+
+// / NewProviderOllama creates a new Ollama provider.
+// / Options: keep_alive and options (Ollama model options such as num_ctx, passed through on every request).
+func NewProviderOllama(options models.ProviderOptions) (Provider, error) {
+	if err := options.Check(ollamaOptionTypes); err != nil {
+		return nil, err
+	}
+	p := &Ollama{
+		keepAlive: options.String("keep_alive", ""),
+		options:   options.Map("options"),
+	}
+	return p, nil
+}
+
+// / init registers the provider.
+func init() {
+	RegisterProvider(_const.ProviderOllama, NewProviderOllama)
+}
+
+// / Ollama implements the Provider interface for Ollama's native /api/chat endpoint.
+type Ollama struct {
+	// keepAlive is how long Ollama keeps the model loaded after the request.
+	keepAlive string
+	// options are the model options sent with every request.
+	options models.ProviderOptions
+}
+
+// / GetProviderType returns the provider's type.
+func (p *Ollama) GetProviderType() _const.ProviderType {
+	return _const.ProviderOllama
+}
+
+// / CreateChatCompletion creates a chat completion.
+func (p *Ollama) CreateChatCompletion(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	// Convert the OpenAI request to an Ollama request.
+	ollamaRequest, err := p.convertRequest(request, false)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, "/api/chat", ollamaRequest, model)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Defer closing the response body.
+	defer func() {
+		err = resp.Body.Close()
+	}()
+
+	// Read the response body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode), convertOllamaError(data, resp.StatusCode)
+	}
+
+	// Check that the response has a message.
+	if !gjson.GetBytes(data, "message").Exists() {
+		return nil, fmt.Errorf("unexpected response: %s", string(data)), data
+	}
+
+	return convertOllamaResponse(data, model, usage), nil, nil
+}
+
+// / CreateChatCompletionStream creates a streaming chat completion.
+func (p *Ollama) CreateChatCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	// Convert the OpenAI request to an Ollama request.
+	ollamaRequest, err := p.convertRequest(request, true)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, "/api/chat", ollamaRequest, model)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp.StatusCode), convertOllamaError(body, resp.StatusCode)
+	}
+
+	// Create a pipe.
+	pr, pw := io.Pipe()
+
+	// Start a goroutine to translate the NDJSON lines into OpenAI chunks.
+	go func() {
+		// Defer closing the pipe and the response body.
+		defer func() {
+			_ = pw.Close()
+			_ = resp.Body.Close()
+		}()
+
+		if errTranslate := translateOllamaStream(resp.Body, pw, model, usage); errTranslate != nil {
+			// If reading fails, cancel the request.
+			cancel()
+		}
+	}()
+
+	return pr, nil, nil
+}
+
+// / CreateEmbedding creates embeddings with Ollama's /api/embed endpoint.
+func (p *Ollama) CreateEmbedding(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	// Convert the OpenAI request to an Ollama request.
+	ollamaRequest, err := p.convertEmbeddingRequest(request)
+	if err != nil {
+		return nil, err, newOpenAIError(err.Error(), "invalid_request_error", http.StatusBadRequest)
+	}
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, "/api/embed", ollamaRequest, model)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Defer closing the response body.
+	defer func() {
+		err = resp.Body.Close()
+	}()
+
+	// Read the response body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode), convertOllamaError(data, resp.StatusCode)
+	}
+
+	// Check that the response has embeddings.
+	embeddings := gjson.GetBytes(data, "embeddings")
+	if !embeddings.IsArray() {
+		return nil, fmt.Errorf("unexpected response: %s", string(data)), data
+	}
+
+	// Convert the response.
+	out := []byte(`{"object":"list","data":[],"model":""}`)
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+	for i, embedding := range embeddings.Array() {
+		item, _ := sjson.SetBytes([]byte(`{"object":"embedding","index":0}`), "index", i)
+		item, _ = sjson.SetRawBytes(item, "embedding", []byte(embedding.Raw))
+		out, _ = sjson.SetRawBytes(out, "data.-1", item)
+	}
+	usage.PromptTokens = int(gjson.GetBytes(data, "prompt_eval_count").Int())
+	usage.TotalTokens = usage.PromptTokens
+	out, _ = sjson.SetBytes(out, "usage", map[string]int{"prompt_tokens": usage.PromptTokens, "total_tokens": usage.TotalTokens})
+	return out, nil, nil
+}
+
+// / Close closes the provider.
+func (p *Ollama) Close() error {
+	return nil
+}
+
+// doRequest sends a request to an Ollama API path such as /api/chat
+func (p *Ollama) doRequest(ctx context.Context, path string, request []byte, model models.Model) (*http.Response, error) {
+	// Build the URL, a direct base URL is the /api/chat URL.
+	baseURL := model.BaseURL
+	if baseURL == "" {
+		baseURL = ollamaDefaultBaseURL
+	}
+	url := strings.Replace(baseURL, "/api/chat", path, 1)
+	if !model.BaseURLDirect {
+		url = fmt.Sprintf("%s%s", strings.TrimRight(baseURL, "/"), path)
+	}
+
+	// Create an HTTP request.
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(request))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the request headers, an API key is only needed when Ollama is behind an authenticating proxy.
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey := getAPIKey(model); apiKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	}
+	// Add the model's headers and query parameters.
+	applyModelRequestOptions(req, model)
+
+	// Use http.Client to send the request.
+	return newHttpClient(model.ProxyURL).Do(req)
+}
+
+// convertRequest converts an OpenAI chat completion request into an Ollama /api/chat request
+func (p *Ollama) convertRequest(request []byte, stream bool) ([]byte, error) {
+	out := []byte(`{"model":"","messages":[],"stream":false}`)
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(request, "model").String())
+	out, _ = sjson.SetBytes(out, "stream", stream)
+
+	// Convert the messages.
+	for _, message := range gjson.GetBytes(request, "messages").Array() {
+		role := message.Get("role").String()
+		if role == "developer" {
+			role = "system"
+		}
+		ollamaMessage, _ := sjson.SetBytes([]byte(`{"role":"","content":""}`), "role", role)
+
+		content := message.Get("content")
+		if content.Type == gjson.String {
+			ollamaMessage, _ = sjson.SetBytes(ollamaMessage, "content", content.String())
+		} else {
+			var text strings.Builder
+			for _, part := range content.Array() {
+				switch part.Get("type").String() {
+				case "text":
+					text.WriteString(part.Get("text").String())
+				case "image_url":
+					_, data, err := parseDataURL(part.Get("image_url.url").String())
+					if err != nil {
+						return nil, fmt.Errorf("ollama only accepts images as base64 data URLs: %w", err)
+					}
+					ollamaMessage, _ = sjson.SetBytes(ollamaMessage, "images.-1", data)
+				}
+			}
+			ollamaMessage, _ = sjson.SetBytes(ollamaMessage, "content", text.String())
+		}
+
+		// Ollama expects the tool call arguments as an object.
+		for _, toolCall := range message.Get("tool_calls").Array() {
+			ollamaToolCall := []byte(`{"function":{"name":"","arguments":{}}}`)
+			ollamaToolCall, _ = sjson.SetBytes(ollamaToolCall, "function.name", toolCall.Get("function.name").String())
+			arguments := toolCall.Get("function.arguments").String()
+			if arguments != "" && gjson.Valid(arguments) {
+				ollamaToolCall, _ = sjson.SetRawBytes(ollamaToolCall, "function.arguments", []byte(arguments))
+			}
+			ollamaMessage, _ = sjson.SetRawBytes(ollamaMessage, "tool_calls.-1", ollamaToolCall)
+		}
+
+		out, _ = sjson.SetRawBytes(out, "messages.-1", ollamaMessage)
+	}
+
+	// Ollama accepts OpenAI function tools as they are.
+	if tools := gjson.GetBytes(request, "tools"); tools.IsArray() {
+		out, _ = sjson.SetRawBytes(out, "tools", []byte(tools.Raw))
+	}
+
+	// Start from the configured options, then apply the request parameters.
+	if len(p.options) > 0 {
+		out, _ = sjson.SetBytes(out, "options", map[string]interface{}(p.options))
+	}
+	for openAIField, ollamaOption := range ollamaRequestOptions {
+		if value := gjson.GetBytes(request, openAIField); value.Type == gjson.Number {
+			out, _ = sjson.SetBytes(out, "options."+ollamaOption, value.Value())
+		}
+	}
+	maxTokens := gjson.GetBytes(request, "max_completion_tokens")
+	if maxTokens.Type != gjson.Number {
+		maxTokens = gjson.GetBytes(request, "max_tokens")
+	}
+	if maxTokens.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "options.num_predict", maxTokens.Int())
+	}
+	stop := gjson.GetBytes(request, "stop")
+	if stop.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "options.stop", []string{stop.String()})
+	} else if stop.IsArray() {
+		out, _ = sjson.SetRawBytes(out, "options.stop", []byte(stop.Raw))
+	}
+
+	// Convert response_format to format.
+	responseFormat := gjson.GetBytes(request, "response_format")
+	switch responseFormat.Get("type").String() {
+	case "json_object":
+		out, _ = sjson.SetBytes(out, "format", "json")
+	case "json_schema":
+		if schema := responseFormat.Get("json_schema.schema"); schema.IsObject() {
+			out, _ = sjson.SetRawBytes(out, "format", []byte(schema.Raw))
+		} else {
+			out, _ = sjson.SetBytes(out, "format", "json")
+		}
+	}
+
+	// Map reasoning_effort to think.
+	if reasoningEffortResult := gjson.GetBytes(request, "reasoning_effort"); reasoningEffortResult.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "think", reasoningEffortResult.String() != "none")
+	}
+
+	if p.keepAlive != "" {
+		out, _ = sjson.SetBytes(out, "keep_alive", p.keepAlive)
+	}
+
+	return out, nil
+}
+
+// convertEmbeddingRequest converts an OpenAI embeddings request into an Ollama /api/embed request
+func (p *Ollama) convertEmbeddingRequest(request []byte) ([]byte, error) {
+	out := []byte(`{"model":"","input":[]}`)
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(request, "model").String())
+
+	// Ollama only embeds text.
+	input := gjson.GetBytes(request, "input")
+	inputs := []gjson.Result{input}
+	if input.IsArray() {
+		inputs = input.Array()
+	}
+	for _, item := range inputs {
+		if item.Type != gjson.String {
+			return nil, fmt.Errorf("ollama only accepts text inputs for embeddings")
+		}
+		out, _ = sjson.SetBytes(out, "input.-1", item.String())
+	}
+
+	if dimensions := gjson.GetBytes(request, "dimensions"); dimensions.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "dimensions", dimensions.Int())
+	}
+	if len(p.options) > 0 {
+		out, _ = sjson.SetBytes(out, "options", map[string]interface{}(p.options))
+	}
+	if p.keepAlive != "" {
+		out, _ = sjson.SetBytes(out, "keep_alive", p.keepAlive)
+	}
+	return out, nil
+}
+
+// convertOllamaResponse converts an Ollama /api/chat response into an OpenAI chat completion and fills the usage
+func convertOllamaResponse(data []byte, model models.Model, usage *Usage) []byte {
+	out := []byte(`{"id":"","object":"chat.completion","created":0,"model":"","choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":null}]}`)
+	out, _ = sjson.SetBytes(out, "id", fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()))
+	out, _ = sjson.SetBytes(out, "created", time.Now().Unix())
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+
+	message := gjson.GetBytes(data, "message")
+	out, _ = sjson.SetBytes(out, "choices.0.message.content", message.Get("content").String())
+	if thinking := message.Get("thinking").String(); thinking != "" {
+		out, _ = sjson.SetBytes(out, "choices.0.message.reasoning_content", thinking)
+	}
+	toolCalls := message.Get("tool_calls").Array()
+	for i, toolCall := range toolCalls {
+		out, _ = sjson.SetRawBytes(out, fmt.Sprintf("choices.0.message.tool_calls.%d", i), ollamaToolCall(toolCall, i, false))
+	}
+	out, _ = sjson.SetBytes(out, "choices.0.finish_reason", ollamaFinishReason(gjson.GetBytes(data, "done_reason").String(), len(toolCalls) > 0))
+
+	// Set the usage.
+	setOllamaUsage(data, usage)
+	out, _ = sjson.SetBytes(out, "usage", usage)
+
+	return out
+}
+
+// ollamaToolCall converts an Ollama tool call into an OpenAI tool call, with the index field for stream deltas
+func ollamaToolCall(toolCall gjson.Result, index int, withIndex bool) []byte {
+	openAIToolCall := []byte(`{"id":"","type":"function","function":{"name":"","arguments":""}}`)
+	if withIndex {
+		openAIToolCall, _ = sjson.SetBytes(openAIToolCall, "index", index)
+	}
+	openAIToolCall, _ = sjson.SetBytes(openAIToolCall, "id", fmt.Sprintf("call_%d_%d", time.Now().UnixNano(), index))
+	openAIToolCall, _ = sjson.SetBytes(openAIToolCall, "function.name", toolCall.Get("function.name").String())
+	arguments := toolCall.Get("function.arguments")
+	if arguments.Exists() {
+		openAIToolCall, _ = sjson.SetBytes(openAIToolCall, "function.arguments", arguments.Raw)
+	} else {
+		openAIToolCall, _ = sjson.SetBytes(openAIToolCall, "function.arguments", "{}")
+	}
+	return openAIToolCall
+}
+
+// setOllamaUsage copies prompt_eval_count and eval_count into usage
+func setOllamaUsage(data []byte, usage *Usage) {
+	if promptEvalCount := gjson.GetBytes(data, "prompt_eval_count"); promptEvalCount.Exists() {
+		usage.PromptTokens = int(promptEvalCount.Int())
+	}
+	if evalCount := gjson.GetBytes(data, "eval_count"); evalCount.Exists() {
+		usage.CompletionTokens = int(evalCount.Int())
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+}
+
+// ollamaFinishReason maps an Ollama done_reason to an OpenAI finish reason
+func ollamaFinishReason(doneReason string, hasToolCalls bool) string {
+	if hasToolCalls {
+		return "tool_calls"
+	}
+	if doneReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// convertOllamaError converts an Ollama error body into an OpenAI error body
+func convertOllamaError(body []byte, statusCode int) []byte {
+	message := gjson.GetBytes(body, "error")
+	if message.Type != gjson.String {
+		return body
+	}
+	return newOpenAIError(message.String(), "ollama_error", statusCode)
+}
+
+// translateOllamaStream reads Ollama NDJSON lines from r and writes OpenAI chat.completion.chunk events to w
+func translateOllamaStream(r io.Reader, w io.Writer, model models.Model, usage *Usage) error {
+	reader := bufio.NewReader(r)
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+	toolCallCount := 0
+
+	// Send the role first.
+	if err := writeDataEvent(w, newChatCompletionChunk(id, created, model.Name, []byte(`{"role":"assistant","content":""}`), "")); err != nil {
+		return err
+	}
+
+	for {
+		// Read a line of data.
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			// An error line ends the stream.
+			if errorMessage := gjson.GetBytes(line, "error"); errorMessage.Type == gjson.String {
+				return writeDataEvent(w, newOpenAIError(errorMessage.String(), "ollama_error", http.StatusInternalServerError))
+			}
+
+			message := gjson.GetBytes(line, "message")
+			if thinking := message.Get("thinking").String(); thinking != "" {
+				delta, _ := sjson.SetBytes([]byte(`{}`), "reasoning_content", thinking)
+				if errWrite := writeDataEvent(w, newChatCompletionChunk(id, created, model.Name, delta, "")); errWrite != nil {
+					return errWrite
+				}
+			}
+			if content := message.Get("content").String(); content != "" {
+				delta, _ := sjson.SetBytes([]byte(`{}`), "content", content)
+				if errWrite := writeDataEvent(w, newChatCompletionChunk(id, created, model.Name, delta, "")); errWrite != nil {
+					return errWrite
+				}
+			}
+			for _, toolCall := range message.Get("tool_calls").Array() {
+				delta, _ := sjson.SetRawBytes([]byte(`{}`), "tool_calls.0", ollamaToolCall(toolCall, toolCallCount, true))
+				toolCallCount++
+				if errWrite := writeDataEvent(w, newChatCompletionChunk(id, created, model.Name, delta, "")); errWrite != nil {
+					return errWrite
+				}
+			}
+
+			// The last line carries the done reason and the token counts.
+			if gjson.GetBytes(line, "done").Bool() {
+				setOllamaUsage(line, usage)
+				finishReason := ollamaFinishReason(gjson.GetBytes(line, "done_reason").String(), toolCallCount > 0)
+				if errWrite := writeDataEvent(w, newChatCompletionChunk(id, created, model.Name, nil, finishReason)); errWrite != nil {
+					return errWrite
+				}
+				if errWrite := writeDataEvent(w, newUsageChunk(id, created, model.Name, usage)); errWrite != nil {
+					return errWrite
+				}
+				return writeDoneEvent(w)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
@@ -8,12 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
-	"sync"
-	"time"
+	"strings"
 
-	"github.com/luispater/mini-router/config"
 	_const "github.com/luispater/mini-router/const"
 	"github.com/luispater/mini-router/models"
 	"github.com/tidwall/gjson"
@@ -21,8 +18,11 @@ import (
 )
 
 // / NewProviderOpenAICompatibility creates a new OpenAICompatibility provider.
-func NewProviderOpenAICompatibility(_ *config.Config) (Provider, error) {
-	// Define the supported models and their features.
+func NewProviderOpenAICompatibility(options models.ProviderOptions) (Provider, error) {
+	// The provider has no options.
+	if err := options.Check(nil); err != nil {
+		return nil, err
+	}
 	return &OpenAICompatibility{}, nil
 }
 
@@ -31,37 +31,21 @@ func init() {
 	RegisterProvider(_const.ProviderOpenAICompatibility, NewProviderOpenAICompatibility)
 }
 
-// apiKeyCounters stores the API key counters for each model
-var apiKeyCounters sync.Map
-
 // / OpenAICompatibility implements the Provider interface for OpenAI models.
 type OpenAICompatibility struct {
 	// baseUrl is the base URL for the API.
 	baseUrl string
 	// baseUrlDirect indicates whether to use the baseUrl directly.
 	baseUrlDirect bool
-}
-
-// getAPIKey selects an API key from the model's API key list
-func (p *OpenAICompatibility) getAPIKey(model models.Model) string {
-	if len(model.ProviderAPIKey) == 0 {
-		return ""
-	}
-
-	// Get the model's counter
-	counterValue, _ := apiKeyCounters.LoadOrStore(model.ID, int64(0))
-	counter := counterValue.(int64)
-
-	// Calculate the index and get the API key
-	index := int(counter) % len(model.ProviderAPIKey)
-	apiKey := model.ProviderAPIKey[index]
-
-	// Increment the counter
-	apiKeyCounters.Store(model.ID, counter+1)
-
-	// log.Printf("Using API key: %s", apiKey)
 
-	return apiKey
+	// endpoint returns the chat completions URL, if nil the base URL is used.
+	endpoint func(model models.Model) string
+	// authorize sets the authentication header, if nil the API key is sent as a bearer token.
+	authorize func(req *http.Request, apiKey string)
+	// transformChunk adjusts a streaming chunk before it is sent, returning nil drops the chunk.
+	transformChunk func(data []byte) []byte
+	// transformError adjusts an upstream error body before it is returned.
+	transformError func(body []byte, statusCode int) []byte
 }
 
 // / SetBaseUrl sets the base URL for the API.
@@ -74,6 +58,72 @@ func (p *OpenAICompatibility) SetBaseUrl(url string, direct ...bool) {
 	}
 }
 
+// chatCompletionsURL returns the chat completions URL for the model
+func (p *OpenAICompatibility) chatCompletionsURL(model models.Model) string {
+	// If an endpoint function is set, use it.
+	if p.endpoint != nil {
+		return p.endpoint(model)
+	}
+	// If baseUrlDirect is true, use the baseUrl directly.
+	if p.baseUrlDirect {
+		return p.baseUrl
+	}
+	// Otherwise, build the URL for chat completion.
+	return fmt.Sprintf("%s/chat/completions", p.baseUrl)
+}
+
+// endpointURL returns the URL of an endpoint such as embeddings or images/generations for the model. It is built
+// from the base URL, or derived from the chat completions URL when that is set by an endpoint function or used directly.
+func (p *OpenAICompatibility) endpointURL(model models.Model, path string) (string, error) {
+	if p.endpoint == nil && !p.baseUrlDirect {
+		return fmt.Sprintf("%s/%s", p.baseUrl, path), nil
+	}
+	chatURL := p.chatCompletionsURL(model)
+	if !strings.Contains(chatURL, "/chat/completions") {
+		return "", fmt.Errorf("the %s URL cannot be derived from the chat completions URL %s", path, chatURL)
+	}
+	return strings.Replace(chatURL, "/chat/completions", "/"+path, 1), nil
+}
+
+// / ValidateModel checks that the URLs of the model's other endpoints can be derived from its chat completions URL
+// / when the base URL is used directly.
+func (p *OpenAICompatibility) ValidateModel(model models.Model) error {
+	chatURL := model.BaseURL
+	if p.endpoint != nil {
+		chatURL = p.endpoint(model)
+	} else if !model.BaseURLDirect {
+		return nil
+	}
+	if strings.Contains(chatURL, "/chat/completions") {
+		return nil
+	}
+	if model.SupportsCompletion || model.SupportsEmbedding || model.SupportsModeration || model.SupportsImageGen ||
+		model.SupportsImageEdit || model.SupportsImageVar || model.SupportsAudioTrans || model.SupportsAudioTrans2 || model.SupportsSpeech {
+		return errors.New("base_url_direct needs a base_url containing /chat/completions to derive the URLs of the other endpoints")
+	}
+	return nil
+}
+
+// setAuthorization sets the authentication header of an upstream request
+func (p *OpenAICompatibility) setAuthorization(req *http.Request, apiKey string) {
+	if apiKey == "" {
+		return
+	}
+	if p.authorize != nil {
+		p.authorize(req, apiKey)
+		return
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+}
+
+// errorBody returns the upstream error body, adjusted by transformError if set
+func (p *OpenAICompatibility) errorBody(body []byte, statusCode int) []byte {
+	if p.transformError != nil {
+		return p.transformError(body, statusCode)
+	}
+	return body
+}
+
 // / GetProviderType returns the provider's type.
 func (p *OpenAICompatibility) GetProviderType() _const.ProviderType {
 	return _const.ProviderOpenAICompatibility
@@ -86,16 +136,154 @@ func (p *OpenAICompatibility) CreateChatCompletion(ctx context.Context, cancel c
 		return p.CreateChatCompletionUseStream(ctx, cancel, request, model, usage)
 	}
 
-	// Define the URL.
-	var url string
-	// If baseUrlDirect is true, use the baseUrl directly.
-	if p.baseUrlDirect {
-		url = p.baseUrl
-	} else {
-		// Otherwise, build the URL for chat completion.
-		url = fmt.Sprintf("%s/chat/completions", p.baseUrl)
+	return p.sendRequest(ctx, p.chatCompletionsURL(model), "application/json", request, model, usage)
+}
+
+// / CreateCompletion creates a legacy text completion.
+func (p *OpenAICompatibility) CreateCompletion(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	requestURL, err := p.endpointURL(model, "completions")
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.sendRequest(ctx, requestURL, "application/json", request, model, usage)
+}
+
+// / CreateEmbedding creates embeddings.
+func (p *OpenAICompatibility) CreateEmbedding(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	requestURL, err := p.endpointURL(model, "embeddings")
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.sendRequest(ctx, requestURL, "application/json", request, model, usage)
+}
+
+// / CreateModeration classifies the inputs of a moderation request.
+func (p *OpenAICompatibility) CreateModeration(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	requestURL, err := p.endpointURL(model, "moderations")
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.sendRequest(ctx, requestURL, "application/json", request, model, usage)
+}
+
+// / CreateImage generates images.
+func (p *OpenAICompatibility) CreateImage(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	requestURL, err := p.endpointURL(model, "images/generations")
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.sendRequest(ctx, requestURL, "application/json", request, model, usage)
+}
+
+// / EditImage edits images, the multipart body is forwarded as it is.
+func (p *OpenAICompatibility) EditImage(ctx context.Context, _ context.CancelFunc, body []byte, contentType string, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	requestURL, err := p.endpointURL(model, "images/edits")
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.sendRequest(ctx, requestURL, contentType, body, model, usage)
+}
+
+// / CreateImageVariation creates variations of an image, the multipart body is forwarded as it is.
+func (p *OpenAICompatibility) CreateImageVariation(ctx context.Context, _ context.CancelFunc, body []byte, contentType string, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	requestURL, err := p.endpointURL(model, "images/variations")
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.sendRequest(ctx, requestURL, contentType, body, model, usage)
+}
+
+// / CreateTranscription transcribes audio, the multipart body is streamed upstream as it is read.
+func (p *OpenAICompatibility) CreateTranscription(ctx context.Context, _ context.CancelFunc, body io.Reader, contentType string, model models.Model, _ *Usage) ([]byte, error, []byte) {
+	requestURL, err := p.endpointURL(model, "audio/transcriptions")
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.sendAudioRequest(ctx, requestURL, contentType, body, model)
+}
+
+// / CreateTranslation translates audio into English, the multipart body is streamed upstream as it is read.
+func (p *OpenAICompatibility) CreateTranslation(ctx context.Context, _ context.CancelFunc, body io.Reader, contentType string, model models.Model, _ *Usage) ([]byte, error, []byte) {
+	requestURL, err := p.endpointURL(model, "audio/translations")
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.sendAudioRequest(ctx, requestURL, contentType, body, model)
+}
+
+// / CreateSpeech synthesizes speech, the audio is returned as it is streamed by the upstream.
+func (p *OpenAICompatibility) CreateSpeech(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, _ *Usage) (io.ReadCloser, error, []byte) {
+	requestURL, err := p.endpointURL(model, "audio/speech")
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Create an HTTP request.
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBuffer(request))
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Set the request headers.
+	req.Header.Set("Content-Type", "application/json")
+	p.setAuthorization(req, getAPIKey(model))
+	applyModelRequestOptions(req, model)
+
+	// Use http.Client to send the request.
+	resp, err := newHttpClient(model.ProxyURL).Do(req)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp.StatusCode), p.errorBody(data, resp.StatusCode)
+	}
+	return resp.Body, nil, nil
+}
+
+// sendAudioRequest sends an audio request and returns the response body as it is, which is not JSON for
+// the text, srt and vtt response formats
+func (p *OpenAICompatibility) sendAudioRequest(ctx context.Context, url, contentType string, body io.Reader, model models.Model) ([]byte, error, []byte) {
+	// Create an HTTP request.
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Set the request headers.
+	req.Header.Set("Content-Type", contentType)
+	p.setAuthorization(req, getAPIKey(model))
+	applyModelRequestOptions(req, model)
+
+	// Use http.Client to send the request.
+	resp, err := newHttpClient(model.ProxyURL).Do(req)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Defer closing the response body.
+	defer func() {
+		err = resp.Body.Close()
+	}()
+
+	// Read the response body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err, nil
 	}
 
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode), p.errorBody(data, resp.StatusCode)
+	}
+	return data, nil, nil
+}
+
+// sendRequest sends a non-streaming request to url and parses the usage of the response
+func (p *OpenAICompatibility) sendRequest(ctx context.Context, url, contentType string, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
 	// Create an HTTP request.
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(request))
 	// If creating the request fails, return an error.
@@ -104,15 +292,14 @@ func (p *OpenAICompatibility) CreateChatCompletion(ctx context.Context, cancel c
 	}
 
 	// Set the request headers.
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 	// Get the API key and set the Authorization header.
-	apiKey := p.getAPIKey(model)
-	if apiKey != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
-	}
+	p.setAuthorization(req, getAPIKey(model))
+	// Add the model's headers and query parameters.
+	applyModelRequestOptions(req, model)
 
 	// Use http.Client to send the request.
-	client := p.newHttpClient()
+	client := newHttpClient(model.ProxyURL)
 	resp, err := client.Do(req)
 	// If sending the request fails, return an error.
 	if err != nil {
@@ -133,14 +320,15 @@ func (p *OpenAICompatibility) CreateChatCompletion(ctx context.Context, cancel c
 
 	// Check the response status code.
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %s", resp.Status), data
+		return nil, newStatusError(resp.StatusCode), p.errorBody(data, resp.StatusCode)
 	}
 
-	// Check if the response contains the id and object fields.
+	// Check if the response contains the id and object fields, image responses only have data.
 	responseIdResult := gjson.GetBytes(data, "id")
 	responseObjectResult := gjson.GetBytes(data, "object")
-	// If the response does not contain the id and object fields, return an error.
-	if responseIdResult.Type == gjson.Null && responseObjectResult.Type == gjson.Null {
+	responseDataResult := gjson.GetBytes(data, "data")
+	// If the response does not contain the id, object or data fields, return an error.
+	if responseIdResult.Type == gjson.Null && responseObjectResult.Type == gjson.Null && !responseDataResult.IsArray() {
 		return nil, fmt.Errorf("unexpected response: %s", string(data)), data
 	}
 
@@ -199,16 +387,20 @@ func (p *OpenAICompatibility) CreateChatCompletion(ctx context.Context, cancel c
 
 // / CreateChatCompletionStream creates a streaming chat completion.
 func (p *OpenAICompatibility) CreateChatCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
-	// Define the URL.
-	var url string
-	// If baseUrlDirect is true, use the baseUrl directly.
-	if p.baseUrlDirect {
-		url = p.baseUrl
-	} else {
-		// Otherwise, build the chat completion URL.
-		url = fmt.Sprintf("%s/chat/completions", p.baseUrl)
+	return p.sendStreamRequest(ctx, cancel, p.chatCompletionsURL(model), request, model, usage)
+}
+
+// / CreateCompletionStream creates a streaming legacy text completion.
+func (p *OpenAICompatibility) CreateCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	requestURL, err := p.endpointURL(model, "completions")
+	if err != nil {
+		return nil, err, nil
 	}
+	return p.sendStreamRequest(ctx, cancel, requestURL, request, model, usage)
+}
 
+// sendStreamRequest sends a streaming request to url and relays the events, parsing the usage
+func (p *OpenAICompatibility) sendStreamRequest(ctx context.Context, cancel context.CancelFunc, url string, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
 	// Set stream_options.include_usage to true.
 	request, err := sjson.SetBytes(request, "stream_options.include_usage", true)
 	// If setting fails, return an error.
@@ -226,15 +418,14 @@ func (p *OpenAICompatibility) CreateChatCompletionStream(ctx context.Context, ca
 	// Set the request headers.
 	req.Header.Set("Content-Type", "application/json")
 	// Get the API key and set the Authorization header.
-	apiKey := p.getAPIKey(model)
-	if apiKey != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
-	}
+	p.setAuthorization(req, getAPIKey(model))
 	// Set the Accept header to text/event-stream.
 	req.Header.Set("Accept", "text/event-stream")
+	// Add the model's headers and query parameters.
+	applyModelRequestOptions(req, model)
 
 	// Use http.Client to send the request.
-	client := p.newHttpClient()
+	client := newHttpClient(model.ProxyURL)
 	resp, err := client.Do(req)
 	// If sending the request fails, return an error.
 	if err != nil {
@@ -244,7 +435,8 @@ func (p *OpenAICompatibility) CreateChatCompletionStream(ctx context.Context, ca
 	// Check the response status code.
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code: %s", resp.Status), body
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp.StatusCode), p.errorBody(body, resp.StatusCode)
 	}
 
 	// Create a pipe.
@@ -301,6 +493,14 @@ func (p *OpenAICompatibility) CreateChatCompletionStream(ctx context.Context, ca
 					break
 				}
 
+				// Let the provider adjust or drop the chunk.
+				if p.transformChunk != nil {
+					data = p.transformChunk(data)
+					if data == nil {
+						continue
+					}
+				}
+
 				// Delete the provider field.
 				data, _ = sjson.DeleteBytes(data, "provider")
 				// Set the model field.
@@ -622,23 +822,3 @@ func (p *OpenAICompatibility) CreateChatCompletionUseStream(ctx context.Context,
 func (p *OpenAICompatibility) Close() error {
 	return nil
 }
-
-// / newHttpClient creates a new HTTP client.
-func (p *OpenAICompatibility) newHttpClient() *http.Client {
-	// Create an HTTP transport.
-	transport := &http.Transport{
-		// Set the connection context.
-		DialContext: (&net.Dialer{
-			// Set the connection timeout to 3 seconds.
-			Timeout: 3 * time.Second,
-			// Set keep-alive.
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-	}
-
-	// Create an HTTP client without a global timeout.
-	return &http.Client{
-		// Set the transport.
-		Transport: transport,
-	}
-}
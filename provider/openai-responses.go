@@ -0,0 +1,486 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// openAIDefaultBaseURL is the OpenAI API base URL used when the model has no base_url
+	openAIDefaultBaseURL = "https://api.openai.com/v1"
+	// openAIResponsesDefaultReasoningSummary is the reasoning.summary requested with reasoning_effort
+	openAIResponsesDefaultReasoningSummary = "auto"
+)
+
+// openAIResponsesOptionTypes are the provider_options of the openai-responses provider
+var openAIResponsesOptionTypes = models.OptionTypes{
+	"reasoning_summary": models.OptionString,
+	"store":             models.OptionBool,
+}
+
+// / NewProviderOpenAIResponses creates a new provider that serves chat completions with the OpenAI Responses API.
+// / Options: reasoning_summary (auto, concise, detailed or none) and store.
+func NewProviderOpenAIResponses(options models.ProviderOptions) (Provider, error) {
+	if err := options.Check(openAIResponsesOptionTypes); err != nil {
+		return nil, err
+	}
+	p := &OpenAIResponses{
+		reasoningSummary: options.String("reasoning_summary", openAIResponsesDefaultReasoningSummary),
+		store:            options.Bool("store", false),
+	}
+	switch p.reasoningSummary {
+	case "auto", "concise", "detailed", "none":
+	default:
+		return nil, fmt.Errorf("reasoning_summary must be auto, concise, detailed or none")
+	}
+	return p, nil
+}
+
+// / init registers the provider.
+func init() {
+	RegisterProvider(_const.ProviderOpenAIResponses, NewProviderOpenAIResponses)
+}
+
+// / OpenAIResponses implements the Provider interface for the OpenAI Responses API.
+type OpenAIResponses struct {
+	// reasoningSummary is the reasoning.summary requested when reasoning is enabled, none disables summaries.
+	reasoningSummary string
+	// store is sent as the store parameter.
+	store bool
+}
+
+// / GetProviderType returns the provider's type.
+func (p *OpenAIResponses) GetProviderType() _const.ProviderType {
+	return _const.ProviderOpenAIResponses
+}
+
+// / CreateChatCompletion creates a chat completion.
+func (p *OpenAIResponses) CreateChatCompletion(ctx context.Context, _ context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	// Convert the chat completion request to a Responses request.
+	responsesRequest := p.convertRequest(request, false)
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, responsesRequest, model)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Defer closing the response body.
+	defer func() {
+		err = resp.Body.Close()
+	}()
+
+	// Read the response body.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp.StatusCode), data
+	}
+
+	// Check that the response is a response object.
+	if gjson.GetBytes(data, "object").String() != "response" {
+		return nil, fmt.Errorf("unexpected response: %s", string(data)), data
+	}
+
+	// A failed response carries its error in the body.
+	if gjson.GetBytes(data, "status").String() == "failed" {
+		return nil, fmt.Errorf("response failed: %s", gjson.GetBytes(data, "error.message").String()), convertResponsesError(gjson.GetBytes(data, "error"))
+	}
+
+	return convertResponsesResponse(data, model, usage), nil, nil
+}
+
+// / CreateChatCompletionStream creates a streaming chat completion.
+func (p *OpenAIResponses) CreateChatCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	// Convert the chat completion request to a Responses request.
+	responsesRequest := p.convertRequest(request, true)
+
+	// Send the request.
+	resp, err := p.doRequest(ctx, responsesRequest, model)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Check the response status code.
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp.StatusCode), body
+	}
+
+	// Create a pipe.
+	pr, pw := io.Pipe()
+
+	// Start a goroutine to translate the Responses events into chat completion chunks.
+	go func() {
+		// Defer closing the pipe and the response body.
+		defer func() {
+			_ = pw.Close()
+			_ = resp.Body.Close()
+		}()
+
+		if errTranslate := translateResponsesStream(resp.Body, pw, model, usage); errTranslate != nil {
+			// If reading fails, cancel the request.
+			cancel()
+		}
+	}()
+
+	return pr, nil, nil
+}
+
+// / Close closes the provider.
+func (p *OpenAIResponses) Close() error {
+	return nil
+}
+
+// doRequest sends a Responses API request
+func (p *OpenAIResponses) doRequest(ctx context.Context, request []byte, model models.Model) (*http.Response, error) {
+	// Build the URL.
+	baseURL := model.BaseURL
+	if baseURL == "" {
+		baseURL = openAIDefaultBaseURL
+	}
+	url := baseURL
+	if !model.BaseURLDirect {
+		url = fmt.Sprintf("%s/responses", strings.TrimRight(baseURL, "/"))
+	}
+
+	// Create an HTTP request.
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(request))
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the request headers.
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey := getAPIKey(model); apiKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	}
+	if gjson.GetBytes(request, "stream").Bool() {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	// Add the model's headers and query parameters.
+	applyModelRequestOptions(req, model)
+
+	// Use http.Client to send the request.
+	return newHttpClient(model.ProxyURL).Do(req)
+}
+
+// convertRequest converts an OpenAI chat completion request into a Responses request
+func (p *OpenAIResponses) convertRequest(request []byte, stream bool) []byte {
+	out := []byte(`{"model":"","input":[]}`)
+	out, _ = sjson.SetBytes(out, "model", gjson.GetBytes(request, "model").String())
+	out, _ = sjson.SetBytes(out, "store", p.store)
+
+	// Convert the messages into input items.
+	for _, message := range gjson.GetBytes(request, "messages").Array() {
+		role := message.Get("role").String()
+		switch role {
+		case "assistant":
+			if text := strings.Join(openAITextParts(message.Get("content")), ""); text != "" {
+				item := []byte(`{"type":"message","role":"assistant","content":[{"type":"output_text","text":""}]}`)
+				item, _ = sjson.SetBytes(item, "content.0.text", text)
+				out, _ = sjson.SetRawBytes(out, "input.-1", item)
+			}
+			for _, toolCall := range message.Get("tool_calls").Array() {
+				item := []byte(`{"type":"function_call","call_id":"","name":"","arguments":""}`)
+				item, _ = sjson.SetBytes(item, "call_id", toolCall.Get("id").String())
+				item, _ = sjson.SetBytes(item, "name", toolCall.Get("function.name").String())
+				item, _ = sjson.SetBytes(item, "arguments", toolCall.Get("function.arguments").String())
+				out, _ = sjson.SetRawBytes(out, "input.-1", item)
+			}
+		case "tool":
+			item := []byte(`{"type":"function_call_output","call_id":"","output":""}`)
+			item, _ = sjson.SetBytes(item, "call_id", message.Get("tool_call_id").String())
+			item, _ = sjson.SetBytes(item, "output", strings.Join(openAITextParts(message.Get("content")), ""))
+			out, _ = sjson.SetRawBytes(out, "input.-1", item)
+		default:
+			item := []byte(`{"type":"message","role":"","content":[]}`)
+			item, _ = sjson.SetBytes(item, "role", role)
+			item, _ = sjson.SetRawBytes(item, "content", convertResponsesInputContent(message.Get("content")))
+			out, _ = sjson.SetRawBytes(out, "input.-1", item)
+		}
+	}
+
+	// Copy the sampling parameters.
+	maxTokens := gjson.GetBytes(request, "max_completion_tokens")
+	if !maxTokens.Exists() {
+		maxTokens = gjson.GetBytes(request, "max_tokens")
+	}
+	if maxTokens.Type == gjson.Number {
+		out, _ = sjson.SetBytes(out, "max_output_tokens", maxTokens.Int())
+	}
+	for _, key := range []string{"temperature", "top_p", "parallel_tool_calls", "user", "metadata", "service_tier", "prompt_cache_key", "safety_identifier"} {
+		if value := gjson.GetBytes(request, key); value.Exists() {
+			out, _ = sjson.SetRawBytes(out, key, []byte(value.Raw))
+		}
+	}
+
+	// Map reasoning_effort to reasoning.effort and request a reasoning summary.
+	if reasoningEffort := gjson.GetBytes(request, "reasoning_effort"); reasoningEffort.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "reasoning.effort", reasoningEffort.String())
+		if p.reasoningSummary != "none" && reasoningEffort.String() != "none" {
+			out, _ = sjson.SetBytes(out, "reasoning.summary", p.reasoningSummary)
+		}
+	}
+
+	// Map response_format and verbosity to text.
+	responseFormat := gjson.GetBytes(request, "response_format")
+	switch responseFormat.Get("type").String() {
+	case "json_object":
+		out, _ = sjson.SetBytes(out, "text.format.type", "json_object")
+	case "json_schema":
+		format := []byte(`{"type":"json_schema"}`)
+		responseFormat.Get("json_schema").ForEach(func(key, value gjson.Result) bool {
+			format, _ = sjson.SetRawBytes(format, key.String(), []byte(value.Raw))
+			return true
+		})
+		out, _ = sjson.SetRawBytes(out, "text.format", format)
+	}
+	if verbosity := gjson.GetBytes(request, "verbosity"); verbosity.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "text.verbosity", verbosity.String())
+	}
+
+	// Convert the tools, function tools are flattened.
+	for _, tool := range gjson.GetBytes(request, "tools").Array() {
+		if tool.Get("type").String() != "function" {
+			continue
+		}
+		responsesTool := []byte(`{"type":"function","name":""}`)
+		tool.Get("function").ForEach(func(key, value gjson.Result) bool {
+			responsesTool, _ = sjson.SetRawBytes(responsesTool, key.String(), []byte(value.Raw))
+			return true
+		})
+		out, _ = sjson.SetRawBytes(out, "tools.-1", responsesTool)
+	}
+
+	// Convert tool_choice, named functions are flattened.
+	toolChoice := gjson.GetBytes(request, "tool_choice")
+	if toolChoice.Type == gjson.String {
+		out, _ = sjson.SetBytes(out, "tool_choice", toolChoice.String())
+	} else if toolChoice.IsObject() {
+		responsesToolChoice := []byte(`{"type":"function","name":""}`)
+		responsesToolChoice, _ = sjson.SetBytes(responsesToolChoice, "name", toolChoice.Get("function.name").String())
+		out, _ = sjson.SetRawBytes(out, "tool_choice", responsesToolChoice)
+	}
+
+	if stream {
+		out, _ = sjson.SetBytes(out, "stream", true)
+	}
+
+	return out
+}
+
+// convertResponsesInputContent converts the content of a user, system or developer message into Responses input content
+func convertResponsesInputContent(content gjson.Result) []byte {
+	out := []byte(`[]`)
+	if content.Type == gjson.String {
+		part, _ := sjson.SetBytes([]byte(`{"type":"input_text"}`), "text", content.String())
+		out, _ = sjson.SetRawBytes(out, "-1", part)
+		return out
+	}
+
+	for _, part := range content.Array() {
+		switch part.Get("type").String() {
+		case "text":
+			inputPart, _ := sjson.SetBytes([]byte(`{"type":"input_text"}`), "text", part.Get("text").String())
+			out, _ = sjson.SetRawBytes(out, "-1", inputPart)
+		case "image_url":
+			inputPart, _ := sjson.SetBytes([]byte(`{"type":"input_image"}`), "image_url", part.Get("image_url.url").String())
+			if detail := part.Get("image_url.detail"); detail.Type == gjson.String {
+				inputPart, _ = sjson.SetBytes(inputPart, "detail", detail.String())
+			}
+			out, _ = sjson.SetRawBytes(out, "-1", inputPart)
+		case "file":
+			inputPart := []byte(`{"type":"input_file"}`)
+			part.Get("file").ForEach(func(key, value gjson.Result) bool {
+				inputPart, _ = sjson.SetRawBytes(inputPart, key.String(), []byte(value.Raw))
+				return true
+			})
+			out, _ = sjson.SetRawBytes(out, "-1", inputPart)
+		}
+	}
+	return out
+}
+
+// convertResponsesResponse converts a Responses response into an OpenAI chat completion and fills the usage
+func convertResponsesResponse(data []byte, model models.Model, usage *Usage) []byte {
+	out := []byte(`{"id":"","object":"chat.completion","created":0,"model":"","choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":null}]}`)
+	out, _ = sjson.SetBytes(out, "id", gjson.GetBytes(data, "id").String())
+	out, _ = sjson.SetBytes(out, "created", time.Now().Unix())
+	out, _ = sjson.SetBytes(out, "model", model.Name)
+
+	// Collect the message, reasoning summary and function call items.
+	var content strings.Builder
+	reasoningSummaries := make([]string, 0)
+	toolCallIndex := 0
+	for _, item := range gjson.GetBytes(data, "output").Array() {
+		switch item.Get("type").String() {
+		case "message":
+			for _, part := range item.Get("content").Array() {
+				switch part.Get("type").String() {
+				case "output_text":
+					content.WriteString(part.Get("text").String())
+				case "refusal":
+					out, _ = sjson.SetBytes(out, "choices.0.message.refusal", part.Get("refusal").String())
+				}
+			}
+		case "reasoning":
+			for _, summary := range item.Get("summary").Array() {
+				reasoningSummaries = append(reasoningSummaries, summary.Get("text").String())
+			}
+		case "function_call":
+			toolCall := []byte(`{"id":"","type":"function","function":{"name":"","arguments":""}}`)
+			toolCall, _ = sjson.SetBytes(toolCall, "id", item.Get("call_id").String())
+			toolCall, _ = sjson.SetBytes(toolCall, "function.name", item.Get("name").String())
+			toolCall, _ = sjson.SetBytes(toolCall, "function.arguments", item.Get("arguments").String())
+			out, _ = sjson.SetRawBytes(out, fmt.Sprintf("choices.0.message.tool_calls.%d", toolCallIndex), toolCall)
+			toolCallIndex++
+		}
+	}
+	out, _ = sjson.SetBytes(out, "choices.0.message.content", content.String())
+	if len(reasoningSummaries) > 0 {
+		out, _ = sjson.SetBytes(out, "choices.0.message.reasoning_content", strings.Join(reasoningSummaries, "\n\n"))
+	}
+	out, _ = sjson.SetBytes(out, "choices.0.finish_reason", responsesFinishReason(gjson.ParseBytes(data), toolCallIndex > 0))
+
+	// Set the usage.
+	setResponsesUsage(gjson.GetBytes(data, "usage"), usage)
+	out, _ = sjson.SetBytes(out, "usage", usage)
+
+	return out
+}
+
+// setResponsesUsage copies the token counts of a Responses usage object into usage
+func setResponsesUsage(responsesUsage gjson.Result, usage *Usage) {
+	usage.PromptTokens = int(responsesUsage.Get("input_tokens").Int())
+	usage.PromptTokensDetails.CachedTokens = int(responsesUsage.Get("input_tokens_details.cached_tokens").Int())
+	usage.CompletionTokens = int(responsesUsage.Get("output_tokens").Int())
+	usage.CompletionTokensDetails.ReasoningTokens = int(responsesUsage.Get("output_tokens_details.reasoning_tokens").Int())
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+}
+
+// responsesFinishReason derives the OpenAI finish reason from a Responses response object
+func responsesFinishReason(response gjson.Result, hasToolCalls bool) string {
+	if response.Get("status").String() == "incomplete" {
+		switch response.Get("incomplete_details.reason").String() {
+		case "max_output_tokens":
+			return "length"
+		case "content_filter":
+			return "content_filter"
+		}
+	}
+	if hasToolCalls {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// convertResponsesError converts the error object of a failed response into an OpenAI error body
+func convertResponsesError(responsesError gjson.Result) []byte {
+	errorType := responsesError.Get("code").String()
+	if errorType == "" {
+		errorType = "server_error"
+	}
+	return newOpenAIError(responsesError.Get("message").String(), errorType, http.StatusInternalServerError)
+}
+
+// translateResponsesStream reads Responses SSE events from r and writes OpenAI chat.completion.chunk events to w
+func translateResponsesStream(r io.Reader, w io.Writer, model models.Model, usage *Usage) error {
+	reader := bufio.NewReader(r)
+	id := ""
+	created := time.Now().Unix()
+	// toolCallIndexes maps output indexes of function calls to tool call indexes.
+	toolCallIndexes := make(map[int64]int)
+
+	for {
+		// Read a line of data.
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, _const.TagData) {
+			data := bytes.TrimPrefix(line, _const.TagData)
+			var chunk []byte
+
+			switch gjson.GetBytes(data, "type").String() {
+			case "response.created":
+				id = gjson.GetBytes(data, "response.id").String()
+				chunk = newChatCompletionChunk(id, created, model.Name, []byte(`{"role":"assistant","content":""}`), "")
+			case "response.output_item.added":
+				item := gjson.GetBytes(data, "item")
+				if item.Get("type").String() == "function_call" {
+					toolCallIndex := len(toolCallIndexes)
+					toolCallIndexes[gjson.GetBytes(data, "output_index").Int()] = toolCallIndex
+					delta := []byte(`{"tool_calls":[{"index":0,"id":"","type":"function","function":{"name":"","arguments":""}}]}`)
+					delta, _ = sjson.SetBytes(delta, "tool_calls.0.index", toolCallIndex)
+					delta, _ = sjson.SetBytes(delta, "tool_calls.0.id", item.Get("call_id").String())
+					delta, _ = sjson.SetBytes(delta, "tool_calls.0.function.name", item.Get("name").String())
+					chunk = newChatCompletionChunk(id, created, model.Name, delta, "")
+				}
+			case "response.output_text.delta":
+				delta, _ := sjson.SetBytes([]byte(`{}`), "content", gjson.GetBytes(data, "delta").String())
+				chunk = newChatCompletionChunk(id, created, model.Name, delta, "")
+			case "response.refusal.delta":
+				delta, _ := sjson.SetBytes([]byte(`{}`), "refusal", gjson.GetBytes(data, "delta").String())
+				chunk = newChatCompletionChunk(id, created, model.Name, delta, "")
+			case "response.reasoning_summary_part.added":
+				// Separate consecutive summary parts like the non-streaming response does.
+				if gjson.GetBytes(data, "summary_index").Int() > 0 {
+					chunk = newChatCompletionChunk(id, created, model.Name, []byte(`{"reasoning_content":"\n\n"}`), "")
+				}
+			case "response.reasoning_summary_text.delta":
+				delta, _ := sjson.SetBytes([]byte(`{}`), "reasoning_content", gjson.GetBytes(data, "delta").String())
+				chunk = newChatCompletionChunk(id, created, model.Name, delta, "")
+			case "response.function_call_arguments.delta":
+				toolCallIndex := toolCallIndexes[gjson.GetBytes(data, "output_index").Int()]
+				delta := []byte(`{"tool_calls":[{"index":0,"function":{"arguments":""}}]}`)
+				delta, _ = sjson.SetBytes(delta, "tool_calls.0.index", toolCallIndex)
+				delta, _ = sjson.SetBytes(delta, "tool_calls.0.function.arguments", gjson.GetBytes(data, "delta").String())
+				chunk = newChatCompletionChunk(id, created, model.Name, delta, "")
+			case "response.completed", "response.incomplete":
+				response := gjson.GetBytes(data, "response")
+				setResponsesUsage(response.Get("usage"), usage)
+				chunk = newChatCompletionChunk(id, created, model.Name, nil, responsesFinishReason(response, len(toolCallIndexes) > 0))
+				if errWrite := writeDataEvent(w, chunk); errWrite != nil {
+					return errWrite
+				}
+				if errWrite := writeDataEvent(w, newUsageChunk(id, created, model.Name, usage)); errWrite != nil {
+					return errWrite
+				}
+				return writeDoneEvent(w)
+			case "response.failed":
+				chunk = convertResponsesError(gjson.GetBytes(data, "response.error"))
+			case "error":
+				chunk = convertResponsesError(gjson.ParseBytes(data))
+			}
+
+			if chunk != nil {
+				if errWrite := writeDataEvent(w, chunk); errWrite != nil {
+					return errWrite
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
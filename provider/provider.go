@@ -3,11 +3,15 @@ package provider
 import (
 	"context"
 	"encoding/json"
-	"github.com/luispater/mini-router/config"
+	"fmt"
 	_const "github.com/luispater/mini-router/const"
 	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 	"io"
+	"net/http"
+	"reflect"
+	"strings"
 )
 
 // Message represents a chat message
@@ -82,6 +86,12 @@ type Usage struct {
 	PromptTokensDetails UsagePromptTokensDetails `json:"prompt_tokens_details"`
 	// CompletionTokensDetails is the detailed completion token usage information
 	CompletionTokensDetails UsageCompletionTokensDetails `json:"completion_tokens_details"`
+	// Images is the number of generated images, it is metered but not part of the response
+	Images int `json:"-"`
+	// AudioSeconds is the duration of the transcribed or translated audio, it is metered but not part of the response
+	AudioSeconds float64 `json:"-"`
+	// Characters is the number of characters synthesized into speech, it is metered but not part of the response
+	Characters int `json:"-"`
 }
 
 // UsagePromptTokensDetails represents detailed prompt token usage information
@@ -115,8 +125,86 @@ type Provider interface {
 	Close() error
 }
 
-// ProviderFactory is a function that creates a new provider instance
-type ProviderFactory func(cfg *config.Config) (Provider, error)
+// CompletionProvider is implemented by providers that serve legacy text completions natively.
+// Models of other providers get their completion requests converted to chat completions.
+type CompletionProvider interface {
+	// CreateCompletion creates a text completion
+	CreateCompletion(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte)
+
+	// CreateCompletionStream creates a streaming text completion
+	CreateCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte)
+}
+
+// EmbeddingProvider is implemented by providers that create embeddings.
+// The request and the response are OpenAI embedding requests and responses with float vectors.
+type EmbeddingProvider interface {
+	// CreateEmbedding creates embeddings for the inputs of the request
+	CreateEmbedding(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte)
+}
+
+// ImageProvider is implemented by providers that generate images. The responses are OpenAI image responses.
+// Edit and variation requests are multipart bodies with the content type that carries their boundary.
+type ImageProvider interface {
+	// CreateImage generates images from a prompt
+	CreateImage(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte)
+
+	// EditImage edits images
+	EditImage(ctx context.Context, cancel context.CancelFunc, body []byte, contentType string, model models.Model, usage *Usage) ([]byte, error, []byte)
+
+	// CreateImageVariation creates variations of an image
+	CreateImageVariation(ctx context.Context, cancel context.CancelFunc, body []byte, contentType string, model models.Model, usage *Usage) ([]byte, error, []byte)
+}
+
+// AudioProvider is implemented by providers that transcribe and translate audio. The body is the multipart
+// request body, read while it is sent upstream, and the response is returned in the requested response_format.
+type AudioProvider interface {
+	// CreateTranscription transcribes audio into the input language
+	CreateTranscription(ctx context.Context, cancel context.CancelFunc, body io.Reader, contentType string, model models.Model, usage *Usage) ([]byte, error, []byte)
+
+	// CreateTranslation translates audio into English
+	CreateTranslation(ctx context.Context, cancel context.CancelFunc, body io.Reader, contentType string, model models.Model, usage *Usage) ([]byte, error, []byte)
+}
+
+// SpeechProvider is implemented by providers that synthesize speech. The request is an OpenAI speech request
+// and the returned stream is the binary audio in the requested response_format, read as it arrives.
+type SpeechProvider interface {
+	// CreateSpeech synthesizes speech from the input text
+	CreateSpeech(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte)
+}
+
+// ModerationProvider is implemented by providers that classify content. The request and the response are
+// OpenAI moderation requests and responses.
+type ModerationProvider interface {
+	// CreateModeration classifies the inputs of the request
+	CreateModeration(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte)
+}
+
+// StatusError is the error of an upstream response with an unexpected HTTP status
+type StatusError struct {
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+	// Status is the HTTP status of the response, such as 400 Bad Request
+	Status string
+}
+
+// Error returns the error message
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %s", e.Status)
+}
+
+// newStatusError returns the error of an upstream response with an unexpected HTTP status
+func newStatusError(statusCode int) error {
+	return &StatusError{StatusCode: statusCode, Status: fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))}
+}
+
+// ModelValidator is implemented by providers that check the settings of a model entry beyond its provider options
+type ModelValidator interface {
+	// ValidateModel returns an error if the provider cannot serve the model entry
+	ValidateModel(model models.Model) error
+}
+
+// ProviderFactory is a function that creates a new provider instance from the model entry's provider options
+type ProviderFactory func(options models.ProviderOptions) (Provider, error)
 
 // ProviderRegistry stores all available providers
 var ProviderRegistry = make(map[_const.ProviderType]ProviderFactory)
@@ -126,6 +214,27 @@ func RegisterProvider(providerType _const.ProviderType, factory ProviderFactory)
 	ProviderRegistry[providerType] = factory
 }
 
+// ValidateModel checks that the model entry's provider type is registered, accepts its options and can serve the entry
+func ValidateModel(model models.Model) error {
+	factory, ok := ProviderRegistry[model.ProviderType]
+	if !ok {
+		return fmt.Errorf("provider_type %s is not registered", model.ProviderType)
+	}
+
+	// Create a provider instance to let the factory validate the options
+	providerInstance, err := factory(model.ProviderOptions)
+	if err != nil {
+		return fmt.Errorf("invalid provider_options for provider_type %s: %w", model.ProviderType, err)
+	}
+	if validator, ok := providerInstance.(ModelValidator); ok {
+		if err = validator.ValidateModel(model); err != nil {
+			_ = providerInstance.Close()
+			return fmt.Errorf("invalid model entry for provider_type %s: %w", model.ProviderType, err)
+		}
+	}
+	return providerInstance.Close()
+}
+
 // jsonMerge merges two JSON objects
 func jsonMerge(original, patch []byte) ([]byte, error) {
 	// Parse the patch JSON
@@ -146,3 +255,136 @@ func jsonMerge(original, patch []byte) ([]byte, error) {
 
 	return result, nil
 }
+
+// googleThinkingBodyRules map reasoning_effort to the thinking_config of Gemini's OpenAI compatible endpoint.
+// They apply to entries with support_google_thinking before the entry's own body rules.
+var googleThinkingBodyRules = []models.BodyRule{
+	newGoogleThinkingBodyRule("none", 0, false),
+	newGoogleThinkingBodyRule("auto", -1, true),
+	newGoogleThinkingBodyRule("low", 1024, true),
+	newGoogleThinkingBodyRule("medium", 8192, true),
+	newGoogleThinkingBodyRule("high", 24576, true),
+	// Other values are not understood by the endpoint.
+	{Remove: []string{"reasoning_effort"}},
+}
+
+// newGoogleThinkingBodyRule builds the body rule that replaces a reasoning_effort value with a thinking budget
+func newGoogleThinkingBodyRule(reasoningEffort string, thinkingBudget int, includeThoughts bool) models.BodyRule {
+	return models.BodyRule{
+		When: map[string]interface{}{"reasoning_effort": reasoningEffort},
+		Overrides: models.BodyPatch{
+			"extra_body": map[string]interface{}{
+				"google": map[string]interface{}{
+					"thinking_config": map[string]interface{}{
+						"thinking_budget":  thinkingBudget,
+						"include_thoughts": includeThoughts,
+					},
+				},
+			},
+		},
+		Remove: []string{"reasoning_effort"},
+	}
+}
+
+// ApplyModelBody rewrites a request body for a model entry. The body rules are applied first, in order,
+// followed by the entry's body_defaults, body_overrides and body_remove. The body itself is not modified, so the
+// original body can be rewritten again for the next entry.
+func ApplyModelBody(body []byte, model models.Model) ([]byte, error) {
+	rules := model.BodyRules
+	if model.SupportGoogleThinking && model.ProviderType == _const.ProviderOpenAICompatibility {
+		rules = append(append([]models.BodyRule{}, googleThinkingBodyRules...), rules...)
+	}
+	rules = append(rules, models.BodyRule{Defaults: model.BodyDefaults, Overrides: model.BodyOverrides, Remove: model.BodyRemove})
+
+	var err error
+	for _, rule := range rules {
+		if !bodyRuleMatches(body, rule.When) {
+			continue
+		}
+		if body, err = applyBodyPatch(body, rule.Defaults, "", false); err != nil {
+			return nil, err
+		}
+		if body, err = applyBodyPatch(body, rule.Overrides, "", true); err != nil {
+			return nil, err
+		}
+		for _, path := range rule.Remove {
+			if body, err = sjson.DeleteBytes(body, path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return body, nil
+}
+
+// bodyRuleMatches reports whether every path of when has the expected value, or one of the expected values of a list
+func bodyRuleMatches(body []byte, when map[string]interface{}) bool {
+	for path, expected := range when {
+		result := gjson.GetBytes(body, path)
+		if !result.Exists() {
+			return false
+		}
+		candidates, isList := expected.([]interface{})
+		if !isList {
+			candidates = []interface{}{expected}
+		}
+		matched := false
+		for _, candidate := range candidates {
+			if bodyValueEquals(result, candidate) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyValueEquals compares a request body value with a configured value by their JSON representation
+func bodyValueEquals(result gjson.Result, expected interface{}) bool {
+	expectedJSON, err := json.Marshal(expected)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(result.Value(), gjson.ParseBytes(expectedJSON).Value())
+}
+
+// applyBodyPatch merges a patch into the body at prefix. Nested objects are merged key by key, other values are
+// only set where the body has no value unless overwrite is set.
+func applyBodyPatch(body []byte, patch models.BodyPatch, prefix string, overwrite bool) ([]byte, error) {
+	var err error
+	for key, value := range patch {
+		path := prefix + escapeBodyPathKey(key)
+		existing := gjson.GetBytes(body, path)
+
+		// Merge nested objects into existing objects.
+		if nested, isObject := value.(map[string]interface{}); isObject && existing.IsObject() {
+			if body, err = applyBodyPatch(body, nested, path+".", overwrite); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if existing.Exists() && !overwrite {
+			continue
+		}
+		if body, err = sjson.SetBytes(body, path, value); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// escapeBodyPathKey escapes the characters that have a meaning in sjson paths
+func escapeBodyPathKey(key string) string {
+	var escaped strings.Builder
+	for _, c := range key {
+		switch c {
+		case '.', '*', '?', '|', '#', '@', '\\':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,217 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	_const "github.com/luispater/mini-router/const"
+	"github.com/luispater/mini-router/models"
+)
+
+const (
+	// vertexDefaultLocation is the location used when the model does not set one
+	vertexDefaultLocation = "us-central1"
+	// vertexDefaultAPIVersion is the Vertex AI API version used when the model does not set one
+	vertexDefaultAPIVersion = "v1"
+	// vertexDefaultPublisher is the model publisher of the native endpoints
+	vertexDefaultPublisher = "google"
+	// vertexAPINative calls the native generateContent endpoints
+	vertexAPINative = "native"
+	// vertexAPIOpenAI calls the OpenAI compatible chat completions endpoint
+	vertexAPIOpenAI = "openai"
+)
+
+// vertexOptionTypes are the provider_options of the vertex provider
+var vertexOptionTypes = models.OptionTypes{
+	"credentials_file": models.OptionString,
+	"credentials_json": models.OptionString,
+	"project":          models.OptionString,
+	"location":         models.OptionString,
+	"api":              models.OptionString,
+	"api_version":      models.OptionString,
+	"publisher":        models.OptionString,
+	"token_url":        models.OptionString,
+	"scopes":           models.OptionString,
+	"thinking_budgets": models.OptionMap,
+}
+
+// / NewProviderVertex creates a new Vertex AI provider authenticated with a service account.
+// / Options: credentials_file (defaults to GOOGLE_APPLICATION_CREDENTIALS) or credentials_json, project, location, api (native or openai),
+// / api_version, publisher, token_url, scopes and the thinking_budgets of the gemini provider.
+func NewProviderVertex(options models.ProviderOptions) (Provider, error) {
+	if err := options.Check(vertexOptionTypes); err != nil {
+		return nil, err
+	}
+	// Load the service account, which is cached across provider instances.
+	var account *googleServiceAccount
+	var err error
+	if credentialsJSON := options.String("credentials_json", ""); credentialsJSON != "" {
+		account, err = loadGoogleServiceAccountJSON([]byte(credentialsJSON))
+	} else {
+		credentialsFile := options.String("credentials_file", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+		if credentialsFile == "" {
+			return nil, fmt.Errorf("credentials_file, credentials_json or GOOGLE_APPLICATION_CREDENTIALS is required")
+		}
+		account, err = loadGoogleServiceAccountFile(credentialsFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Vertex{
+		project:    options.String("project", account.ProjectID),
+		location:   options.String("location", vertexDefaultLocation),
+		apiVersion: options.String("api_version", vertexDefaultAPIVersion),
+		publisher:  options.String("publisher", vertexDefaultPublisher),
+	}
+	if p.project == "" {
+		return nil, fmt.Errorf("project is required when the service account has no project_id")
+	}
+
+	// Get the shared token source, so access tokens are cached across requests.
+	tokenURL := account.TokenURI
+	if tokenURL == "" {
+		tokenURL = googleDefaultTokenURL
+	}
+	p.tokenSource, err = getGoogleTokenSource(account, options.String("token_url", tokenURL), options.String("scopes", googleCloudPlatformScope))
+	if err != nil {
+		return nil, err
+	}
+
+	// Reuse the Gemini or OpenAI compatible implementation with Vertex AI's URLs and authentication.
+	switch api := options.String("api", vertexAPINative); api {
+	case vertexAPINative:
+		p.gemini, err = newGemini(options)
+		if err != nil {
+			return nil, err
+		}
+		p.gemini.endpoint = p.nativeEndpoint
+		p.gemini.authorize = p.bearerAuthorize
+	case vertexAPIOpenAI:
+		p.openAI = &OpenAICompatibility{}
+		p.openAI.endpoint = p.openAIEndpoint
+	default:
+		return nil, fmt.Errorf("api must be %q or %q", vertexAPINative, vertexAPIOpenAI)
+	}
+	return p, nil
+}
+
+// / init registers the provider.
+func init() {
+	RegisterProvider(_const.ProviderVertex, NewProviderVertex)
+}
+
+// / Vertex implements the Provider interface for Vertex AI.
+type Vertex struct {
+	// project is the Google Cloud project.
+	project string
+	// location is the Vertex AI location, such as us-central1 or global.
+	location string
+	// apiVersion is the Vertex AI API version.
+	apiVersion string
+	// publisher is the model publisher of the native endpoints.
+	publisher string
+	// tokenSource mints the OAuth access tokens.
+	tokenSource *googleTokenSource
+
+	// gemini serves the native API, nil when the OpenAI compatible API is used.
+	gemini *Gemini
+	// openAI serves the OpenAI compatible API, nil when the native API is used.
+	openAI *OpenAICompatibility
+}
+
+// / GetProviderType returns the provider's type.
+func (p *Vertex) GetProviderType() _const.ProviderType {
+	return _const.ProviderVertex
+}
+
+// / CreateChatCompletion creates a chat completion.
+func (p *Vertex) CreateChatCompletion(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) ([]byte, error, []byte) {
+	if p.gemini != nil {
+		return p.gemini.CreateChatCompletion(ctx, cancel, request, model, usage)
+	}
+
+	// The OpenAI compatible implementation sends the access token as the API key.
+	model, err := p.withAccessToken(ctx, model)
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.openAI.CreateChatCompletion(ctx, cancel, request, model, usage)
+}
+
+// / CreateChatCompletionStream creates a streaming chat completion.
+func (p *Vertex) CreateChatCompletionStream(ctx context.Context, cancel context.CancelFunc, request []byte, model models.Model, usage *Usage) (io.ReadCloser, error, []byte) {
+	if p.gemini != nil {
+		return p.gemini.CreateChatCompletionStream(ctx, cancel, request, model, usage)
+	}
+
+	// The OpenAI compatible implementation sends the access token as the API key.
+	model, err := p.withAccessToken(ctx, model)
+	if err != nil {
+		return nil, err, nil
+	}
+	return p.openAI.CreateChatCompletionStream(ctx, cancel, request, model, usage)
+}
+
+// / Close closes the provider.
+func (p *Vertex) Close() error {
+	return nil
+}
+
+// baseURL returns the Vertex AI API URL of the project and location
+func (p *Vertex) baseURL(model models.Model) string {
+	host := strings.TrimRight(model.BaseURL, "/")
+	if host == "" {
+		if p.location == "global" {
+			host = "https://aiplatform.googleapis.com"
+		} else {
+			host = fmt.Sprintf("https://%s-aiplatform.googleapis.com", p.location)
+		}
+	}
+	return fmt.Sprintf("%s/%s/projects/%s/locations/%s", host, p.apiVersion, url.PathEscape(p.project), url.PathEscape(p.location))
+}
+
+// nativeEndpoint returns the generateContent or streamGenerateContent URL for the model
+func (p *Vertex) nativeEndpoint(model models.Model, stream bool) (string, error) {
+	if model.BaseURLDirect {
+		return model.BaseURL, nil
+	}
+	modelURL := fmt.Sprintf("%s/publishers/%s/models/%s", p.baseURL(model), p.publisher, model.ProviderModelName)
+	if stream {
+		return modelURL + ":streamGenerateContent?alt=sse", nil
+	}
+	return modelURL + ":generateContent", nil
+}
+
+// openAIEndpoint returns the URL of the OpenAI compatible chat completions endpoint
+func (p *Vertex) openAIEndpoint(model models.Model) string {
+	if model.BaseURLDirect {
+		return model.BaseURL
+	}
+	return p.baseURL(model) + "/endpoints/openapi/chat/completions"
+}
+
+// bearerAuthorize authenticates a native request with an OAuth access token
+func (p *Vertex) bearerAuthorize(ctx context.Context, req *http.Request, model models.Model) error {
+	accessToken, err := p.tokenSource.Token(ctx, model.ProxyURL)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return nil
+}
+
+// withAccessToken returns a copy of the model whose only API key is a current access token
+func (p *Vertex) withAccessToken(ctx context.Context, model models.Model) (models.Model, error) {
+	accessToken, err := p.tokenSource.Token(ctx, model.ProxyURL)
+	if err != nil {
+		return model, err
+	}
+	model.ProviderAPIKey = []string{accessToken}
+	return model, nil
+}
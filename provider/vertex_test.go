@@ -0,0 +1,157 @@
+package provider
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/luispater/mini-router/models"
+	"github.com/tidwall/gjson"
+)
+
+// newTestServiceAccount writes a service account key file whose token endpoint is tokenURL
+func newTestServiceAccount(t *testing.T, clientEmail, tokenURL string) (string, *rsa.PrivateKey) {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	data, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test-project",
+		"private_key_id": "test-key",
+		"private_key":    string(privateKeyPEM),
+		"client_email":   clientEmail,
+		"token_uri":      tokenURL,
+	})
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, privateKey
+}
+
+// newTestTokenServer starts an OAuth token endpoint that checks the JWT bearer assertion and counts the tokens it mints
+func newTestTokenServer(t *testing.T, clientEmail string, publicKey func() *rsa.PublicKey, minted *atomic.Int32) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(publicKey(), crypto.SHA256, hash[:], signature); err != nil {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if gjson.GetBytes(claims, "iss").String() != clientEmail || gjson.GetBytes(claims, "aud").String() != server.URL ||
+			gjson.GetBytes(claims, "scope").String() != googleCloudPlatformScope {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		minted.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"test-access-token","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVertexJWTBearerExchange(t *testing.T) {
+	const clientEmail = "jwt-bearer@test-project.iam.gserviceaccount.com"
+	var minted atomic.Int32
+	var privateKey *rsa.PrivateKey
+	tokenServer := newTestTokenServer(t, clientEmail, func() *rsa.PublicKey { return &privateKey.PublicKey }, &minted)
+	credentialsFile, key := newTestServiceAccount(t, clientEmail, tokenServer.URL)
+	privateKey = key
+
+	// The upstream accepts the minted access token on the OpenAI compatible endpoint of the project.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-access-token" {
+			http.Error(w, `{"error":{"message":"unauthenticated"}}`, http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v1/projects/test-project/locations/us-central1/endpoints/openapi/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","created":1,"model":"google/gemini-2.5-flash","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`))
+	}))
+	defer upstream.Close()
+
+	model := models.Model{Name: "gemini", ProviderModelName: "google/gemini-2.5-flash", BaseURL: upstream.URL}
+	options := models.ProviderOptions{"credentials_file": credentialsFile, "api": "openai"}
+	var tokenSource *googleTokenSource
+	for i := 0; i < 2; i++ {
+		providerInstance, err := NewProviderVertex(options)
+		if err != nil {
+			t.Fatalf("NewProviderVertex() error = %v", err)
+		}
+		vertex := providerInstance.(*Vertex)
+		if tokenSource != nil && vertex.tokenSource != tokenSource {
+			t.Errorf("provider instance %d does not share the token source", i)
+		}
+		tokenSource = vertex.tokenSource
+
+		response, err, errBody := providerInstance.CreateChatCompletion(context.Background(), func() {}, []byte(`{"model":"google/gemini-2.5-flash","messages":[{"role":"user","content":"Hi"}]}`), model, &Usage{})
+		if err != nil {
+			t.Fatalf("CreateChatCompletion() error = %v, body %s", err, errBody)
+		}
+		if content := gjson.GetBytes(response, "choices.0.message.content").String(); content != "Hello" {
+			t.Errorf("content = %q, want Hello", content)
+		}
+	}
+	if got := minted.Load(); got != 1 {
+		t.Errorf("token endpoint minted %d tokens, want 1", got)
+	}
+}
+
+func TestLoadGoogleServiceAccountFileRereadsReplacedFile(t *testing.T) {
+	credentialsFile, _ := newTestServiceAccount(t, "first@test-project.iam.gserviceaccount.com", googleDefaultTokenURL)
+	first, err := loadGoogleServiceAccountFile(credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := loadGoogleServiceAccountFile(credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Error("the service account of an unchanged file is parsed again")
+	}
+
+	replacement, _ := newTestServiceAccount(t, "second@test-project.iam.gserviceaccount.com", googleDefaultTokenURL)
+	if err = os.Rename(replacement, credentialsFile); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := loadGoogleServiceAccountFile(credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.ClientEmail != "second@test-project.iam.gserviceaccount.com" {
+		t.Errorf("ClientEmail = %q, want the one of the replaced file", replaced.ClientEmail)
+	}
+}
@@ -3,7 +3,6 @@ package router
 import (
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	_const "github.com/luispater/mini-router/const"
@@ -11,19 +10,57 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/luispater/mini-router/api"
 	"github.com/luispater/mini-router/config"
-	"github.com/luispater/mini-router/models"
+	"github.com/luispater/mini-router/core"
 	"github.com/luispater/mini-router/provider"
 )
 
 // / SetupRouter creates and configures the Gin router.
 // / cfg: Application configuration.
 // / providerRegistry: Provider registry.
-// / rateLimitersMutex: Mutex for the rate limiter map.
 // / Returns a configured Gin router.
-func SetupRouter(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) *gin.Engine {
+func SetupRouter(cfg *config.Config, providerRegistry map[_const.ProviderType]provider.ProviderFactory) (*gin.Engine, error) {
 	// Create a new Gin router.
 	router := gin.Default()
 
+	// Only trust forwarding headers from the configured proxies, gin trusts every proxy by default.
+	trustedProxies := cfg.Server.TrustedProxies
+	if len(trustedProxies) == 0 {
+		trustedProxies = nil
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		return nil, fmt.Errorf("failed to set trusted proxies: %w", err)
+	}
+
+	// Write the usage of served requests to the usage log.
+	if cfg.Server.UsageLog != "" {
+		recorder, err := core.NewUsageRecorder(cfg.Server.UsageLog)
+		if err != nil {
+			return nil, err
+		}
+		api.SetUsageRecorder(recorder)
+	}
+
+	// Store the responses of the Responses API in files, or in memory with a size and time limit.
+	if cfg.Server.ResponseStoreDir != "" {
+		store, err := core.NewFileResponseStore(cfg.Server.ResponseStoreDir)
+		if err != nil {
+			return nil, err
+		}
+		api.SetResponseStore(store)
+	} else {
+		api.SetResponseStore(core.NewMemoryResponseStore(cfg.Server.ResponseStoreMaxEntries, cfg.Server.ResponseStoreTTL))
+	}
+
+	// Store the files and the batches of the Batch API, which is disabled without a directory.
+	var batchStore *core.BatchStore
+	if cfg.Server.BatchDir != "" {
+		var err error
+		batchStore, err = core.NewBatchStore(cfg.Server.BatchDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Add middleware.
 	// Add CORS middleware.
 	router.Use(api.CORSMiddleware())
@@ -31,6 +68,10 @@ func SetupRouter(cfg *config.Config, providerRegistry map[_const.ProviderType]pr
 	router.Use(api.LoggingMiddleware())
 	// Add error handling middleware.
 	router.Use(api.ErrorMiddleware())
+	// Add request body size limit middleware.
+	if cfg.Server.MaxRequestBodySize > 0 {
+		router.Use(api.BodyLimitMiddleware(cfg.Server.MaxRequestBodySize))
+	}
 
 	// Health check endpoint.
 	// Define the GET request handler for the /health route.
@@ -47,85 +88,84 @@ func SetupRouter(cfg *config.Config, providerRegistry map[_const.ProviderType]pr
 	// API v1 route group.
 	v1 := router.Group("/v1")
 	{
-		// Routes that do not require authentication.
-		// Define the GET request handler for the /models route.
-		v1.GET("/models", func(c *gin.Context) {
-			// Get all models from the configuration.
-			m := cfg.Models
-
-			// Convert to the response format.
-			// Create a slice to store the converted data.
-			data := make([]models.DisplayModel, 0)
-
-			names := make(map[string]string)
-			// Iterate over all models.
-			for _, model := range m {
-				// Add the model data to the slice.
-				if _, hasKey := names[model.Name]; !hasKey && model.Visible && model.Enabled {
-					modality := ""
-					inputModalities := make([]string, 0)
-					outputModalities := make([]string, 0)
-					if model.SupportsCompletion {
-						inputModalities = append(inputModalities, "text")
-						outputModalities = append(outputModalities, "text")
-					} else if model.SupportsImageGen {
-						inputModalities = append(inputModalities, "text")
-						outputModalities = append(outputModalities, "image")
-					}
-					if model.SupportsInputImage {
-						inputModalities = append(inputModalities, "image")
-					}
-					modality = fmt.Sprintf("%s->%s", strings.Join(inputModalities, "+"), strings.Join(outputModalities, "+"))
-
-					data = append(data, models.DisplayModel{
-						ID:                  model.Name,
-						Object:              "model",
-						Name:                model.DisplayName,
-						Description:         model.Description,
-						SupportedParameters: model.SupportedParameters,
-						ContextLength:       model.ContextLength,
-						MaxCompletionTokens: model.MaxTokens,
-						Architecture: struct {
-							Modality         string   `json:"modality"`
-							InputModalities  []string `json:"input_modalities"`
-							OutputModalities []string `json:"output_modalities"`
-						}{
-							Modality:         modality,
-							InputModalities:  inputModalities,
-							OutputModalities: outputModalities,
-						},
-						Pricing: struct {
-							Prompt     string `json:"prompt"`
-							Completion string `json:"completion"`
-						}{
-							Prompt:     strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.10f", model.InputPricePerToken), "0"), "."),
-							Completion: strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.10f", model.OutputPricePerToken), "0"), "."),
-						},
-					})
-					names[model.Name] = ""
-				}
-			}
-
-			// Return a JSON response with the model list.
-			c.JSON(http.StatusOK, gin.H{
-				// The object type is "list".
-				"object": "list",
-				// Model data.
-				"data": data,
-			})
-		})
+		// Routes where authentication is optional, an API key only sees the models it may use.
+		catalog := v1.Group("")
+		catalog.Use(api.OptionalAuthMiddleware(cfg))
+		{
+			// Define the GET request handlers for the /models routes.
+			catalog.GET("/models", api.ModelsHandler(cfg))
+			catalog.GET("/models/*id", api.ModelHandler(cfg))
+		}
 
 		// Route group that requires authentication.
 		auth := v1.Group("")
 		// Use authentication middleware.
 		auth.Use(api.AuthMiddleware(cfg))
+		// Make the client headers available for forwarding upstream.
+		auth.Use(api.ClientHeadersMiddleware())
 		{
 			// Chat completion.
 			// Define the POST request handler for the /chat/completions route.
 			auth.POST("/chat/completions", api.ChatCompletionHandler(cfg, providerRegistry))
+			// Legacy text completion.
+			// Define the POST request handler for the /completions route.
+			auth.POST("/completions", api.CompletionHandler(cfg, providerRegistry))
+			// Embeddings.
+			// Define the POST request handler for the /embeddings route.
+			auth.POST("/embeddings", api.EmbeddingHandler(cfg, providerRegistry))
+			// Images.
+			// Define the POST request handlers for the /images routes.
+			auth.POST("/images/generations", api.ImageGenerationHandler(cfg, providerRegistry))
+			auth.POST("/images/edits", api.ImageEditHandler(cfg, providerRegistry))
+			auth.POST("/images/variations", api.ImageVariationHandler(cfg, providerRegistry))
+			// Audio.
+			// Define the POST request handlers for the /audio routes.
+			auth.POST("/audio/transcriptions", api.AudioTranscriptionHandler(cfg, providerRegistry))
+			auth.POST("/audio/translations", api.AudioTranslationHandler(cfg, providerRegistry))
+			auth.POST("/audio/speech", api.SpeechHandler(cfg, providerRegistry))
+			// Moderations.
+			// Define the POST request handler for the /moderations route.
+			auth.POST("/moderations", api.ModerationHandler(cfg, providerRegistry))
+			// Anthropic Messages API.
+			// Define the POST request handlers for the /messages routes.
+			auth.POST("/messages", api.MessagesHandler(cfg, providerRegistry))
+			auth.POST("/messages/count_tokens", api.MessagesCountTokensHandler(cfg))
+			// Responses API.
+			// Define the request handlers for the /responses routes.
+			auth.POST("/responses", api.ResponsesHandler(cfg, providerRegistry))
+			auth.GET("/responses/:id", api.ResponseGetHandler())
+			auth.DELETE("/responses/:id", api.ResponseDeleteHandler())
+			// Files and Batch API.
+			// Define the request handlers for the /files and /batches routes.
+			auth.POST("/files", api.FileUploadHandler())
+			auth.GET("/files", api.FileListHandler())
+			auth.GET("/files/:id", api.FileGetHandler())
+			auth.DELETE("/files/:id", api.FileDeleteHandler())
+			auth.GET("/files/:id/content", api.FileContentHandler())
+			auth.POST("/batches", api.BatchCreateHandler())
+			auth.GET("/batches", api.BatchListHandler())
+			auth.GET("/batches/:id", api.BatchGetHandler())
+			auth.POST("/batches/:id/cancel", api.BatchCancelHandler())
+		}
+	}
+
+	// Gemini API v1beta route group, authenticated like v1.
+	v1beta := router.Group("/v1beta")
+	v1beta.Use(api.AuthMiddleware(cfg))
+	v1beta.Use(api.ClientHeadersMiddleware())
+	{
+		// Gemini generateContent and streamGenerateContent.
+		// The model name and the method share the last path segment, such as gemini-2.5-flash:generateContent.
+		v1beta.POST("/models/*action", api.GeminiHandler(cfg, providerRegistry))
+	}
+
+	// Process the batches through the router, resuming the batches that had not ended.
+	if batchStore != nil {
+		if err := api.StartBatchRunner(cfg, batchStore, router); err != nil {
+			return nil, err
 		}
 	}
 
 	// Return the configured router.
-	return router
+	return router, nil
 }